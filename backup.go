@@ -0,0 +1,130 @@
+package bbolt
+
+import (
+	"io"
+	"os"
+)
+
+// DefaultBackupChunkSize is the default BackupOptions.ChunkSize.
+const DefaultBackupChunkSize = 4 * 1024 * 1024
+
+// BackupOptions configures DB.BackupSnapshot.
+type BackupOptions struct {
+	// WriteFlag is the flag the database file is opened with to read the
+	// pages, as for Tx.WriteFlag. Set it to syscall.O_DIRECT for databases
+	// much larger than the available RAM.
+	WriteFlag int
+
+	// ChunkSize is the number of bytes of pages read from the database file
+	// at a time. The pages of a chunk are released to writers as soon as it
+	// has been read. Zero means DefaultBackupChunkSize.
+	ChunkSize int
+}
+
+// backupPin holds back the pages of a backup's snapshot from being reused,
+// like an open read transaction, except for those below copied, which it
+// has read already, and those from hwm on, which are not part of it.
+type backupPin struct {
+	txid   txid
+	copied pgid
+	hwm    pgid
+}
+
+// BackupSnapshot writes a consistent copy of the database to w, like
+// Tx.WriteTo, without keeping a read transaction open while it does. The
+// snapshot is taken in a short read transaction that records the meta page
+// and which pages are reachable, after which its pages are pinned instead:
+// they are copied in order of page id, and every chunk read releases its
+// pages to writers, so that a slow w neither blocks the remapping of the
+// database nor keeps the pages freed by writers pending until it finishes.
+// Pages that are not reachable are written as zeros.
+//
+// Exactly the size of the snapshot is written. If w fails, the number of
+// bytes written so far is returned with the error.
+func (db *DB) BackupSnapshot(w io.Writer, opts BackupOptions) (n int64, err error) {
+	f, err := db.openFile(db.path, os.O_RDONLY|opts.WriteFlag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	pin := &backupPin{txid: tx.meta.txid, hwm: tx.meta.pgid}
+	db.metalock.Lock()
+	db.backupPins = append(db.backupPins, pin)
+	db.metalock.Unlock()
+	defer func() {
+		db.metalock.Lock()
+		for i, p := range db.backupPins {
+			if p == pin {
+				db.backupPins = append(db.backupPins[:i], db.backupPins[i+1:]...)
+				break
+			}
+		}
+		db.metalock.Unlock()
+	}()
+
+	pageSize, hwm := db.pageSize, tx.meta.pgid
+	reachable := tx.reachablePages()
+	header, err := tx.snapshotHeader(reachable)
+	_ = tx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+
+	emit := func(b []byte) error {
+		wn, err := w.Write(b)
+		n += int64(wn)
+		if err == nil && wn < len(b) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}
+	for _, b := range header {
+		if err := emit(b); err != nil {
+			return n, err
+		}
+	}
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultBackupChunkSize
+	}
+	chunkPages := pgid((chunkSize + pageSize - 1) / pageSize)
+	chunk := make([]byte, int(chunkPages)*pageSize)
+	for start := db.dataStart(); start < hwm; start += chunkPages {
+		end := start + chunkPages
+		if end > hwm {
+			end = hwm
+		}
+		buf := chunk[:int(end-start)*pageSize]
+		if _, err := f.ReadAt(buf, int64(start)*int64(pageSize)); err != nil {
+			return n, err
+		}
+		for id := start; id < end; id++ {
+			if !reachable.has(id) {
+				b := buf[int(id-start)*pageSize : int(id-start+1)*pageSize]
+				for i := range b {
+					b[i] = 0
+				}
+			}
+		}
+
+		// The pages are in memory now, so writers may have them back.
+		db.metalock.Lock()
+		pin.copied = end
+		db.metalock.Unlock()
+
+		if err := emit(buf); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,121 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// writeFunc calls fn before every write to a buffer.
+type writeFunc struct {
+	fn  func()
+	buf bytes.Buffer
+}
+
+func (w *writeFunc) Write(p []byte) (int, error) {
+	w.fn()
+	return w.buf.Write(p)
+}
+
+// Ensure that BackupSnapshot copies a consistent snapshot while writers go on,
+// and lets them reuse the pages it has copied.
+func TestDB_BackupSnapshot(t *testing.T) {
+	const keys = 2000
+	db := btesting.MustCreateDB(t)
+	rnd := rand.New(rand.NewSource(1))
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%05d", i)) }
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < keys; i++ {
+			require.NoError(t, b.Put(key(i), bytes.Repeat([]byte{0}, 1000)))
+		}
+		return nil
+	}))
+
+	// Every write of the backup is preceded by a transaction that rewrites
+	// a tenth of the keys, and the pending pages are recorded.
+	gen := byte(0)
+	run := func(backup func(w io.Writer) (int64, error)) (data []byte, pending []int) {
+		w := &writeFunc{fn: func() {
+			gen++
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				for i := 0; i < keys/10; i++ {
+					require.NoError(t, b.Put(key(rnd.Intn(keys)), bytes.Repeat([]byte{gen}, 1000)))
+				}
+				return nil
+			}))
+			pending = append(pending, db.Stats().PendingPageN)
+		}}
+		n, err := backup(w)
+		require.NoError(t, err)
+		require.Equal(t, int64(w.buf.Len()), n)
+		return w.buf.Bytes(), pending
+	}
+
+	// verify opens a backup and checks that it holds the values of
+	// generation want.
+	verify := func(data []byte, want byte) {
+		path := filepath.Join(t.TempDir(), "backup.db")
+		require.NoError(t, os.WriteFile(path, data, 0666))
+		bdb, err := bolt.Open(path, 0666, nil)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, bdb.Close()) }()
+		require.NoError(t, bdb.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			n := 0
+			require.NoError(t, tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+				n++
+				require.Len(t, v, 1000)
+				require.LessOrEqual(t, v[0], want)
+				return nil
+			}))
+			require.Equal(t, keys, n)
+			return nil
+		}))
+	}
+
+	// The pages of the snapshot are all that may be held back.
+	var pages int
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		s := tx.Bucket([]byte("widgets")).Stats()
+		pages = s.BranchPageN + s.BranchOverflowN + s.LeafPageN + s.LeafOverflowN
+		return nil
+	}))
+
+	want := gen
+	data, pending := run(func(w io.Writer) (int64, error) {
+		return db.BackupSnapshot(w, bolt.BackupOptions{ChunkSize: 64 * 1024})
+	})
+	verify(data, want)
+
+	// Writers soon rewrite every page of the snapshot, which keeps the pages
+	// not yet copied pending, but those copied are released as it goes.
+	max := 0
+	for _, n := range pending {
+		if n > max {
+			max = n
+		}
+	}
+	require.Greater(t, len(pending), 20)
+	require.Greater(t, max, pages/2)
+	require.LessOrEqual(t, max, 2*pages)
+	require.Less(t, pending[len(pending)-1], max/4)
+
+	// Nothing is held back once the backup is done.
+	_, err := db.ReclaimPending()
+	require.NoError(t, err)
+	require.Zero(t, db.Stats().PendingPageN)
+}
@@ -0,0 +1,130 @@
+package bbolt
+
+import (
+	"sync/atomic"
+)
+
+// The number of filter bits allocated per expected key and the number of
+// hash probes per key. Together they give a false positive rate of about 1%.
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7
+)
+
+// bloomFilter is an in-memory membership filter for the keys of a top-level
+// bucket. It may report false positives but never false negatives for keys
+// that were added. Bits are set and read atomically so that the writer can
+// add keys while read transactions consult the filter.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter returns an empty filter sized for n keys.
+func newBloomFilter(n int) *bloomFilter {
+	if n < 64 {
+		n = 64
+	}
+	return &bloomFilter{bits: make([]uint64, (n*bloomBitsPerKey+63)/64)}
+}
+
+// add records key in the filter.
+func (f *bloomFilter) add(key []byte) {
+	m := uint32(len(f.bits) * 64)
+	h := bloomHash(key)
+	a, b := uint32(h), uint32(h>>32)|1
+	for i := uint32(0); i < bloomProbes; i++ {
+		bit := (a + i*b) % m
+		word, mask := &f.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain returns false if key was definitely never added to the filter.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	m := uint32(len(f.bits) * 64)
+	h := bloomHash(key)
+	a, b := uint32(h), uint32(h>>32)|1
+	for i := uint32(0); i < bloomProbes; i++ {
+		bit := (a + i*b) % m
+		if atomic.LoadUint64(&f.bits[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns the 64-bit FNV-1a hash of key.
+func bloomHash(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// EnableBloomFilter builds an in-memory Bloom filter for the top-level bucket
+// with the given name so that Bucket.Get can skip the tree descent for most
+// absent keys. The filter is sized for expectedKeys, or for the current number
+// of keys in the bucket if that is larger; it keeps working beyond that size
+// but with a higher false positive rate.
+//
+// The filter is updated by Put but deleted keys are never removed from it,
+// so calling EnableBloomFilter again rebuilds it from the bucket's current
+// contents. Filters are not persisted and must be enabled after every Open.
+//
+// EnableBloomFilter starts a write transaction to build the filter, so it
+// must not be called from within a transaction.
+func (db *DB) EnableBloomFilter(name []byte, expectedKeys int) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	b := tx.Bucket(name)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	if n := b.Stats().KeyN; n > expectedKeys {
+		expectedKeys = n
+	}
+
+	f := newBloomFilter(expectedKeys)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		f.add(k)
+	}
+
+	db.setBloomFilter(name, f)
+	return nil
+}
+
+// DisableBloomFilter removes the Bloom filter of the top-level bucket with
+// the given name, if any.
+func (db *DB) DisableBloomFilter(name []byte) {
+	db.setBloomFilter(name, nil)
+}
+
+// setBloomFilter installs or removes a filter. The filters map is copied on
+// write so that transactions can use their snapshot of it without locking.
+func (db *DB) setBloomFilter(name []byte, f *bloomFilter) {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	filters := make(map[string]*bloomFilter, len(db.filters)+1)
+	for k, v := range db.filters {
+		filters[k] = v
+	}
+	if f != nil {
+		filters[string(name)] = f
+	} else {
+		delete(filters, string(name))
+	}
+	db.filters = filters
+}
@@ -0,0 +1,111 @@
+package bbolt_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+func bloomKey(i int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(i))
+	return k
+}
+
+// Ensure that a Bloom filter never hides keys that exist in the bucket.
+func TestDB_EnableBloomFilter_NoFalseNegatives(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i += 2 {
+			if err := b.Put(bloomKey(i), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// Rebuild the filter after reopening, as filters are not persisted.
+	db.MustClose()
+	db.MustReopen()
+	require.Equal(t, bolt.ErrBucketNotFound, db.EnableBloomFilter([]byte("missing"), 100))
+	require.NoError(t, db.EnableBloomFilter([]byte("widgets"), 100))
+
+	// Keys written after the filter was enabled must be visible as well,
+	// including across a rolled back transaction.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 1000; i < 2000; i += 2 {
+			if err := b.Put(bloomKey(i), []byte("v")); err != nil {
+				return err
+			}
+			require.NotNil(t, b.Get(bloomKey(i)))
+		}
+		return b.Delete(bloomKey(0))
+	}))
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, tx.Bucket([]byte("widgets")).Put(bloomKey(1), []byte("v")))
+	require.NoError(t, tx.Rollback())
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 2000; i++ {
+			if i%2 == 0 && i != 0 {
+				require.NotNil(t, b.Get(bloomKey(i)), "key %d", i)
+			} else {
+				require.Nil(t, b.Get(bloomKey(i)), "key %d", i)
+			}
+		}
+		return nil
+	}))
+
+	db.DisableBloomFilter([]byte("widgets"))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("widgets")).Get(bloomKey(2)))
+		return nil
+	}))
+}
+
+func BenchmarkBucket_Get_Absent(b *testing.B) {
+	b.Run("NoFilter", func(b *testing.B) { benchmarkBucketGetAbsent(b, false) })
+	b.Run("BloomFilter", func(b *testing.B) { benchmarkBucketGetAbsent(b, true) })
+}
+
+func benchmarkBucketGetAbsent(b *testing.B, filter bool) {
+	db := btesting.MustCreateDB(b)
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i += 2 {
+			if err := bkt.Put(bloomKey(i), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	if filter {
+		require.NoError(b, db.EnableBloomFilter([]byte("bench"), 0))
+	}
+
+	b.ResetTimer()
+	require.NoError(b, db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("bench"))
+		for i := 0; i < b.N; i++ {
+			if v := bkt.Get(bloomKey((i*2 + 1) % 100000)); v != nil {
+				b.Fatalf("unexpected value for absent key")
+			}
+		}
+		return nil
+	}))
+}
@@ -4,6 +4,9 @@ import (
 	"syscall"
 )
 
+// mmapPopulateFlag asks the kernel to prefault the whole mapping.
+const mmapPopulateFlag = syscall.MAP_POPULATE
+
 // fdatasync flushes written data to a file descriptor.
 func fdatasync(db *DB) error {
 	return syscall.Fdatasync(int(db.file.Fd()))
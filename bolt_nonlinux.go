@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package bbolt
+
+// mmapPopulateFlag is not supported outside Linux, so Options.MmapPopulate
+// has no effect.
+const mmapPopulateFlag = 0
@@ -52,7 +52,11 @@ func funlock(db *DB) error {
 // mmap memory maps a DB's data file.
 func mmap(db *DB, sz int) error {
 	// Map the data file to memory.
-	b, err := unix.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED|db.MmapFlags)
+	prot, flags := syscall.PROT_READ, syscall.MAP_SHARED
+	if db.copyOnWriteMmap {
+		prot, flags = syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE
+	}
+	b, err := unix.Mmap(int(db.file.Fd()), 0, sz, prot, flags|db.MmapFlags)
 	if err != nil {
 		return err
 	}
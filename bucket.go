@@ -2,7 +2,10 @@ package bbolt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"unsafe"
 )
 
@@ -10,12 +13,18 @@ const (
 	// MaxKeySize is the maximum length of a key, in bytes.
 	MaxKeySize = 8191
 
-	// MaxValueSize is the maximum length of a value, in bytes.
+	// MaxValueSize is the maximum length of a value, in bytes. Values larger
+	// than half of it may be stored on a leaf page of their own instead of
+	// sharing it with at least one other key.
 	MaxValueSize = 16777215
 )
 
 const bucketHeaderSize = int(unsafe.Sizeof(bucket{}))
 
+// bucketFillSize is the size of the persisted fill percent that starts the
+// optional trailer of a bucket value. See Bucket.trailer.
+const bucketFillSize = int(unsafe.Sizeof(float64(0)))
+
 const (
 	minFillPercent = 0.1
 	maxFillPercent = 1.0
@@ -29,17 +38,27 @@ const DefaultFillPercent = 0.5
 type Bucket struct {
 	*bucket
 	tx       *Tx                // the associated transaction
+	name     []byte             // key of the bucket in its parent, nil for the root bucket
+	parent   *Bucket            // parent bucket, nil for the root bucket
 	buckets  map[string]*Bucket // subbucket cache
 	page     *page              // inline page reference
 	rootNode *node              // materialized node for the root page.
 	nodes    map[pgid]*node     // node cache
+	filter   *bloomFilter       // optional membership filter, top-level buckets only
 
 	// Sets the threshold for filling nodes when they split. By default,
 	// the bucket will fill to 50% but it can be useful to increase this
 	// amount if you know that your write workloads are mostly append-only.
 	//
-	// This is non-persisted across transactions so it must be set in every Tx.
+	// This is non-persisted across transactions so it must be set in every Tx,
+	// unless it was stored with SetPersistentFillPercent.
 	FillPercent float64
+
+	persistentFill float64               // fill percent stored with the bucket, zero if unset
+	comparator     string                // name of the key comparator stored with the bucket, empty for bytes
+	compare        func(a, b []byte) int // key comparator, nil for bytes.Compare
+	indexes        []*bucketIndex        // secondary indexes registered with WithIndex
+	err            error                 // ErrUnknownComparator if the comparator is not registered
 }
 
 // bucket represents the on-file representation of a bucket.
@@ -76,6 +95,16 @@ func (b *Bucket) Writable() bool {
 	return b.tx.writable
 }
 
+// path returns the names of the buckets leading from the root to b,
+// outermost first. It is nil for the root bucket.
+func (b *Bucket) path() [][]byte {
+	var path [][]byte
+	for ; b.parent != nil; b = b.parent {
+		path = append([][]byte{b.name}, path...)
+	}
+	return path
+}
+
 // Cursor creates a cursor associated with the bucket.
 // The cursor is only valid as long as the transaction is open.
 // Do not use a cursor after the transaction is closed.
@@ -91,33 +120,91 @@ func (b *Bucket) Cursor() *Cursor {
 }
 
 // Bucket retrieves a nested bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist, or if its keys are ordered by a
+// comparator that is not registered; use OpenBucket to tell these apart.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) Bucket(name []byte) *Bucket {
-	if b.buckets != nil {
-		if child := b.buckets[string(name)]; child != nil {
-			return child
-		}
+	child, err := b.OpenBucket(name)
+	if err != nil {
+		return nil
+	}
+	return child
+}
+
+// OpenBucket retrieves a nested bucket by name, like Bucket, but returns
+// ErrBucketNotFound if the bucket does not exist, ErrIncompatibleValue if the
+// key holds a value, and ErrUnknownComparator if the keys of the bucket are
+// ordered by a comparator that is not registered with RegisterComparator.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) OpenBucket(name []byte) (*Bucket, error) {
+	if child := b.buckets[string(name)]; child != nil {
+		return child, child.err
 	}
 
 	// Move cursor to key.
 	c := b.Cursor()
 	k, v, flags := c.seek(name)
+	if c.err != nil {
+		return nil, c.err
+	}
 
-	// Return nil if the key doesn't exist or it is not a bucket.
-	if !bytes.Equal(name, k) || (flags&bucketLeafFlag) == 0 {
-		return nil
+	// Return an error if the key doesn't exist or it is not a bucket.
+	if !bytes.Equal(name, k) {
+		return nil, c.wrapError(ErrBucketNotFound, name)
+	} else if (flags & bucketLeafFlag) == 0 {
+		return nil, c.wrapError(ErrIncompatibleValue, name)
+	}
+
+	child := b.childBucket(k, v)
+	if child.err != nil {
+		return nil, child.err
+	}
+	return child, nil
+}
+
+// childBucket returns the nested bucket stored under key k with the bucket
+// value v, and caches it. Unlike OpenBucket it does not look the key up, so
+// it also opens buckets with an unknown comparator; such buckets must only be
+// walked, never searched.
+func (b *Bucket) childBucket(k, v []byte) *Bucket {
+	if child := b.buckets[string(k)]; child != nil {
+		return child
 	}
 
 	// Otherwise create a bucket and cache it.
 	var child = b.openBucket(v)
+	child.parent = b
 	if b.buckets != nil {
-		b.buckets[string(name)] = child
+		child.name = cloneBytes(k)
+		b.buckets[string(k)] = child
+	} else {
+		child.name = k
+	}
+	if b == &b.tx.root {
+		child.filter = b.tx.filters[string(k)]
+	}
+	if child.comparator != "" && child.compare == nil {
+		// Any search of the keys would be out of order.
+		child.err = &BoltError{Err: ErrUnknownComparator, BucketPath: child.path(), Key: []byte(child.comparator)}
 	}
 
 	return child
 }
 
+// forEachChild calls fn for each nested bucket, in key order, without looking
+// up their keys. See childBucket.
+func (b *Bucket) forEachChild(fn func(child *Bucket) error) error {
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if flags&bucketLeafFlag != 0 {
+			if err := fn(b.childBucket(k, v)); err != nil {
+				return err
+			}
+		}
+	}
+	return c.err
+}
+
 // Helper method that re-interprets a sub-bucket value
 // from a parent into a Bucket
 func (b *Bucket) openBucket(value []byte) *Bucket {
@@ -147,9 +234,72 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 		child.page = (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
 	}
 
+	// Load the settings stored after the header or the inline page.
+	end := bucketHeaderSize
+	if child.root == 0 {
+		end += inlinePageSize(child.page)
+	}
+	child.readTrailer(value[end:])
+
 	return &child
 }
 
+// trailer returns the settings stored after the bucket header, or after the
+// inline page of inline buckets. It is empty if no setting was changed, and
+// otherwise holds the persisted fill percent, followed by the comparator name
+// and its length in a single byte if a comparator was set.
+func (b *Bucket) trailer() []byte {
+	if b.persistentFill == 0 && b.comparator == "" {
+		return nil
+	}
+	f := b.persistentFill
+	buf := make([]byte, bucketFillSize, bucketFillSize+len(b.comparator)+1)
+	copy(buf, unsafeByteSlice(unsafe.Pointer(&f), 0, 0, bucketFillSize))
+	if b.comparator != "" {
+		buf = append(buf, b.comparator...)
+		buf = append(buf, byte(len(b.comparator)))
+	}
+	return buf
+}
+
+// readTrailer loads the settings written by trailer.
+func (b *Bucket) readTrailer(t []byte) {
+	if len(t) < bucketFillSize {
+		return
+	}
+	var f float64
+	copy(unsafeByteSlice(unsafe.Pointer(&f), 0, 0, bucketFillSize), t)
+	if f != 0 {
+		b.persistentFill = f
+		b.FillPercent = f
+	}
+
+	if n := len(t) - bucketFillSize - 1; n > 0 && int(t[len(t)-1]) == n {
+		b.comparator = string(t[bucketFillSize : bucketFillSize+n])
+		// An unknown comparator leaves compare nil; see childBucket.
+		b.compare, _ = lookupComparator(b.comparator)
+	}
+}
+
+// compareKeys compares two keys with the comparator of the bucket.
+func (b *Bucket) compareKeys(x, y []byte) int {
+	if b.compare == nil {
+		return bytes.Compare(x, y)
+	}
+	return b.compare(x, y)
+}
+
+// inlinePageSize returns the number of bytes used by an inline page.
+func inlinePageSize(p *page) int {
+	if p.count == 0 {
+		return int(pageHeaderSize)
+	}
+	// The data of the last element ends the page.
+	last := p.leafPageElement(p.count - 1)
+	off := uintptr(unsafe.Pointer(last)) - uintptr(unsafe.Pointer(p))
+	return int(off) + int(last.pos()) + int(last.ksize()) + int(last.vsize())
+}
+
 // CreateBucket creates a new bucket at the given key and returns the new bucket.
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
@@ -160,18 +310,23 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 		return nil, ErrTxNotWritable
 	} else if len(key) == 0 {
 		return nil, ErrBucketNameRequired
+	} else if len(key) > MaxKeySize {
+		return nil, ErrKeyTooLarge
 	}
 
 	// Move cursor to correct position.
 	c := b.Cursor()
 	k, _, flags := c.seek(key)
+	if c.err != nil {
+		return nil, c.err
+	}
 
 	// Return an error if there is an existing key.
 	if bytes.Equal(key, k) {
 		if (flags & bucketLeafFlag) != 0 {
-			return nil, ErrBucketExists
+			return nil, c.wrapError(ErrBucketExists, key)
 		}
-		return nil, ErrIncompatibleValue
+		return nil, c.wrapError(ErrIncompatibleValue, key)
 	}
 
 	// Create empty, inline bucket.
@@ -199,8 +354,8 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) CreateBucketIfNotExists(key []byte) (*Bucket, error) {
 	child, err := b.CreateBucket(key)
-	if err == ErrBucketExists {
-		return b.Bucket(key), nil
+	if errors.Is(err, ErrBucketExists) {
+		return b.OpenBucket(key)
 	} else if err != nil {
 		return nil, err
 	}
@@ -218,37 +373,83 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, v, flags := c.seek(key)
+	if c.err != nil {
+		return c.err
+	}
 
 	// Return an error if bucket doesn't exist or is not a bucket.
 	if !bytes.Equal(key, k) {
-		return ErrBucketNotFound
+		return c.wrapError(ErrBucketNotFound, key)
 	} else if (flags & bucketLeafFlag) == 0 {
-		return ErrIncompatibleValue
+		return c.wrapError(ErrIncompatibleValue, key)
 	}
 
-	// Recursively delete all child buckets.
-	child := b.Bucket(key)
-	err := child.ForEachBucket(func(k []byte) error {
-		if err := child.DeleteBucket(k); err != nil {
-			return fmt.Errorf("delete bucket: %s", err)
-		}
-		return nil
-	})
-	if err != nil {
+	// Release all pages of the bucket and its child buckets to freelist.
+	if err := b.childBucket(k, v).freeAll(); err != nil {
 		return err
 	}
 
 	// Remove cached copy.
 	delete(b.buckets, string(key))
 
-	// Release all bucket pages to freelist.
-	child.nodes = nil
-	child.rootNode = nil
-	child.free()
-
 	// Delete the node if we have a matching key.
 	c.node().del(key)
+	b.logBucketDrop(key)
+
+	return nil
+}
+
+// replaceBucket builds a detached bucket with build and, on success, swaps it
+// in for the existing child bucket at key.
+func (b *Bucket) replaceBucket(key []byte, build func(*Bucket) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Return an error if bucket doesn't exist or is not a bucket.
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+	if c.err != nil {
+		return c.err
+	}
+	if !bytes.Equal(key, k) {
+		return c.wrapError(ErrBucketNotFound, key)
+	} else if (flags & bucketLeafFlag) == 0 {
+		return c.wrapError(ErrIncompatibleValue, key)
+	}
+
+	// Build the replacement from an empty, inline bucket that is not yet
+	// reachable from the parent, so a failed build leaves nothing behind.
+	var empty = Bucket{
+		bucket:      &bucket{},
+		rootNode:    &node{isLeaf: true},
+		FillPercent: DefaultFillPercent,
+	}
+	var value = empty.write()
+
+	key = cloneBytes(key)
+	child := b.openBucket(value)
+	child.name = key
+	child.parent = b
+	if b == &b.tx.root {
+		child.filter = b.tx.filters[string(key)]
+	}
+	if err := build(child); err != nil {
+		return err
+	}
+
+	// Release the old bucket and insert the new one under the same key.
+	if err := b.DeleteBucket(key); err != nil {
+		return err
+	}
+	c = b.Cursor()
+	c.seek(key)
+	c.node().put(key, key, value, 0, bucketLeafFlag)
+	b.buckets[string(key)] = child
+	b.page = nil
 
 	return nil
 }
@@ -257,6 +458,11 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
 // The returned value is only valid for the life of the transaction.
 func (b *Bucket) Get(key []byte) []byte {
+	// Skip the tree descent if the filter rules the key out.
+	if b.filter != nil && !b.filter.mayContain(key) {
+		return nil
+	}
+
 	k, v, flags := b.Cursor().seek(key)
 
 	// Return nil if this is a bucket.
@@ -271,37 +477,301 @@ func (b *Bucket) Get(key []byte) []byte {
 	return v
 }
 
+// GetWithFlags retrieves the value for a key in the bucket together with the
+// flags of its leaf element: BucketLeafFlag if the key holds a nested bucket,
+// FlaggedValue if the value was written with PutFlagged, or zero. found
+// reports whether the key exists; the value is nil for nested buckets.
+// The returned value is only valid for the life of the transaction.
+func (b *Bucket) GetWithFlags(key []byte) (value []byte, flags uint32, found bool) {
+	// The Bloom filter is not consulted as it does not track nested buckets.
+	k, v, flags := b.Cursor().seek(key)
+	if !bytes.Equal(key, k) {
+		return nil, 0, false
+	}
+	if (flags & bucketLeafFlag) != 0 {
+		return nil, flags, true
+	}
+	return v, flags, true
+}
+
+// CursorScratch holds a cursor stack that Bucket.GetInto reuses across
+// lookups, so repeated point reads don't allocate a new cursor each time.
+// The zero value is ready to use. A CursorScratch must not be used by several
+// goroutines at once, but it may be reused across buckets and transactions.
+type CursorScratch struct {
+	c Cursor
+}
+
+// GetInto retrieves the value for a key in the bucket like Get, using scratch
+// for the cursor instead of allocating one. found reports whether the key
+// exists and holds a value rather than a nested bucket.
+// The returned value is only valid for the life of the transaction.
+func (b *Bucket) GetInto(key []byte, scratch *CursorScratch) (value []byte, found bool) {
+	// Skip the tree descent if the filter rules the key out.
+	if b.filter != nil && !b.filter.mayContain(key) {
+		return nil, false
+	}
+
+	b.tx.stats.IncCursorCount(1)
+	c := &scratch.c
+	c.bucket = b
+	k, v, flags := c.seek(key)
+
+	// Drop the references to pages and nodes so that the scratch doesn't keep
+	// them alive, but keep the capacity for the next lookup.
+	for i := range c.stack {
+		c.stack[i] = elemRef{}
+	}
+	c.stack = c.stack[:0]
+	c.bucket = nil
+	c.err = nil
+
+	if (flags&bucketLeafFlag) != 0 || !bytes.Equal(key, k) {
+		return nil, false
+	}
+	return v, true
+}
+
+// GetBatch retrieves the values for several keys in the bucket, in the order
+// of keys, with nil for keys that don't exist or hold nested buckets. The keys
+// are looked up in sorted order with a single cursor, which only descends
+// from the deepest page that still covers the next key, so it is cheaper than
+// calling Get for each of many keys.
+// The returned values are only valid for the life of the transaction.
+func (b *Bucket) GetBatch(keys [][]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	order := make([]int, 0, len(keys))
+	for i, key := range keys {
+		// Skip the keys the filter rules out.
+		if b.filter != nil && !b.filter.mayContain(key) {
+			continue
+		}
+		order = append(order, i)
+	}
+	if len(order) == 0 {
+		return values
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return b.compareKeys(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	c := b.Cursor()
+	for _, i := range order {
+		k, v, flags := c.reseek(keys[i])
+		if (flags&bucketLeafFlag) == 0 && bytes.Equal(keys[i], k) {
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// ReadAmplification reports how many pages are read to fetch key from the
+// bucket, and their size in bytes: every page on the path from the root of
+// the bucket to the leaf holding key, including the overflow pages of each,
+// such as those of a leaf holding a large value. Pages the transaction has
+// already materialized in memory and inline buckets, which live in their
+// parent's leaf, add nothing. Returns ErrKeyNotFound if key does not exist
+// and ErrIncompatibleValue if it names a nested bucket.
+func (b *Bucket) ReadAmplification(key []byte) (pages int, size int64, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	}
+
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+	if c.err != nil {
+		return 0, 0, c.err
+	}
+	if !bytes.Equal(key, k) {
+		return 0, 0, c.wrapError(ErrKeyNotFound, key)
+	} else if (flags & bucketLeafFlag) != 0 {
+		return 0, 0, c.wrapError(ErrIncompatibleValue, key)
+	}
+	if b.root == 0 {
+		return 0, 0, nil
+	}
+
+	for _, ref := range c.stack {
+		if ref.page != nil {
+			pages += 1 + int(ref.page.overflow)
+		}
+	}
+	return pages, int64(pages) * int64(b.tx.db.pageSize), nil
+}
+
+// Reserve prepares the database for a bulk insert of about expectedKeys new
+// pairs with values of avgValueSize bytes into the bucket. It estimates the
+// leaf and branch pages the pairs will need from the element encoding, the
+// bucket's FillPercent and the size of its existing keys, subtracts the pages
+// already available on the freelist and grows the data file once to fit the
+// rest, so later commits don't have to grow it step by step. The mmap is left
+// alone until the next commit needs it, keeping data returned by the
+// transaction valid. Reserve is only a hint: nothing is held back if the
+// estimate turns out too small or too large.
+func (b *Bucket) Reserve(expectedKeys int, avgValueSize int) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+	if expectedKeys <= 0 {
+		return nil
+	}
+	db := b.tx.db
+
+	// Estimate the key size from the first few existing keys.
+	ksize, n := 0, 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && n < 64; k, _ = c.Next() {
+		ksize += len(k)
+		n++
+	}
+	if n > 0 {
+		ksize /= n
+	} else {
+		ksize = 16
+	}
+
+	fillPercent := b.FillPercent
+	if fillPercent < minFillPercent {
+		fillPercent = minFillPercent
+	} else if fillPercent > maxFillPercent {
+		fillPercent = maxFillPercent
+	}
+
+	// Leaf pages, with large values spilling onto overflow pages.
+	var pages int
+	elsz := int(leafPageElementSize) + ksize + avgValueSize
+	usable := int(float64(db.pageSize)*fillPercent) - int(pageHeaderSize)
+	if elsz > usable {
+		pages = expectedKeys * ((int(pageHeaderSize) + elsz + db.pageSize - 1) / db.pageSize)
+	} else {
+		pages = (expectedKeys + usable/elsz - 1) / (usable / elsz)
+	}
+
+	// Branch pages above them.
+	perBranch := (db.pageSize - int(pageHeaderSize)) / (int(branchPageElementSize) + ksize)
+	if perBranch < 2 {
+		perBranch = 2
+	}
+	for n := pages; n > 1; {
+		n = (n + perBranch - 1) / perBranch
+		pages += n
+	}
+
+	if pages -= db.freelist.free_count(); pages <= 0 {
+		return nil
+	}
+	return db.grow(int(b.tx.meta.pgid+pgid(pages)+1) * db.pageSize)
+}
+
+// Compact rewrites the bucket's B+tree into densely filled pages, according
+// to FillPercent, and releases the pages it used before. This undoes the
+// internal fragmentation left behind by deletes without rewriting any other
+// bucket; nested buckets are carried over unchanged. The new pages are
+// allocated when the transaction commits. Inline buckets are left as is.
+func (b *Bucket) Compact() error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+	if b.root == 0 {
+		return nil
+	}
+
+	// Gather every element, including uncommitted changes, into a single
+	// leaf which is split into full pages when it is spilled.
+	var all inodes
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		all = append(all, inode{flags: flags, key: k, value: v})
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	// Release every page of the old tree except the root, which is reused
+	// by the new leaf and released when it is spilled.
+	if err := b.forEachPageNode(func(p *page, n *node, _ int) {
+		var id pgid
+		if n != nil {
+			id = n.pgid
+		} else {
+			id = p.id
+		}
+		if id != b.root {
+			b.tx.db.freelist.free(b.tx.meta.txid, b.tx.page(id))
+		}
+	}); err != nil {
+		return err
+	}
+
+	n := &node{bucket: b, isLeaf: true, pgid: b.root, inodes: all}
+	b.rootNode = n
+	b.nodes = map[pgid]*node{b.root: n}
+	b.tx.stats.IncNodeCount(1)
+	return nil
+}
+
 // Put sets the value for a key in the bucket.
 // If the key exist then its previous value will be overwritten.
 // Supplied value must remain valid for the life of the transaction.
 // Returns an error if the bucket was created from a read-only transaction, if the key is blank, if the key is too large, or if the value is too large.
 func (b *Bucket) Put(key []byte, value []byte) error {
+	return b.put(key, value, 0)
+}
+
+// PutFlagged sets the value for a key in the bucket like Put, and also marks
+// the value with FlaggedValue, which is reported by Cursor.Flags. The flag is
+// stored alongside the key and value and is cleared by a subsequent Put.
+// Returns ErrValueFlagsUnsupported if the data file is in a format version
+// that predates value flags.
+func (b *Bucket) PutFlagged(key []byte, value []byte) error {
+	return b.put(key, value, FlaggedValue)
+}
+
+func (b *Bucket) put(key []byte, value []byte, flags uint32) error {
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
 		return ErrTxNotWritable
-	} else if len(key) == 0 {
+	} else if len(key) == 0 && !b.tx.db.allowEmptyKeys {
 		return ErrKeyRequired
 	} else if len(key) > MaxKeySize {
 		return ErrKeyTooLarge
 	} else if int64(len(value)) > MaxValueSize {
 		return ErrValueTooLarge
+	} else if flags&FlaggedValue != 0 && !b.tx.meta.valueFlags() {
+		return ErrValueFlagsUnsupported
 	}
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, old, oflags := c.seek(key)
+	if c.err != nil {
+		return c.err
+	}
+	found := bytes.Equal(key, k)
 
 	// Return an error if there is an existing key with a bucket value.
-	if bytes.Equal(key, k) && (flags&bucketLeafFlag) != 0 {
-		return ErrIncompatibleValue
+	if found && (oflags&bucketLeafFlag) != 0 {
+		return c.wrapError(ErrIncompatibleValue, key)
 	}
 
-	// Insert into node.
+	// Insert into node, unless that would exceed the memory budget.
+	n := c.node()
+	if err := b.tx.chargeMemory(len(key) + len(value)); err != nil {
+		return err
+	}
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	n.put(key, key, value, 0, flags)
+	if b.filter != nil {
+		b.filter.add(key)
+	}
+	b.logMutation(MutationPut, key, value)
 
-	return nil
+	return b.reindex(key, old, value, found, true)
 }
 
 func (b *Bucket) TestPut(key []byte, value []byte) (bool, error) {
@@ -309,7 +779,7 @@ func (b *Bucket) TestPut(key []byte, value []byte) (bool, error) {
 		return false, ErrTxClosed
 	} else if !b.Writable() {
 		return false, ErrTxNotWritable
-	} else if len(key) == 0 {
+	} else if len(key) == 0 && !b.tx.db.allowEmptyKeys {
 		return false, ErrKeyRequired
 	} else if len(key) > MaxKeySize {
 		return false, ErrKeyTooLarge
@@ -319,75 +789,333 @@ func (b *Bucket) TestPut(key []byte, value []byte) (bool, error) {
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, old, flags := c.seek(key)
+	if c.err != nil {
+		return false, c.err
+	}
+	found := bytes.Equal(key, k)
 
 	// Return an error if there is an existing key with a bucket value.
-	if bytes.Equal(key, k) && (flags&bucketLeafFlag) != 0 {
-		return false, ErrIncompatibleValue
+	if found && (flags&bucketLeafFlag) != 0 {
+		return false, c.wrapError(ErrIncompatibleValue, key)
 	}
 
-	// Insert into node.
+	// Insert into node, unless that would exceed the memory budget.
+	n := c.node()
+	if err := b.tx.chargeMemory(len(key) + len(value)); err != nil {
+		return false, err
+	}
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	n.put(key, key, value, 0, 0)
+	if b.filter != nil {
+		b.filter.add(key)
+	}
+	b.logMutation(MutationPut, key, value)
+
+	return !found, b.reindex(key, old, value, found, true)
+}
+
+// Delete removes a key from the bucket.
+// If the key does not exist then nothing is done and a nil error is returned.
+// Returns an error if the bucket was created from a read-only transaction.
+func (b *Bucket) Delete(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Move cursor to correct position.
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if c.err != nil {
+		return c.err
+	}
+
+	// Return nil if the key doesn't exist.
+	if !bytes.Equal(key, k) {
+		return nil
+	}
+
+	// Return an error if there is already existing bucket value.
+	if (flags & bucketLeafFlag) != 0 {
+		return c.wrapError(ErrIncompatibleValue, key)
+	}
+
+	// Delete the node if we have a matching key.
+	c.node().del(key)
+	b.logMutation(MutationDelete, key, nil)
+
+	return b.reindex(key, v, nil, true, false)
+}
+
+// DeleteIf removes a key from the bucket only if pred returns true for its
+// current value. The lookup and the deletion share a single cursor seek.
+// Returns true if the key was deleted. If the key does not exist then pred
+// is not called and false is returned with a nil error.
+// Returns an error if the bucket was created from a read-only transaction
+// or if the key represents a nested bucket.
+func (b *Bucket) DeleteIf(key []byte, pred func(value []byte) bool) (bool, error) {
+	if b.tx.db == nil {
+		return false, ErrTxClosed
+	} else if !b.Writable() {
+		return false, ErrTxNotWritable
+	}
+
+	// Move cursor to correct position.
+	c := b.Cursor()
+	k, v, flags := c.seek(key)
+	if c.err != nil {
+		return false, c.err
+	}
+
+	// Return false if the key doesn't exist.
+	if !bytes.Equal(key, k) {
+		return false, nil
+	}
+
+	// Return an error if there is already existing bucket value.
+	if (flags & bucketLeafFlag) != 0 {
+		return false, c.wrapError(ErrIncompatibleValue, key)
+	}
+
+	if !pred(v) {
+		return false, nil
+	}
+
+	// Delete the node if we have a matching key.
+	c.node().del(key)
+	b.logMutation(MutationDelete, key, nil)
+
+	return true, b.reindex(key, v, nil, true, false)
+}
+
+// DeleteAll removes a batch of keys from the bucket. Keys are deleted in
+// sorted order so that neighbouring keys share the same leaf, and keys that
+// do not exist are skipped. The slice itself is not modified.
+//
+// It returns the number of keys removed and the number of pages, including
+// overflow pages, that the deletions return to the freelist: the pages
+// rebalancing merges away, which are merged right away, and the pages copied
+// on write, whose old copies are released when the transaction commits. On
+// error the counts cover the keys deleted so far.
+func (b *Bucket) DeleteAll(keys [][]byte) (deleted int, freedPages int, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, 0, ErrTxNotWritable
+	}
+
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool { return b.compareKeys(sorted[i], sorted[j]) == -1 })
+
+	freed := b.trackFreed()
+	defer func() { freedPages = freed() }()
+
+	c := b.Cursor()
+	for _, key := range sorted {
+		k, v, flags := c.seek(key)
+		if c.err != nil {
+			return deleted, freedPages, c.err
+		}
+		if !bytes.Equal(key, k) {
+			continue
+		} else if (flags & bucketLeafFlag) != 0 {
+			return deleted, freedPages, c.wrapError(ErrIncompatibleValue, key)
+		}
+		c.node().del(key)
+		b.logMutation(MutationDelete, key, nil)
+		deleted++
+		if err := b.reindex(key, v, nil, true, false); err != nil {
+			return deleted, freedPages, err
+		}
+	}
+	return deleted, freedPages, nil
+}
+
+// DeletePrefix removes every key starting with prefix from the bucket.
+// Nested buckets whose key has the prefix are left in place. Like DeleteAll,
+// it returns the number of keys removed and the number of pages, including
+// overflow pages, that the deletions return to the freelist. It relies on keys
+// sharing a prefix being adjacent, so it returns ErrPrefixUnordered unless
+// the bucket uses BytesComparator. Returns an error if the bucket was created
+// from a read-only transaction.
+func (b *Bucket) DeletePrefix(prefix []byte) (deleted int, freedPages int, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, 0, ErrTxNotWritable
+	} else if b.compare != nil {
+		return 0, 0, ErrPrefixUnordered
+	}
+
+	freed := b.trackFreed()
+	defer func() { freedPages = freed() }()
+
+	c := b.Cursor()
+	from := prefix
+	for {
+		k, v, flags := c.seek(from)
+		if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+			k, v, flags = c.next()
+		}
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			return deleted, freedPages, c.err
+		}
+		// Keys after a nested bucket are found by seeking just past it, and
+		// keys after a deleted key by seeking to it again.
+		from = cloneBytes(k)
+		if (flags & bucketLeafFlag) != 0 {
+			from = append(from, 0)
+			continue
+		}
+		c.node().del(from)
+		b.logMutation(MutationDelete, from, nil)
+		deleted++
+		if err := b.reindex(from, v, nil, true, false); err != nil {
+			return deleted, freedPages, err
+		}
+	}
+}
+
+// DeletePrefixDryRun reports what DeletePrefix would return for prefix
+// without changing the bucket: the number of keys it would remove and the
+// number of pages it would free. The page count leaves out pages that
+// rebalancing would merge away, which depend on the merges themselves, so
+// DeletePrefix may report more. It may be called from a read-only
+// transaction. Pages of index buckets registered with WithIndex are not
+// included.
+func (b *Bucket) DeletePrefixDryRun(prefix []byte) (keys int, freedPages int, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	} else if b.compare != nil {
+		return 0, 0, ErrPrefixUnordered
+	}
 
-	return !bytes.Equal(key, k), nil
+	// Every page on the path to a deleted key is copied on write and its old
+	// copy freed, so count each page that is not a node already.
+	seen := make(map[pgid]bool)
+	c := b.Cursor()
+	k, _, flags := c.seek(prefix)
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		k, _, flags = c.next()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _, flags = c.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			continue
+		}
+		keys++
+		for _, ref := range c.stack {
+			if ref.node != nil || ref.page.id == 0 || seen[ref.page.id] {
+				continue
+			}
+			seen[ref.page.id] = true
+			freedPages += int(ref.page.overflow) + 1
+		}
+	}
+	return keys, freedPages, c.err
 }
 
-// Delete removes a key from the bucket.
-// If the key does not exist then nothing is done and a nil error is returned.
-// Returns an error if the bucket was created from a read-only transaction.
-func (b *Bucket) Delete(key []byte) error {
+func (b *Bucket) TestDelete(key []byte) ([]byte, error) {
 	if b.tx.db == nil {
-		return ErrTxClosed
+		return nil, ErrTxClosed
 	} else if !b.Writable() {
-		return ErrTxNotWritable
+		return nil, ErrTxNotWritable
 	}
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, v, flags := c.seek(key)
+	if c.err != nil {
+		return nil, c.err
+	}
 
 	// Return nil if the key doesn't exist.
 	if !bytes.Equal(key, k) {
-		return nil
+		return nil, nil
 	}
 
 	// Return an error if there is already existing bucket value.
 	if (flags & bucketLeafFlag) != 0 {
-		return ErrIncompatibleValue
+		return nil, c.wrapError(ErrIncompatibleValue, key)
 	}
 
 	// Delete the node if we have a matching key.
 	c.node().del(key)
+	b.logMutation(MutationDelete, key, nil)
 
-	return nil
+	return v, b.reindex(key, v, nil, true, false)
 }
 
-func (b *Bucket) TestDelete(key []byte) ([]byte, error) {
+// Truncate removes every key and nested bucket from the bucket and releases
+// their pages, keeping the bucket itself, its sequence and its stored
+// settings. Every removed key is logged as a delete, like Delete does, and
+// the index buckets of indexes registered with WithIndex are left empty.
+// Returns an error if the bucket was created from a read-only transaction.
+func (b *Bucket) Truncate() error {
+	return b.truncate(false)
+}
+
+// Clear removes every key and nested bucket from the bucket, like Truncate,
+// and also resets its sequence to zero, so that the bucket can be reused as
+// if it had just been created. Returns an error if the bucket was created
+// from a read-only transaction.
+func (b *Bucket) Clear() error {
+	return b.truncate(true)
+}
+
+func (b *Bucket) truncate(resetSequence bool) error {
 	if b.tx.db == nil {
-		return nil, ErrTxClosed
+		return ErrTxClosed
 	} else if !b.Writable() {
-		return nil, ErrTxNotWritable
+		return ErrTxNotWritable
 	}
 
-	// Move cursor to correct position.
-	c := b.Cursor()
-	k, v, flags := c.seek(key)
-
-	// Return nil if the key doesn't exist.
-	if !bytes.Equal(key, k) {
-		return nil, nil
+	// Log the removal of every key, as Delete would.
+	if b.tx.db.mutationLog != nil {
+		c := b.Cursor()
+		for k, _, flags := c.first(); k != nil; k, _, flags = c.next() {
+			if (flags & bucketLeafFlag) == 0 {
+				b.logMutation(MutationDelete, k, nil)
+			}
+		}
+		if c.err != nil {
+			return c.err
+		}
 	}
 
-	// Return an error if there is already existing bucket value.
-	if (flags & bucketLeafFlag) != 0 {
-		return nil, ErrIncompatibleValue
+	// Release nested buckets first, index buckets included, then the
+	// bucket's own pages. The nested buckets are freed without deleting
+	// their keys, which would shift the elements under the cursor.
+	if err := b.forEachChild(func(child *Bucket) error {
+		return child.freeAll()
+	}); err != nil {
+		return err
+	}
+	b.buckets = make(map[string]*Bucket)
+	b.nodes = nil
+	b.rootNode = nil
+	if err := b.free(); err != nil {
+		return err
 	}
 
-	// Delete the node if we have a matching key.
-	c.node().del(key)
+	// Start over from an empty inline root, which marks the bucket dirty.
+	b.page = nil
+	b.nodes = make(map[pgid]*node)
+	b.rootNode = &node{bucket: b, isLeaf: true}
+	b.nodes[0] = b.rootNode
+	if resetSequence {
+		b.bucket.sequence = 0
+	}
 
-	return v, nil
+	// Registered indexes carry on from empty index buckets.
+	for _, ix := range b.indexes {
+		if _, err := b.CreateBucket(ix.name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Sequence returns the current integer for the bucket without incrementing it.
@@ -412,6 +1140,89 @@ func (b *Bucket) SetSequence(v uint64) error {
 	return nil
 }
 
+// PersistentFillPercent returns the fill percent stored with the bucket, or
+// zero if none was set.
+func (b *Bucket) PersistentFillPercent() float64 { return b.persistentFill }
+
+// SetPersistentFillPercent stores f with the bucket so that later
+// transactions open it with FillPercent already set to f. The value must be
+// between 0.1 and 1.0; passing zero removes the stored value, leaving
+// FillPercent at its current setting for this transaction. The root bucket
+// has no bucket header, so the value only lasts for the transaction there.
+// Returns ErrBucketSettingsUnsupported for a non-zero f if the data file is
+// in a format version that predates stored bucket settings.
+func (b *Bucket) SetPersistentFillPercent(f float64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	} else if f != 0 && (f < minFillPercent || f > maxFillPercent) {
+		return ErrInvalidFillPercent
+	} else if f != 0 && !b.tx.meta.bucketSettings() {
+		return ErrBucketSettingsUnsupported
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	b.persistentFill = f
+	if f != 0 {
+		b.FillPercent = f
+	}
+	return nil
+}
+
+// Comparator returns the name of the comparator that orders the keys of the
+// bucket, which is BytesComparator unless SetComparator was called.
+func (b *Bucket) Comparator() string {
+	if b.comparator == "" {
+		return BytesComparator
+	}
+	return b.comparator
+}
+
+// SetComparator orders the keys of the bucket with the comparator registered
+// under name, such as Uint64LEComparator, and stores the name with the bucket
+// so that later transactions keep using it. Inserts, Seek and iteration all
+// follow the comparator; nested buckets keep their own. The bucket must be
+// empty. Returns ErrUnknownComparator if name is not registered,
+// ErrBucketNotEmpty if the bucket holds any key and
+// ErrBucketSettingsUnsupported for any name but BytesComparator if the data
+// file is in a format version that predates stored bucket settings.
+func (b *Bucket) SetComparator(name string) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	} else if name != BytesComparator && !b.tx.meta.bucketSettings() {
+		return ErrBucketSettingsUnsupported
+	}
+
+	compare, ok := lookupComparator(name)
+	if !ok {
+		return &BoltError{Err: ErrUnknownComparator, BucketPath: b.path(), Key: []byte(name)}
+	}
+	if k, _ := b.Cursor().First(); k != nil {
+		return &BoltError{Err: ErrBucketNotEmpty, BucketPath: b.path()}
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	if name == BytesComparator {
+		b.comparator, b.compare = "", nil
+	} else {
+		b.comparator, b.compare = name, compare
+	}
+	return nil
+}
+
 // NextSequence returns an autoincrementing integer for the bucket.
 func (b *Bucket) NextSequence() (uint64, error) {
 	if b.tx.db == nil {
@@ -446,9 +1257,205 @@ func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
 			return err
 		}
 	}
+	return c.err
+}
+
+// ForEachCopy executes a function for each key/value pair in a bucket, like
+// ForEach, but passes fn copies of the key and value instead of slices into
+// the database, so they remain valid after the transaction ends. Nested
+// buckets are still passed with a nil value.
+func (b *Bucket) ForEachCopy(fn func(k, v []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			v = cloneBytes(v)
+		}
+		return fn(cloneBytes(k), v)
+	})
+}
+
+// ForEachParallel executes a function for each key/value pair in a bucket,
+// dispatching the calls across the given number of worker goroutines.
+// Iteration stays on the calling goroutine; keys and values are copied before
+// being handed to fn, so they remain valid after the transaction ends. Calls
+// are made in no particular order. If fn returns an error then no further
+// pairs are dispatched and the first error is returned once all workers
+// have finished. The provided function must not modify the bucket.
+func (b *Bucket) ForEachParallel(workers int, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	type pair struct{ k, v []byte }
+	var (
+		pairs    = make(chan pair, workers)
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pairs {
+				select {
+				case <-done:
+					continue
+				default:
+				}
+				if err := fn(p.k, p.v); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(done)
+					})
+				}
+			}
+		}()
+	}
+
+	c := b.Cursor()
+loop:
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		p := pair{k: cloneBytes(k)}
+		if v != nil {
+			p.v = cloneBytes(v)
+		}
+		select {
+		case pairs <- p:
+		case <-done:
+			break loop
+		}
+	}
+	close(pairs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = c.err
+	}
+	return firstErr
+}
+
+// ForEachHashed executes a function for each key/value pair in a bucket in an
+// order determined by a seeded hash of the key rather than by the key itself,
+// so that consecutive calls are not biased by clustered keys. The same seed
+// always yields the same order. All pairs are buffered and sorted before the
+// first call, costing roughly 56 bytes of memory per pair in addition to the
+// pairs themselves staying referenced. If fn returns an error then iteration
+// stops and the error is returned. The provided function must not modify
+// the bucket.
+func (b *Bucket) ForEachHashed(seed uint64, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+
+	type hashedPair struct {
+		hash uint64
+		k, v []byte
+	}
+	var pairs []hashedPair
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		pairs = append(pairs, hashedPair{hash: hashKey(seed, k), k: k, v: v})
+	}
+	if c.err != nil {
+		return c.err
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].hash != pairs[j].hash {
+			return pairs[i].hash < pairs[j].hash
+		}
+		return bytes.Compare(pairs[i].k, pairs[j].k) < 0
+	})
+
+	for _, p := range pairs {
+		if err := fn(p.k, p.v); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// OversizeScan returns the keys of the bucket that are longer than
+// keyThreshold bytes or whose values are longer than valueThreshold bytes, in
+// key order. It helps find data approaching MaxKeySize and MaxValueSize
+// before writes start failing. Keys of nested buckets are checked but their
+// contents are not. The returned keys are copies and remain valid after the
+// transaction ends.
+func (b *Bucket) OversizeScan(keyThreshold, valueThreshold int) ([][]byte, error) {
+	if b.tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	var keys [][]byte
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			v = nil
+		}
+		if len(k) > keyThreshold || len(v) > valueThreshold {
+			keys = append(keys, cloneBytes(k))
+		}
+	}
+	return keys, c.err
+}
+
+// Extremes returns the length of the longest key and of the longest value in
+// the bucket and all of its nested buckets, to show how close they come to
+// MaxKeySize and MaxValueSize. The names of nested buckets count as keys;
+// their headers don't count as values. Both are zero for an empty bucket.
+func (b *Bucket) Extremes() (maxKeyLen, maxValueLen int, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	}
+
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if len(k) > maxKeyLen {
+			maxKeyLen = len(k)
+		}
+		if (flags & bucketLeafFlag) == 0 {
+			if len(v) > maxValueLen {
+				maxValueLen = len(v)
+			}
+			continue
+		}
+
+		childKeyLen, childValueLen, err := b.childBucket(k, v).Extremes()
+		if err != nil {
+			return 0, 0, err
+		}
+		if childKeyLen > maxKeyLen {
+			maxKeyLen = childKeyLen
+		}
+		if childValueLen > maxValueLen {
+			maxValueLen = childValueLen
+		}
+	}
+	return maxKeyLen, maxValueLen, nil
+}
+
+// hashKey returns the FNV-1a hash of key, with seed mixed into the offset
+// basis.
+func hashKey(seed uint64, key []byte) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < 8; i++ {
+		h ^= (seed >> (8 * i)) & 0xff
+		h *= prime64
+	}
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	return h
+}
+
 func (b *Bucket) ForEachBucket(fn func(k []byte) error) error {
 	if b.tx.db == nil {
 		return ErrTxClosed
@@ -461,7 +1468,187 @@ func (b *Bucket) ForEachBucket(fn func(k []byte) error) error {
 			}
 		}
 	}
-	return nil
+	return c.err
+}
+
+// ForEachKey executes a function for each key/value pair in a bucket, like
+// ForEach, but skips nested buckets, so fn is only called for plain keys and
+// never with a nil value. If fn returns an error then the iteration is
+// stopped and the error is returned to the caller. The provided function must
+// not modify the bucket.
+func (b *Bucket) ForEachKey(fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if flags&bucketLeafFlag != 0 {
+			continue
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// ForEachMatch executes a function for each key/value pair in a bucket whose
+// key matches the given glob pattern. Patterns match bytes, not runes, so
+// they work on binary keys. The pattern syntax is:
+//
+//	'*'         matches any sequence of bytes
+//	'?'         matches any single byte
+//	'[' [ '!' ] { byte-range } ']'
+//	            byte class (must be non-empty)
+//	'\\' c      matches byte c
+//
+// The pattern must match the entire key. If the pattern starts with a literal
+// prefix the cursor seeks directly to it instead of scanning the whole bucket,
+// unless the bucket has a comparator other than BytesComparator, which
+// doesn't keep keys with a common prefix together. An error is returned if
+// the pattern is malformed.
+func (b *Bucket) ForEachMatch(pattern string, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	g, prefix, err := compileGlob(pattern)
+	if err != nil {
+		return err
+	}
+	if b.compare != nil {
+		prefix = nil
+	}
+	c := b.Cursor()
+	k, v := c.First()
+	if len(prefix) > 0 {
+		k, v = c.Seek(prefix)
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if !g.match(k) {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// glob is a compiled glob pattern. It matches keys byte by byte, so that
+// binary keys and keys that aren't valid UTF-8 match as written.
+type glob []globElem
+
+// globElem is a single element of a glob: a '*', or a set of bytes that
+// matches exactly one byte of the key.
+type globElem struct {
+	star bool
+	set  [256 / 8]byte
+}
+
+func (e *globElem) add(lo, hi byte) {
+	for c := int(lo); c <= int(hi); c++ {
+		e.set[c/8] |= 1 << (c % 8)
+	}
+}
+
+func (e *globElem) has(c byte) bool {
+	return e.set[c/8]&(1<<(c%8)) != 0
+}
+
+// match returns true if the glob matches all of k.
+func (g glob) match(k []byte) bool {
+	// On a mismatch, let the last '*' seen swallow one more byte and retry.
+	var i, j int
+	star, next := -1, 0
+	for j < len(k) {
+		if i < len(g) && g[i].star {
+			star, next = i, j
+			i++
+		} else if i < len(g) && g[i].has(k[j]) {
+			i++
+			j++
+		} else if star >= 0 {
+			next++
+			i, j = star+1, next
+		} else {
+			return false
+		}
+	}
+	for i < len(g) && g[i].star {
+		i++
+	}
+	return i == len(g)
+}
+
+// compileGlob compiles a glob pattern and returns the literal prefix every
+// matching key must start with.
+func compileGlob(pattern string) (glob, []byte, error) {
+	var g glob
+	var prefix []byte
+	literal := true
+
+	for i := 0; i < len(pattern); i++ {
+		var e globElem
+		switch ch := pattern[i]; ch {
+		case '*':
+			literal = false
+			e.star = true
+		case '?':
+			literal = false
+			e.add(0, 0xFF)
+		case '[':
+			literal = false
+			j := i + 1
+			negate := j < len(pattern) && (pattern[j] == '!' || pattern[j] == '^')
+			if negate {
+				j++
+			}
+			start := j
+			if j < len(pattern) && pattern[j] == ']' {
+				j++
+			}
+			for j < len(pattern) && pattern[j] != ']' {
+				j++
+			}
+			if j >= len(pattern) {
+				return nil, nil, fmt.Errorf("glob: unterminated character class in %q", pattern)
+			}
+			class := pattern[start:j]
+			for k := 0; k < len(class); k++ {
+				if k+2 < len(class) && class[k+1] == '-' {
+					if class[k] > class[k+2] {
+						return nil, nil, fmt.Errorf("glob: invalid range %q in %q", class[k:k+3], pattern)
+					}
+					e.add(class[k], class[k+2])
+					k += 2
+				} else {
+					e.add(class[k], class[k])
+				}
+			}
+			if negate {
+				for k := range e.set {
+					e.set[k] = ^e.set[k]
+				}
+			}
+			i = j
+		default:
+			if ch == '\\' {
+				if i++; i >= len(pattern) {
+					return nil, nil, fmt.Errorf("glob: trailing escape in %q", pattern)
+				}
+				ch = pattern[i]
+			}
+			if literal {
+				prefix = append(prefix, ch)
+			}
+			e.add(ch, ch)
+		}
+		g = append(g, e)
+	}
+	return g, prefix, nil
 }
 
 // Stats returns stats on a bucket.
@@ -472,7 +1659,7 @@ func (b *Bucket) Stats() BucketStats {
 	if b.root == 0 {
 		s.InlineBucketN += 1
 	}
-	b.forEachPage(func(p *page, depth int, pgstack []pgid) {
+	_ = b.forEachPage(func(p *page, depth int, pgstack []pgid) {
 		if (p.flags & leafPageFlag) != 0 {
 			s.KeyN += int(p.count)
 
@@ -547,29 +1734,34 @@ func (b *Bucket) Stats() BucketStats {
 }
 
 // forEachPage iterates over every page in a bucket, including inline pages.
-func (b *Bucket) forEachPage(fn func(*page, int, []pgid)) {
+// It returns ErrTreeTooDeep if the tree is deeper than the depth guard.
+func (b *Bucket) forEachPage(fn func(*page, int, []pgid)) error {
 	// If we have an inline page then just use that.
 	if b.page != nil {
 		fn(b.page, 0, []pgid{b.root})
-		return
+		return nil
 	}
 
 	// Otherwise traverse the page hierarchy.
-	b.tx.forEachPage(b.root, fn)
+	return b.tx.forEachPage(b.root, fn)
 }
 
 // forEachPageNode iterates over every page (or node) in a bucket.
-// This also includes inline pages.
-func (b *Bucket) forEachPageNode(fn func(*page, *node, int)) {
+// This also includes inline pages. It returns ErrTreeTooDeep if the tree is
+// deeper than the depth guard.
+func (b *Bucket) forEachPageNode(fn func(*page, *node, int)) error {
 	// If we have an inline page or root node then just use that.
 	if b.page != nil {
 		fn(b.page, nil, 0)
-		return
+		return nil
 	}
-	b._forEachPageNode(b.root, 0, fn)
+	return b._forEachPageNode(b.root, 0, fn)
 }
 
-func (b *Bucket) _forEachPageNode(pgId pgid, depth int, fn func(*page, *node, int)) {
+func (b *Bucket) _forEachPageNode(pgId pgid, depth int, fn func(*page, *node, int)) error {
+	if depth >= b.tx.db.maxTreeDepth {
+		return &BoltError{Err: ErrTreeTooDeep, PageID: int(pgId), BucketPath: b.path()}
+	}
 	var p, n = b.pageNode(pgId)
 
 	// Execute function.
@@ -580,16 +1772,21 @@ func (b *Bucket) _forEachPageNode(pgId pgid, depth int, fn func(*page, *node, in
 		if (p.flags & branchPageFlag) != 0 {
 			for i := 0; i < int(p.count); i++ {
 				elem := p.branchPageElement(uint16(i))
-				b._forEachPageNode(elem.pgid, depth+1, fn)
+				if err := b._forEachPageNode(elem.pgid, depth+1, fn); err != nil {
+					return err
+				}
 			}
 		}
 	} else {
 		if !n.isLeaf {
 			for _, inode := range n.inodes {
-				b._forEachPageNode(inode.pgid, depth+1, fn)
+				if err := b._forEachPageNode(inode.pgid, depth+1, fn); err != nil {
+					return err
+				}
 			}
 		}
 	}
+	return nil
 }
 
 // spill writes all the nodes for this bucket to dirty pages.
@@ -601,7 +1798,9 @@ func (b *Bucket) spill() error {
 		// like a normal bucket and make the parent value a pointer to the page.
 		var value []byte
 		if child.inlineable() {
-			child.free()
+			if err := child.free(); err != nil {
+				return err
+			}
 			value = child.write()
 		} else {
 			if err := child.spill(); err != nil {
@@ -614,6 +1813,9 @@ func (b *Bucket) spill() error {
 			*bucket = *child.bucket
 		}
 
+		// Append the settings stored with the bucket, if any.
+		value = append(value, child.trailer()...)
+
 		// Skip writing the bucket if there are no materialized nodes.
 		if child.rootNode == nil {
 			continue
@@ -663,9 +1865,9 @@ func (b *Bucket) inlineable() bool {
 
 	// Bucket is not inlineable if it contains subbuckets or if it goes beyond
 	// our threshold for inline bucket size.
-	var size = pageHeaderSize
+	var size, elsz = pageHeaderSize, n.pageElementSize()
 	for _, inode := range n.inodes {
-		size += leafPageElementSize + uintptr(len(inode.key)) + uintptr(len(inode.value))
+		size += elsz + uintptr(len(inode.key)) + uintptr(len(inode.value))
 
 		if inode.flags&bucketLeafFlag != 0 {
 			return false
@@ -679,7 +1881,7 @@ func (b *Bucket) inlineable() bool {
 
 // Returns the maximum total size of a bucket to make it a candidate for inlining.
 func (b *Bucket) maxInlineBucketSize() uintptr {
-	return uintptr(b.tx.db.pageSize / 4)
+	return uintptr(b.tx.db.inlineBucketMaxSize)
 }
 
 // write allocates and writes a bucket to a byte slice.
@@ -709,6 +1911,32 @@ func (b *Bucket) rebalance() {
 	}
 }
 
+// trackFreed returns a function that reports the pages, including overflow
+// pages, that the changes made to b since trackFreed was called return to the
+// freelist. It first rebalances the nodes of b, so that the pages merged away
+// are freed and counted, then adds the pages newly copied on write, whose old
+// copies are freed when they are spilled.
+func (b *Bucket) trackFreed() func() int {
+	txid, freelist := b.tx.meta.txid, b.tx.db.freelist
+	before := freelist.freedBy(txid)
+	wasDirty := make(map[pgid]bool, len(b.nodes))
+	for id := range b.nodes {
+		wasDirty[id] = true
+	}
+	return func() int {
+		for _, n := range b.nodes {
+			n.rebalance()
+		}
+		freed := freelist.freedBy(txid) - before
+		for id := range b.nodes {
+			if id != 0 && !wasDirty[id] {
+				freed += int(b.tx.page(id).overflow) + 1
+			}
+		}
+		return freed
+	}
+}
+
 // node creates a node from a page and associates it with a given parent.
 func (b *Bucket) node(pgId pgid, parent *node) *node {
 	_assert(b.nodes != nil, "nodes map expected")
@@ -735,6 +1963,7 @@ func (b *Bucket) node(pgId pgid, parent *node) *node {
 	// Read the page into the node and cache it.
 	n.read(p)
 	b.nodes[pgId] = n
+	b.tx.memory += int(n.size())
 
 	// Update statistics.
 	b.tx.stats.IncNodeCount(1)
@@ -743,20 +1972,37 @@ func (b *Bucket) node(pgId pgid, parent *node) *node {
 }
 
 // free recursively frees all pages in the bucket.
-func (b *Bucket) free() {
+func (b *Bucket) free() error {
 	if b.root == 0 {
-		return
+		return nil
 	}
 
 	var tx = b.tx
-	b.forEachPageNode(func(p *page, n *node, _ int) {
+	if err := b.forEachPageNode(func(p *page, n *node, _ int) {
 		if p != nil {
 			tx.db.freelist.free(tx.meta.txid, p)
 		} else {
 			n.free()
 		}
-	})
+	}); err != nil {
+		return err
+	}
 	b.root = 0
+	return nil
+}
+
+// freeAll frees the pages of the bucket and of all its nested buckets. The
+// nested buckets are walked rather than looked up, so buckets with an unknown
+// comparator can be deleted too.
+func (b *Bucket) freeAll() error {
+	if err := b.forEachChild(func(child *Bucket) error {
+		return child.freeAll()
+	}); err != nil {
+		return err
+	}
+	b.nodes = nil
+	b.rootNode = nil
+	return b.free()
 }
 
 // dereference removes all references to the old mmap.
@@ -802,7 +2048,7 @@ type BucketStats struct {
 	BranchPageN     int // number of logical branch pages
 	BranchOverflowN int // number of physical branch overflow pages
 	LeafPageN       int // number of logical leaf pages
-	LeafOverflowN   int // number of physical leaf overflow pages
+	LeafOverflowN   int // number of physical leaf overflow pages, used by large values
 
 	// Tree statistics.
 	KeyN  int // number of keys/value pairs
@@ -2,6 +2,7 @@ package bbolt_test
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,10 +10,15 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -122,6 +128,217 @@ func TestBucket_Get_Capacity(t *testing.T) {
 	}
 }
 
+// Ensure that GetInto finds the same values as Get while reusing its scratch.
+func TestBucket_GetInto(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(strconv.Itoa(i))))
+		}
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	}))
+
+	var scratch bolt.CursorScratch
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i += 7 {
+			v, found := b.GetInto([]byte(fmt.Sprintf("%04d", i)), &scratch)
+			require.True(t, found)
+			require.Equal(t, []byte(strconv.Itoa(i)), v)
+		}
+		v, found := b.GetInto([]byte("missing"), &scratch)
+		require.False(t, found)
+		require.Nil(t, v)
+		_, found = b.GetInto([]byte("nested"), &scratch)
+		require.False(t, found)
+		return nil
+	}))
+
+	// The scratch can be reused by later transactions.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		v, found := tx.Bucket([]byte("widgets")).GetInto([]byte("0042"), &scratch)
+		require.True(t, found)
+		require.Equal(t, []byte("42"), v)
+		return nil
+	}))
+}
+
+func BenchmarkBucket_GetInto(b *testing.B) {
+	db := btesting.MustCreateDB(b)
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i++ {
+			if err := bkt.Put([]byte(fmt.Sprintf("%08d", i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%08d", i*97))
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		require.NoError(b, db.View(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte("bench"))
+			for i := 0; i < b.N; i++ {
+				if bkt.Get(keys[i%len(keys)]) == nil {
+					b.Fatal("missing key")
+				}
+			}
+			return nil
+		}))
+	})
+	b.Run("GetInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var scratch bolt.CursorScratch
+		require.NoError(b, db.View(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte("bench"))
+			for i := 0; i < b.N; i++ {
+				if _, found := bkt.GetInto(keys[i%len(keys)], &scratch); !found {
+					b.Fatal("missing key")
+				}
+			}
+			return nil
+		}))
+	})
+}
+
+// Ensure that a batch of gets returns the values in the order of the keys.
+func TestBucket_GetBatch(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 20000; i += 2 {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), []byte(strconv.Itoa(i)+strings.Repeat(".", 100))))
+		}
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	}))
+
+	rnd := rand.New(rand.NewSource(1))
+	check := func(b *bolt.Bucket) {
+		keys := [][]byte{[]byte("nested"), []byte("missing"), []byte("")}
+		for i := 0; i < 3000; i++ {
+			keys = append(keys, []byte(fmt.Sprintf("%05d", rnd.Intn(20000))))
+		}
+		keys = append(keys, keys[10], []byte("00000"), []byte("19998"))
+
+		values := b.GetBatch(keys)
+		require.Len(t, values, len(keys))
+		for i, key := range keys {
+			require.Equal(t, b.Get(key), values[i], "key %q", key)
+		}
+		require.Nil(t, values[0])
+	}
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Greater(t, b.Stats().Depth, 2)
+		check(b)
+		require.Empty(t, b.GetBatch(nil))
+		return nil
+	}))
+
+	// Nodes materialized by a write transaction are searched as well.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 1; i < 20000; i += 10 {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), []byte("odd")))
+		}
+		for i := 0; i < 20000; i += 6 {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+		}
+		check(b)
+		return nil
+	}))
+}
+
+// Ensure that the read amplification of a key covers its path and overflow.
+func TestBucket_ReadAmplification(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 500; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%03d", i)), make([]byte, 20)))
+		}
+		require.NoError(t, b.Put([]byte("zzz"), make([]byte, 10*4096+17)))
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 10, b.Stats().LeafOverflowN)
+
+		// A small value costs the branch page and its leaf.
+		pages, size, err := b.ReadAmplification([]byte("000"))
+		require.NoError(t, err)
+		require.Equal(t, 2, pages)
+		require.Equal(t, int64(2*4096), size)
+
+		// The large value adds the overflow chain of its leaf.
+		pages, size, err = b.ReadAmplification([]byte("zzz"))
+		require.NoError(t, err)
+		require.Equal(t, 2+10, pages)
+		require.Equal(t, int64(12*4096), size)
+
+		_, _, err = b.ReadAmplification([]byte("missing"))
+		require.ErrorIs(t, err, bolt.ErrKeyNotFound)
+		_, _, err = b.ReadAmplification([]byte("nested"))
+		require.ErrorIs(t, err, bolt.ErrIncompatibleValue)
+		return nil
+	}))
+}
+
+// Ensure that GetWithFlags returns values with their leaf flags.
+func TestBucket_GetWithFlags(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("bar")))
+		require.NoError(t, b.PutFlagged([]byte("flagged"), []byte("baz")))
+		_, err = b.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+
+		v, flags, found := b.GetWithFlags([]byte("foo"))
+		require.True(t, found)
+		require.Equal(t, []byte("bar"), v)
+		require.Equal(t, uint32(0), flags)
+
+		v, flags, found = b.GetWithFlags([]byte("flagged"))
+		require.True(t, found)
+		require.Equal(t, []byte("baz"), v)
+		require.Equal(t, uint32(bolt.FlaggedValue), flags)
+
+		v, flags, found = b.GetWithFlags([]byte("sub"))
+		require.True(t, found)
+		require.Nil(t, v)
+		require.Equal(t, uint32(bolt.BucketLeafFlag), flags)
+
+		v, flags, found = b.GetWithFlags([]byte("missing"))
+		require.False(t, found)
+		require.Nil(t, v)
+		require.Equal(t, uint32(0), flags)
+		return nil
+	}))
+}
+
 // Ensure that a bucket can write a key/value.
 func TestBucket_Put(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -203,7 +420,7 @@ func TestBucket_Put_Large(t *testing.T) {
 	}
 }
 
-// Really large values in single page.
+// Really large values on pages of their own.
 func TestBucket_Put_Large_SinglePage(t *testing.T) {
 	db := btesting.MustCreateDB(t)
 
@@ -245,13 +462,66 @@ func TestBucket_Put_Large_SinglePage(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pages := int64(math.Ceil((float64(bolt.MaxKeySize+bolt.MaxValueSize)*4 + pageHeaderSize) / 4096)) // leaf data
-	pages++                                                                                           // meta
+	// Each value is too large to share a leaf, so it gets a leaf of its own.
+	const leafElementSize, branchElementSize = 8, 16
+	pages := 4 * int64(math.Ceil((pageHeaderSize+leafElementSize+float64(bolt.MaxKeySize+bolt.MaxValueSize))/4096)) // leaves
+	pages += int64(math.Ceil((pageHeaderSize + 4*float64(branchElementSize+bolt.MaxKeySize)) / 4096))               // branch
+	pages++                                                                                                         // root
 	if p := db.Stats().TxStats.PageCount; pages != p {
 		t.Fatalf("incorrect pages %d and %d", pages, p)
 	}
 }
 
+// Ensure that huge values are split onto leaf pages of their own and stay
+// there when a neighbour is deleted.
+func TestBucket_Put_HugeValues_SeparatePages(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	value := make([]byte, 10*1024*1024)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			value := make([]byte, len(value))
+			value[0] = k[0]
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	leaves := func() int {
+		var n int
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte("widgets")).Stats().LeafPageN
+			return nil
+		}))
+		return n
+	}
+	require.Equal(t, 3, leaves())
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("b"))
+	}))
+	require.Equal(t, 2, leaves())
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		b := tx.Bucket([]byte("widgets"))
+		for _, k := range []string{"a", "c"} {
+			v := b.Get([]byte(k))
+			require.Len(t, v, len(value))
+			require.Equal(t, k[0], v[0])
+		}
+		return nil
+	}))
+}
+
 // Ensure that a database can perform multiple large appends safely.
 func TestDB_Put_VeryLarge(t *testing.T) {
 	if testing.Short() {
@@ -296,7 +566,7 @@ func TestBucket_Put_IncompatibleValue(t *testing.T) {
 		if _, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("foo")); err != nil {
 			t.Fatal(err)
 		}
-		if err := b0.Put([]byte("foo"), []byte("bar")); err != bolt.ErrIncompatibleValue {
+		if err := b0.Put([]byte("foo"), []byte("bar")); !errors.Is(err, bolt.ErrIncompatibleValue) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -603,6 +873,349 @@ func TestBucket_Nested(t *testing.T) {
 	}
 }
 
+// Ensure that Reserve grows the file up front for a bulk insert.
+func TestBucket_Reserve(t *testing.T) {
+	without := bulkInsertGrowths(t, false)
+	with := bulkInsertGrowths(t, true)
+	t.Logf("file growths: %d without Reserve, %d with Reserve", without, with)
+	require.LessOrEqual(t, with, 1)
+	require.Greater(t, without, with)
+
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, bolt.ErrTxNotWritable, tx.Bucket([]byte("widgets")).Reserve(10, 10))
+		return nil
+	}))
+}
+
+func BenchmarkBucket_Reserve(b *testing.B) {
+	b.Run("Default", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bulkInsertGrowths(b, false)
+		}
+	})
+	b.Run("Reserve", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bulkInsertGrowths(b, true)
+		}
+	})
+}
+
+// bulkInsertGrowths inserts 20000 pairs with 1KB values over 20 commits into
+// a new database with a small AllocSize and returns how many commits grew the
+// data file.
+func bulkInsertGrowths(t testing.TB, reserve bool) int {
+	db := btesting.MustCreateDB(t)
+	defer db.MustClose()
+	db.AllocSize = 64 * 1024
+
+	fileSize := func() int64 {
+		info, err := os.Stat(db.Path())
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	var growths int
+	size := fileSize()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			if i == 0 && reserve {
+				if err := b.Reserve(20000, 1000); err != nil {
+					return err
+				}
+			}
+			for j := 0; j < 1000; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%08d", i*1000+j)), make([]byte, 1000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		if sz := fileSize(); sz != size {
+			growths, size = growths+1, sz
+		}
+	}
+	return growths
+}
+
+// Ensure that Compact rewrites a fragmented bucket into fewer pages.
+func TestBucket_Compact(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"widgets", "other"} {
+			b, err := tx.CreateBucket([]byte(name))
+			require.NoError(t, err)
+			for i := 0; i < 5000; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)))
+			}
+		}
+		sub, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("sub"))
+		require.NoError(t, err)
+		return sub.Put([]byte("foo"), []byte("bar"))
+	}))
+
+	// Fragment the bucket by deleting random keys.
+	rng := rand.New(rand.NewSource(42))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, i := range rng.Perm(5000)[:3000] {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+		}
+		return nil
+	}))
+
+	type snapshot struct {
+		pages     int
+		data      map[string]string
+		otherRoot uint64
+	}
+	snap := func() snapshot {
+		var s snapshot
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			stats := b.Stats()
+			s.pages = stats.BranchPageN + stats.LeafPageN
+			s.data = make(map[string]string)
+			require.NoError(t, b.ForEach(func(k, v []byte) error {
+				s.data[string(k)] = string(v)
+				return nil
+			}))
+			s.data["sub/foo"] = string(b.Bucket([]byte("sub")).Get([]byte("foo")))
+			s.otherRoot = uint64(tx.Bucket([]byte("other")).Root())
+			return nil
+		}))
+		return s
+	}
+	before := snap()
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Compact())
+		// Compacting again before committing is harmless.
+		return b.Compact()
+	}))
+
+	after := snap()
+	t.Logf("pages: %d before, %d after", before.pages, after.pages)
+	require.Less(t, after.pages, before.pages)
+	require.Equal(t, before.data, after.data)
+	require.Equal(t, before.otherRoot, after.otherRoot)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+
+	// The bucket stays usable.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("new"), []byte("value")))
+		return b.Delete([]byte(fmt.Sprintf("%05d", rng.Intn(5000))))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("value"), tx.Bucket([]byte("widgets")).Get([]byte("new")))
+		return nil
+	}))
+}
+
+// Ensure that DeleteAll reports deleted keys and the pages they release.
+func TestBucket_DeleteAll(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		_, err = b.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	// Delete every other key in shuffled order, plus duplicates and misses.
+	var keys [][]byte
+	for _, i := range rand.Perm(10000) {
+		if i%2 == 0 {
+			keys = append(keys, []byte(fmt.Sprintf("%05d", i)))
+		}
+	}
+	keys = append(keys, []byte("00000"), []byte("missing"))
+	first := keys[0]
+
+	var freed int
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		deleted, freedPages, err := tx.Bucket([]byte("widgets")).DeleteAll(keys)
+		require.NoError(t, err)
+		require.Equal(t, 5000, deleted)
+		require.Greater(t, freedPages, 10)
+		freed = freedPages
+		return nil
+	}))
+	require.Equal(t, first, keys[0], "keys were reordered")
+
+	// Without readers only the pages of the last commit are pending: those
+	// DeleteAll reported and the root bucket's leaf holding "widgets".
+	require.Equal(t, freed+1, db.Stats().PendingPageN)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 5001, b.Stats().KeyN)
+		require.Nil(t, b.Get([]byte("00000")))
+		require.NotNil(t, b.Get([]byte("00001")))
+
+		// Deleting a nested bucket fails after the keys before it.
+		deleted, _, err := b.DeleteAll([][]byte{[]byte("sub"), []byte("00001")})
+		require.ErrorIs(t, err, bolt.ErrIncompatibleValue)
+		require.Equal(t, 1, deleted)
+		return nil
+	}))
+}
+
+// Ensure that DeletePrefixDryRun reports what DeletePrefix then does.
+func TestBucket_DeletePrefix(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, prefix := range []string{"a", "b", "c"} {
+			for i := 0; i < 3000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%s%05d", prefix, i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = b.CreateBucket([]byte("b-sub"))
+		return err
+	}))
+
+	// From a read-only transaction nothing is materialized yet.
+	var keys, pages int
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		var err error
+		keys, pages, err = tx.Bucket([]byte("widgets")).DeletePrefixDryRun([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, 3000, keys)
+		require.Greater(t, pages, 10)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		dryKeys, dryPages, err := b.DeletePrefixDryRun([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, keys, dryKeys)
+		require.Equal(t, pages, dryPages)
+
+		deleted, freedPages, err := b.DeletePrefix([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, dryKeys, deleted)
+		require.LessOrEqual(t, dryPages, freedPages)
+
+		// The dry run left nothing behind, the delete everything but the
+		// nested bucket.
+		n := 0
+		require.NoError(t, b.ForEach(func(k, v []byte) error {
+			if v != nil {
+				n++
+			}
+			return nil
+		}))
+		require.Equal(t, 6000, n)
+		require.NotNil(t, b.Bucket([]byte("b-sub")))
+		k, _ := b.Cursor().Seek([]byte("b"))
+		require.Equal(t, []byte("b-sub"), k)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+
+		// Pages already dirtied in the transaction are not counted again.
+		require.NoError(t, b.Put([]byte("c00000"), []byte("x")))
+		dryKeys, dryPages, err := b.DeletePrefixDryRun([]byte("c0"))
+		require.NoError(t, err)
+		deleted, freedPages, err := b.DeletePrefix([]byte("c0"))
+		require.NoError(t, err)
+		require.Equal(t, 3000, deleted)
+		require.Equal(t, dryKeys, deleted)
+		require.LessOrEqual(t, dryPages, freedPages)
+
+		// A prefix with no keys does nothing.
+		deleted, freedPages, err = b.DeletePrefix([]byte("z"))
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+		require.Zero(t, freedPages)
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		_, _, err := tx.Bucket([]byte("widgets")).DeletePrefix([]byte("a"))
+		require.ErrorIs(t, err, bolt.ErrTxNotWritable)
+		return nil
+	}))
+}
+
+// Ensure that DeleteIf only deletes when the predicate passes.
+func TestBucket_DeleteIf(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("expired")))
+		require.NoError(t, b.Put([]byte("bar"), []byte("fresh")))
+		_, err = b.CreateBucket([]byte("sub"))
+		require.NoError(t, err)
+
+		isExpired := func(v []byte) bool { return bytes.Equal(v, []byte("expired")) }
+
+		// Predicate passes: the key is deleted.
+		deleted, err := b.DeleteIf([]byte("foo"), isExpired)
+		require.NoError(t, err)
+		require.True(t, deleted)
+		require.Nil(t, b.Get([]byte("foo")))
+
+		// Predicate fails: nothing happens.
+		deleted, err = b.DeleteIf([]byte("bar"), isExpired)
+		require.NoError(t, err)
+		require.False(t, deleted)
+		require.Equal(t, []byte("fresh"), b.Get([]byte("bar")))
+
+		// Absent key: the predicate is not called.
+		deleted, err = b.DeleteIf([]byte("baz"), func(v []byte) bool {
+			t.Fatal("predicate called for absent key")
+			return true
+		})
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		_, err = b.DeleteIf([]byte("sub"), isExpired)
+		require.ErrorIs(t, err, bolt.ErrIncompatibleValue)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte("widgets")).DeleteIf([]byte("bar"), func([]byte) bool { return true })
+		require.Equal(t, bolt.ErrTxNotWritable, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 // Ensure that deleting a bucket using Delete() returns an error.
 func TestBucket_Delete_Bucket(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -614,7 +1227,7 @@ func TestBucket_Delete_Bucket(t *testing.T) {
 		if _, err := b.CreateBucket([]byte("foo")); err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Delete([]byte("foo")); err != bolt.ErrIncompatibleValue {
+		if err := b.Delete([]byte("foo")); !errors.Is(err, bolt.ErrIncompatibleValue) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -834,7 +1447,7 @@ func TestBucket_CreateBucket_IncompatibleValue(t *testing.T) {
 		if err := widgets.Put([]byte("foo"), []byte("bar")); err != nil {
 			t.Fatal(err)
 		}
-		if _, err := widgets.CreateBucket([]byte("foo")); err != bolt.ErrIncompatibleValue {
+		if _, err := widgets.CreateBucket([]byte("foo")); !errors.Is(err, bolt.ErrIncompatibleValue) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -855,7 +1468,7 @@ func TestBucket_DeleteBucket_IncompatibleValue(t *testing.T) {
 		if err := widgets.Put([]byte("foo"), []byte("bar")); err != nil {
 			t.Fatal(err)
 		}
-		if err := tx.Bucket([]byte("widgets")).DeleteBucket([]byte("foo")); err != bolt.ErrIncompatibleValue {
+		if err := tx.Bucket([]byte("widgets")).DeleteBucket([]byte("foo")); !errors.Is(err, bolt.ErrIncompatibleValue) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -864,6 +1477,54 @@ func TestBucket_DeleteBucket_IncompatibleValue(t *testing.T) {
 	}
 }
 
+// Ensure errors from bucket operations carry the bucket path, key and page.
+func TestBucket_BoltError(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, widgets.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+		}
+		child, err := widgets.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+		_, err = child.CreateBucket([]byte("grandchild"))
+		return err
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		widgets := tx.Bucket([]byte("widgets"))
+		var berr *bolt.BoltError
+
+		// Not found in a nested inline bucket: no page to report.
+		err := widgets.Bucket([]byte("child")).DeleteBucket([]byte("missing"))
+		require.ErrorIs(t, err, bolt.ErrBucketNotFound)
+		require.True(t, errors.As(err, &berr))
+		require.Equal(t, [][]byte{[]byte("widgets"), []byte("child")}, berr.BucketPath)
+		require.Equal(t, []byte("missing"), berr.Key)
+		require.Equal(t, `bucket not found (bucket "widgets/child", key "missing")`, err.Error())
+
+		// Writing a value over a bucket reports the leaf holding the key.
+		err = widgets.Put([]byte("child"), []byte("v"))
+		require.ErrorIs(t, err, bolt.ErrIncompatibleValue)
+		require.True(t, errors.As(err, &berr))
+		require.Equal(t, [][]byte{[]byte("widgets")}, berr.BucketPath)
+		require.Equal(t, []byte("child"), berr.Key)
+		require.NotZero(t, berr.PageID)
+
+		// Top level buckets have no bucket path.
+		_, err = tx.CreateBucket([]byte("widgets"))
+		require.ErrorIs(t, err, bolt.ErrBucketExists)
+		require.True(t, errors.As(err, &berr))
+		require.Nil(t, berr.BucketPath)
+		require.Equal(t, []byte("widgets"), berr.Key)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 // Ensure bucket can set and update its sequence number.
 func TestBucket_Sequence(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -905,6 +1566,72 @@ func TestBucket_Sequence(t *testing.T) {
 	}
 }
 
+// Ensure that a persisted fill percent is reloaded and used by later transactions.
+func TestBucket_SetPersistentFillPercent(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("persisted"))
+		require.NoError(t, err)
+		require.ErrorIs(t, b.SetPersistentFillPercent(1.5), bolt.ErrInvalidFillPercent)
+		require.ErrorIs(t, b.SetPersistentFillPercent(0.05), bolt.ErrInvalidFillPercent)
+		require.NoError(t, b.SetPersistentFillPercent(1.0))
+
+		// A small nested bucket stays inline and keeps its value too.
+		child, err := b.CreateBucket([]byte("inline"))
+		require.NoError(t, err)
+		require.NoError(t, child.Put([]byte("foo"), []byte("bar")))
+		require.NoError(t, child.SetPersistentFillPercent(0.9))
+
+		_, err = tx.CreateBucket([]byte("default"))
+		return err
+	})
+	require.NoError(t, err)
+
+	db.MustClose()
+	db.MustReopen()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("persisted"))
+		require.Equal(t, 1.0, b.PersistentFillPercent())
+		require.Equal(t, 1.0, b.FillPercent)
+
+		child := b.Bucket([]byte("inline"))
+		require.Equal(t, 0.9, child.PersistentFillPercent())
+		require.Equal(t, []byte("bar"), child.Get([]byte("foo")))
+
+		d := tx.Bucket([]byte("default"))
+		require.Equal(t, 0.0, d.PersistentFillPercent())
+		require.Equal(t, bolt.DefaultFillPercent, d.FillPercent)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Append the same keys to both buckets without setting FillPercent.
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"persisted", "default"} {
+			b := tx.Bucket([]byte(name))
+			for i := 0; i < 2000; i++ {
+				k := []byte(fmt.Sprintf("%08d", i))
+				require.NoError(t, b.Put(k, make([]byte, 100)))
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		persisted := tx.Bucket([]byte("persisted")).Stats()
+		def := tx.Bucket([]byte("default")).Stats()
+		if persisted.LeafPageN*3/2 > def.LeafPageN {
+			t.Fatalf("expected fewer leaf pages with fill percent 1.0: %d vs %d", persisted.LeafPageN, def.LeafPageN)
+		}
+		require.Equal(t, 0.9, tx.Bucket([]byte("persisted")).Bucket([]byte("inline")).PersistentFillPercent())
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 // Ensure that a bucket can return an autoincrementing sequence.
 func TestBucket_NextSequence(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1119,6 +1846,52 @@ func TestBucket_ForEachBucket(t *testing.T) {
 	assert.NoErrorf(t, err, "db.View failed")
 }
 
+// Ensure that ForEachKey visits plain keys in order and skips nested buckets.
+func TestBucket_ForEachKey(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	verifyReads := func(b *bolt.Bucket) {
+		var keys, values []string
+		require.NoError(t, b.ForEachKey(func(k, v []byte) error {
+			require.NotNil(t, v)
+			keys = append(keys, string(k))
+			values = append(values, string(v))
+			return nil
+		}))
+		require.Equal(t, []string{"bar", "baz", "empty", "foo"}, keys)
+		require.Equal(t, []string{"0002", "0001", "", "0000"}, values)
+
+		// Stop at the first error.
+		errStop := errors.New("stop")
+		var n int
+		require.ErrorIs(t, b.ForEachKey(func(k, v []byte) error {
+			n++
+			return errStop
+		}), errStop)
+		require.Equal(t, 1, n)
+	}
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("0000")))
+		_, err = b.CreateBucket([]byte("zsubbucket"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("baz"), []byte("0001")))
+		require.NoError(t, b.Put([]byte("bar"), []byte("0002")))
+		require.NoError(t, b.Put([]byte("empty"), nil))
+		_, err = b.CreateBucket([]byte("csubbucket"))
+		require.NoError(t, err)
+
+		verifyReads(b)
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		verifyReads(tx.Bucket([]byte("widgets")))
+		return nil
+	}))
+}
+
 func TestBucket_ForEachBucket_NoBuckets(t *testing.T) {
 	db := btesting.MustCreateDB(t)
 
@@ -1194,6 +1967,239 @@ func TestBucket_ForEach_ShortCircuit(t *testing.T) {
 	}
 }
 
+// spin burns CPU by repeatedly hashing v.
+func spin(v []byte) {
+	sum := sha256.Sum256(v)
+	for i := 0; i < 2000; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+}
+
+// Ensure Extremes reports the longest key and value, including nested buckets.
+func TestBucket_Extremes(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+
+		maxKeyLen, maxValueLen, err := b.Extremes()
+		require.NoError(t, err)
+		require.Zero(t, maxKeyLen)
+		require.Zero(t, maxValueLen)
+
+		require.NoError(t, b.Put([]byte("a"), make([]byte, 3000)))
+		require.NoError(t, b.Put([]byte(strings.Repeat("k", 200)), make([]byte, 10)))
+		require.NoError(t, b.Put([]byte("b"), nil))
+
+		sub, err := b.CreateBucket([]byte(strings.Repeat("s", 50)))
+		require.NoError(t, err)
+		require.NoError(t, sub.Put([]byte(strings.Repeat("n", 300)), make([]byte, 20000)))
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		maxKeyLen, maxValueLen, err := b.Extremes()
+		require.NoError(t, err)
+		require.Equal(t, 300, maxKeyLen)
+		require.Equal(t, 20000, maxValueLen)
+
+		maxKeyLen, maxValueLen, err = b.Bucket([]byte(strings.Repeat("s", 50))).Extremes()
+		require.NoError(t, err)
+		require.Equal(t, 300, maxKeyLen)
+		require.Equal(t, 20000, maxValueLen)
+		return nil
+	}))
+}
+
+// Ensure OversizeScan flags keys and values above the thresholds.
+func TestBucket_OversizeScan(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, kv := range []struct {
+			key   string
+			vsize int
+		}{
+			{key: "small", vsize: 10},
+			{key: "edge", vsize: 1000},
+			{key: "large-value", vsize: 1001},
+			{key: strings.Repeat("k", 100), vsize: 0},
+			{key: strings.Repeat("l", 101), vsize: 0},
+			{key: strings.Repeat("m", bolt.MaxKeySize), vsize: 5000},
+		} {
+			if err := b.Put([]byte(kv.key), make([]byte, kv.vsize)); err != nil {
+				return err
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		return sub.Put([]byte("nested"), make([]byte, 5000))
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		keys, err := tx.Bucket([]byte("widgets")).OversizeScan(100, 1000)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{
+			[]byte("large-value"),
+			[]byte(strings.Repeat("l", 101)),
+			[]byte(strings.Repeat("m", bolt.MaxKeySize)),
+		}, keys)
+
+		keys, err = tx.Bucket([]byte("widgets")).OversizeScan(bolt.MaxKeySize, bolt.MaxValueSize)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+		return nil
+	}))
+}
+
+// Ensure ForEachHashed visits every pair once in a seed dependent order.
+func TestBucket_ForEachHashed(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	visit := func(seed uint64) []string {
+		var keys []string
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).ForEachHashed(seed, func(k, v []byte) error {
+				i, err := strconv.Atoi(string(k))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("v%d", i), string(v))
+				keys = append(keys, string(k))
+				return nil
+			})
+		}))
+		return keys
+	}
+
+	keys := visit(1)
+	require.Len(t, keys, 1000)
+	require.False(t, sort.StringsAreSorted(keys), "expected hash order to differ from byte order")
+	require.Equal(t, keys, visit(1))
+	require.NotEqual(t, keys, visit(2))
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for i, k := range sorted {
+		require.Equal(t, fmt.Sprintf("%04d", i), k)
+	}
+
+	// An error from fn stops iteration.
+	errStop := errors.New("stop")
+	var n int
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).ForEachHashed(1, func(k, v []byte) error {
+			if n++; n == 10 {
+				return errStop
+			}
+			return nil
+		})
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, 10, n)
+}
+
+// Ensure that ForEachParallel visits every pair across workers and propagates errors.
+func TestBucket_ForEachParallel(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 200; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		_, err = b.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	run := func(workers int, fn func(k, v []byte) error) (time.Duration, error) {
+		start := time.Now()
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).ForEachParallel(workers, fn)
+		})
+		return time.Since(start), err
+	}
+
+	// Every pair is visited exactly once, with a nil value for nested buckets.
+	var (
+		visited  [201]int32
+		active   int32
+		maxSeen  int32
+		children int32
+	)
+	serial, err := run(1, func(k, v []byte) error {
+		if v == nil {
+			atomic.AddInt32(&children, 1)
+			return nil
+		}
+		spin(v)
+		return nil
+	})
+	require.NoError(t, err)
+	parallel, err := run(4, func(k, v []byte) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxSeen)
+			if n <= m || atomic.CompareAndSwapInt32(&maxSeen, m, n) {
+				break
+			}
+		}
+		if v == nil {
+			atomic.AddInt32(&children, 1)
+			atomic.AddInt32(&visited[200], 1)
+			return nil
+		}
+		i, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&visited[i], 1)
+		spin(v)
+		return nil
+	})
+	require.NoError(t, err)
+	for i, n := range visited {
+		require.Equal(t, int32(1), n, "pair %d", i)
+	}
+	require.Equal(t, int32(2), children)
+	if runtime.NumCPU() > 1 {
+		require.Greater(t, maxSeen, int32(1), "callbacks never ran concurrently")
+		require.Less(t, parallel, serial, "no speedup with 4 workers")
+	}
+
+	// The first error stops dispatching and is returned.
+	errMarker := errors.New("marker")
+	var calls int32
+	_, err = run(4, func(k, v []byte) error {
+		atomic.AddInt32(&calls, 1)
+		if string(k) == "0010" {
+			return errMarker
+		}
+		return nil
+	})
+	require.Equal(t, errMarker, err)
+	require.Less(t, atomic.LoadInt32(&calls), int32(201))
+}
+
 // Ensure that looping over a bucket on a closed database returns an error.
 func TestBucket_ForEach_Closed(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1217,6 +2223,161 @@ func TestBucket_ForEach_Closed(t *testing.T) {
 	}
 }
 
+// Ensure that ForEachCopy passes slices that stay valid after the transaction.
+func TestBucket_ForEachCopy(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	value := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 100) }
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), value(i)))
+		}
+		_, err = b.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	var keys, values [][]byte
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).ForEachCopy(func(k, v []byte) error {
+			keys = append(keys, k)
+			values = append(values, v)
+			return nil
+		})
+	}))
+	require.Len(t, keys, 1001)
+
+	// Overwrite and free the pages the pairs were read from, and grow the
+	// file so that it is remapped.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for j := 0; j < 1000; j++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", j)), bytes.Repeat([]byte{0xff}, 1000)))
+			}
+			return nil
+		}))
+	}
+
+	for i := 0; i < 1000; i++ {
+		require.Equal(t, fmt.Sprintf("%04d", i), string(keys[i]))
+		require.Equal(t, value(i), values[i])
+	}
+	require.Equal(t, "sub", string(keys[1000]))
+	require.Nil(t, values[1000])
+}
+
+// Ensure that ForEachMatch only yields keys matching a prefix-anchored glob.
+func TestBucket_ForEachMatch_Prefix(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, k := range []string{"apple", "user/1", "user/10", "user/2", "users", "zebra"} {
+			require.NoError(t, b.Put([]byte(k), []byte("v-"+k)))
+		}
+		_, err = b.CreateBucket([]byte("user/sub"))
+		require.NoError(t, err)
+
+		var keys []string
+		require.NoError(t, b.ForEachMatch("user/*", func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"user/1", "user/10", "user/2", "user/sub"}, keys)
+
+		keys = nil
+		require.NoError(t, b.ForEachMatch("user/?", func(k, v []byte) error {
+			keys = append(keys, string(k))
+			require.Equal(t, "v-"+string(k), string(v))
+			return nil
+		}))
+		require.Equal(t, []string{"user/1", "user/2"}, keys)
+
+		keys = nil
+		require.NoError(t, b.ForEachMatch("zebra", func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"zebra"}, keys)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that ForEachMatch handles wildcards in the middle of a pattern.
+func TestBucket_ForEachMatch_Wildcard(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, k := range []string{"a.log", "a.txt", "b.log", "b/c.log", "c.log.gz", "*.log"} {
+			require.NoError(t, b.Put([]byte(k), []byte(k)))
+		}
+
+		for _, tc := range []struct {
+			pattern string
+			want    []string
+		}{
+			{pattern: "*.log", want: []string{"*.log", "a.log", "b.log", "b/c.log"}},
+			{pattern: "[ab].*", want: []string{"a.log", "a.txt", "b.log"}},
+			{pattern: "[!ab]*.log*", want: []string{"*.log", "c.log.gz"}},
+			{pattern: "\\*.log", want: []string{"*.log"}},
+			{pattern: "?/*", want: []string{"b/c.log"}},
+		} {
+			var keys []string
+			require.NoError(t, b.ForEachMatch(tc.pattern, func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			}))
+			require.Equal(t, tc.want, keys, "pattern %q", tc.pattern)
+		}
+
+		require.Error(t, b.ForEachMatch("[ab", func(k, v []byte) error { return nil }))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that ForEachMatch matches non-ASCII and binary keys byte by byte.
+func TestBucket_ForEachMatch_Binary(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, k := range []string{"caf\xc3\xa9", "cafe", "caf\xff", "\x00\x01\x02", "\x00\xff\x02", "\xfe\x00"} {
+			require.NoError(t, b.Put([]byte(k), []byte(k)))
+		}
+
+		for _, tc := range []struct {
+			pattern string
+			want    []string
+		}{
+			// Literal bytes past ASCII, and the prefix seek on them.
+			{pattern: "caf\xc3\xa9", want: []string{"caf\xc3\xa9"}},
+			{pattern: "\xfe*", want: []string{"\xfe\x00"}},
+			// '?' is a single byte, even in the middle of a UTF-8 sequence.
+			{pattern: "caf?", want: []string{"cafe", "caf\xff"}},
+			{pattern: "caf??", want: []string{"caf\xc3\xa9"}},
+			{pattern: "caf\xc3?", want: []string{"caf\xc3\xa9"}},
+			{pattern: "\x00?\x02", want: []string{"\x00\x01\x02", "\x00\xff\x02"}},
+			{pattern: "*\x02", want: []string{"\x00\x01\x02", "\x00\xff\x02"}},
+			// Byte classes and ranges.
+			{pattern: "caf[\x80-\xff]*", want: []string{"caf\xc3\xa9", "caf\xff"}},
+			{pattern: "\x00[!\x01]*", want: []string{"\x00\xff\x02"}},
+		} {
+			var keys []string
+			require.NoError(t, b.ForEachMatch(tc.pattern, func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			}))
+			require.Equal(t, tc.want, keys, "pattern %q", tc.pattern)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
 // Ensure that an error is returned when inserting with an empty key.
 func TestBucket_Put_EmptyKey(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1232,12 +2393,70 @@ func TestBucket_Put_EmptyKey(t *testing.T) {
 		if err := b.Put(nil, []byte("bar")); err != bolt.ErrKeyRequired {
 			t.Fatalf("unexpected error: %s", err)
 		}
+		if err := b.PutFlagged(nil, []byte("bar")); err != bolt.ErrKeyRequired {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := b.TestPut([]byte(""), []byte("bar")); err != bolt.ErrKeyRequired {
+			t.Fatalf("unexpected error: %s", err)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 }
 
+// Ensure that an empty key can be stored when Options.AllowEmptyKeys is set.
+func TestBucket_Put_EmptyKey_Allowed(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{AllowEmptyKeys: true})
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+		}
+		require.NoError(t, b.Put(nil, []byte("other")))
+
+		ok, err := b.TestPut([]byte(""), []byte("sentinel"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// Bucket names are still required.
+		_, err = b.CreateBucket(nil)
+		require.ErrorIs(t, err, bolt.ErrBucketNameRequired)
+		return nil
+	}))
+
+	db.MustClose()
+	db.MustReopen()
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Greater(t, b.Stats().BranchPageN, 0)
+		require.Equal(t, []byte("sentinel"), b.Get([]byte("")))
+
+		// The empty key sorts first.
+		k, v := b.Cursor().First()
+		require.NotNil(t, k)
+		require.Empty(t, k)
+		require.Equal(t, []byte("sentinel"), v)
+
+		var n int
+		require.NoError(t, b.ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}))
+		require.Equal(t, 1001, n)
+		return nil
+	}))
+
+	// Removing the sentinel leaves a consistent tree.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete(nil)
+	}))
+	db.MustCheck()
+}
+
 // Ensure that an error is returned when inserting with a key that's too large.
 func TestBucket_Put_KeyTooLarge(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1255,6 +2474,132 @@ func TestBucket_Put_KeyTooLarge(t *testing.T) {
 	}
 }
 
+// Ensure that keys, values and bucket names past the limits of leaf elements
+// are rejected before anything is written.
+func TestBucket_Put_SizeLimits(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+
+		require.Equal(t, 8191, bolt.MaxKeySize)
+		for _, size := range []int{8192, 10000} {
+			key := make([]byte, size)
+			require.ErrorIs(t, b.Put(key, []byte("bar")), bolt.ErrKeyTooLarge)
+			require.ErrorIs(t, b.PutFlagged(key, []byte("bar")), bolt.ErrKeyTooLarge)
+			_, err := b.TestPut(key, []byte("bar"))
+			require.ErrorIs(t, err, bolt.ErrKeyTooLarge)
+			_, err = b.CreateBucket(key)
+			require.ErrorIs(t, err, bolt.ErrKeyTooLarge)
+			_, err = b.CreateBucketIfNotExists(key)
+			require.ErrorIs(t, err, bolt.ErrKeyTooLarge)
+		}
+		require.ErrorIs(t, b.Put([]byte("foo"), make([]byte, bolt.MaxValueSize+1)), bolt.ErrValueTooLarge)
+
+		// The largest key and bucket name fit.
+		require.NoError(t, b.Put(bytes.Repeat([]byte("k"), bolt.MaxKeySize), []byte("bar")))
+		_, err = b.CreateBucket(bytes.Repeat([]byte("b"), bolt.MaxKeySize))
+		return err
+	}))
+
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 2, b.Stats().KeyN)
+		require.Equal(t, []byte("bar"), b.Get(bytes.Repeat([]byte("k"), bolt.MaxKeySize)))
+		require.NotNil(t, b.Bucket(bytes.Repeat([]byte("b"), bolt.MaxKeySize)))
+		return nil
+	}))
+}
+
+// Ensure that value flags written with PutFlagged round-trip through commits.
+func TestBucket_PutFlagged(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if i%3 == 0 {
+				err = b.PutFlagged(k, []byte("tombstone"))
+			} else {
+				err = b.Put(k, []byte("value"))
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// A flagged value with a maximum size key spans overflow pages.
+		if err := b.PutFlagged(make([]byte, bolt.MaxKeySize), make([]byte, 10000)); err != nil {
+			return err
+		}
+		// An inline bucket keeps them too.
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		return sub.PutFlagged([]byte("foo"), []byte("bar"))
+	}))
+
+	// Overwriting with Put clears the flag and PutFlagged sets it.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("0000"), []byte("value")); err != nil {
+			return err
+		}
+		return b.PutFlagged([]byte("0001"), []byte("tombstone"))
+	}))
+
+	db.MustClose()
+	db.MustReopen()
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		require.Zero(t, c.Flags())
+
+		k, _ := c.First()
+		require.Equal(t, uint32(bolt.FlaggedValue), c.Flags())
+		require.Len(t, k, bolt.MaxKeySize)
+
+		var flagged int
+		for k, v := c.Next(); k != nil; k, v = c.Next() {
+			if string(k) == "sub" {
+				require.Nil(t, v)
+				require.Zero(t, c.Flags())
+				continue
+			}
+			if c.Flags() == bolt.FlaggedValue {
+				require.Equal(t, "tombstone", string(v), "key %s", k)
+				flagged++
+			} else {
+				require.Equal(t, "value", string(v), "key %s", k)
+			}
+		}
+		require.Equal(t, 334, flagged)
+
+		k, _ = c.Seek([]byte("0000"))
+		require.Equal(t, "0000", string(k))
+		require.Zero(t, c.Flags())
+		c.Next()
+		require.Equal(t, uint32(bolt.FlaggedValue), c.Flags())
+
+		c = tx.Bucket([]byte("widgets")).Bucket([]byte("sub")).Cursor()
+		k, v := c.First()
+		require.Equal(t, "foo", string(k))
+		require.Equal(t, "bar", string(v))
+		require.Equal(t, uint32(bolt.FlaggedValue), c.Flags())
+
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	}))
+}
+
 // Ensure that an error is returned when inserting a value that's too large.
 func TestBucket_Put_ValueTooLarge(t *testing.T) {
 	// Skip this test on DroneCI because the machine is resource constrained.
@@ -1557,6 +2902,43 @@ func TestBucket_Stats_EmptyBucket(t *testing.T) {
 	}
 }
 
+// Ensure that the overflow pages used by large values are counted, including
+// those of nested buckets.
+func TestBucket_Stats_LargeValueOverflow(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	// Four values of four pages each fit on a single leaf of seventeen
+	// pages: one page plus sixteen overflow pages. With the nested bucket
+	// header, the parent has five keys and is split into two leaves of
+	// nine pages each.
+	putLarge := func(b *bolt.Bucket) {
+		for i := 0; i < 4; i++ {
+			require.NoError(t, b.Put([]byte{byte('0' + i)}, make([]byte, 4*4096)))
+		}
+	}
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		putLarge(b)
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		putLarge(child)
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		child := b.Bucket([]byte("nested")).Stats()
+		require.Equal(t, 1, child.LeafPageN)
+		require.Equal(t, 16, child.LeafOverflowN)
+		require.Equal(t, (1+16)*4096, child.LeafAlloc)
+
+		// The parent includes the overflow pages of its nested bucket.
+		require.Equal(t, 32, b.Stats().LeafOverflowN)
+		return nil
+	}))
+}
+
 // Ensure a bucket can calculate stats.
 func TestBucket_Stats_Nested(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -2053,3 +3435,141 @@ func ExampleBucket_ForEach() {
 	// A dog is fun.
 	// A liger is awesome.
 }
+
+// Ensure that Options.InlineBucketMaxSize decides which nested buckets stay
+// inline.
+func TestOpen_InlineBucketMaxSize(t *testing.T) {
+	testCases := []struct {
+		maxSize    int
+		inline     int
+		standalone int
+	}{
+		{maxSize: 0, inline: 10, standalone: 10},   // a quarter page
+		{maxSize: 200, inline: 0, standalone: 20},  // smaller than either
+		{maxSize: 2048, inline: 20, standalone: 0}, // larger than both
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(fmt.Sprint(tc.maxSize), func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, InlineBucketMaxSize: tc.maxSize})
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				parent, err := tx.CreateBucket([]byte("parent"))
+				require.NoError(t, err)
+				for i := 0; i < 20; i++ {
+					child, err := parent.CreateBucket([]byte(fmt.Sprintf("child-%02d", i)))
+					require.NoError(t, err)
+					// Ten children of roughly 500 bytes and ten of 1500.
+					size := 500
+					if i%2 == 1 {
+						size = 1500
+					}
+					require.NoError(t, child.Put([]byte("value"), make([]byte, size)))
+				}
+				return nil
+			}))
+
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				stats := tx.Bucket([]byte("parent")).Stats()
+				require.Equal(t, tc.inline, stats.InlineBucketN)
+				require.Equal(t, 21, stats.BucketN)
+				require.Equal(t, tc.standalone, stats.BucketN-1-stats.InlineBucketN)
+				return nil
+			}))
+		})
+	}
+
+	for _, size := range []int{-1, 2049} {
+		_, err := bolt.Open(filepath.Join(t.TempDir(), "db"), 0666, &bolt.Options{PageSize: 4096, InlineBucketMaxSize: size})
+		require.Error(t, err, "size %d", size)
+	}
+}
+
+// Ensure that Truncate empties a bucket but keeps its sequence, while Clear
+// also resets the sequence.
+func TestBucket_Truncate_Clear(t *testing.T) {
+	testCases := []struct {
+		name     string
+		clear    bool
+		keys     int
+		sequence uint64
+	}{
+		{name: "truncate", clear: false, keys: 1000, sequence: 42},
+		{name: "truncate-small", clear: false, keys: 2, sequence: 42},
+		{name: "clear", clear: true, keys: 1000, sequence: 0},
+		{name: "clear-small", clear: true, keys: 2, sequence: 0},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			db := btesting.MustCreateDB(t)
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				parent, err := tx.CreateBucket([]byte("parent"))
+				require.NoError(t, err)
+				b, err := parent.CreateBucket([]byte("widgets"))
+				require.NoError(t, err)
+				require.NoError(t, b.SetComparator(bolt.Uint64BEComparator))
+				require.NoError(t, b.SetSequence(42))
+				for i := 0; i < tc.keys; i++ {
+					require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+				}
+				child, err := b.CreateBucket([]byte("child"))
+				require.NoError(t, err)
+				return child.Put([]byte("foo"), make([]byte, 5000))
+			}))
+
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("parent")).Bucket([]byte("widgets"))
+				if tc.clear {
+					require.NoError(t, b.Clear())
+				} else {
+					require.NoError(t, b.Truncate())
+				}
+				k, _ := b.Cursor().First()
+				require.Nil(t, k)
+				return b.Put([]byte("after"), []byte("value"))
+			}))
+
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("parent")).Bucket([]byte("widgets"))
+				require.Equal(t, tc.sequence, b.Sequence())
+				require.Equal(t, bolt.Uint64BEComparator, b.Comparator())
+				require.Nil(t, b.Bucket([]byte("child")))
+				require.Equal(t, 1, b.Stats().KeyN)
+				require.Equal(t, []byte("value"), b.Get([]byte("after")))
+				return nil
+			}))
+			db.MustCheck()
+
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				require.ErrorIs(t, tx.Bucket([]byte("parent")).Truncate(), bolt.ErrTxNotWritable)
+				return nil
+			}))
+		})
+	}
+}
+
+// Ensure that Truncate frees every nested bucket when the bucket was already
+// changed earlier in the same transaction.
+func TestBucket_Truncate_AfterPut(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			child, err := b.CreateBucket([]byte(fmt.Sprintf("child%02d", i)))
+			require.NoError(t, err)
+			require.NoError(t, child.Put([]byte("foo"), make([]byte, 5000)))
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("zz"), []byte("value")))
+		require.NoError(t, b.Truncate())
+		k, _ := b.Cursor().First()
+		require.Nil(t, k)
+		return nil
+	}))
+	db.MustCheck()
+}
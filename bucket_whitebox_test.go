@@ -0,0 +1,119 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileGlob_Prefix(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		prefix  string
+	}{
+		{pattern: "user/*", prefix: "user/"},
+		{pattern: "user/?/name", prefix: "user/"},
+		{pattern: "abc", prefix: "abc"},
+		{pattern: `a\*b*`, prefix: "a*b"},
+		{pattern: "*abc", prefix: ""},
+		{pattern: "[ab]c", prefix: ""},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.pattern, func(t *testing.T) {
+			_, prefix, err := compileGlob(tc.pattern)
+			require.NoError(t, err)
+			require.Equal(t, tc.prefix, string(prefix))
+		})
+	}
+}
+
+func TestGlob_Match(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{pattern: "", key: "", match: true},
+		{pattern: "", key: "a", match: false},
+		{pattern: "*", key: "", match: true},
+		{pattern: "a*b*c", key: "abxbc", match: true},
+		{pattern: "a*b*c", key: "abxbcx", match: false},
+		{pattern: "*ab", key: "aab", match: true},
+		{pattern: "**a", key: "ba", match: true},
+		{pattern: "[]a]", key: "]", match: true},
+		{pattern: "[a-c]?", key: "bz", match: true},
+		{pattern: "[!a-c]", key: "b", match: false},
+		{pattern: `[\]`, key: `\`, match: true},
+		{pattern: "\xe9", key: "\xe9", match: true},
+		{pattern: "\xe9", key: "é", match: false},
+		{pattern: "?", key: "é", match: false},
+		{pattern: "??", key: "é", match: true},
+	}
+
+	for _, tc := range testCases {
+		g, _, err := compileGlob(tc.pattern)
+		require.NoError(t, err)
+		require.Equal(t, tc.match, g.match([]byte(tc.key)), "pattern %q, key %q", tc.pattern, tc.key)
+	}
+
+	_, _, err := compileGlob("[z-a]")
+	require.Error(t, err)
+}
+
+// Ensure that a bucket stored with a comparator that is no longer registered
+// can't be opened, but can still be checked and deleted.
+func TestBucket_UnknownComparator(t *testing.T) {
+	const name = "test-unknown"
+	RegisterComparator(name, func(a, b []byte) int { return bytes.Compare(b, a) })
+
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetComparator(name))
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+		return child.Put([]byte("foo"), []byte("bar"))
+	}))
+	require.NoError(t, db.Close())
+
+	comparators.Lock()
+	delete(comparators.m, name)
+	comparators.Unlock()
+
+	db, err = Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Nil(t, tx.Bucket([]byte("widgets")))
+		_, err := tx.OpenBucket([]byte("widgets"))
+		require.ErrorIs(t, err, ErrUnknownComparator)
+		require.ErrorIs(t, tx.ForEach(func(_ []byte, _ *Bucket) error { return nil }), ErrUnknownComparator)
+
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 1)
+		require.ErrorIs(t, errs[0], ErrUnknownComparator)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		return <-tx.Check()
+	}))
+}
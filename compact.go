@@ -1,11 +1,64 @@
 package bbolt
 
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// compactConfig holds the settings of a Compact call.
+type compactConfig struct {
+	preserveFill bool
+	fillPercents map[string]float64 // by changesPath of the bucket
+}
+
+// CompactOption configures Compact.
+type CompactOption func(c *compactConfig)
+
+// WithPreservedFillPercent makes Compact write the pages of each bucket with
+// the fill percent stored with it by SetPersistentFillPercent, rather than
+// filling them completely, so that the copy keeps the room left for inserts.
+func WithPreservedFillPercent() CompactOption {
+	return func(c *compactConfig) {
+		c.preserveFill = true
+	}
+}
+
+// WithFillPercent makes Compact write the pages of the bucket at path, given
+// by the names of the buckets leading to it, with the fill percent f. It
+// takes precedence over a fill percent stored with the bucket.
+func WithFillPercent(f float64, path ...[]byte) CompactOption {
+	return func(c *compactConfig) {
+		if c.fillPercents == nil {
+			c.fillPercents = make(map[string]float64)
+		}
+		c.fillPercents[changesPath(path)] = f
+	}
+}
+
+// fillPercent returns the fill percent to write the pages of b, found at
+// path, with.
+func (c *compactConfig) fillPercent(b *Bucket, path [][]byte) float64 {
+	if f, ok := c.fillPercents[changesPath(path)]; ok {
+		return f
+	} else if f := b.PersistentFillPercent(); c.preserveFill && f != 0 {
+		return f
+	}
+	return 1.0
+}
+
 // Compact will create a copy of the source DB and in the destination DB. This may
 // reclaim space that the source database no longer has use for. txMaxSize can be
 // used to limit the transactions size of this process and may trigger intermittent
-// commits. A value of zero will ignore transaction sizes.
+// commits. A value of zero will ignore transaction sizes. Pages are filled
+// completely unless options say otherwise.
 // TODO: merge with: https://github.com/etcd-io/etcd/blob/b7f0f52a16dbf83f18ca1d803f7892d750366a94/mvcc/backend/backend.go#L349
-func Compact(dst, src *DB, txMaxSize int64) error {
+func Compact(dst, src *DB, txMaxSize int64, options ...CompactOption) error {
+	var cfg compactConfig
+	for _, op := range options {
+		op(&cfg)
+	}
+
 	// commit regularly, or we'll run out of memory for large datasets if using one transaction.
 	var size int64
 	tx, err := dst.Begin(true)
@@ -18,7 +71,7 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 		}
 	}()
 
-	if err := walk(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+	if err := walk(src, func(keys [][]byte, k, v []byte, srcBkt *Bucket, flags uint32) error {
 		// On each key/value, check if we have exceeded tx size.
 		sz := int64(len(k) + len(v))
 		if size+sz > txMaxSize && txMaxSize != 0 {
@@ -43,10 +96,7 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 			if err != nil {
 				return err
 			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
+			return copyBucketSettings(bkt, srcBkt)
 		}
 
 		// Create buckets on subsequent levels, if necessary.
@@ -57,8 +107,8 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 			}
 		}
 
-		// Fill the entire page for best compaction.
-		b.FillPercent = 1.0
+		// Fill the entire page for best compaction, unless asked otherwise.
+		b.FillPercent = cfg.fillPercent(b, keys)
 
 		// If there is no value then this is a bucket call.
 		if v == nil {
@@ -66,14 +116,11 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 			if err != nil {
 				return err
 			}
-			if err := bkt.SetSequence(seq); err != nil {
-				return err
-			}
-			return nil
+			return copyBucketSettings(bkt, srcBkt)
 		}
 
 		// Otherwise treat it as a key/value pair.
-		return b.Put(k, v)
+		return b.put(k, v, flags&FlaggedValue)
 	}); err != nil {
 		return err
 	}
@@ -82,38 +129,317 @@ func Compact(dst, src *DB, txMaxSize int64) error {
 	return err
 }
 
+// Compact copies the buckets and key/value pairs of the database into dst,
+// which should be empty, as the package-level Compact does, committing each
+// time the pending transaction grows past txMaxSize bytes. Bucket nesting,
+// sequences, settings and value flags are kept. The pages freed by the
+// intermediate commits are then dropped from dst with RewriteFreelist, so
+// dst ends up densely packed with a near empty freelist. options are passed
+// on to Compact.
+func (db *DB) Compact(dst *DB, txMaxSize int64, options ...CompactOption) error {
+	if err := Compact(dst, db, txMaxSize, options...); err != nil {
+		return err
+	}
+	_, err := dst.RewriteFreelist()
+	return err
+}
+
+// migrateTxMaxSize is the size of the transactions Migrate writes the new
+// database in.
+const migrateTxMaxSize = 64 * 1024 * 1024
+
+// Migrate writes a copy of the database at srcPath to a new database at
+// dstPath that uses newPageSize, which must be a power of two of at least
+// 1024 bytes. Pages can't be reinterpreted with a different size, so every
+// bucket is walked and rebuilt as Compact does, keeping sequences, value
+// flags and bucket settings. The source is opened read-only, so it can keep
+// serving readers in other processes, and dstPath must not exist yet.
+func Migrate(srcPath, dstPath string, newPageSize int) error {
+	if newPageSize < 1024 || newPageSize&(newPageSize-1) != 0 {
+		return fmt.Errorf("migrate: invalid page size %d", newPageSize)
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dstPath); err == nil {
+		return fmt.Errorf("migrate: %s already exists", dstPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := Open(srcPath, info.Mode().Perm(), &Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := Open(dstPath, info.Mode().Perm(), &Options{PageSize: newPageSize, NoSync: true})
+	if err != nil {
+		return err
+	}
+	if err := Compact(dst, src, migrateTxMaxSize); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// CompactLive compacts the database into a new file and puts it in place of
+// the current one. Read-only transactions keep being served from the current
+// file while the copy is written; write transactions block until the call
+// returns. Once the copy is complete, CompactLive waits for the open read
+// transactions to finish, holding off new ones, and then swaps the new file
+// in under the database's path and remaps it.
+//
+// The copy is written next to the database with a ".compact" suffix, so the
+// directory must be writable. If the swap fails after the new file has been
+// renamed into place, the database is left unmapped and must be reopened.
+func (db *DB) CompactLive() error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	tmpPath := db.path + ".compact"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Carry the transaction id over so that it keeps moving forward.
+	dst, err := Open(tmpPath, info.Mode().Perm(), &Options{
+		PageSize:            db.pageSize,
+		FreelistRegionSize:  db.freelistRegionSize,
+		FreelistType:        db.FreelistType,
+		NoSync:              true,
+		OpenFile:            db.openFile,
+		InlineBucketMaxSize: db.inlineBucketMaxSize,
+		AllowEmptyKeys:      db.allowEmptyKeys,
+		MinTxID:             uint64(db.meta().txid),
+	})
+	if err != nil {
+		return err
+	}
+	if err := Compact(dst, db, migrateTxMaxSize); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	f, err := db.openFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return db.swapFile(f, tmpPath)
+}
+
+// swapFile replaces the data file with f, a complete database at tmpPath,
+// once no read transaction is open. The writer lock must be held.
+func (db *DB) swapFile(f *os.File, tmpPath string) error {
+	// Hold off new read transactions and wait for the open ones to release
+	// the mmap.
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+	db.mmaplock.Lock()
+
+	// Lock the new file before it takes the database's name, so that no
+	// other process can get hold of it unlocked.
+	old := db.file
+	db.file = f
+	if err := flock(db, true, 0); err != nil {
+		db.file = old
+		db.mmaplock.Unlock()
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		_ = funlock(db)
+		db.file = old
+		db.mmaplock.Unlock()
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	// Closing the old file releases its lock. A file given to OpenFile is
+	// unlocked instead and left open, while the new one is ours to close.
+	err := db.munmap()
+	if db.closeFile {
+		if closeErr := old.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		db.file = old
+		if unlockErr := funlock(db); err == nil {
+			err = unlockErr
+		}
+		db.file, db.closeFile = f, true
+	}
+	db.ops.writeAt = db.file.WriteAt
+	db.filesz = 0
+	db.mmaplock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := db.mmap(0); err != nil {
+		return err
+	}
+	db.freelistRegionSize = db.meta().regionSize()
+	if db.meta().freelistChecksum() {
+		if err := db.freelistPage().verifyFreelistChecksum(db.freelistRegionSize); err != nil {
+			return err
+		}
+	}
+
+	db.statlock.Lock()
+	defer db.statlock.Unlock()
+	db.freelistLoad = sync.Once{}
+	db.loadFreelist()
+	db.stats.PendingPageN = 0
+	return nil
+}
+
 // walkFunc is the type of the function called for keys (buckets and "normal"
 // values) discovered by Walk. keys is the list of keys to descend to the bucket
-// owning the discovered key/value pair k/v.
-type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+// owning the discovered key/value pair k/v, and flags holds its leaf flags.
+// b is the bucket named by k, or nil if k holds a value.
+type walkFunc func(keys [][]byte, k, v []byte, b *Bucket, flags uint32) error
 
 // walk walks recursively the bolt database db, calling walkFn for each key it finds.
 func walk(db *DB, walkFn walkFunc) error {
 	return db.View(func(tx *Tx) error {
 		return tx.ForEach(func(name []byte, b *Bucket) error {
-			return walkBucket(b, nil, name, nil, b.Sequence(), walkFn)
+			return walkBucket(b, nil, name, nil, bucketLeafFlag, walkFn)
 		})
 	})
 }
 
-func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
-	// Execute callback.
-	if err := fn(keypath, k, v, seq); err != nil {
-		return err
-	}
-
-	// If this is not a bucket then stop.
+func walkBucket(b *Bucket, keypath [][]byte, k, v []byte, flags uint32, fn walkFunc) error {
+	// If this is not a bucket then stop after the callback.
 	if v != nil {
-		return nil
+		return fn(keypath, k, v, nil, flags)
+	}
+	if err := fn(keypath, k, nil, b, flags); err != nil {
+		return err
 	}
 
 	// Iterate over each child key/value.
 	keypath = append(keypath, k)
-	return b.ForEach(func(k, v []byte) error {
-		if v == nil {
-			bkt := b.Bucket(k)
-			return walkBucket(bkt, keypath, k, nil, bkt.Sequence(), fn)
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		var err error
+		if (flags & bucketLeafFlag) != 0 {
+			err = walkBucket(b.childBucket(k, v), keypath, k, nil, flags, fn)
+		} else {
+			err = walkBucket(b, keypath, k, v, flags, fn)
 		}
-		return walkBucket(b, keypath, k, v, b.Sequence(), fn)
-	})
+		if err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// RewriteFreelist shrinks the freelist by moving the pages at the end of the
+// file into free pages nearer its start, and then dropping the run of free
+// pages left at the end, which lowers the high water mark. The file is not
+// truncated; the space is reused as the database grows again.
+//
+// It runs two write transactions: the first moves the pages, and the second
+// drops the pages that were moved once no read transaction can see them. A
+// read transaction open during the call may leave that part to a later call.
+// Returns how many pages were dropped from the freelist.
+func (db *DB) RewriteFreelist() (int, error) {
+	var n int
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			n += tx.trimFreeTail()
+			if i == 0 {
+				tx.relocateTail()
+			}
+			return nil
+		}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// trimFreeTail drops the free pages at the end of the file from the freelist
+// and lowers the high water mark, returning how many pages were dropped. A
+// failed commit reloads the freelist from disk, which puts them back.
+func (tx *Tx) trimFreeTail() int {
+	hwm := tx.db.freelist.trimTail(tx.meta.pgid)
+	n := int(tx.meta.pgid - hwm)
+	tx.meta.pgid = hwm
+	return n
+}
+
+// relocateTail materializes the nodes of every page that lies past the point
+// the high water mark could drop to if all free pages were at the end of the
+// file, so that spill moves them to pages allocated nearer the start.
+func (tx *Tx) relocateTail() {
+	cutoff := tx.meta.pgid - pgid(tx.db.freelist.free_count())
+	tx.root.relocate(tx.root.root, cutoff, func() *node { return nil })
+}
+
+// relocate materializes the node of page id if any of it lies at or beyond
+// cutoff, along with the nodes of its ancestors, and then does the same for
+// its descendants and nested buckets. parent returns the parent node,
+// materializing it on first use.
+func (b *Bucket) relocate(id, cutoff pgid, parent func() *node) {
+	var n *node
+	self := func() *node {
+		if n == nil {
+			n = b.node(id, parent())
+		}
+		return n
+	}
+
+	p := b.tx.page(id)
+	if id+pgid(p.overflow) >= cutoff {
+		self()
+	}
+
+	if (p.flags & branchPageFlag) != 0 {
+		for i := uint16(0); i < p.count; i++ {
+			b.relocate(p.branchPageElement(i).pgid, cutoff, self)
+		}
+		return
+	}
+
+	for i := uint16(0); i < p.count; i++ {
+		elem := p.leafPageElement(i)
+		if (elem.flags() & bucketLeafFlag) == 0 {
+			continue
+		}
+		if child := b.childBucket(elem.key(), elem.value()); child.root != 0 {
+			child.relocate(child.root, cutoff, func() *node { return nil })
+		}
+	}
 }
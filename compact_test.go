@@ -0,0 +1,413 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// Ensure that DB.Compact copies a database into a densely packed one.
+func TestDB_Compact(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(42))
+		for i := 0; i < 5000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("key-%04d", i)), make([]byte, 200)))
+		}
+		require.NoError(t, b.PutFlagged([]byte("flagged"), []byte("yes")))
+
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		require.NoError(t, child.SetSequence(7))
+		require.NoError(t, child.SetComparator(bolt.Uint64BEComparator))
+		for i := uint64(0); i < 500; i++ {
+			require.NoError(t, child.Put(u64tob(1000-i), []byte("v")))
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	}))
+
+	// Leave most of the source file free.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 5000; i++ {
+			if i%10 != 0 {
+				require.NoError(t, b.Delete([]byte(fmt.Sprintf("key-%04d", i))))
+			}
+		}
+		return nil
+	}))
+
+	dst := btesting.MustCreateDB(t)
+	require.NoError(t, db.Compact(dst.DB, 16*1024))
+	require.NoError(t, dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, uint64(42), b.Sequence())
+		require.Equal(t, uint64(7), b.Bucket([]byte("nested")).Sequence())
+		require.NotNil(t, tx.Bucket([]byte("empty")))
+		return nil
+	}))
+
+	// The copy takes fewer pages, and next to none of them are free.
+	size := func(db *btesting.DB) (size int64, free int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error { return nil }))
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			size = tx.Size()
+			return nil
+		}))
+		stats := db.Stats()
+		return size, stats.FreePageN + stats.PendingPageN
+	}
+	srcSize, srcFree := size(db)
+	dstSize, dstFree := size(dst)
+	require.Less(t, dstSize, srcSize)
+	require.Less(t, dstFree, srcFree/10)
+
+	db.MustClose()
+	dst.MustClose()
+
+	equal, err := bolt.Equal(db.Path(), dst.Path())
+	require.NoError(t, err)
+	require.True(t, equal)
+}
+
+// Ensure that compaction can keep the fill percents of buckets.
+func TestCompact_FillPercent(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		for name, fill := range map[string]float64{"dense": 1.0, "sparse": 0.5, "override": 0, "nested": 0} {
+			b, err := tx.CreateBucket([]byte(name))
+			require.NoError(t, err)
+			if name == "nested" {
+				b, err = b.CreateBucket([]byte("child"))
+				require.NoError(t, err)
+			}
+			require.NoError(t, b.SetPersistentFillPercent(fill))
+			for i := 0; i < 2000; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 50)))
+			}
+		}
+		return nil
+	}))
+
+	// density returns the fraction of the leaf pages of the bucket at path
+	// that is in use.
+	density := func(db *btesting.DB, path ...string) float64 {
+		var stats bolt.BucketStats
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(path[0]))
+			for _, name := range path[1:] {
+				b = b.Bucket([]byte(name))
+			}
+			stats = b.Stats()
+			return nil
+		}))
+		return float64(stats.LeafInuse) / float64(stats.LeafAlloc)
+	}
+
+	dst := btesting.MustCreateDB(t)
+	require.NoError(t, db.Compact(dst.DB, 0,
+		bolt.WithPreservedFillPercent(),
+		bolt.WithFillPercent(0.3, []byte("override")),
+		bolt.WithFillPercent(0.3, []byte("nested"), []byte("child")),
+	))
+	dense, sparse := density(dst, "dense"), density(dst, "sparse")
+	override, nested := density(dst, "override"), density(dst, "nested", "child")
+	require.Greater(t, dense, 0.9)
+	require.InDelta(t, 0.5, sparse, 0.1)
+	require.InDelta(t, 0.3, override, 0.1)
+	require.InDelta(t, 0.3, nested, 0.1)
+
+	// The stored fill percents are copied either way.
+	require.NoError(t, dst.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 0.5, tx.Bucket([]byte("sparse")).PersistentFillPercent())
+		return nil
+	}))
+
+	// Without options every bucket is packed.
+	packed := btesting.MustCreateDB(t)
+	require.NoError(t, db.Compact(packed.DB, 0))
+	require.Greater(t, density(packed, "sparse"), 0.9)
+	require.Greater(t, density(packed, "override"), 0.9)
+}
+
+// Ensure that Migrate rebuilds a database with a different page size.
+func TestMigrate(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(42))
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		require.NoError(t, b.PutFlagged([]byte("flagged"), []byte("yes")))
+		require.NoError(t, b.Put([]byte("large"), make([]byte, 50000)))
+
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		require.NoError(t, child.SetComparator(bolt.Uint64BEComparator))
+		return child.Put([]byte("foo"), []byte("bar"))
+	}))
+	db.MustClose()
+
+	dstPath := filepath.Join(t.TempDir(), "migrated.db")
+	require.NoError(t, bolt.Migrate(db.Path(), dstPath, 16384))
+
+	info, err := bolt.ReadInfo(dstPath)
+	require.NoError(t, err)
+	require.Equal(t, 16384, info.PageSize)
+
+	db.MustReopen()
+	migrated, err := bolt.Open(dstPath, 0666, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer migrated.Close()
+
+	require.NoError(t, db.View(func(srcTx *bolt.Tx) error {
+		return migrated.View(func(tx *bolt.Tx) error {
+			src, b := srcTx.Bucket([]byte("widgets")), tx.Bucket([]byte("widgets"))
+			require.Equal(t, uint64(42), b.Sequence())
+
+			c, n := src.Cursor(), 0
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				got, flags, found := b.GetWithFlags(k)
+				_, srcFlags, _ := src.GetWithFlags(k)
+				require.True(t, found, "missing key %q", k)
+				require.Equal(t, v, got)
+				require.Equal(t, srcFlags, flags)
+				n++
+			}
+			require.Equal(t, src.Stats().KeyN, b.Stats().KeyN)
+			require.Equal(t, 2003, n)
+
+			child := b.Bucket([]byte("nested"))
+			require.Equal(t, bolt.Uint64BEComparator, child.Comparator())
+			require.Equal(t, []byte("bar"), child.Get([]byte("foo")))
+
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			return nil
+		})
+	}))
+
+	// The destination must not exist yet, and the page size must be valid.
+	require.Error(t, bolt.Migrate(db.Path(), dstPath, 8192))
+	require.Error(t, bolt.Migrate(db.Path(), filepath.Join(t.TempDir(), "bad.db"), 5000))
+}
+
+// Ensure that RewriteFreelist moves pages off the end of the file and drops
+// the free pages left behind.
+func TestDB_RewriteFreelist(t *testing.T) {
+	for _, typ := range []bolt.FreelistType{bolt.FreelistArrayType, bolt.FreelistMapType} {
+		t.Run(string(typ), func(t *testing.T) {
+			db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, FreelistType: typ})
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				require.NoError(t, err)
+				child, err := b.CreateBucket([]byte("nested"))
+				require.NoError(t, err)
+				for i := 0; i < 5000; i++ {
+					key := []byte(fmt.Sprintf("%05d", i))
+					require.NoError(t, b.Put(key, make([]byte, 200)))
+					require.NoError(t, child.Put(key, make([]byte, 200)))
+				}
+				return nil
+			}))
+
+			// Leave one key in ten, spread over the whole file.
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				child := b.Bucket([]byte("nested"))
+				for i := 0; i < 5000; i++ {
+					if i%10 != 0 {
+						key := []byte(fmt.Sprintf("%05d", i))
+						require.NoError(t, b.Delete(key))
+						require.NoError(t, child.Delete(key))
+					}
+				}
+				return nil
+			}))
+			_, err := db.ReclaimPending()
+			require.NoError(t, err)
+
+			before := db.Stats().FreePageN
+			var sizeBefore int64
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				sizeBefore = tx.Size()
+				return nil
+			}))
+
+			n, err := db.RewriteFreelist()
+			require.NoError(t, err)
+			require.Greater(t, n, 0)
+			require.Less(t, db.Stats().FreePageN, before/2)
+
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				require.Less(t, tx.Size(), sizeBefore)
+				b := tx.Bucket([]byte("widgets"))
+				child := b.Bucket([]byte("nested"))
+				for i := 0; i < 5000; i += 10 {
+					key := []byte(fmt.Sprintf("%05d", i))
+					require.NotNil(t, b.Get(key))
+					require.NotNil(t, child.Get(key))
+				}
+				require.Equal(t, 1001, b.Stats().KeyN) // including the nested bucket
+				return nil
+			}))
+
+			// The smaller high water mark survives a reopen.
+			db.MustClose()
+			db.MustReopen()
+			db.MustCheck()
+		})
+	}
+}
+
+// Ensure that CompactLive shrinks the file while read transactions keep
+// being served.
+func TestDB_CompactLive(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("key-%04d", i)), make([]byte, 500)))
+		}
+		for i := 0; i < 64; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("large-%02d", i)), make([]byte, 1<<20)))
+		}
+		_, err = b.CreateBucket([]byte("nested"))
+		return err
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 64; i++ {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("large-%02d", i))))
+		}
+		return nil
+	}))
+	before, err := os.Stat(db.Path())
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	errc := make(chan error, 4)
+	var reads int64
+	for i := 0; i < cap(errc); i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errc <- nil
+					return
+				default:
+				}
+				if err := db.View(func(tx *bolt.Tx) error {
+					b := tx.Bucket([]byte("widgets"))
+					for i := 0; i < 100; i++ {
+						if v := b.Get([]byte(fmt.Sprintf("key-%04d", i))); len(v) != 500 {
+							return fmt.Errorf("key-%04d: unexpected value length %d", i, len(v))
+						}
+					}
+					if b.Get([]byte("large-00")) != nil {
+						return fmt.Errorf("deleted key is visible")
+					}
+					return nil
+				}); err != nil {
+					errc <- err
+					return
+				}
+				atomic.AddInt64(&reads, 1)
+			}
+		}()
+	}
+
+	// Let the readers get going before compacting under them.
+	for atomic.LoadInt64(&reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, db.CompactLive())
+	close(stop)
+	for i := 0; i < cap(errc); i++ {
+		require.NoError(t, <-errc)
+	}
+
+	after, err := os.Stat(db.Path())
+	require.NoError(t, err)
+	require.Less(t, after.Size(), before.Size())
+	_, err = os.Stat(db.Path() + ".compact")
+	require.True(t, os.IsNotExist(err))
+
+	// The compacted database takes writes and survives a reopen.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("key-0100"), []byte("back"))
+	}))
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Nil(t, b.Get([]byte("large-00")))
+		require.NotNil(t, b.Bucket([]byte("nested")))
+		require.Equal(t, []byte("back"), b.Get([]byte("key-0100")))
+		return nil
+	}))
+}
+
+// Ensure that CompactLive keeps a non-default freelist region size.
+func TestDB_CompactLive_FreelistRegionSize(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, FreelistRegionSize: 4 * 4096})
+	put := func(from, to int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			require.NoError(t, err)
+			for i := from; i < to; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("key-%04d", i)), make([]byte, 500)))
+			}
+			return nil
+		}))
+	}
+	del := func(from, to int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := from; i < to; i++ {
+				require.NoError(t, b.Delete([]byte(fmt.Sprintf("key-%04d", i))))
+			}
+			return nil
+		}))
+	}
+	check := func() {
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				return err
+			}
+			return nil
+		}))
+	}
+
+	put(0, 1000)
+	del(0, 500)
+	require.NoError(t, db.CompactLive())
+	check()
+
+	// The swapped in file is written and read with the same region size.
+	put(1000, 1500)
+	del(500, 1000)
+	check()
+	db.MustClose()
+	db.MustReopen()
+	check()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 500, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	}))
+}
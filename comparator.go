@@ -0,0 +1,89 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Names of the built-in key comparators. A bucket orders its keys with
+// BytesComparator unless Bucket.SetComparator was called on it.
+const (
+	// BytesComparator orders keys lexicographically, as bytes.Compare does.
+	BytesComparator = "bytes"
+
+	// Uint64BEComparator orders 8-byte keys as big-endian unsigned integers.
+	// Keys of any other length sort after them, in byte order.
+	Uint64BEComparator = "uint64be"
+
+	// Uint64LEComparator orders 8-byte keys as little-endian unsigned
+	// integers. Keys of any other length sort after them, in byte order.
+	Uint64LEComparator = "uint64le"
+)
+
+// maxComparatorNameSize is the longest comparator name that can be stored
+// with a bucket.
+const maxComparatorNameSize = 255
+
+var comparators = struct {
+	sync.RWMutex
+	m map[string]func(a, b []byte) int
+}{
+	m: map[string]func(a, b []byte) int{
+		BytesComparator:    bytes.Compare,
+		Uint64BEComparator: func(a, b []byte) int { return compareUint64(a, b, binary.BigEndian) },
+		Uint64LEComparator: func(a, b []byte) int { return compareUint64(a, b, binary.LittleEndian) },
+	},
+}
+
+// RegisterComparator makes a key comparator available under name, so that
+// buckets can be ordered by it with Bucket.SetComparator. Only the name is
+// stored in the database, so the comparator must be registered before any
+// bucket using it is opened, in every process that opens the database.
+//
+// compare must define a total order and return 0 only for identical keys.
+// RegisterComparator panics if name is empty or longer than 255 bytes, if
+// compare is nil, or if name is already registered.
+func RegisterComparator(name string, compare func(a, b []byte) int) {
+	if name == "" || len(name) > maxComparatorNameSize {
+		panic(fmt.Sprintf("bbolt: invalid comparator name %q", name))
+	} else if compare == nil {
+		panic("bbolt: RegisterComparator compare is nil")
+	}
+
+	comparators.Lock()
+	defer comparators.Unlock()
+	if _, ok := comparators.m[name]; ok {
+		panic(fmt.Sprintf("bbolt: RegisterComparator called twice for %q", name))
+	}
+	comparators.m[name] = compare
+}
+
+// lookupComparator returns the comparator registered under name.
+func lookupComparator(name string) (func(a, b []byte) int, bool) {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	compare, ok := comparators.m[name]
+	return compare, ok
+}
+
+// compareUint64 compares 8-byte keys as integers in the given byte order and
+// sorts keys of other lengths after them, in byte order.
+func compareUint64(a, b []byte, order binary.ByteOrder) int {
+	switch {
+	case len(a) == 8 && len(b) == 8:
+		x, y := order.Uint64(a), order.Uint64(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case len(a) == 8:
+		return -1
+	case len(b) == 8:
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
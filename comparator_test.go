@@ -0,0 +1,172 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+func uint64le(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+// Ensure that keys are ordered by the comparator stored with the bucket.
+func TestBucket_SetComparator(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	const n = 1000
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("numbers"))
+		require.NoError(t, err)
+		require.Equal(t, bolt.BytesComparator, b.Comparator())
+		require.NoError(t, b.SetComparator(bolt.Uint64LEComparator))
+
+		// A small nested bucket stays inline and keeps its own comparator.
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		require.NoError(t, child.SetComparator(bolt.Uint64LEComparator))
+		for _, v := range []uint64{256, 1, 2} {
+			require.NoError(t, child.Put(uint64le(v), nil))
+		}
+
+		for _, i := range rand.Perm(n / 2) {
+			require.NoError(t, b.Put(uint64le(uint64(i)), make([]byte, 50)))
+		}
+		return nil
+	}))
+
+	db.MustClose()
+	db.MustReopen()
+
+	// Keep inserting after the reopen.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("numbers"))
+		require.Equal(t, bolt.Uint64LEComparator, b.Comparator())
+		for _, i := range rand.Perm(n / 2) {
+			require.NoError(t, b.Put(uint64le(uint64(n/2+i)), make([]byte, 50)))
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("numbers"))
+		require.Greater(t, b.Stats().LeafPageN, 1)
+
+		// Numeric order, then the other keys in byte order.
+		var want uint64
+		c := b.Cursor()
+		k, _ := c.First()
+		for ; len(k) == 8; k, _ = c.Next() {
+			require.Equal(t, want, binary.LittleEndian.Uint64(k))
+			want++
+		}
+		require.Equal(t, uint64(n), want)
+		require.Equal(t, []byte("nested"), k)
+
+		k, _ = c.Seek(uint64le(300))
+		require.Equal(t, uint64le(300), k)
+		k, _ = c.Prev()
+		require.Equal(t, uint64le(299), k)
+
+		var nested []uint64
+		require.NoError(t, b.Bucket([]byte("nested")).ForEach(func(k, _ []byte) error {
+			nested = append(nested, binary.LittleEndian.Uint64(k))
+			return nil
+		}))
+		require.Equal(t, []uint64{1, 2, 256}, nested)
+		return nil
+	}))
+
+	// Compaction keeps the comparator.
+	compacted, err := bolt.Open(filepath.Join(t.TempDir(), "compacted.db"), 0666, nil)
+	require.NoError(t, err)
+	defer compacted.Close()
+	require.NoError(t, bolt.Compact(compacted, db.DB, 0))
+	require.NoError(t, compacted.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("numbers"))
+		require.Equal(t, bolt.Uint64LEComparator, b.Comparator())
+		k, _ := b.Cursor().Last()
+		require.Equal(t, []byte("nested"), k)
+		return nil
+	}))
+}
+
+// Ensure that SetComparator rejects unknown comparators and non-empty buckets.
+func TestBucket_SetComparator_Errors(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.ErrorIs(t, b.SetComparator("no-such-comparator"), bolt.ErrUnknownComparator)
+
+		require.NoError(t, b.Put([]byte("foo"), []byte("bar")))
+		require.ErrorIs(t, b.SetComparator(bolt.Uint64BEComparator), bolt.ErrBucketNotEmpty)
+		require.Equal(t, bolt.BytesComparator, b.Comparator())
+		return nil
+	}))
+}
+
+// Ensure that a registered comparator can be used by name.
+func TestRegisterComparator(t *testing.T) {
+	reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+	bolt.RegisterComparator("test-reverse", reverse)
+	require.Panics(t, func() { bolt.RegisterComparator("test-reverse", reverse) })
+	require.Panics(t, func() { bolt.RegisterComparator("", reverse) })
+
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetComparator("test-reverse"))
+		for _, k := range []string{"b", "c", "a"} {
+			require.NoError(t, b.Put([]byte(k), nil))
+		}
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		var keys []string
+		require.NoError(t, tx.Bucket([]byte("widgets")).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"c", "b", "a"}, keys)
+		return nil
+	}))
+}
+
+// Ensure that prefix operations don't assume that keys with a common prefix
+// are adjacent in buckets with a comparator.
+func TestBucket_SetComparator_Prefix(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("numbers"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetComparator(bolt.Uint64LEComparator))
+		for _, v := range []uint64{1, 256, 257} {
+			require.NoError(t, b.Put(uint64le(v), nil))
+		}
+
+		// 1 and 257 start with 0x01 but 256 sorts between them.
+		var matched [][]byte
+		require.NoError(t, b.ForEachMatch("\x01*", func(k, _ []byte) error {
+			matched = append(matched, k)
+			return nil
+		}))
+		require.Equal(t, [][]byte{uint64le(1), uint64le(257)}, matched)
+
+		_, _, err = b.DeletePrefix([]byte{0x01})
+		require.ErrorIs(t, err, bolt.ErrPrefixUnordered)
+		_, _, err = b.DeletePrefixDryRun([]byte{0x01})
+		require.ErrorIs(t, err, bolt.ErrPrefixUnordered)
+		return nil
+	}))
+}
@@ -0,0 +1,91 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+)
+
+// openFixture decompresses a database fixture from testdata into a
+// temporary file and opens it.
+func openFixture(t *testing.T, name string) *bolt.DB {
+	in, err := os.Open(filepath.Join("testdata", name+".gz"))
+	require.NoError(t, err)
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), name)
+	out, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = io.Copy(out, zr)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+
+	db, err := bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// Ensure that a database written before format version 3 can still be read
+// and written, and that keys longer than 4095 bytes load intact.
+//
+// testdata/baseline.db.gz holds a bucket "widgets" with the keys 0250 to
+// 0499 (values "value0250" to "value0499"), a 5000 byte key of 'k's with
+// value "long", and a nested bucket "child" holding foo=bar. Keys 0000 to
+// 0249 were deleted in a second transaction, so the freelist is not empty.
+func TestOpen_BaselineFixture(t *testing.T) {
+	db := openFixture(t, "baseline.db")
+	longKey := bytes.Repeat([]byte("k"), 5000)
+
+	verify := func() {
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				return err
+			}
+			b := tx.Bucket([]byte("widgets"))
+			require.NotNil(t, b)
+			require.Nil(t, b.Get([]byte("0000")))
+			for i := 250; i < 500; i++ {
+				require.Equal(t, []byte(fmt.Sprintf("value%04d", i)), b.Get([]byte(fmt.Sprintf("%04d", i))))
+			}
+			require.Equal(t, []byte("long"), b.Get(longKey))
+			require.Equal(t, []byte("bar"), b.Bucket([]byte("child")).Get([]byte("foo")))
+			return nil
+		}))
+	}
+	verify()
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		// Value flags and stored bucket settings need format version 3.
+		require.ErrorIs(t, b.PutFlagged([]byte("flagged"), []byte("value")), bolt.ErrValueFlagsUnsupported)
+		require.ErrorIs(t, b.SetPersistentFillPercent(0.9), bolt.ErrBucketSettingsUnsupported)
+		require.NoError(t, b.SetPersistentFillPercent(0))
+
+		empty, err := tx.CreateBucket([]byte("empty"))
+		require.NoError(t, err)
+		require.ErrorIs(t, empty.SetComparator(bolt.Uint64LEComparator), bolt.ErrBucketSettingsUnsupported)
+		require.NoError(t, empty.SetComparator(bolt.BytesComparator))
+		require.NoError(t, tx.DeleteBucket([]byte("empty")))
+
+		return b.Put([]byte("new"), []byte("value"))
+	}))
+	verify()
+
+	path := db.Path()
+	require.NoError(t, db.Close())
+	db, err := bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	verify()
+}
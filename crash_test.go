@@ -0,0 +1,152 @@
+package bbolt
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crashJournal records the previous contents of every range written to a
+// database file since its last sync, so that the writes can be undone.
+type crashJournal struct {
+	mu     sync.Mutex
+	undo   []crashUndo
+	synced int64 // file size at the last sync
+}
+
+type crashUndo struct {
+	off int64
+	old []byte
+}
+
+var (
+	crashJournalsMu sync.Mutex
+	crashJournals   = make(map[*DB]*crashJournal)
+)
+
+// TrackUnsyncedWrites starts recording writes to the data file so that a
+// later SimulateCrash can drop those that were never synced. It is only
+// available to tests.
+func (db *DB) TrackUnsyncedWrites() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	j := &crashJournal{synced: info.Size()}
+
+	writeAt, sync := db.ops.writeAt, db.ops.fdatasync
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		old := make([]byte, len(b))
+		if _, err := db.file.ReadAt(old, off); err != nil && err != io.EOF {
+			return 0, err
+		}
+		j.mu.Lock()
+		j.undo = append(j.undo, crashUndo{off: off, old: old})
+		j.mu.Unlock()
+		return writeAt(b, off)
+	}
+	db.ops.fdatasync = func(db *DB) error {
+		if err := sync(db); err != nil {
+			return err
+		}
+		info, err := db.file.Stat()
+		if err != nil {
+			return err
+		}
+		j.mu.Lock()
+		j.undo, j.synced = nil, info.Size()
+		j.mu.Unlock()
+		return nil
+	}
+
+	crashJournalsMu.Lock()
+	crashJournals[db] = j
+	crashJournalsMu.Unlock()
+	return nil
+}
+
+// SimulateCrash abandons the database as if the process had crashed: every
+// write made since the last sync is undone, the file is truncated back to its
+// last synced size and the mmap and file handle are released without waiting
+// for transactions. The database must be tracked with TrackUnsyncedWrites
+// and can then be reopened from its path. It is only available to tests.
+func (db *DB) SimulateCrash() error {
+	crashJournalsMu.Lock()
+	j := crashJournals[db]
+	delete(crashJournals, db)
+	crashJournalsMu.Unlock()
+	if j == nil {
+		panic("bolt: SimulateCrash called without TrackUnsyncedWrites")
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		if _, err := db.file.WriteAt(j.undo[i].old, j.undo[i].off); err != nil {
+			return err
+		}
+	}
+	if err := db.file.Truncate(j.synced); err != nil {
+		return err
+	}
+	return db.close()
+}
+
+func TestDB_SimulateCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	open := func() *DB {
+		db, err := Open(path, 0666, nil)
+		require.NoError(t, err)
+		require.NoError(t, db.TrackUnsyncedWrites())
+		return db
+	}
+	put := func(db *DB, key string) {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), make([]byte, 5000))
+		}))
+	}
+	keys := func(db *DB) []string {
+		var keys []string
+		require.NoError(t, db.View(func(tx *Tx) error {
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			return tx.Bucket([]byte("widgets")).ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}))
+		return keys
+	}
+
+	// Synced commits survive a crash.
+	db := open()
+	put(db, "synced")
+	require.NoError(t, db.SimulateCrash())
+
+	// Commits made with NoSync are lost unless Sync is called.
+	db = open()
+	require.Equal(t, []string{"synced"}, keys(db))
+	db.NoSync = true
+	put(db, "flushed")
+	require.NoError(t, db.Sync())
+	put(db, "lost1")
+	put(db, "lost2")
+	require.Equal(t, []string{"flushed", "lost1", "lost2", "synced"}, keys(db))
+	require.NoError(t, db.SimulateCrash())
+
+	db = open()
+	defer db.Close()
+	require.Equal(t, []string{"flushed", "synced"}, keys(db))
+
+	// The database keeps working after recovery.
+	put(db, "after")
+	require.Equal(t, []string{"after", "flushed", "synced"}, keys(db))
+}
@@ -2,6 +2,7 @@ package bbolt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sort"
 )
@@ -19,6 +20,30 @@ import (
 type Cursor struct {
 	bucket *Bucket
 	stack  []elemRef
+
+	// MaxValueRead, if positive, is the largest value the cursor returns.
+	// Longer values are cut short and Truncated reports true. Scanning
+	// possibly corrupt data with a limit keeps a damaged value size from
+	// producing a slice that reaches far past the page.
+	MaxValueRead int
+
+	truncated bool
+	err       error
+}
+
+// Truncated returns true if the last value the cursor returned was cut
+// short by MaxValueRead.
+func (c *Cursor) Truncated() bool {
+	return c.truncated
+}
+
+// Err returns the error that stopped the cursor, or nil. It is a *BoltError
+// wrapping ErrTreeTooDeep if the cursor went deeper than
+// Options.MaxTreeDepthGuard, which usually means a corrupt, cyclic tree.
+// Once the cursor has stopped, every move returns a nil key, so callers
+// that walk to a nil key should check Err afterwards.
+func (c *Cursor) Err() error {
+	return c.err
 }
 
 // Bucket returns the bucket that this cursor was created from.
@@ -41,7 +66,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 func (c *Cursor) first() (key []byte, value []byte, flags uint32) {
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
-	c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
+	c.push(elemRef{page: p, node: n, index: 0})
 	c.goToFirstElementOnTheStack()
 
 	// If we land on an empty page then move to the next value.
@@ -50,11 +75,7 @@ func (c *Cursor) first() (key []byte, value []byte, flags uint32) {
 		c.next()
 	}
 
-	k, v, flags := c.keyValue()
-	if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil, flags
-	}
-	return k, v, flags
+	return c.keyValue()
 }
 
 // Last moves the cursor to the last item in the bucket and returns its key and value.
@@ -66,7 +87,7 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 	p, n := c.bucket.pageNode(c.bucket.root)
 	ref := elemRef{page: p, node: n}
 	ref.index = ref.count() - 1
-	c.stack = append(c.stack, ref)
+	c.push(ref)
 	c.last()
 
 	// If this is an empty page (calling Delete may result in empty pages)
@@ -121,6 +142,21 @@ func (c *Cursor) PrevSamePage() (key []byte, value []byte, ok bool) {
 	return k, v, ok
 }
 
+// NextPage moves the cursor to the first key of the next leaf page, skipping
+// the rest of the current one, and returns that key and its value. In a
+// writable transaction the pages are those of the bucket's nodes once
+// materialized. If the cursor is not positioned or there are no more leaf
+// pages, a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) NextPage() (key []byte, value []byte) {
+	_assert(c.bucket.tx.db != nil, "tx closed")
+	k, v, flags := c.nextPage()
+	if (flags & uint32(bucketLeafFlag)) != 0 {
+		return k, nil
+	}
+	return k, v
+}
+
 // PrevN is equivalent to calling Cursor.Prev() N times, and returns the exact number of calls
 // if running out of keys.
 func (c *Cursor) PrevN(n int) (count int, key []byte, value []byte) {
@@ -165,6 +201,57 @@ func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
 	return k, v
 }
 
+// PrevFrom moves the cursor to a given key using a b-tree search and returns
+// it. If the key does not exist then the previous key is used, so seeking
+// past the end returns the last key. If no keys precede it, a nil key is
+// returned. Following it with Prev scans keys in descending order; keys of
+// nested buckets are returned with a nil value and never descended into.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) PrevFrom(seek []byte) (key []byte, value []byte) {
+	_assert(c.bucket.tx.db != nil, "tx closed")
+
+	k, v, flags := c.prevFrom(seek)
+	if k == nil {
+		return nil, nil
+	} else if (flags & uint32(bucketLeafFlag)) != 0 {
+		return k, nil
+	}
+	return k, v
+}
+
+func (c *Cursor) prevFrom(seek []byte) (key []byte, value []byte, flags uint32) {
+	k, v, flags := c.seek(seek)
+	if ref := &c.stack[len(c.stack)-1]; ref.index < ref.count() && c.bucket.compareKeys(k, seek) == 0 {
+		return k, v, flags
+	}
+
+	// The cursor is on the first key after seek, or just past the end of a
+	// page, so the key we want is the one before.
+	k, v, flags = c.prev()
+
+	// Skip over empty pages that deletions may have left behind.
+	for len(c.stack) > 0 && c.stack[len(c.stack)-1].count() == 0 {
+		k, v, flags = c.prev()
+	}
+	return k, v, flags
+}
+
+// SeekLast is an alias for PrevFrom, named for descending range scans.
+func (c *Cursor) SeekLast(prefix []byte) (key []byte, value []byte) {
+	return c.PrevFrom(prefix)
+}
+
+// Flags returns the value flags of the current key/value under the cursor,
+// which is FlaggedValue for values written with Bucket.PutFlagged and zero
+// otherwise. Returns zero if the cursor is not positioned on a key.
+func (c *Cursor) Flags() uint32 {
+	if len(c.stack) == 0 {
+		return 0
+	}
+	_, _, flags := c.keyValue()
+	return flags & FlaggedValue
+}
+
 // Delete removes the current key/value under the cursor from the bucket.
 // Delete fails if current key/value is a bucket or if the transaction is not writable.
 func (c *Cursor) Delete() error {
@@ -172,16 +259,19 @@ func (c *Cursor) Delete() error {
 		return ErrTxClosed
 	} else if !c.bucket.Writable() {
 		return ErrTxNotWritable
+	} else if c.err != nil {
+		return c.err
 	}
 
-	key, _, flags := c.keyValue()
+	key, v, flags := c.keyValue()
 	// Return an error if current value is a bucket.
 	if (flags & bucketLeafFlag) != 0 {
-		return ErrIncompatibleValue
+		return c.wrapError(ErrIncompatibleValue, key)
 	}
 	c.node().del(key)
+	c.bucket.logMutation(MutationDelete, key, nil)
 
-	return nil
+	return c.bucket.reindex(key, v, nil, true, false)
 }
 
 // seek moves the cursor to a given key and returns it.
@@ -195,6 +285,48 @@ func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	return c.keyValue()
 }
 
+// reseek moves the cursor to a key like seek, but keeps the part of the stack
+// that still leads to it and only descends from the deepest page whose range
+// covers the key. Keys must be given in ascending order after a seek.
+func (c *Cursor) reseek(seek []byte) (key []byte, value []byte, flags uint32) {
+	if len(c.stack) == 0 {
+		return c.seek(seek)
+	}
+
+	// The child under a branch element ends where the next element begins,
+	// or where its branch ends if it is the last one.
+	depth := len(c.stack) - 1
+	for i := depth - 1; i >= 0; i-- {
+		ref := &c.stack[i]
+		if ref.index+1 >= ref.count() {
+			continue
+		}
+		var next []byte
+		if ref.node != nil {
+			next = ref.node.inodes[ref.index+1].key
+		} else {
+			next = ref.page.branchPageElement(uint16(ref.index + 1)).key()
+		}
+		if c.bucket.compareKeys(seek, next) < 0 {
+			break
+		}
+		depth = i
+	}
+
+	pgId := c.bucket.root
+	if depth > 0 {
+		ref := &c.stack[depth-1]
+		if ref.node != nil {
+			pgId = ref.node.inodes[ref.index].pgid
+		} else {
+			pgId = ref.page.branchPageElement(uint16(ref.index)).pgid
+		}
+	}
+	c.stack = c.stack[:depth]
+	c.search(seek, pgId)
+	return c.keyValue()
+}
+
 // first moves the cursor to the first leaf element under the last page in the stack.
 func (c *Cursor) goToFirstElementOnTheStack() {
 	for {
@@ -212,7 +344,9 @@ func (c *Cursor) goToFirstElementOnTheStack() {
 			pgId = ref.page.branchPageElement(uint16(ref.index)).pgid
 		}
 		p, n := c.bucket.pageNode(pgId)
-		c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
+		if !c.push(elemRef{page: p, node: n, index: 0}) {
+			return
+		}
 	}
 }
 
@@ -236,8 +370,28 @@ func (c *Cursor) last() {
 
 		var nextRef = elemRef{page: p, node: n}
 		nextRef.index = nextRef.count() - 1
-		c.stack = append(c.stack, nextRef)
+		if !c.push(nextRef) {
+			return
+		}
+	}
+}
+
+// push descends into a page or node by adding it to the stack. If the stack
+// would grow beyond the depth guard, it stops the cursor with ErrTreeTooDeep
+// instead and returns false; see Err.
+func (c *Cursor) push(ref elemRef) bool {
+	if len(c.stack) >= c.bucket.tx.db.maxTreeDepth {
+		var id pgid
+		if ref.page != nil {
+			id = ref.page.id
+		} else {
+			id = ref.node.pgid
+		}
+		c.err = &BoltError{Err: ErrTreeTooDeep, PageID: int(id), BucketPath: c.bucket.path()}
+		return false
 	}
+	c.stack = append(c.stack, ref)
+	return true
 }
 
 // next moves to the next leaf element and returns the key and value.
@@ -341,6 +495,20 @@ RET:
 	return count, key, value, flags
 }
 
+func (c *Cursor) nextPage() (key []byte, value []byte, flags uint32) {
+	if len(c.stack) == 0 {
+		return nil, nil, 0
+	}
+
+	// Move to the last element of the leaf so that next crosses over into
+	// the following one.
+	leaf := &c.stack[len(c.stack)-1]
+	if n := leaf.count(); n > 0 {
+		leaf.index = n - 1
+	}
+	return c.next()
+}
+
 func (c *Cursor) prevSamePage() (key []byte, value []byte, flags uint32, ok bool) {
 	// Attempt to move back one element until we're successful.
 	// Don't move up the stack as we hit the beginning of each page in our stack.
@@ -364,7 +532,9 @@ func (c *Cursor) search(key []byte, pgId pgid) {
 		panic(fmt.Sprintf("invalid page type: %d: %x", p.id, p.flags))
 	}
 	e := elemRef{page: p, node: n}
-	c.stack = append(c.stack, e)
+	if !c.push(e) {
+		return
+	}
 
 	// If we're on a leaf page/node then find the specific node.
 	if e.isLeaf() {
@@ -381,10 +551,10 @@ func (c *Cursor) search(key []byte, pgId pgid) {
 
 func (c *Cursor) searchNode(key []byte, n *node) {
 	var exact bool
-	index := sort.Search(len(n.inodes), func(i int) bool {
+	index := c.searchElements(len(n.inodes), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(n.inodes[i].key, key)
+		ret := c.bucket.compareKeys(n.inodes[i].key, key)
 		if ret == 0 {
 			exact = true
 		}
@@ -404,10 +574,10 @@ func (c *Cursor) searchPage(key []byte, p *page) {
 	inodes := p.branchPageElements()
 
 	var exact bool
-	index := sort.Search(int(p.count), func(i int) bool {
+	index := c.searchElements(int(p.count), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(inodes[i].key(), key)
+		ret := c.bucket.compareKeys(inodes[i].key(), key)
 		if ret == 0 {
 			exact = true
 		}
@@ -429,8 +599,8 @@ func (c *Cursor) nsearch(key []byte) {
 
 	// If we have a node then search its inodes.
 	if n != nil {
-		index := sort.Search(len(n.inodes), func(i int) bool {
-			return bytes.Compare(n.inodes[i].key, key) != -1
+		index := c.searchElements(len(n.inodes), func(i int) bool {
+			return c.bucket.compareKeys(n.inodes[i].key, key) != -1
 		})
 		e.index = index
 		return
@@ -438,30 +608,72 @@ func (c *Cursor) nsearch(key []byte) {
 
 	// If we have a page then search its leaf elements.
 	inodes := p.leafPageElements()
-	index := sort.Search(int(p.count), func(i int) bool {
-		return bytes.Compare(inodes[i].key(), key) != -1
+	index := c.searchElements(int(p.count), func(i int) bool {
+		return c.bucket.compareKeys(inodes[i].key(), key) != -1
 	})
 	e.index = index
 }
 
+// searchElements returns the smallest index in [0, n) at which f is true, or
+// n if there is none, like sort.Search. Pages and nodes with fewer elements
+// than DB.linearSearchThreshold are scanned linearly instead, which avoids
+// the unpredictable branches of a binary search on small inputs.
+func (c *Cursor) searchElements(n int, f func(int) bool) int {
+	if n < c.bucket.tx.db.linearSearchThreshold {
+		for i := 0; i < n; i++ {
+			if f(i) {
+				return i
+			}
+		}
+		return n
+	}
+	return sort.Search(n, f)
+}
+
+// wrapError returns err as a *BoltError carrying the cursor's bucket path,
+// the given key and the page or node the cursor is positioned on.
+func (c *Cursor) wrapError(err error, key []byte) error {
+	e := &BoltError{Err: err, BucketPath: c.bucket.path(), Key: cloneBytes(key)}
+	if len(c.stack) > 0 {
+		if ref := &c.stack[len(c.stack)-1]; ref.node != nil {
+			e.PageID = int(ref.node.pgid)
+		} else {
+			e.PageID = int(ref.page.id)
+		}
+	}
+	return e
+}
+
 // keyValue returns the key and value of the current leaf element.
 func (c *Cursor) keyValue() ([]byte, []byte, uint32) {
 	ref := &c.stack[len(c.stack)-1]
 
-	// If the cursor is pointing to the end of page/node then return nil.
-	if ref.count() == 0 || ref.index >= ref.count() {
+	// If the cursor is stopped, or pointing to the end of page/node then
+	// return nil.
+	if c.err != nil || ref.count() == 0 || ref.index >= ref.count() {
+		c.truncated = false
 		return nil, nil, 0
 	}
 
 	// Retrieve value from node.
 	if ref.node != nil {
 		inode := &ref.node.inodes[ref.index]
-		return inode.key, inode.value, inode.flags
+		return inode.key, c.limitValue(inode.value), inode.flags
 	}
 
 	// Or retrieve value from page.
 	elem := ref.page.leafPageElement(uint16(ref.index))
-	return elem.key(), elem.value(), elem.flags()
+	return elem.key(), c.limitValue(elem.value()), ref.page.leafPageElementFlags(uint16(ref.index))
+}
+
+// limitValue cuts v down to MaxValueRead bytes, if set, and records whether
+// it did.
+func (c *Cursor) limitValue(v []byte) []byte {
+	c.truncated = c.MaxValueRead > 0 && len(v) > c.MaxValueRead
+	if c.truncated {
+		return v[:c.MaxValueRead:c.MaxValueRead]
+	}
+	return v
 }
 
 // node returns the node that the cursor is currently positioned on.
@@ -508,3 +720,174 @@ func (r *elemRef) count() int {
 	}
 	return int(r.page.count)
 }
+
+// RefreshableCursor is a cursor that reads from its own read-only transaction
+// and can be moved forward to the latest committed state with Refresh. This
+// lets a long-lived reader loop observe new commits at controlled points
+// without closing and reopening transactions.
+//
+// Keys and values returned by the cursor are only valid until the next call
+// to Refresh or Close. The cursor must be closed when no longer needed,
+// otherwise the pages of its snapshot can never be reclaimed.
+type RefreshableCursor struct {
+	*Cursor
+	tx   *Tx
+	path [][]byte
+}
+
+// RefreshableCursor creates a RefreshableCursor over the bucket. The cursor
+// starts at the latest committed state of the database, which may be newer
+// than the bucket's own transaction.
+//
+// Like opening a read transaction, this must not be called from within a
+// write transaction as the writer may need to remap the database.
+func (b *Bucket) RefreshableCursor() (*RefreshableCursor, error) {
+	if b.tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	var path [][]byte
+	for p := b; p.parent != nil; p = p.parent {
+		path = append([][]byte{cloneBytes(p.name)}, path...)
+	}
+
+	tx, err := b.tx.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	c := &RefreshableCursor{tx: tx, path: path}
+	if err := c.open(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh moves the cursor's snapshot to the latest committed state. The
+// cursor is left unpositioned and must be repositioned with First, Last or
+// Seek. Returns ErrBucketNotFound if the bucket no longer exists, in which
+// case the cursor can only be closed.
+func (c *RefreshableCursor) Refresh() error {
+	tx := c.tx
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	// Moving the transaction id forward under the meta lock releases the
+	// pages of the old snapshot to the writer, so no references to them
+	// may survive past this point.
+	tx.db.metalock.Lock()
+	tx.db.meta().copy(tx.meta)
+	tx.root = newBucket(tx)
+	tx.root.bucket = &bucket{}
+	*tx.root.bucket = tx.meta.root
+	tx.db.metalock.Unlock()
+
+	return c.open()
+}
+
+// Close releases the cursor's transaction.
+func (c *RefreshableCursor) Close() error {
+	return c.tx.Rollback()
+}
+
+// open resolves the bucket path in the cursor's transaction and resets the
+// embedded cursor to it.
+func (c *RefreshableCursor) open() error {
+	b := &c.tx.root
+	for _, name := range c.path {
+		var err error
+		if b, err = b.OpenBucket(name); errors.Is(err, ErrBucketNotFound) {
+			c.Cursor = nil
+			return ErrBucketNotFound
+		} else if err != nil {
+			c.Cursor = nil
+			return err
+		}
+	}
+	c.Cursor = b.Cursor()
+	return nil
+}
+
+// PrefixCursor iterates over the keys of a bucket that start with a given
+// prefix. It behaves like a Cursor that is bounded to that range: First and
+// Last move to the first and last key with the prefix, and Next and Prev
+// return a nil key once they leave it, so callers don't need to compare
+// prefixes themselves.
+type PrefixCursor struct {
+	c      *Cursor
+	prefix []byte
+}
+
+// PrefixCursor creates a PrefixCursor over the keys of the bucket starting
+// with prefix. An empty prefix covers the whole bucket. The cursor is only
+// valid as long as the transaction is open. It relies on keys sharing a prefix
+// being adjacent, which only holds for buckets using BytesComparator; on other
+// buckets it may miss keys with the prefix.
+func (b *Bucket) PrefixCursor(prefix []byte) *PrefixCursor {
+	return &PrefixCursor{c: b.Cursor(), prefix: cloneBytes(prefix)}
+}
+
+// Bucket returns the bucket that this cursor was created from.
+func (c *PrefixCursor) Bucket() *Bucket {
+	return c.c.Bucket()
+}
+
+// Prefix returns the prefix the cursor is bounded to.
+func (c *PrefixCursor) Prefix() []byte {
+	return c.prefix
+}
+
+// First moves the cursor to the first key with the prefix and returns its
+// key and value. If there is no such key then a nil key and value are
+// returned.
+func (c *PrefixCursor) First() (key []byte, value []byte) {
+	return c.bound(c.c.Seek(c.prefix))
+}
+
+// Last moves the cursor to the last key with the prefix and returns its key
+// and value. If there is no such key then a nil key and value are returned.
+func (c *PrefixCursor) Last() (key []byte, value []byte) {
+	if end := prefixEnd(c.prefix); end != nil {
+		if k, _ := c.c.Seek(end); k == nil {
+			return c.bound(c.c.Last())
+		}
+		return c.bound(c.c.Prev())
+	}
+	return c.bound(c.c.Last())
+}
+
+// Next moves the cursor to the next key with the prefix and returns its key
+// and value. If the cursor moves past the last such key then a nil key and
+// value are returned.
+func (c *PrefixCursor) Next() (key []byte, value []byte) {
+	return c.bound(c.c.Next())
+}
+
+// Prev moves the cursor to the previous key with the prefix and returns its
+// key and value. If the cursor moves before the first such key then a nil
+// key and value are returned.
+func (c *PrefixCursor) Prev() (key []byte, value []byte) {
+	return c.bound(c.c.Prev())
+}
+
+// bound hides keys outside of the prefix.
+func (c *PrefixCursor) bound(k, v []byte) ([]byte, []byte) {
+	if k == nil || !bytes.HasPrefix(k, c.prefix) {
+		return nil, nil
+	}
+	return k, v
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none because prefix is empty or all 0xff.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := cloneBytes(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package bbolt_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -14,6 +15,8 @@ import (
 	"testing/quick"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	bolt "github.com/coyove/bbolt"
 	"github.com/coyove/bbolt/internal/btesting"
 )
@@ -142,7 +145,7 @@ func TestCursor_Delete(t *testing.T) {
 		}
 
 		c.Seek([]byte("sub"))
-		if err := c.Delete(); err != bolt.ErrIncompatibleValue {
+		if err := c.Delete(); !errors.Is(err, bolt.ErrIncompatibleValue) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 
@@ -854,6 +857,61 @@ func TestCursor_PrevN(t *testing.T) {
 	})
 }
 
+// Ensure that a RefreshableCursor only observes new commits after Refresh.
+func TestCursor_Refresh(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{InitialMmapSize: 1 << 20})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte("root"))
+		require.NoError(t, err)
+		b, err := root.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("a"), []byte("1")))
+		require.NoError(t, b.Put([]byte("b"), []byte("2")))
+		return nil
+	}))
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	c, err := tx.Bucket([]byte("root")).Bucket([]byte("widgets")).RefreshableCursor()
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	k, v := c.First()
+	require.Equal(t, []byte("a"), k)
+	require.Equal(t, []byte("1"), v)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("root")).Bucket([]byte("widgets"))
+		require.NoError(t, b.Delete([]byte("a")))
+		require.NoError(t, b.Put([]byte("b"), []byte("20")))
+		return b.Put([]byte("c"), []byte("3"))
+	}))
+
+	// The old snapshot stays consistent until Refresh.
+	k, v = c.Next()
+	require.Equal(t, []byte("b"), k)
+	require.Equal(t, []byte("2"), v)
+	k, _ = c.Next()
+	require.Nil(t, k)
+
+	require.NoError(t, c.Refresh())
+	var keys, values []string
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		keys = append(keys, string(k))
+		values = append(values, string(v))
+	}
+	require.Equal(t, []string{"b", "c"}, keys)
+	require.Equal(t, []string{"20", "3"}, values)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("root")).DeleteBucket([]byte("widgets"))
+	}))
+	require.Equal(t, bolt.ErrBucketNotFound, c.Refresh())
+	require.NoError(t, c.Close())
+	require.Equal(t, bolt.ErrTxClosed, c.Refresh())
+	require.Empty(t, db.ActiveTxns())
+}
+
 func ExampleCursor() {
 	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
@@ -963,3 +1021,364 @@ func ExampleCursor_reverse() {
 	// A dog is fun.
 	// A cat is lame.
 }
+
+// Ensure that cursors find the same keys with linear and binary search.
+func TestCursor_Seek_LinearSearchThreshold(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	path := db.Path()
+	rnd := rand.New(rand.NewSource(1))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", rnd.Intn(100000))), make([]byte, rnd.Intn(200))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	db.MustClose()
+
+	probes := make([][]byte, 2000)
+	for i := range probes {
+		probes[i] = []byte(fmt.Sprintf("%08d", rnd.Intn(110000)))
+	}
+	seekAll := func(tx *bolt.Tx) []string {
+		var keys []string
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for _, p := range probes {
+			k, _ := c.Seek(p)
+			keys = append(keys, string(k))
+		}
+		return keys
+	}
+
+	var want []string
+	for _, threshold := range []int{0, 8, 64, math.MaxInt32} {
+		db, err := bolt.Open(path, 0666, &bolt.Options{LinearSearchThreshold: threshold})
+		require.NoError(t, err)
+
+		var pages, nodes []string
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			pages = seekAll(tx)
+			return nil
+		}))
+
+		// Search materialized nodes as well as pages.
+		tx, err := db.Begin(true)
+		require.NoError(t, err)
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 5000; i += 7 {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%08d", i*20)), []byte("v")))
+		}
+		nodes = seekAll(tx)
+		require.NoError(t, tx.Rollback())
+		require.NoError(t, db.Close())
+
+		if want == nil {
+			want = append(pages, nodes...)
+			continue
+		}
+		require.Equal(t, want, append(pages, nodes...), "threshold %d", threshold)
+	}
+}
+
+func BenchmarkCursor_Seek_LinearSearchThreshold(b *testing.B) {
+	// Larger values leave fewer elements on each leaf page.
+	for _, vsize := range []int{1000, 200, 50, 0} {
+		for _, threshold := range []int{0, 16, 64, 256} {
+			b.Run(fmt.Sprintf("vsize=%d/threshold=%d", vsize, threshold), func(b *testing.B) {
+				benchmarkCursorSeekLinearSearch(b, vsize, threshold)
+			})
+		}
+	}
+}
+
+func benchmarkCursorSeekLinearSearch(b *testing.B, vsize, threshold int) {
+	const n = 20000
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{LinearSearchThreshold: threshold})
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		bkt.FillPercent = 1.0
+		for i := 0; i < n; i++ {
+			if err := bkt.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, vsize)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	rnd := rand.New(rand.NewSource(1))
+	probes := make([][]byte, 1024)
+	for i := range probes {
+		probes[i] = []byte(fmt.Sprintf("%08d", rnd.Intn(n)))
+	}
+
+	b.ResetTimer()
+	require.NoError(b, db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("bench")).Cursor()
+		for i := 0; i < b.N; i++ {
+			if k, _ := c.Seek(probes[i%len(probes)]); k == nil {
+				b.Fatal("key not found")
+			}
+		}
+		return nil
+	}))
+}
+
+// Ensure that a PrefixCursor stops at the boundaries of its prefix.
+func TestBucket_PrefixCursor(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	keys := []string{"a", "ab", "ab\x00", "abc", "abd", "ab\xff", "ab\xff\xff", "ac", "b", "\xff", "\xff\x01"}
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Put([]byte(k), []byte("v-"+k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	forward := func(c *bolt.PrefixCursor) []string {
+		var got []string
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			require.Equal(t, "v-"+string(k), string(v))
+			got = append(got, string(k))
+		}
+		return got
+	}
+	backward := func(c *bolt.PrefixCursor) []string {
+		var got []string
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			got = append([]string{string(k)}, got...)
+		}
+		return got
+	}
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, tc := range []struct {
+			prefix string
+			want   []string
+		}{
+			{prefix: "ab", want: []string{"ab", "ab\x00", "abc", "abd", "ab\xff", "ab\xff\xff"}},
+			{prefix: "abc", want: []string{"abc"}},
+			{prefix: "a", want: []string{"a", "ab", "ab\x00", "abc", "abd", "ab\xff", "ab\xff\xff", "ac"}},
+			{prefix: "ab\xff", want: []string{"ab\xff", "ab\xff\xff"}},
+			{prefix: "\xff", want: []string{"\xff", "\xff\x01"}},
+			{prefix: "aa", want: nil},
+			{prefix: "c", want: nil},
+			{prefix: "", want: keys},
+		} {
+			c := b.PrefixCursor([]byte(tc.prefix))
+			require.Equal(t, tc.want, forward(c), "prefix %q forward", tc.prefix)
+			require.Equal(t, tc.want, backward(c), "prefix %q backward", tc.prefix)
+		}
+
+		// Once past the boundary the cursor keeps returning nil.
+		c := b.PrefixCursor([]byte("abc"))
+		k, _ := c.First()
+		require.Equal(t, []byte("abc"), k)
+		for i := 0; i < 3; i++ {
+			k, v := c.Next()
+			require.Nil(t, k)
+			require.Nil(t, v)
+		}
+		return nil
+	}))
+}
+
+// Ensure that NextPage lands on the first key of every leaf page in turn.
+func TestCursor_NextPage(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			if err := b.Put(fmt.Appendf(nil, "%05d", i), make([]byte, 50)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+
+		// Find the first key of every leaf page: the keys that have no
+		// previous key on the same page.
+		var want []string
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if _, _, ok := c.PrevSamePage(); ok {
+				c.Next()
+			} else {
+				want = append(want, string(k))
+			}
+		}
+		require.Len(t, want, b.Stats().LeafPageN)
+		require.Greater(t, len(want), 1)
+
+		var got []string
+		k, v := c.First()
+		for ; k != nil; k, v = c.NextPage() {
+			require.Len(t, v, 50)
+			got = append(got, string(k))
+		}
+		require.Equal(t, want, got)
+
+		// Past the last page NextPage keeps returning nil.
+		k, v = c.NextPage()
+		require.Nil(t, k)
+		require.Nil(t, v)
+
+		// From the middle of a page it skips the rest of that page.
+		k, _ = c.Seek([]byte(want[1]))
+		require.Equal(t, want[1], string(k))
+		c.Next()
+		k, _ = c.NextPage()
+		require.Equal(t, want[2], string(k))
+		return nil
+	}))
+}
+
+// Ensure that PrevFrom lands on the last key at or before the sought one.
+func TestCursor_PrevFrom(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket([]byte("empty")); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		k, v := c.PrevFrom([]byte("zzz"))
+		require.Equal(t, []byte("empty"), k)
+		require.Nil(t, v)
+		require.NoError(t, b.DeleteBucket([]byte("empty")))
+		k, v = c.PrevFrom([]byte("zzz"))
+		require.Nil(t, k)
+		require.Nil(t, v)
+
+		for i := 0; i < 10000; i += 2 {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("v%05d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	check := func(b *bolt.Bucket) {
+		c := b.Cursor()
+		for _, tc := range []struct {
+			seek string
+			want string
+		}{
+			{seek: "00000", want: "00000"},
+			{seek: "00001", want: "00000"},
+			{seek: "04242", want: "04242"},
+			{seek: "04243", want: "04242"},
+			{seek: "04243\x00", want: "04242"},
+			{seek: "09998", want: "09998"},
+			{seek: "zzz", want: "09998"},
+			{seek: "", want: ""},
+			{seek: "0", want: ""},
+		} {
+			k, v := c.PrevFrom([]byte(tc.seek))
+			if tc.want == "" {
+				require.Nil(t, k, "seek %q", tc.seek)
+				continue
+			}
+			require.Equal(t, tc.want, string(k), "seek %q", tc.seek)
+			require.Equal(t, "v"+tc.want, string(v), "seek %q", tc.seek)
+		}
+
+		// Every key between two stored ones lands on the lower one, and
+		// iteration continues downwards from there.
+		for i := 1; i < 10000; i += 2 {
+			k, _ := c.PrevFrom([]byte(fmt.Sprintf("%05d", i)))
+			require.Equal(t, fmt.Sprintf("%05d", i-1), string(k))
+		}
+		k, _ := c.PrevFrom([]byte("05001"))
+		require.Equal(t, "05000", string(k))
+		k, _ = c.Prev()
+		require.Equal(t, "04998", string(k))
+	}
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		check(tx.Bucket([]byte("widgets")))
+		return nil
+	}))
+
+	// Pages emptied by deletions within the transaction are skipped.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 2000; i < 8000; i += 2 {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+		}
+		c := b.Cursor()
+		k, _ := c.PrevFrom([]byte("07999"))
+		require.Equal(t, "01998", string(k))
+		k, _ = c.PrevFrom([]byte("08000"))
+		require.Equal(t, "08000", string(k))
+		return nil
+	}))
+}
+
+// Ensure that SeekLast supports descending scans over a half-open range.
+func TestCursor_SeekLast(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("series"))
+		require.NoError(t, err)
+		k, _ := b.Cursor().SeekLast([]byte("t5"))
+		require.Nil(t, k, "empty bucket")
+
+		for i := 1; i <= 9; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("t%d", i)), []byte(fmt.Sprintf("v%d", i))))
+		}
+		sub, err := b.CreateBucket([]byte("t55"))
+		require.NoError(t, err)
+		return sub.Put([]byte("t54"), []byte("inner"))
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("series")).Cursor()
+
+		k, v := c.SeekLast([]byte("t5"))
+		require.Equal(t, "t5", string(k))
+		require.Equal(t, "v5", string(v))
+
+		k, v = c.SeekLast([]byte("t56"))
+		require.Equal(t, "t55", string(k))
+		require.Nil(t, v, "nested bucket")
+
+		k, _ = c.SeekLast([]byte("z"))
+		require.Equal(t, "t9", string(k))
+
+		k, _ = c.SeekLast([]byte("t0"))
+		require.Nil(t, k, "before every key")
+
+		// Scan [t7, t3) newest first, stepping over the nested bucket
+		// without entering it.
+		var got []string
+		for k, _ := c.SeekLast([]byte("t7")); k != nil && string(k) > "t3"; k, _ = c.Prev() {
+			got = append(got, string(k))
+		}
+		require.Equal(t, []string{"t7", "t6", "t55", "t5", "t4"}, got)
+		return nil
+	}))
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"math"
 	"os"
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -18,14 +20,21 @@ import (
 // The largest step that can be taken when remapping the mmap.
 const maxMmapStep = 1 << 30 // 1GB
 
-// The data file format version.
-const version = 2
+// The data file format version. Version 3 added the freelist page checksum,
+// the value flags of leaf pages and the settings stored after bucket headers.
+const version = 3
+
+// version2 is the format version of files written before version 3. They are
+// still read and written, but without the version 3 additions.
+const version2 = 2
 
 const pgidNoFreelist pgid = 0xffffffffffffffff
 
 const freelistMaxSize = 1 * 1024 * 1024
 
-const freelistRegionSize = 8 * freelistMaxSize
+// DefaultFreelistRegionSize is the size in bytes of each of the two freelist
+// regions of a database created without Options.FreelistRegionSize.
+const DefaultFreelistRegionSize = 8 * freelistMaxSize
 
 // IgnoreNoSync specifies whether the NoSync field of a DB is ignored when
 // syncing changes to a file.  This is required as some operating systems,
@@ -38,6 +47,16 @@ const (
 	DefaultMaxBatchSize  int = 1000
 	DefaultMaxBatchDelay     = 10 * time.Millisecond
 	DefaultAllocSize         = 32 * 1024 * 1024
+
+	DefaultWriteCoalesceSize = 1024 * 1024
+
+	DefaultMaxTreeDepthGuard = 64
+
+	DefaultFreelistAutoCompactThreshold = 0.5
+
+	DefaultRebalanceThreshold = 0.25
+
+	DefaultChangesRetention = 10000
 )
 
 // default page size for db is set to the OS page size.
@@ -46,6 +65,10 @@ var defaultPageSize = os.Getpagesize()
 // The time elapsed between consecutive file locking attempts.
 const flockRetryTimeout = 50 * time.Millisecond
 
+// The time elapsed between consecutive checks for open read transactions
+// when closing with a timeout.
+const closeRetryTimeout = 10 * time.Millisecond
+
 // FreelistType is the type of the freelist backend
 type FreelistType string
 
@@ -56,6 +79,22 @@ const (
 	FreelistMapType = FreelistType("hashmap")
 )
 
+// FsyncMode selects which writes of a commit are followed by fdatasync.
+type FsyncMode string
+
+const (
+	// FsyncBoth syncs after writing the data pages and again after writing
+	// the meta page, so the meta page never reaches disk before the data it
+	// points to. This is the default.
+	FsyncBoth = FsyncMode("both")
+	// FsyncMetaOnly only syncs after writing the meta page. It is only safe
+	// on storage that persists writes in the order they were issued.
+	FsyncMetaOnly = FsyncMode("meta-only")
+	// FsyncDataOnly only syncs after writing the data pages. A crash may
+	// lose the last commits, which the next sync makes durable.
+	FsyncDataOnly = FsyncMode("data-only")
+)
+
 // DB represents a collection of buckets persisted to a file on disk.
 // All data access is performed through transactions which can be obtained through the DB.
 // All the functions on DB will return a ErrDatabaseNotOpen if accessed before Open() is called.
@@ -67,11 +106,17 @@ type DB struct {
 	stats Stats
 
 	// When enabled, the database will perform a Check() after every commit.
-	// A panic is issued if the database is in an inconsistent state. This
-	// flag has a large performance impact so it should only be used for
-	// debugging purposes.
+	// A panic is issued if the database is in an inconsistent state, or if
+	// the freelist overflows its region instead of returning
+	// ErrFreelistRegionFull. This flag has a large performance impact so it
+	// should only be used for debugging purposes.
 	StrictMode bool
 
+	// StrictModeReturnsError makes a failed StrictMode check roll the
+	// transaction back and return a *CheckError from Commit instead of
+	// panicking.
+	StrictModeReturnsError bool
+
 	// Setting the NoSync flag will cause the database to skip fsync()
 	// calls after each commit. This can be useful when bulk loading data
 	// into a database and you can restart the bulk load in the event of
@@ -84,6 +129,17 @@ type DB struct {
 	// THIS IS UNSAFE. PLEASE USE WITH CAUTION.
 	NoSync bool
 
+	// FsyncMode selects which of the two writes of a commit, the data pages
+	// and the meta page, are followed by fdatasync. It has no effect when
+	// NoSync is set. See FsyncBoth, FsyncMetaOnly and FsyncDataOnly.
+	FsyncMode FsyncMode
+
+	// When enabled, every page written by a commit is read back from the
+	// data file after syncing and compared with what was written. A
+	// mismatch fails the commit with ErrWriteVerifyFailed. This is useful
+	// on unreliable storage but roughly doubles the I/O of each commit.
+	VerifyWrites bool
+
 	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
 	// dramatic performance degradation if database is large and fragmentation in freelist is common.
 	// The alternative one is using hashmap, it is faster in almost all circumstances
@@ -124,6 +180,13 @@ type DB struct {
 	// of truncate() and fsync() when growing the data file.
 	AllocSize int
 
+	// WriteCoalesceSize is the maximum number of bytes written by a single
+	// write call when committing runs of contiguous dirty pages. Default
+	// value is copied from DefaultWriteCoalesceSize in Open.
+	//
+	// If <=0, every page is written separately.
+	WriteCoalesceSize int
+
 	// Mlock locks database file in memory when set to true.
 	// It prevents major page faults, however used memory can't be reclaimed.
 	//
@@ -132,9 +195,30 @@ type DB struct {
 
 	HardLimitPendingPages int
 
+	// MaxOverflowPages is the maximum number of overflow pages a single
+	// page allocation may have. Committing a node or value that needs
+	// more fails with ErrTooManyOverflowPages.
+	//
+	// If <=0, no limit is enforced.
+	MaxOverflowPages int
+
+	// MaxPendingPages is the maximum number of pages that may be pending
+	// release after a commit. Pages freed by a transaction stay pending
+	// until no read transaction can still see them, so long running readers
+	// make them pile up and the file grow. Committing while more pages than
+	// this, freed by earlier transactions, are pending fails with
+	// ErrTooManyPendingPages and rolls the transaction back. Pages freed by
+	// the committing transaction itself are not counted.
+	//
+	// If <=0, no limit is enforced.
+	MaxPendingPages int
+
 	path     string
 	openFile func(string, int, os.FileMode) (*os.File, error)
 	file     *os.File
+	// closeFile is set unless the file was given to OpenFile without
+	// Options.CloseFile.
+	closeFile bool
 	// `dataref` isn't used at all on Windows, and the golangci-lint
 	// always fails on Windows platform.
 	//nolint
@@ -149,26 +233,121 @@ type DB struct {
 	rwtx     *Tx
 	txs      []*Tx
 
+	// backupPins holds the snapshots of backups in progress. See
+	// DB.BackupSnapshot.
+	backupPins []*backupPin
+
+	// fastEpoch points to the fastEpoch that DB.GetFast reads, or is nil
+	// while the file is not mapped. fastRetired holds the epochs replaced by
+	// later commits, which may still have readers, protected by rwlock.
+	fastEpoch   unsafe.Pointer
+	fastRetired []*fastEpoch
+
 	freelist     *freelist
 	freelistLoad sync.Once
 
-	pagePool sync.Pool
+	pagePool     sync.Pool
+	pagePoolSize int // size of the buffers in pagePool
 
 	batchMu sync.Mutex
 	batch   *batch
 
+	filters map[string]*bloomFilter // Bloom filters of top-level buckets, copied on write.
+
+	freeRuns []freeRun // runs of free pages as of the last write transaction, protected by statlock
+
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
 	statlock sync.RWMutex // Protects stats access.
 
 	ops struct {
-		writeAt func(b []byte, off int64) (n int, err error)
+		writeAt   func(b []byte, off int64) (n int, err error)
+		fdatasync func(db *DB) error
+
+		// readPage is called with the id of every page a transaction reads.
+		readPage func(id pgid)
 	}
 
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
+
+	// copyOnWriteMmap maps the data file privately and writable, so that
+	// stray writes through returned slices never reach the file.
+	copyOnWriteMmap bool
+
+	// linearSearchThreshold is the element count below which cursors scan
+	// pages and nodes linearly instead of using binary search.
+	linearSearchThreshold int
+
+	// allocAlignment is the byte alignment of buffers allocated for
+	// multi-page writes. Zero or one means no alignment.
+	allocAlignment int
+
+	// allowEmptyKeys lets Put store a zero-length key.
+	allowEmptyKeys bool
+
+	// autoCompactStop is closed to stop the freelist compactor, which
+	// closes autoCompactDone once it has exited. Both are nil when the
+	// compactor is not running.
+	autoCompactInterval  time.Duration
+	autoCompactThreshold float64
+	autoCompactStop      chan struct{}
+	autoCompactDone      chan struct{}
+
+	// inlineBucketMaxSize is the largest size, in bytes, that a nested
+	// bucket may have and still be stored inline in its parent.
+	inlineBucketMaxSize int
+
+	// txMemoryBudget is the most memory, in bytes, a write transaction may
+	// hold in nodes and dirty pages. Zero means no limit.
+	txMemoryBudget int
+
+	// batchFree makes the freelist batch the pages freed by a write
+	// transaction. See Options.BatchFree.
+	batchFree bool
+
+	// rebalanceThreshold is the fill, as a fraction of the page size, below
+	// which a node is merged with a sibling. See Options.RebalanceThreshold.
+	rebalanceThreshold float64
+
+	// onRemap is called after the file is remapped to grow the database.
+	onRemap func(oldSize, newSize int)
+
+	// mutationLog receives the records of committed changes. It is only
+	// written by commits, while they hold the writer lock, which also
+	// guards mutationLogErr, the first failed write. See ErrMutationLogWrite.
+	mutationLog    io.Writer
+	mutationLogErr error
+
+	// freelistRegionSize is the size in bytes of each of the two freelist
+	// regions, as recorded in the meta pages.
+	freelistRegionSize int
+
+	// changes holds the txid of the last change to each key, by bucket,
+	// changesDropped the txid of the last deletion of each bucket, and
+	// changesFrom the first txid they cover. Older changes are forgotten
+	// once they fall changesRetention transactions behind. It is only kept
+	// along with mutationLog, and guarded by changesMu. See
+	// Bucket.ChangedSince.
+	changes          map[string]map[string]txid
+	changesDropped   map[string]txid
+	changesFrom      txid
+	changesRetention int
+	changesMu        sync.RWMutex
+
+	// skipFreelist is set when a read-only database was opened without
+	// loading the freelist. It is loaded on demand by Tx.Check.
+	skipFreelist bool
+
+	// maxTreeDepth is the deepest a B+tree may be walked before the walk
+	// gives up with ErrTreeTooDeep.
+	maxTreeDepth int
+
+	// closeTimeout is the maximum time Close waits for open read
+	// transactions. Zero means wait indefinitely.
+	closeTimeout time.Duration
 }
 
 // Path returns the path to currently open database file.
@@ -190,23 +369,87 @@ func (db *DB) String() string {
 // If the file does not exist then it will be created automatically.
 // Passing in nil options will cause Bolt to open the database with the default options.
 func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
+	return open(path, mode, nil, options)
+}
+
+// OpenFile opens a database from a file that is already open, for sandboxed
+// environments that are handed file descriptors rather than paths. The file
+// must be open for reading, and for writing too unless options.ReadOnly is
+// set. An empty file is initialized as a new database. The file is left open
+// by DB.Close unless options.CloseFile is set, and on errors likewise.
+//
+// The file's name is used as the database path, so methods that open the
+// database file again by path, such as Tx.WriteTo and DB.Compact, only work
+// if the name still refers to it.
+func OpenFile(f *os.File, options *Options) (*DB, error) {
+	return open(f.Name(), 0, f, options)
+}
+
+// open implements Open and OpenFile, using f if it is not nil instead of
+// opening path.
+func open(path string, mode os.FileMode, f *os.File, options *Options) (*DB, error) {
 	db := &DB{
-		opened: true,
+		opened:    true,
+		closeFile: true,
 	}
 	// Set default options if no options are provided.
 	if options == nil {
 		options = DefaultOptions
 	}
 	db.NoSync = options.NoSync
+	db.VerifyWrites = options.VerifyWrites
+	db.MaxOverflowPages = options.MaxOverflowPages
+	db.MaxPendingPages = options.MaxPendingPages
+	db.StrictModeReturnsError = options.StrictModeReturnsError
 	db.NoGrowSync = options.NoGrowSync
 	db.MmapFlags = options.MmapFlags
+	if options.MmapPopulate {
+		db.MmapFlags |= mmapPopulateFlag
+	}
 	db.FreelistType = options.FreelistType
+	switch options.FsyncMode {
+	case "", FsyncBoth:
+		db.FsyncMode = FsyncBoth
+	case FsyncMetaOnly, FsyncDataOnly:
+		db.FsyncMode = options.FsyncMode
+	default:
+		return nil, fmt.Errorf("invalid fsync mode: %q", options.FsyncMode)
+	}
 	db.Mlock = options.Mlock
+	db.closeTimeout = options.CloseTimeout
+	db.linearSearchThreshold = options.LinearSearchThreshold
+	db.copyOnWriteMmap = options.CopyOnWriteMmap
+	db.allocAlignment = options.AllocAlignment
+	db.allowEmptyKeys = options.AllowEmptyKeys
+	db.mutationLog = options.MutationLog
+	db.changesRetention = options.ChangesRetention
+	if db.changesRetention <= 0 {
+		db.changesRetention = DefaultChangesRetention
+	}
+	db.onRemap = options.OnRemap
+	db.txMemoryBudget = options.TxMemoryBudget
+	db.batchFree = options.BatchFree
+	db.rebalanceThreshold = options.RebalanceThreshold
+	if db.rebalanceThreshold == 0 {
+		db.rebalanceThreshold = DefaultRebalanceThreshold
+	} else if db.rebalanceThreshold < 0 || db.rebalanceThreshold > 0.5 {
+		return nil, fmt.Errorf("invalid rebalance threshold %v", options.RebalanceThreshold)
+	}
+	db.autoCompactInterval = options.FreelistAutoCompact
+	db.autoCompactThreshold = options.FreelistAutoCompactThreshold
+	if db.autoCompactThreshold == 0 {
+		db.autoCompactThreshold = DefaultFreelistAutoCompactThreshold
+	}
+	db.maxTreeDepth = options.MaxTreeDepthGuard
+	if db.maxTreeDepth <= 0 {
+		db.maxTreeDepth = DefaultMaxTreeDepthGuard
+	}
 
 	// Set default values for later DB operations.
 	db.MaxBatchSize = DefaultMaxBatchSize
 	db.MaxBatchDelay = DefaultMaxBatchDelay
 	db.AllocSize = DefaultAllocSize
+	db.WriteCoalesceSize = DefaultWriteCoalesceSize
 	db.HardLimitPendingPages = freelistMaxSize / 2
 
 	flag := os.O_RDWR
@@ -222,7 +465,9 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 
 	// Open data file and separate sync handler for metadata writes.
 	var err error
-	if db.file, err = db.openFile(path, flag|os.O_CREATE, mode); err != nil {
+	if f != nil {
+		db.file, db.closeFile = f, options.CloseFile
+	} else if db.file, err = db.openFile(path, flag|os.O_CREATE, mode); err != nil {
 		_ = db.close()
 		return nil, err
 	}
@@ -242,17 +487,27 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 
 	// Default values for test hooks
 	db.ops.writeAt = db.file.WriteAt
+	db.ops.fdatasync = fdatasync
 
 	if db.pageSize = options.PageSize; db.pageSize == 0 {
 		// Set the default page size to the OS page size.
 		db.pageSize = defaultPageSize
 	}
+	if db.freelistRegionSize = options.FreelistRegionSize; db.freelistRegionSize == 0 {
+		db.freelistRegionSize = DefaultFreelistRegionSize
+	}
 
 	// Initialize the database if it doesn't exist.
 	if info, err := db.file.Stat(); err != nil {
 		_ = db.close()
 		return nil, err
 	} else if info.Size() == 0 {
+		// The freelist regions must hold at least the empty freelist page.
+		if size := options.FreelistRegionSize; size != 0 && (size < db.pageSize || size%db.pageSize != 0 || uint64(size/db.pageSize) > math.MaxUint32) {
+			_ = db.close()
+			return nil, fmt.Errorf("invalid freelist region size %d for page size %d", size, db.pageSize)
+		}
+
 		// Initialize new files with meta pages.
 		if err := db.init(); err != nil {
 			// clean up file descriptor on initialization fail
@@ -269,10 +524,25 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		}
 	}
 
-	// Initialize page pool.
+	// An inline bucket lives inside its parent's leaf page, so it may take at
+	// most half of it.
+	switch size := options.InlineBucketMaxSize; {
+	case size == 0:
+		db.inlineBucketMaxSize = db.pageSize / 4
+	case size > 0 && size <= db.pageSize/2:
+		db.inlineBucketMaxSize = size
+	default:
+		_ = db.close()
+		return nil, fmt.Errorf("invalid inline bucket max size %d for page size %d", size, db.pageSize)
+	}
+
+	// Initialize page pool. The pool belongs to this DB and only ever holds
+	// buffers of its page size.
+	pagePoolSize := db.pageSize
+	db.pagePoolSize = pagePoolSize
 	db.pagePool = sync.Pool{
 		New: func() interface{} {
-			return make([]byte, db.pageSize)
+			return make([]byte, pagePoolSize)
 		},
 	}
 
@@ -281,17 +551,85 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		_ = db.close()
 		return nil, err
 	}
+	db.freelistRegionSize = db.meta().regionSize()
 
-	db.loadFreelist()
+	// Read-only tooling may not need the freelist at all.
+	db.skipFreelist = db.readOnly && options.ReadOnlyNoFreelist
+	if !db.skipFreelist {
+		// Verify the freelist before trusting it for allocations.
+		if db.meta().freelistChecksum() {
+			if err := db.freelistPage().verifyFreelistChecksum(db.freelistRegionSize); err != nil {
+				_ = db.close()
+				return nil, err
+			}
+		}
+
+		db.loadFreelist()
+	}
+
+	// Fail fast on an inconsistent database if asked to.
+	if options.CheckOnOpen {
+		if err := db.checkOnOpen(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
 
 	if db.readOnly {
 		return db, nil
 	}
 
+	// Move the transaction id forward if the file is older than expected.
+	if options.MinTxID > 0 && uint64(db.meta().txid) < options.MinTxID {
+		if err := db.advanceTxID(txid(options.MinTxID)); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
+	// Track the keys changed from here on for Bucket.ChangedSince.
+	if db.mutationLog != nil {
+		db.changes = make(map[string]map[string]txid)
+		db.changesDropped = make(map[string]txid)
+		db.changesFrom = db.meta().txid + 1
+	}
+
+	db.startAutoCompact()
+
 	// Mark the database as opened and return.
 	return db, nil
 }
 
+// checkOnOpen runs Tx.Check in a read-only transaction and returns a
+// *CheckError holding everything it reported, if anything.
+func (db *DB) checkOnOpen() error {
+	var errs []error
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &CheckError{Errors: errs}
+	}
+	return nil
+}
+
+// advanceTxID commits an empty transaction with the given id.
+func (db *DB) advanceTxID(id txid) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if tx.meta.txid < id {
+		tx.meta.txid = id
+	}
+	return tx.Commit()
+}
+
 // getPageSize reads the pageSize from the meta pages. It tries
 // to read the first meta page firstly. If the first page is invalid,
 // then it tries to read the second page using the default page size.
@@ -388,8 +726,12 @@ func (db *DB) getPageSizeFromSecondMeta() (int, bool, error) {
 func (db *DB) loadFreelist() {
 	db.freelistLoad.Do(func() {
 		db.freelist = newFreelist(db.FreelistType)
+		db.freelist.batchFree = db.batchFree
+		db.freelist.checksum = db.meta().freelistChecksum()
 		db.freelist.read(db.freelistPage())
 		db.stats.FreePageN = db.freelist.free_count()
+		db.freeRuns = db.freelist.runs()
+		db.stats.FreeRunN = len(db.freeRuns)
 	})
 }
 
@@ -471,6 +813,7 @@ func (db *DB) mmap(minsz int) (err error) {
 		return err0
 	}
 
+	db.publishFastEpoch(db.meta())
 	return nil
 }
 
@@ -486,6 +829,7 @@ func (db *DB) invalidate() {
 // munmap unmaps the data file from memory.
 func (db *DB) munmap() error {
 	defer db.invalidate()
+	db.drainFastEpochs()
 
 	// gofail: var unmapError string
 	// return errors.New(unmapError)
@@ -564,8 +908,9 @@ func (db *DB) mrelock(fileSizeFrom, fileSizeTo int) error {
 // init creates a new database file and initializes its meta pages.
 func (db *DB) init() error {
 	// Create two meta pages on a buffer.
-	buf := make([]byte, db.pageSize*2+freelistRegionSize*2+db.pageSize)
-	root := 2 + pgid(freelistRegionSize*2/db.pageSize)
+	regionPages := pgid(db.freelistRegionSize / db.pageSize)
+	buf := make([]byte, db.pageSize*2+db.freelistRegionSize*2+db.pageSize)
+	root := 2 + pgid(db.freelistRegionSize*2/db.pageSize)
 	for i := 0; i < 2; i++ {
 		p := db.pageInBuffer(buf, pgid(i))
 		p.id = pgid(i)
@@ -576,6 +921,9 @@ func (db *DB) init() error {
 		m.magic = internal.Magic
 		m.version = version
 		m.pageSize = uint32(db.pageSize)
+		if db.freelistRegionSize != DefaultFreelistRegionSize {
+			m.flpages = uint32(regionPages)
+		}
 		m.flid = 0
 		m.root = bucket{root: root}
 		m.pgid = root + 1
@@ -588,13 +936,15 @@ func (db *DB) init() error {
 	p.id = pgid(2)
 	p.flags = freelistPageFlag
 	p.count = 0
-	p.overflow = freelistRegionSize/uint32(db.pageSize) - 1
+	p.overflow = uint32(regionPages) - 1
+	p.setFreelistChecksum()
 
-	p = db.pageInBuffer(buf, pgid(2)+freelistRegionSize/pgid(db.pageSize))
-	p.id = pgid(2) + freelistRegionSize/pgid(db.pageSize)
+	p = db.pageInBuffer(buf, 2+regionPages)
+	p.id = 2 + regionPages
 	p.flags = freelistPageFlag
 	p.count = 0
-	p.overflow = freelistRegionSize/uint32(db.pageSize) - 1
+	p.overflow = uint32(regionPages) - 1
+	p.setFreelistChecksum()
 
 	// Write an empty leaf page at page `root`.
 	p = db.pageInBuffer(buf, root)
@@ -606,7 +956,7 @@ func (db *DB) init() error {
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
 	}
-	if err := fdatasync(db); err != nil {
+	if err := db.ops.fdatasync(db); err != nil {
 		return err
 	}
 	db.filesz = len(buf)
@@ -617,11 +967,26 @@ func (db *DB) init() error {
 // Close releases all database resources.
 // It will block waiting for any open transactions to finish
 // before closing the database and returning.
+//
+// If Options.CloseTimeout was set and read transactions are still open
+// after the timeout, ErrCloseTimeout is returned and the database is
+// left open and fully usable.
 func (db *DB) Close() error {
+	// Stop the freelist compactor before taking the writer lock it may be
+	// waiting for.
+	db.stopAutoCompact()
+
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
-	db.metalock.Lock()
+	if db.closeTimeout > 0 {
+		if err := db.waitReadTxs(db.closeTimeout); err != nil {
+			db.startAutoCompact()
+			return err
+		}
+	} else {
+		db.metalock.Lock()
+	}
 	defer db.metalock.Unlock()
 
 	db.mmaplock.Lock()
@@ -630,6 +995,68 @@ func (db *DB) Close() error {
 	return db.close()
 }
 
+// startAutoCompact starts the freelist compactor if Options.FreelistAutoCompact
+// was set.
+func (db *DB) startAutoCompact() {
+	if db.autoCompactInterval <= 0 || db.readOnly {
+		return
+	}
+	db.autoCompactStop = make(chan struct{})
+	db.autoCompactDone = make(chan struct{})
+	go db.autoCompact(db.autoCompactStop, db.autoCompactDone)
+}
+
+// stopAutoCompact stops the freelist compactor, if running, and waits for it
+// to exit.
+func (db *DB) stopAutoCompact() {
+	if db.autoCompactStop == nil {
+		return
+	}
+	close(db.autoCompactStop)
+	<-db.autoCompactDone
+	db.autoCompactStop, db.autoCompactDone = nil, nil
+}
+
+// autoCompact calls RewriteFreelist every autoCompactInterval while the
+// freelist is more fragmented than autoCompactThreshold. Errors are ignored;
+// the next tick simply tries again.
+func (db *DB) autoCompact(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(db.autoCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if db.FreelistFragmentation() > db.autoCompactThreshold {
+				_, _ = db.RewriteFreelist()
+			}
+		}
+	}
+}
+
+// waitReadTxs polls until no read transactions are open and returns with
+// the meta lock held. If the timeout elapses first, ErrCloseTimeout is
+// returned and the meta lock is not held.
+func (db *DB) waitReadTxs(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		db.metalock.Lock()
+		// Read transactions are removed from db.txs only after releasing
+		// their mmap read lock, so an empty list means mmaplock is free.
+		if len(db.txs) == 0 {
+			return nil
+		}
+		db.metalock.Unlock()
+
+		if time.Now().After(deadline) {
+			return ErrCloseTimeout
+		}
+		time.Sleep(closeRetryTimeout)
+	}
+}
+
 func (db *DB) close() error {
 	if !db.opened {
 		return nil
@@ -650,8 +1077,8 @@ func (db *DB) close() error {
 
 	// Close file handles.
 	if db.file != nil {
-		// No need to unlock read-only file.
-		if !db.readOnly {
+		// No need to unlock read-only file, unless it stays open.
+		if !db.readOnly || !db.closeFile {
 			// Unlock the file.
 			if err := funlock(db); err != nil {
 				errs = append(errs, fmt.Errorf("bolt.Close(): funlock error: %w", err))
@@ -659,8 +1086,10 @@ func (db *DB) close() error {
 		}
 
 		// Close the file descriptor.
-		if err := db.file.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("db file close: %w", err))
+		if db.closeFile {
+			if err := db.file.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("db file close: %w", err))
+			}
 		}
 		db.file = nil
 	}
@@ -752,6 +1181,12 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	// This enforces only one writer transaction at a time.
 	db.rwlock.Lock()
 
+	// Refuse to commit changes that could not be logged.
+	if err := db.mutationLogErr; err != nil {
+		db.rwlock.Unlock()
+		return nil, err
+	}
+
 	// If we are having a lot of pending pages, return a temporary error (caller can retry later).
 	if stats := db.Stats(); stats.FreePageN+stats.PendingPageN > db.HardLimitPendingPages {
 		db.rwlock.Unlock()
@@ -779,28 +1214,76 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	t := &Tx{writable: true}
 	t.init(db)
 	db.rwtx = t
-	db.freePages()
+	t.reclaimed = db.freePages()
 	return t, nil
 }
 
-// freePages releases any pages associated with closed read-only transactions.
-func (db *DB) freePages() {
-	// Free all pending pages prior to earliest open transaction.
+// freePages releases any pages associated with closed read-only transactions
+// and returns how many pending pages it released.
+func (db *DB) freePages() int {
+	pending := db.freelist.pending_count()
+
+	// Backups in progress need the pages of their snapshot like readers.
 	sort.Sort(txsById(db.txs))
+	readers := make([]txid, 0, len(db.txs)+len(db.backupPins)+len(db.fastRetired))
+	for _, t := range db.txs {
+		readers = append(readers, t.meta.txid)
+	}
+	for _, id := range db.pruneFastEpochs() {
+		readers = append(readers, id)
+	}
+	for _, pin := range db.backupPins {
+		readers = append(readers, pin.txid)
+	}
+	sort.Slice(readers, func(i, j int) bool { return readers[i] < readers[j] })
+
+	// Free all pending pages prior to earliest open transaction.
 	minid := txid(0xFFFFFFFFFFFFFFFF)
-	if len(db.txs) > 0 {
-		minid = db.txs[0].meta.txid
+	if len(readers) > 0 {
+		minid = readers[0]
 	}
 	if minid > 0 {
 		db.freelist.release(minid - 1)
 	}
 	// Release unused txid extents.
-	for _, t := range db.txs {
-		db.freelist.releaseRange(minid, t.meta.txid-1)
-		minid = t.meta.txid + 1
+	for _, id := range readers {
+		db.freelist.releaseRange(minid, id-1)
+		minid = id + 1
 	}
 	db.freelist.releaseRange(minid, txid(0xFFFFFFFFFFFFFFFF))
 	// Any page both allocated and freed in an extent is safe to release.
+
+	// A backup only needs the pages of its snapshot it has not copied yet,
+	// so release those outside of them that only it was holding back.
+	for _, pin := range db.backupPins {
+		minid, skipped := txid(0), false
+		for _, id := range readers {
+			if id == pin.txid && !skipped {
+				skipped = true
+				continue
+			}
+			db.freelist.releaseRangeOutside(minid, id-1, pin.copied, pin.hwm)
+			minid = id + 1
+		}
+		db.freelist.releaseRangeOutside(minid, txid(0xFFFFFFFFFFFFFFFF), pin.copied, pin.hwm)
+	}
+
+	return pending - db.freelist.pending_count()
+}
+
+// ReclaimPending commits an empty write transaction, which releases the
+// pages still pending from transactions no open reader can see anymore, and
+// returns how many pages were released. Pages freed while a long running
+// reader was open otherwise stay pending until the next write transaction
+// begins, so calling it once such a reader closes makes their space
+// available right away, and visible in Stats.
+func (db *DB) ReclaimPending() (int, error) {
+	var n int
+	err := db.Update(func(tx *Tx) error {
+		n = tx.reclaimed
+		return nil
+	})
+	return n, err
 }
 
 type txsById []*Tx
@@ -836,9 +1319,36 @@ func (db *DB) removeTx(tx *Tx) {
 	db.statlock.Lock()
 	db.stats.OpenTxN = n
 	db.stats.TxStats.add(&tx.stats)
+	db.stats.TxStats.add(&tx.statsReset)
 	db.statlock.Unlock()
 }
 
+// ActiveTxns returns information about every open transaction, ordered by
+// transaction id. It is intended for diagnosing long-running readers that
+// prevent pages from being reclaimed.
+func (db *DB) ActiveTxns() []TxnInfo {
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	now := time.Now()
+	infos := make([]TxnInfo, 0, len(db.txs)+1)
+	for _, t := range db.txs {
+		infos = append(infos, TxnInfo{ID: int(t.meta.txid), Age: now.Sub(t.start)})
+	}
+	if t := db.rwtx; t != nil {
+		infos = append(infos, TxnInfo{ID: int(t.meta.txid), Writable: true, Age: now.Sub(t.start)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// TxnInfo describes an open transaction.
+type TxnInfo struct {
+	ID       int           // transaction id, as returned by Tx.ID()
+	Writable bool          // whether the transaction is the writer
+	Age      time.Duration // time elapsed since the transaction began
+}
+
 // Update executes a function within the context of a read-write managed transaction.
 // If no error is returned from the function then the transaction is committed.
 // If an error is returned then the entire transaction is rolled back.
@@ -904,6 +1414,195 @@ func (db *DB) View(fn func(*Tx) error) error {
 	return t.Rollback()
 }
 
+// GetAsOf returns a copy of the value of key in the top-level bucket as of
+// the committed transaction with the given id, or nil if the key did not
+// exist then. Besides the latest transaction, only the one before it can be
+// read, from the other meta page, and only while the pages the latest
+// transaction replaced are still pending release; that is, until the next
+// write transaction starts with no read transaction holding them. Otherwise
+// ErrSnapshotExpired is returned.
+func (db *DB) GetAsOf(id int, bucket, key []byte) ([]byte, error) {
+	tx, err := db.beginAsOf(txid(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	b, err := tx.OpenBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	return cloneBytes(v), nil
+}
+
+// GetFast returns a copy of the value of key in the top-level bucket as of
+// the latest committed transaction, or nil if the key does not exist. It is
+// a point lookup for read-heavy workloads that skips the bookkeeping of a
+// read transaction: instead of taking the locks of Begin, it enters the
+// epoch of the latest commit with an atomic counter, which writers check
+// before reusing pages the snapshot may need and before remapping the file.
+// The lookup is not tracked by Stats or ActiveTxns. While the file is being
+// remapped it waits like Begin.
+func (db *DB) GetFast(bucket, key []byte) ([]byte, error) {
+	e := db.enterFastEpoch()
+	if e == nil {
+		return db.getFastLocked(bucket, key)
+	}
+	defer atomic.AddInt64(&e.readers, -1)
+
+	// Filters are left out: the lookup doesn't need them, and they are
+	// swapped under the meta lock.
+	tx := Tx{db: db, meta: &e.meta}
+	tx.root = newBucket(&tx)
+	root := tx.meta.root
+	tx.root.bucket = &root
+	return tx.getCopy(bucket, key)
+}
+
+// getFastLocked is GetFast in a read transaction, for when no epoch is
+// published.
+func (db *DB) getFastLocked(bucket, key []byte) ([]byte, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	return tx.getCopy(bucket, key)
+}
+
+// getCopy returns a copy of the value of key in the top-level bucket, or nil
+// if the key does not exist.
+func (tx *Tx) getCopy(bucket, key []byte) ([]byte, error) {
+	b, err := tx.OpenBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	return cloneBytes(v), nil
+}
+
+// fastEpoch is the snapshot of a commit as read by DB.GetFast. A reader
+// enters it by incrementing readers and then checking that it is still the
+// published epoch; a writer replaces it and then checks readers. With both
+// steps atomic, either the reader sees the replacement and leaves, or the
+// writer sees the reader.
+type fastEpoch struct {
+	readers int64
+	meta    meta
+}
+
+// enterFastEpoch enters the published epoch, or returns nil if there is none.
+// The caller leaves it by decrementing its readers.
+func (db *DB) enterFastEpoch() *fastEpoch {
+	for {
+		e := (*fastEpoch)(atomic.LoadPointer(&db.fastEpoch))
+		if e == nil {
+			return nil
+		}
+		atomic.AddInt64(&e.readers, 1)
+		if atomic.LoadPointer(&db.fastEpoch) == unsafe.Pointer(e) {
+			return e
+		}
+		atomic.AddInt64(&e.readers, -1)
+	}
+}
+
+// publishFastEpoch makes m, which must be committed and mapped, the snapshot
+// read by DB.GetFast. The epoch it replaces is kept until its readers leave.
+func (db *DB) publishFastEpoch(m *meta) {
+	e := &fastEpoch{}
+	m.copy(&e.meta)
+	if old := atomic.SwapPointer(&db.fastEpoch, unsafe.Pointer(e)); old != nil {
+		db.fastRetired = append(db.fastRetired, (*fastEpoch)(old))
+	}
+}
+
+// pruneFastEpochs drops the retired epochs without readers and returns the
+// txids of the others, whose pages must not be reused yet.
+func (db *DB) pruneFastEpochs() []txid {
+	var ids []txid
+	retired := db.fastRetired[:0]
+	for _, e := range db.fastRetired {
+		if atomic.LoadInt64(&e.readers) > 0 {
+			retired = append(retired, e)
+			ids = append(ids, e.meta.txid)
+		}
+	}
+	for i := len(retired); i < len(db.fastRetired); i++ {
+		db.fastRetired[i] = nil
+	}
+	db.fastRetired = retired
+	return ids
+}
+
+// drainFastEpochs unpublishes the epoch and waits for the readers of every
+// epoch to leave, so that the file can be unmapped. GetFast falls back to a
+// read transaction until the next epoch is published.
+func (db *DB) drainFastEpochs() {
+	if old := atomic.SwapPointer(&db.fastEpoch, nil); old != nil {
+		db.fastRetired = append(db.fastRetired, (*fastEpoch)(old))
+	}
+	for _, e := range db.fastRetired {
+		for atomic.LoadInt64(&e.readers) > 0 {
+			runtime.Gosched()
+		}
+	}
+	db.fastRetired = nil
+}
+
+// beginAsOf starts a read-only transaction on the snapshot of the committed
+// transaction id.
+func (db *DB) beginAsOf(id txid) (*Tx, error) {
+	// Hold off writers, which may release pending pages and overwrite the
+	// older meta page.
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	tx, err := db.beginTx()
+	if err != nil {
+		return nil, err
+	}
+	cur := tx.meta.txid
+	if id == cur {
+		return tx, nil
+	} else if id > cur {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf("transaction %d not committed yet", id)
+	}
+
+	var old *meta
+	for _, m := range []*meta{db.meta0, db.meta1} {
+		if m.txid == id && m.validate() == nil {
+			old = m
+		}
+	}
+
+	// The snapshot is intact if it shares the current root, or if none of
+	// its pages that the current transaction freed has been released. Once
+	// the transaction is registered under the older id, they stay pending.
+	intact := old != nil && (old.root.root == tx.meta.root.root ||
+		(db.freelist != nil && db.freelist.retainsFreed(cur, id)))
+	if !intact {
+		_ = tx.Rollback()
+		return nil, ErrSnapshotExpired
+	}
+
+	db.metalock.Lock()
+	old.copy(tx.meta)
+	db.metalock.Unlock()
+	*tx.root.bucket = tx.meta.root
+	// Bloom filters describe the latest state only.
+	tx.filters = nil
+	return tx, nil
+}
+
 // Batch calls fn as part of a batch. It behaves similar to Update,
 // except:
 //
@@ -1036,7 +1735,7 @@ func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
 //
 // This is not necessary under normal operation, however, if you use NoSync
 // then it allows you to force the database file to sync against the disk.
-func (db *DB) Sync() error { return fdatasync(db) }
+func (db *DB) Sync() error { return db.ops.fdatasync(db) }
 
 // Stats retrieves ongoing performance stats for the database.
 // This is only updated when a transaction closes.
@@ -1046,6 +1745,36 @@ func (db *DB) Stats() Stats {
 	return db.stats
 }
 
+// FreelistFragmentation returns how fragmented the free pages are, as the
+// number of contiguous runs of free pages divided by the number of free
+// pages. It approaches 1.0 when every free page stands alone and is small
+// when free space is coalesced into long runs, which large allocations can
+// use; it is zero when there are no free pages. Like Stats, it reflects the
+// freelist as of the last write transaction.
+func (db *DB) FreelistFragmentation() float64 {
+	db.statlock.RLock()
+	defer db.statlock.RUnlock()
+	if db.stats.FreePageN == 0 {
+		return 0
+	}
+	return float64(db.stats.FreeRunN) / float64(db.stats.FreePageN)
+}
+
+// ForEachFreeRun calls fn for each contiguous run of free pages on the
+// freelist, in page order, with the id of its first page and its length.
+// Pages still pending release by open read transactions are not included.
+// Like Stats, it reflects the freelist as of the last write transaction;
+// fn is called on a snapshot, so it may start transactions of its own.
+func (db *DB) ForEachFreeRun(fn func(start, count int)) {
+	db.statlock.RLock()
+	runs := db.freeRuns
+	db.statlock.RUnlock()
+
+	for _, r := range runs {
+		fn(int(r.start), int(r.count))
+	}
+}
+
 // This is for internal access to the raw data bytes from the C cursor, use
 // carefully, or not at all.
 func (db *DB) Info() *Info {
@@ -1053,6 +1782,17 @@ func (db *DB) Info() *Info {
 	return &Info{uintptr(unsafe.Pointer(&db.data[0])), db.pageSize}
 }
 
+// EncodingInfo returns the hard limits of the file format, so that
+// applications can check their keys and values against them at startup.
+func (db *DB) EncodingInfo() EncodingInfo {
+	return EncodingInfo{
+		MaxKeySize:    MaxKeySize,
+		MaxValueSize:  MaxValueSize,
+		MaxPageOffset: maxLeafPos,
+		SpareFlagBits: 64 - leafFlagBits - leafPosBits - leafKsizeBits - leafVsizeBits,
+	}
+}
+
 // page retrieves a page reference from the mmap based on the current page size.
 func (db *DB) page(id pgid) *page {
 	pos := id * pgid(db.pageSize)
@@ -1107,14 +1847,69 @@ func ReadTxID(buf []byte) uint64 {
 	panic("bolt.DB.meta(): invalid meta pages")
 }
 
+// DBInfo describes a database file as recorded in its current meta page.
+type DBInfo struct {
+	PageSize           int    // page size the database was created with
+	TxID               uint64 // id of the last committed transaction
+	FreelistRegionSize int    // size in bytes of each of the two freelist regions
+	Root               uint64 // page id of the root bucket
+	Size               int64  // bytes in use below the high water mark
+}
+
+// ReadInfo reads the meta pages of the database file at path and returns the
+// details recorded in the current one. The file is opened read-only and is not
+// locked, mapped or otherwise opened as a DB, so this is cheap enough to scan
+// many files and works while another process has the database open. Returns
+// ErrInvalid, ErrVersionMismatch or ErrChecksum if neither meta page is valid.
+func ReadInfo(path string) (*DBInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &DB{file: f, pageSize: defaultPageSize}
+	if db.pageSize, err = db.getPageSize(); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 2*db.pageSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	metaA, metaB := db.pageInBuffer(buf, 0).meta(), db.pageInBuffer(buf, 1).meta()
+	if metaB.txid > metaA.txid {
+		metaA, metaB = metaB, metaA
+	}
+	m := metaA
+	if err := metaA.validate(); err != nil {
+		if metaB.validate() != nil {
+			return nil, err
+		}
+		m = metaB
+	}
+
+	return &DBInfo{
+		PageSize:           int(m.pageSize),
+		TxID:               uint64(m.txid),
+		FreelistRegionSize: m.regionSize(),
+		Root:               uint64(m.root.root),
+		Size:               int64(m.pgid) * int64(m.pageSize),
+	}, nil
+}
+
 // allocate returns a contiguous block of memory starting at a given page.
 func (db *DB) allocate(txid txid, count int) (*page, error) {
+	if db.MaxOverflowPages > 0 && count-1 > db.MaxOverflowPages {
+		return nil, ErrTooManyOverflowPages
+	}
+
 	// Allocate a temporary buffer for the page.
 	var buf []byte
 	if count == 1 {
-		buf = db.pagePool.Get().([]byte)
+		buf = db.getPageBuffer()
 	} else {
-		buf = make([]byte, count*db.pageSize)
+		buf = db.allocBuffer(count * db.pageSize)
 	}
 	p := (*page)(unsafe.Pointer(&buf[0]))
 	p.overflow = uint32(count - 1)
@@ -1128,9 +1923,17 @@ func (db *DB) allocate(txid txid, count int) (*page, error) {
 	p.id = db.rwtx.meta.pgid
 	var minsz = int((p.id+pgid(count))+1) * db.pageSize
 	if minsz >= db.datasz {
+		oldsz := db.datasz
 		if err := db.mmap(minsz); err != nil {
 			return nil, fmt.Errorf("mmap allocate error: %s", err)
 		}
+
+		db.statlock.Lock()
+		db.stats.RemapCount++
+		db.statlock.Unlock()
+		if db.onRemap != nil {
+			db.onRemap(oldsz, db.datasz)
+		}
 	}
 
 	// Move the page id high water mark.
@@ -1139,6 +1942,44 @@ func (db *DB) allocate(txid txid, count int) (*page, error) {
 	return p, nil
 }
 
+// getPageBuffer returns a zeroed single page buffer from the page pool. A
+// pooled buffer of the wrong size is dropped rather than used.
+func (db *DB) getPageBuffer() []byte {
+	if buf := db.pagePool.Get().([]byte); len(buf) == db.pageSize {
+		return buf
+	}
+	return make([]byte, db.pageSize)
+}
+
+// putPageBuffer zeroes a single page buffer and returns it to the page pool,
+// unless its size does not match the buffers of the pool.
+func (db *DB) putPageBuffer(buf []byte) {
+	if len(buf) != db.pagePoolSize {
+		return
+	}
+
+	// See https://go.googlesource.com/go/+/f03c9202c43e0abb130669852082117ca50aa9b1
+	for i := range buf {
+		buf[i] = 0
+	}
+	db.pagePool.Put(buf) //nolint:staticcheck
+}
+
+// allocBuffer returns a zeroed buffer of size bytes for a multi-page
+// allocation, starting at a multiple of allocAlignment if it is set.
+func (db *DB) allocBuffer(size int) []byte {
+	align := db.allocAlignment
+	if align <= 1 {
+		return make([]byte, size)
+	}
+	buf := make([]byte, size+align-1)
+	var off int
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); r != 0 {
+		off = align - r
+	}
+	return buf[off : off+size : off+size]
+}
+
 // grow grows the size of the database to the given sz.
 func (db *DB) grow(sz int) error {
 	// Ignore if the new size is less than available file size.
@@ -1149,7 +1990,9 @@ func (db *DB) grow(sz int) error {
 	// If the data is smaller than the alloc size then only allocate what's needed.
 	// Once it goes over the allocation size then allocate in chunks.
 	if db.datasz <= db.AllocSize {
-		sz = db.datasz
+		if sz < db.datasz {
+			sz = db.datasz
+		}
 	} else {
 		sz += db.AllocSize
 	}
@@ -1191,6 +2034,144 @@ func (db *DB) Size() (sz int64) {
 	return int64(db.meta().pgid) * int64(db.pageSize)
 }
 
+// PageTypeCounts returns the number of pages of each type below the high
+// water mark, keyed by "meta", "freelist", "branch", "leaf" and "free".
+// Overflow pages are counted with the page they belong to and the whole
+// fixed freelist region is counted as "freelist", so the counts add up to
+// the total number of pages in use. Pages with an unexpected header are
+// counted under their PageInfo type, such as "unknown<00>".
+//
+// A write transaction is used to keep the freelist stable while walking,
+// unless the database is read-only.
+func (db *DB) PageTypeCounts() (map[string]int, error) {
+	tx, err := db.Begin(!db.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if db.freelist == nil {
+		return nil, ErrFreePagesNotLoaded
+	}
+	return tx.pageTypeCounts(), nil
+}
+
+// pageTypeCounts implements PageTypeCounts. The freelist must be loaded.
+func (tx *Tx) pageTypeCounts() map[string]int {
+	db := tx.db
+	counts := map[string]int{"meta": 2}
+	id := pgid(2)
+	for end := db.dataStart(); id < end && id < tx.meta.pgid; id++ {
+		counts["freelist"]++
+	}
+	for id < tx.meta.pgid {
+		if db.freelist.freed(id) {
+			counts["free"]++
+			id++
+			continue
+		}
+
+		p := db.page(id)
+		n := pgid(p.overflow) + 1
+		if p.id != id || id+n > tx.meta.pgid {
+			n = 1
+		}
+		counts[p.typ()] += int(n)
+		id += n
+	}
+	return counts
+}
+
+// VerifyReport is the result of a consistency check run by DB.Verify.
+type VerifyReport struct {
+	// OK is true if no errors were found.
+	OK bool
+
+	// PageCounts holds the number of pages of each type, as returned by
+	// PageTypeCounts.
+	PageCounts map[string]int
+
+	// Errors holds every problem reported by Tx.Check, in order.
+	Errors []error
+}
+
+// Verify runs a full consistency check of the database, as Tx.Check does, and
+// collects the result into a report together with the page counts. The
+// returned error is only set if the check could not be run; problems found in
+// the database are reported in VerifyReport.Errors.
+//
+// A write transaction is used to keep the freelist stable while walking,
+// unless the database is read-only.
+func (db *DB) Verify() (*VerifyReport, error) {
+	tx, err := db.Begin(!db.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Force loading free list if opened in ReadOnly mode.
+	db.loadFreelist()
+
+	report := &VerifyReport{PageCounts: tx.pageTypeCounts()}
+	for err := range tx.Check() {
+		report.Errors = append(report.Errors, err)
+	}
+	report.OK = len(report.Errors) == 0
+	return report, nil
+}
+
+// MaxTreeDepth returns the depth of the deepest B+tree among all buckets,
+// including nested buckets. Unlike BucketStats.Depth, the depth of a nested
+// bucket is not added to that of its parent. A database without buckets
+// has a depth of zero.
+func (db *DB) MaxTreeDepth() (int, error) {
+	var max int
+	var visit func(b *Bucket) error
+	visit = func(b *Bucket) error {
+		if err := b.forEachPage(func(_ *page, depth int, _ []pgid) {
+			if depth+1 > max {
+				max = depth + 1
+			}
+		}); err != nil {
+			return err
+		}
+		return b.forEachChild(visit)
+	}
+
+	err := db.View(func(tx *Tx) error {
+		return tx.root.forEachChild(visit)
+	})
+	return max, err
+}
+
+// WarmUp reads the branch pages of the named top-level buckets so that they
+// are faulted into memory before the first queries after Open. Leaf pages
+// are not read, apart from the leftmost one of each bucket which is used to
+// find the depth of the tree. Returns ErrBucketNotFound if a bucket does not
+// exist.
+func (db *DB) WarmUp(buckets [][]byte) error {
+	return db.View(func(tx *Tx) error {
+		for _, name := range buckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				return ErrBucketNotFound
+			} else if b.root == 0 {
+				// Inline buckets live in their parent's leaf page.
+				continue
+			}
+
+			// All leaves are at the same depth, so follow the leftmost
+			// path to find it and then visit every branch above it.
+			depth := 0
+			for p := tx.page(b.root); (p.flags & branchPageFlag) != 0; p = tx.page(p.branchPageElement(0).pgid) {
+				depth++
+			}
+			tx.warmUpBranch(b.root, depth)
+		}
+		return nil
+	})
+}
+
 func (db *DB) Copy(w io.Writer) error {
 	_, err := db.WriteTo(w)
 	return err
@@ -1210,7 +2191,7 @@ func (db *DB) WriteTo(w io.Writer) (n int64, err error) {
 		}
 	}()
 
-	fullMetaSize := int64(db.pageSize*2) + freelistRegionSize*2
+	fullMetaSize := int64(db.pageSize*2) + int64(db.freelistRegionSize*2)
 
 	// Lock to prevent any changes on meta pages.
 	db.rwlock.Lock()
@@ -1287,6 +2268,11 @@ type Options struct {
 	// Sets the DB.MmapFlags flag before memory mapping the file.
 	MmapFlags int
 
+	// MmapPopulate adds MAP_POPULATE to DB.MmapFlags so the whole file is
+	// faulted in when it is mapped. This benefits read-heavy workloads that
+	// scan most of the database. It is ignored on platforms other than Linux.
+	MmapPopulate bool
+
 	// InitialMmapSize is the initial mmap size of the database
 	// in bytes. Read transactions won't block write transaction
 	// if the InitialMmapSize is large enough to hold database mmap
@@ -1300,6 +2286,9 @@ type Options struct {
 	// PageSize overrides the default OS page size.
 	PageSize int
 
+	// FsyncMode sets the DB.FsyncMode. The default is FsyncBoth.
+	FsyncMode FsyncMode
+
 	// NoSync sets the initial value of DB.NoSync. Normally this can just be
 	// set directly on the DB itself when returned from Open(), but this option
 	// is useful in APIs which expose Options but not the underlying DB.
@@ -1313,6 +2302,169 @@ type Options struct {
 	// It prevents potential page faults, however
 	// used memory can't be reclaimed. (UNIX only)
 	Mlock bool
+
+	// VerifyWrites sets the DB.VerifyWrites flag.
+	VerifyWrites bool
+
+	// MaxOverflowPages sets the DB.MaxOverflowPages limit.
+	MaxOverflowPages int
+
+	// MaxPendingPages sets the DB.MaxPendingPages limit.
+	MaxPendingPages int
+
+	// CloseTimeout is the amount of time Close waits for open read
+	// transactions to finish before returning ErrCloseTimeout.
+	// When set to zero it will wait indefinitely.
+	CloseTimeout time.Duration
+
+	// CopyOnWriteMmap maps the data file with MAP_PRIVATE and write access
+	// instead of read-only MAP_SHARED. Writes by callers that mutate slices
+	// returned by Get or a Cursor then modify a private copy of the page
+	// instead of faulting, and never reach the file. Database writes still
+	// go through the file, and writable transactions read pages from the file
+	// instead of the mapping so that they never write modified bytes back.
+	// A page modified this way keeps its private copy until the file is
+	// remapped, so reads of it by read-only transactions may be stale.
+	// This option is only available on Unix.
+	CopyOnWriteMmap bool
+
+	// LinearSearchThreshold makes cursors scan pages and nodes with fewer
+	// elements than this linearly instead of using binary search, which can
+	// be faster for small pages. When set to zero binary search is always used.
+	// BenchmarkCursor_Seek_LinearSearchThreshold shows the crossover is low,
+	// so values above 16 rarely help.
+	LinearSearchThreshold int
+
+	// AllocAlignment aligns the start of the buffers allocated for pages
+	// that span several pages, such as large values and freelists, to the
+	// given number of bytes. Setting it to the filesystem block size can
+	// speed up writes on storage that penalizes unaligned buffers, at the
+	// cost of up to AllocAlignment-1 unused bytes per buffer. Single pages
+	// come from a pool and are not affected. When set to zero no alignment
+	// beyond Go's own is applied.
+	AllocAlignment int
+
+	// MinTxID is the lowest transaction id the database may be at once it
+	// is open. If the file records an older id, for example because it was
+	// restored from a backup, Open commits an empty transaction with this
+	// id so that ids never go backwards for replication and other readers
+	// of Tx.ID. It is ignored in read-only mode.
+	MinTxID uint64
+
+	// CheckOnOpen runs a full Tx.Check right after the database is opened,
+	// so a service can refuse to start on a corrupt file. Open returns a
+	// *CheckError listing every inconsistency found. The check reads every
+	// page of the database, so it is off by default.
+	CheckOnOpen bool
+
+	// MaxTreeDepthGuard is the deepest a B+tree may be walked. A corrupt
+	// branch page that points back at one of its ancestors would otherwise
+	// recurse until the stack overflows. Walks such as Tx.Check and
+	// DB.MaxTreeDepth report ErrTreeTooDeep; cursors stop and return it from
+	// Cursor.Err. Real trees are far shallower than the default of
+	// DefaultMaxTreeDepthGuard, which is used when it is zero.
+	MaxTreeDepthGuard int
+
+	// ReadOnlyNoFreelist skips verifying and loading the freelist when
+	// opening in read-only mode, which speeds up inspecting huge files and
+	// allows reading databases whose freelist region is damaged. Without a
+	// freelist, Tx.Page cannot tell free pages apart: it reports them by
+	// their stale contents, or as "unknown-free" if those cannot be
+	// classified. It is ignored unless ReadOnly is set.
+	ReadOnlyNoFreelist bool
+
+	// AllowEmptyKeys lets Put, PutFlagged and TestPut store a zero-length
+	// key, for the rare case where a single sentinel key is wanted. The
+	// empty key sorts before every other key. Nil and empty keys are the same
+	// key. Bucket names may never be empty. By default such writes fail with
+	// ErrKeyRequired.
+	AllowEmptyKeys bool
+
+	// MutationLog, if set, receives a record of every key put or deleted by
+	// a writable transaction, written once the transaction has committed.
+	// Rolled back transactions are never logged, and records appear in
+	// commit order. Creating and deleting buckets is not logged. Records are
+	// read back with ReadMutation. If a write fails or is short, Commit
+	// returns ErrMutationLogWrite although the changes are already durable,
+	// and so does every later Begin(true) until the database is reopened.
+	// Setting it also enables Bucket.ChangedSince.
+	MutationLog io.Writer
+
+	// ChangesRetention is the number of most recent transactions whose
+	// changes Bucket.ChangedSince can report. Older changes are forgotten,
+	// in batches, so that tracking never holds more than the keys changed by
+	// about twice as many transactions.
+	//
+	// If <=0, DefaultChangesRetention is used.
+	ChangesRetention int
+
+	// FreelistAutoCompact, if positive, starts a goroutine that checks the
+	// freelist at this interval and calls DB.RewriteFreelist whenever
+	// DB.FreelistFragmentation exceeds FreelistAutoCompactThreshold. This
+	// keeps the freelist, which must fit in a fixed region of the file, from
+	// growing without bound under steady churn. Being a write transaction, it
+	// never runs alongside another writer. It is stopped by Close and is
+	// ignored in read-only mode.
+	FreelistAutoCompact time.Duration
+
+	// FreelistAutoCompactThreshold is the fragmentation above which the
+	// compactor rewrites the freelist. DefaultFreelistAutoCompactThreshold
+	// is used when it is zero.
+	FreelistAutoCompactThreshold float64
+
+	// StrictModeReturnsError sets the DB.StrictModeReturnsError flag.
+	StrictModeReturnsError bool
+
+	// OnRemap, if set, is called each time a write transaction grows the
+	// database past the end of the current mapping and the file is mapped
+	// again, with the old and new mapped sizes in bytes. Every such remap is
+	// also counted in Stats.RemapCount. It is called by the writer while it
+	// holds the writer lock, so it must not start a write transaction.
+	OnRemap func(oldSize, newSize int)
+
+	// InlineBucketMaxSize is the largest size, in bytes, that a nested
+	// bucket without nested buckets of its own may have and still be stored
+	// inline in its parent's leaf page rather than on pages of its own.
+	// Raising it keeps more tiny buckets inline, saving a page each, at the
+	// cost of larger parent pages. It must not exceed half the page size.
+	// A quarter of the page size is used when it is zero.
+	InlineBucketMaxSize int
+
+	// TxMemoryBudget, if positive, is the approximate number of bytes a
+	// write transaction may hold in materialized nodes, inserted keys and
+	// values, and dirty pages. A Put that would exceed it fails with
+	// ErrTxMemoryExceeded and leaves the bucket unchanged; a Commit that
+	// would exceed it while writing out pages fails and rolls back.
+	TxMemoryBudget int
+
+	// BatchFree makes write transactions collect the pages they free and
+	// add them to the freelist's pending pages in one sorted pass after the
+	// transaction's changes have been spilled, instead of one page at a
+	// time. It speeds up transactions that delete large numbers of keys.
+	// Until then, Tx.Page and Tx.ForEachPageOrdered don't report the pages
+	// the transaction has freed as free.
+	BatchFree bool
+
+	// RebalanceThreshold is the fill, as a fraction of the page size, below
+	// which a node changed by a write transaction is merged with a sibling
+	// when the transaction commits. Lower values merge less often, saving
+	// writes at the cost of sparser pages; higher values keep pages denser.
+	// It must be at most 0.5 so that merged pages fit in a page. Zero means
+	// DefaultRebalanceThreshold.
+	RebalanceThreshold float64
+
+	// FreelistRegionSize sets the size in bytes of each of the two regions
+	// the freelist is written to when creating a database, for workloads
+	// that fragment the file into more free pages than the default regions
+	// hold. It must be a multiple of the page size. The size is recorded in
+	// the meta pages, so it is ignored when opening an existing database.
+	// Zero means DefaultFreelistRegionSize. Commits whose freelist would not
+	// fit fail with ErrFreelistRegionFull.
+	FreelistRegionSize int
+
+	// CloseFile makes DB.Close close the file given to OpenFile. Databases
+	// opened by path always close their file.
+	CloseFile bool
 }
 
 // DefaultOptions represent the options used if nil options are passed into Open().
@@ -1333,6 +2485,7 @@ type Stats struct {
 
 	// Freelist stats
 	FreePageN     int // total number of free pages on the freelist
+	FreeRunN      int // number of contiguous runs of free pages on the freelist
 	PendingPageN  int // total number of pending pages on the freelist
 	PendingN      int // total number of pending transactions
 	FreeAlloc     int // total bytes allocated in free pages
@@ -1341,6 +2494,9 @@ type Stats struct {
 	// Transaction stats
 	TxN     int // total number of started read transactions
 	OpenTxN int // number of currently open read transactions
+
+	// Mmap stats
+	RemapCount int // total number of remaps because the database grew
 }
 
 // Sub calculates and returns the difference between two sets of database stats.
@@ -1352,10 +2508,12 @@ func (s *Stats) Sub(other *Stats) Stats {
 	}
 	var diff Stats
 	diff.FreePageN = s.FreePageN
+	diff.FreeRunN = s.FreeRunN
 	diff.PendingPageN = s.PendingPageN
 	diff.FreeAlloc = s.FreeAlloc
 	diff.FreelistInuse = s.FreelistInuse
 	diff.TxN = s.TxN - other.TxN
+	diff.RemapCount = s.RemapCount - other.RemapCount
 	diff.TxStats = s.TxStats.Sub(&other.TxStats)
 	return diff
 }
@@ -1365,11 +2523,24 @@ type Info struct {
 	PageSize int
 }
 
+// EncodingInfo describes the limits imposed by the packed leaf elements of
+// the file format.
+type EncodingInfo struct {
+	MaxKeySize    int // longest key, from the 13-bit key size of leaf elements
+	MaxValueSize  int // longest value, from the 24-bit value size
+	MaxPageOffset int // furthest a key may start from its leaf element, from the 26-bit offset
+
+	// SpareFlagBits is the number of leaf element bits left for new flags.
+	// It is zero: value flags such as FlaggedValue are stored on the leaf
+	// page, after the elements.
+	SpareFlagBits int
+}
+
 type meta struct {
 	magic    uint32
 	version  uint32
 	pageSize uint32
-	flags    uint32
+	flpages  uint32 // pages in each freelist region, 0 for the default size
 	root     bucket
 	flid     pgid
 	pgid     pgid
@@ -1377,16 +2548,52 @@ type meta struct {
 	checksum uint64
 }
 
+// dataStart returns the id of the first page after the meta pages and the
+// freelist regions.
+func (db *DB) dataStart() pgid {
+	return 2 + 2*pgid(db.freelistRegionSize/db.pageSize)
+}
+
+// freelistRegion returns the id of the first page of the freelist region
+// used by a meta page with the given flid.
+func (db *DB) freelistRegion(flid pgid) pgid {
+	return 2 + (flid%2)*pgid(db.freelistRegionSize/db.pageSize)
+}
+
 func (db *DB) freelistPage() *page {
-	p := 2 + (db.meta().flid%2)*freelistRegionSize/pgid(db.pageSize)
-	return db.page(p)
+	return db.page(db.freelistRegion(db.meta().flid))
+}
+
+// freelistChecksum returns true if the freelist pages of the file end with
+// a checksum.
+func (m *meta) freelistChecksum() bool {
+	return m.version != version2
+}
+
+// valueFlags returns true if leaf pages of the file may store value flags.
+func (m *meta) valueFlags() bool {
+	return m.version != version2
+}
+
+// bucketSettings returns true if bucket values of the file may carry the
+// settings trailer written by Bucket.trailer. Older binaries would ignore it.
+func (m *meta) bucketSettings() bool {
+	return m.version != version2
+}
+
+// regionSize returns the size in bytes of each freelist region.
+func (m *meta) regionSize() int {
+	if m.flpages == 0 {
+		return DefaultFreelistRegionSize
+	}
+	return int(m.flpages) * int(m.pageSize)
 }
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
 func (m *meta) validate() error {
 	if m.magic != internal.Magic {
 		return ErrInvalid
-	} else if m.version != version {
+	} else if m.version != version && m.version != version2 {
 		return ErrVersionMismatch
 	} else if m.checksum != m.sum64() {
 		return ErrChecksum
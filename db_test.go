@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -214,6 +215,43 @@ func TestOpen_ErrChecksum(t *testing.T) {
 	}
 }
 
+// Ensure that opening a file with a corrupt freelist returns ErrFreelistCorrupt.
+func TestOpen_ErrFreelistCorrupt(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	path := db.Path()
+	pageSize := db.Info().PageSize
+
+	// Free some pages so that the freelist is not empty.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 4*pageSize))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("foo"))
+	}))
+	db.MustClose()
+
+	// A clean freelist passes verification.
+	db.MustReopen()
+	db.MustClose()
+
+	// Flip the first byte after the page header in both freelist regions,
+	// which start after the meta pages and are 8MB each.
+	const freelistRegionSize = 8 * 1024 * 1024
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for _, off := range []int{2 * pageSize, 2*pageSize + freelistRegionSize} {
+		buf[off+int(pageHeaderSize)] ^= 0xFF
+	}
+	require.NoError(t, os.WriteFile(path, buf, 0666))
+
+	_, err = bolt.Open(path, 0666, nil)
+	require.Equal(t, bolt.ErrFreelistCorrupt, err)
+}
+
 // Ensure that it can read the page size from the second meta page if the first one is invalid.
 // The page size is expected to be the OS's page size in this case.
 func TestOpen_ReadPageSize_FromMeta1_OS(t *testing.T) {
@@ -562,6 +600,78 @@ func TestDB_Open_ReadOnly(t *testing.T) {
 	}
 }
 
+// Ensure that a database can be opened from a file that is already open.
+func TestOpenFile(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+	path := db.Path()
+	db.MustClose()
+
+	// A read-only descriptor is enough for a read-only database, and it is
+	// left open by Close.
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	rodb, err := bolt.OpenFile(f, &bolt.Options{ReadOnly: true})
+	require.NoError(t, err)
+	require.True(t, rodb.IsReadOnly())
+	require.Equal(t, path, rodb.Path())
+	require.NoError(t, rodb.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	}))
+	require.NoError(t, rodb.Close())
+	_, err = f.Stat()
+	require.NoError(t, err)
+
+	// A writable descriptor is closed along with the database if asked to.
+	rw, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	rwdb, err := bolt.OpenFile(rw, &bolt.Options{CloseFile: true})
+	require.NoError(t, err)
+	require.NoError(t, rwdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("baz"), []byte("qux"))
+	}))
+	require.NoError(t, rwdb.Close())
+	_, err = rw.Stat()
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	// The changes made through it are there when opened by path.
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("qux"), tx.Bucket([]byte("widgets")).Get([]byte("baz")))
+		return nil
+	}))
+}
+
+// Ensure that an empty file given to OpenFile is initialized.
+func TestOpenFile_Empty(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	db, err := bolt.OpenFile(f, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}))
+	require.NoError(t, db.Close())
+
+	// The file can be opened again once the database has released its lock.
+	db, err = bolt.OpenFile(f, &bolt.Options{Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("widgets")))
+		return nil
+	}))
+	require.NoError(t, db.Close())
+}
+
 // TestOpen_BigPage checks the database uses bigger pages when
 // changing PageSize.
 func TestOpen_BigPage(t *testing.T) {
@@ -789,6 +899,515 @@ func testDB_Close_PendingTx(t *testing.T, writable bool) {
 	}
 }
 
+// Ensure that Close gives up on open read transactions after CloseTimeout.
+func TestDB_Close_Timeout(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{CloseTimeout: 100 * time.Millisecond})
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.Equal(t, bolt.ErrCloseTimeout, db.DB.Close())
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// The database is still open and usable.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}))
+
+	// Close succeeds once the reader finishes.
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, db.Close())
+}
+
+// Ensure that ActiveTxns reports every open transaction.
+func TestDB_ActiveTxns(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.Empty(t, db.ActiveTxns())
+
+	r1, err := db.Begin(false)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	r2, err := db.Begin(false)
+	require.NoError(t, err)
+	w, err := db.Begin(true)
+	require.NoError(t, err)
+
+	txs := db.ActiveTxns()
+	require.Len(t, txs, 3)
+	require.Equal(t, r1.ID(), txs[0].ID)
+	require.Equal(t, r2.ID(), txs[1].ID)
+	require.False(t, txs[0].Writable)
+	require.False(t, txs[1].Writable)
+	require.Equal(t, w.ID(), txs[2].ID)
+	require.True(t, txs[2].Writable)
+	require.GreaterOrEqual(t, txs[0].Age, 10*time.Millisecond)
+	require.Greater(t, txs[0].Age, txs[2].Age)
+
+	require.NoError(t, w.Commit())
+	require.NoError(t, r1.Rollback())
+	txs = db.ActiveTxns()
+	require.Len(t, txs, 1)
+	require.Equal(t, r2.ID(), txs[0].ID)
+
+	require.NoError(t, r2.Rollback())
+	require.Empty(t, db.ActiveTxns())
+}
+
+// Ensure that PageTypeCounts accounts for every page in the database.
+func TestDB_PageTypeCounts(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("large"), make([]byte, 3*db.Info().PageSize))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("0000"))
+	}))
+
+	counts, err := db.PageTypeCounts()
+	require.NoError(t, err)
+	require.Equal(t, 2, counts["meta"])
+	require.Greater(t, counts["freelist"], 0)
+	require.Greater(t, counts["branch"], 0)
+	require.Greater(t, counts["leaf"], 3)
+	require.Greater(t, counts["free"], 0)
+
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, int(tx.Size())/db.Info().PageSize, total)
+		return nil
+	}))
+}
+
+// Ensure that Verify reports page counts and the problems found by Check.
+func TestDB_Verify(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%03d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	report, err := db.Verify()
+	require.NoError(t, err)
+	require.True(t, report.OK)
+	require.Empty(t, report.Errors)
+	counts, err := db.PageTypeCounts()
+	require.NoError(t, err)
+	require.Equal(t, counts, report.PageCounts)
+	require.Equal(t, 2, report.PageCounts["meta"])
+	require.Greater(t, report.PageCounts["leaf"], 0)
+
+	// Rename a key on disk so that it breaks the key order of its leaf.
+	db.MustClose()
+	buf, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(buf, []byte("key-050")))
+	copy(buf[bytes.Index(buf, []byte("key-050")):], "key-000")
+	path := filepath.Join(t.TempDir(), "corrupted.db")
+	require.NoError(t, os.WriteFile(path, buf, 0666))
+	corrupted, err := bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer corrupted.Close()
+
+	report, err = corrupted.Verify()
+	require.NoError(t, err)
+	require.False(t, report.OK)
+	require.NotEmpty(t, report.Errors)
+	require.Contains(t, report.Errors[0].Error(), "needs to be >")
+	require.Equal(t, counts, report.PageCounts)
+}
+
+// Ensure that Open reports inconsistencies when CheckOnOpen is set.
+func TestOpen_CheckOnOpen(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%03d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	db.MustClose()
+
+	// A consistent database opens normally.
+	opts := &bolt.Options{CheckOnOpen: true}
+	clean, err := bolt.Open(db.Path(), 0666, opts)
+	require.NoError(t, err)
+	require.NoError(t, clean.Close())
+
+	// Rename a key on disk so that it breaks the key order of its leaf.
+	buf, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	copy(buf[bytes.Index(buf, []byte("key-050")):], "key-000")
+	path := filepath.Join(t.TempDir(), "corrupted.db")
+	require.NoError(t, os.WriteFile(path, buf, 0666))
+
+	// Without the option the corruption goes unnoticed.
+	corrupted, err := bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	require.NoError(t, corrupted.Close())
+
+	_, err = bolt.Open(path, 0666, opts)
+	var checkErr *bolt.CheckError
+	require.ErrorAs(t, err, &checkErr)
+	require.NotEmpty(t, checkErr.Errors)
+	require.Contains(t, err.Error(), "needs to be >")
+
+	// The file is left unlocked so it can be opened again.
+	_, err = bolt.Open(path, 0666, &bolt.Options{CheckOnOpen: true, ReadOnly: true})
+	require.ErrorAs(t, err, &checkErr)
+}
+
+// Ensure that a read-only database can be opened and read without its freelist.
+func TestOpen_ReadOnlyNoFreelist(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+	pageSize := db.Info().PageSize
+	db.MustClose()
+
+	// Wipe both freelist regions, which follow the two meta pages.
+	buf, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	info, err := bolt.ReadInfo(db.Path())
+	require.NoError(t, err)
+	region := buf[2*pageSize : 2*pageSize+2*info.FreelistRegionSize]
+	for i := range region {
+		region[i] = 0xff
+	}
+	path := filepath.Join(t.TempDir(), "nofreelist.db")
+	require.NoError(t, os.WriteFile(path, buf, 0666))
+
+	_, err = bolt.Open(path, 0666, &bolt.Options{ReadOnly: true})
+	require.Error(t, err)
+
+	// The option is ignored unless the database is read-only.
+	_, err = bolt.Open(path, 0666, &bolt.Options{ReadOnlyNoFreelist: true})
+	require.Error(t, err)
+
+	ro, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true, ReadOnlyNoFreelist: true})
+	require.NoError(t, err)
+	defer ro.Close()
+	require.NoError(t, ro.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+
+		p, err := tx.Page(2)
+		require.NoError(t, err)
+		require.Equal(t, "unknown-free", p.Type)
+		p, err = tx.Page(0)
+		require.NoError(t, err)
+		require.Equal(t, "meta", p.Type)
+		return nil
+	}))
+}
+
+// Ensure that ReadInfo reports the current meta page without opening the DB.
+func TestReadInfo(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 8192})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+
+	info, err := bolt.ReadInfo(db.Path())
+	require.NoError(t, err)
+	require.Equal(t, 8192, info.PageSize)
+	require.Equal(t, 8*1024*1024, info.FreelistRegionSize)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, uint64(tx.ID()), info.TxID)
+		require.Equal(t, tx.Size(), info.Size)
+
+		p, err := tx.Page(int(info.Root))
+		require.NoError(t, err)
+		require.Equal(t, "leaf", p.Type)
+		return nil
+	}))
+
+	// A file that is not a database is rejected.
+	path := filepath.Join(t.TempDir(), "garbage")
+	require.NoError(t, os.WriteFile(path, make([]byte, 64*1024), 0666))
+	_, err = bolt.ReadInfo(path)
+	require.Equal(t, bolt.ErrInvalid, err)
+}
+
+// Ensure that Options.MinTxID moves an older database forward on open.
+func TestOpen_MinTxID(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			return err
+		}))
+	}
+	path := db.Path()
+	db.MustClose()
+
+	txID := func(db *bolt.DB) (id int) {
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			id = tx.ID()
+			return nil
+		}))
+		return id
+	}
+
+	// A lower MinTxID leaves the database alone.
+	db2, err := bolt.Open(path, 0666, &bolt.Options{MinTxID: 2})
+	require.NoError(t, err)
+	require.Equal(t, 4, txID(db2))
+	require.NoError(t, db2.Close())
+
+	db2, err = bolt.Open(path, 0666, &bolt.Options{MinTxID: 1000})
+	require.NoError(t, err)
+	require.Equal(t, 1000, txID(db2))
+	require.NoError(t, db2.Close())
+
+	// The new id is persisted and later commits continue from it.
+	info, err := bolt.ReadInfo(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), info.TxID)
+
+	db2, err = bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db2.Close()
+	require.Equal(t, 1000, txID(db2))
+	require.NoError(t, db2.Update(func(tx *bolt.Tx) error {
+		require.Equal(t, 1001, tx.ID())
+		return nil
+	}))
+	require.NoError(t, db2.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+}
+
+// Ensure that committing a value above MaxOverflowPages returns an error.
+func TestDB_MaxOverflowPages(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MaxOverflowPages: 4})
+	pageSize := db.Info().PageSize
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), make([]byte, 8*pageSize))
+	})
+	require.Equal(t, bolt.ErrTooManyOverflowPages, err)
+
+	// Values within the limit can still be committed.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("small"), make([]byte, 2*pageSize))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Len(t, tx.Bucket([]byte("widgets")).Get([]byte("small")), 2*pageSize)
+		return nil
+	}))
+}
+
+// Ensure that MaxTreeDepth reports the deepest bucket tree.
+func TestDB_MaxTreeDepth(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	depth, err := db.MaxTreeDepth()
+	require.NoError(t, err)
+	require.Equal(t, 0, depth)
+
+	fill := func(b *bolt.Bucket, n int) error {
+		for i := 0; i < n; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A single small bucket lives in one inline page.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("small"))
+		if err != nil {
+			return err
+		}
+		return fill(b, 1)
+	}))
+	depth, err = db.MaxTreeDepth()
+	require.NoError(t, err)
+	require.Equal(t, 1, depth)
+
+	// The deepest tree is nested inside a shallow bucket.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("medium"))
+		if err != nil {
+			return err
+		}
+		if err := fill(b, 100); err != nil {
+			return err
+		}
+		nested, err := tx.Bucket([]byte("small")).CreateBucket([]byte("large"))
+		if err != nil {
+			return err
+		}
+		return fill(nested, 50000)
+	}))
+	depth, err = db.MaxTreeDepth()
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		small := tx.Bucket([]byte("small"))
+		want := small.Bucket([]byte("large")).Stats().Depth
+		require.Greater(t, want, tx.Bucket([]byte("medium")).Stats().Depth)
+		require.Equal(t, want, depth)
+		require.Equal(t, 1+want, small.Stats().Depth)
+		return nil
+	}))
+}
+
+// Ensure that mutating a value under CopyOnWriteMmap leaves the file untouched.
+func TestOpen_CopyOnWriteMmap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("CopyOnWriteMmap is not supported on Windows")
+	}
+
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{CopyOnWriteMmap: true})
+	value := []byte("precious-value")
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), value)
+	}))
+
+	// A buggy caller writes through the mmap-aliased slice.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		copy(v, "CORRUPTED")
+		return nil
+	}))
+
+	// Later commits still reach the file and are visible.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("bar"), []byte("baz"))
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("baz"), tx.Bucket([]byte("widgets")).Get([]byte("bar")))
+		return nil
+	}))
+
+	buf, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf, []byte("CORRUPTED")))
+
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, value, tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	}))
+}
+
+// Ensure that a write to a leaf mutated under CopyOnWriteMmap doesn't carry
+// the mutation into the file when the bucket isn't inline.
+func TestOpen_CopyOnWriteMmap_SameLeaf(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("CopyOnWriteMmap is not supported on Windows")
+	}
+
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{CopyOnWriteMmap: true})
+	value := bytes.Repeat([]byte("v"), 100)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 200; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("k%04d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		copy(tx.Bucket([]byte("widgets")).Get([]byte("k0001")), "CORRUPTED")
+		return nil
+	}))
+
+	// The write lands in the leaf holding the mutated value.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("k0002"), []byte("x"))
+	}))
+
+	buf, err := os.ReadFile(db.Path())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(buf, []byte("CORRUPTED")))
+
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, value, b.Get([]byte("k0001")))
+		require.Equal(t, []byte("x"), b.Get([]byte("k0002")))
+		return nil
+	}))
+}
+
+// Ensure that a database can be opened with MmapPopulate.
+func TestOpen_MmapPopulate(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MmapPopulate: true})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	}))
+}
+
 // Ensure a database can provide a transactional block.
 func TestDB_Update(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1003,34 +1622,227 @@ func TestDB_View_Panic(t *testing.T) {
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	// Panic during view transaction but recover.
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Log("recover: view", r)
+
+	// Panic during view transaction but recover.
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Log("recover: view", r)
+			}
+		}()
+
+		if err := db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("widgets")) == nil {
+				t.Fatal("expected bucket")
+			}
+			panic("omg")
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Verify that we can still use read transactions.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that GetAsOf reads the previous transaction until its pages are released.
+func TestDB_GetAsOf(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	put := func(key, value string) (id int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			id = tx.ID()
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			require.NoError(t, err)
+			return b.Put([]byte(key), []byte(value))
+		}))
+		return id
+	}
+	getAsOf := func(id int, key string) []byte {
+		v, err := db.GetAsOf(id, []byte("widgets"), []byte(key))
+		require.NoError(t, err)
+		return v
+	}
+
+	id1 := put("foo", "1")
+	id2 := put("foo", "2")
+	require.Equal(t, []byte("1"), getAsOf(id1, "foo"))
+	require.Equal(t, []byte("2"), getAsOf(id2, "foo"))
+
+	_, err := db.GetAsOf(id2+1, []byte("widgets"), []byte("foo"))
+	require.Error(t, err)
+	_, err = db.GetAsOf(id2, []byte("missing"), []byte("foo"))
+	require.ErrorIs(t, err, bolt.ErrBucketNotFound)
+
+	// A read transaction keeps the pages replaced by the next write pending.
+	rtx, err := db.Begin(false)
+	require.NoError(t, err)
+	id3 := put("bar", "3")
+	_, err = db.GetAsOf(id1, []byte("widgets"), []byte("foo"))
+	require.ErrorIs(t, err, bolt.ErrSnapshotExpired)
+	require.Equal(t, []byte("2"), getAsOf(id2, "foo"))
+	require.Nil(t, getAsOf(id2, "bar"))
+
+	rollback := func() {
+		tx, err := db.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+	}
+	rollback()
+	require.Equal(t, []byte("2"), getAsOf(id2, "foo"))
+
+	// Once the reader is gone, the next writer releases them.
+	require.NoError(t, rtx.Rollback())
+	rollback()
+	_, err = db.GetAsOf(id2, []byte("widgets"), []byte("foo"))
+	require.ErrorIs(t, err, bolt.ErrSnapshotExpired)
+	require.Equal(t, []byte("3"), getAsOf(id3, "bar"))
+}
+
+func TestDB_GetFast(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	_, err := db.GetFast([]byte("widgets"), []byte("foo"))
+	require.ErrorIs(t, err, bolt.ErrBucketNotFound)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+	v, err := db.GetFast([]byte("widgets"), []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), v)
+	missing, err := db.GetFast([]byte("widgets"), []byte("baz"))
+	require.NoError(t, err)
+	require.Nil(t, missing)
+
+	// The value stays valid after later writes.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("qux"))
+	}))
+	require.Equal(t, []byte("bar"), v)
+}
+
+// Ensure that GetFast reads consistent values while a writer rewrites and
+// grows the database, which reuses freed pages and remaps the file.
+func TestDB_GetFast_ConcurrentWrites(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{InitialMmapSize: 1 << 16})
+
+	// Every value is its version repeated, so a torn or reused page shows.
+	value := func(n uint64) []byte {
+		v := make([]byte, 1024)
+		for i := 0; i < len(v); i += 8 {
+			binary.BigEndian.PutUint64(v[i:], n)
+		}
+		return v
+	}
+	const keys = 16
+	put := func(n uint64) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
 			}
-		}()
+			for i := 0; i < keys; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%02d", i)), value(n)); err != nil {
+					return err
+				}
+			}
+			// Grow the database to force remaps.
+			return b.Put([]byte(fmt.Sprintf("pad%08d", n)), make([]byte, 4096))
+		})
+	}
+	require.NoError(t, put(1))
 
-		if err := db.View(func(tx *bolt.Tx) error {
-			if tx.Bucket([]byte("widgets")) == nil {
-				t.Fatal("expected bucket")
+	const versions = 300
+	done := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for n := uint64(2); n <= versions; n++ {
+			if err := put(n); err != nil {
+				writeErr <- err
+				return
 			}
-			panic("omg")
-		}); err != nil {
-			t.Fatal(err)
 		}
 	}()
 
-	// Verify that we can still use read transactions.
-	if err := db.View(func(tx *bolt.Tx) error {
-		if tx.Bucket([]byte("widgets")) == nil {
-			t.Fatal("expected bucket")
-		}
-		return nil
-	}); err != nil {
+	var wg sync.WaitGroup
+	readErrs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			var last uint64
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				v, err := db.GetFast([]byte("widgets"), []byte(fmt.Sprintf("%02d", (r+i)%keys)))
+				if err != nil {
+					readErrs <- err
+					return
+				}
+				n := binary.BigEndian.Uint64(v)
+				if !bytes.Equal(v, value(n)) {
+					readErrs <- fmt.Errorf("torn value for version %d", n)
+					return
+				} else if n < last {
+					readErrs <- fmt.Errorf("read version %d after %d", n, last)
+					return
+				}
+				last = n
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(readErrs)
+	select {
+	case err := <-writeErr:
+		t.Fatal(err)
+	default:
+	}
+	for err := range readErrs {
 		t.Fatal(err)
 	}
+
+	v, err := db.GetFast([]byte("widgets"), []byte("00"))
+	require.NoError(t, err)
+	require.Equal(t, value(versions), v)
+}
+
+// Ensure that EncodingInfo reports the limits of the leaf element encoding.
+func TestDB_EncodingInfo(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	info := db.EncodingInfo()
+	require.Equal(t, bolt.EncodingInfo{
+		MaxKeySize:    1<<13 - 1,
+		MaxValueSize:  1<<24 - 1,
+		MaxPageOffset: 1<<26 - 1,
+		SpareFlagBits: 0,
+	}, info)
+	require.Equal(t, bolt.MaxKeySize, info.MaxKeySize)
+	require.Equal(t, bolt.MaxValueSize, info.MaxValueSize)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put(make([]byte, info.MaxKeySize), []byte("bar")))
+		require.ErrorIs(t, b.Put(make([]byte, info.MaxKeySize+1), []byte("bar")), bolt.ErrKeyTooLarge)
+		require.ErrorIs(t, b.Put([]byte("foo"), make([]byte, info.MaxValueSize+1)), bolt.ErrValueTooLarge)
+		return nil
+	}))
 }
 
 // Ensure that DB stats can be returned.
@@ -1053,6 +1865,32 @@ func TestDB_Stats(t *testing.T) {
 	}
 }
 
+// Ensure that growing past the current mapping is counted and reported.
+func TestDB_Stats_RemapCount(t *testing.T) {
+	type remap struct{ oldSize, newSize int }
+	var remaps []remap
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		OnRemap: func(oldSize, newSize int) {
+			remaps = append(remaps, remap{oldSize, newSize})
+		},
+	})
+	require.Equal(t, 0, db.Stats().RemapCount)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			require.NoError(t, err)
+			return b.Put([]byte(fmt.Sprintf("%02d", i)), make([]byte, 1<<20))
+		}))
+	}
+
+	require.NotEmpty(t, remaps)
+	require.Equal(t, len(remaps), db.Stats().RemapCount)
+	for _, r := range remaps {
+		require.Less(t, r.oldSize, r.newSize)
+	}
+}
+
 // Ensure that database pages are in expected order and type.
 func TestDB_Consistency(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -1116,6 +1954,8 @@ func TestDBStats_Sub(t *testing.T) {
 	a.FreePageN = 4
 	b.TxStats.PageCount = 10
 	b.FreePageN = 14
+	a.RemapCount = 1
+	b.RemapCount = 3
 	diff := b.Sub(&a)
 	if diff.TxStats.GetPageCount() != 7 {
 		t.Fatalf("unexpected TxStats.PageCount: %d", diff.TxStats.GetPageCount())
@@ -1125,6 +1965,9 @@ func TestDBStats_Sub(t *testing.T) {
 	if diff.FreePageN != 14 {
 		t.Fatalf("unexpected FreePageN: %d", diff.FreePageN)
 	}
+	if diff.RemapCount != 2 {
+		t.Fatalf("unexpected RemapCount: %d", diff.RemapCount)
+	}
 }
 
 // Ensure two functions can perform updates in a single batch.
@@ -1359,6 +2202,318 @@ func TestDB_HardLimitPendingPages(t *testing.T) {
 	}
 }
 
+// Ensure that a commit fails once an old reader holds back too many pages.
+func TestDB_MaxPendingPages(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MaxPendingPages: 50})
+	put := func(i int) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 10; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", j*100+i)), make([]byte, 500)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, put(i))
+	}
+
+	// Without readers, pending pages are released before every writer, so
+	// only the pages of the last commit are pending.
+	require.NoError(t, put(20))
+	perCommit := db.Stats().PendingPageN
+
+	// An old reader keeps every page freed after it started pending.
+	reader, err := db.Begin(false)
+	require.NoError(t, err)
+	var i int
+	for i = 21; i < 100; i++ {
+		if err = put(i); err != nil {
+			break
+		}
+	}
+	require.ErrorIs(t, err, bolt.ErrTooManyPendingPages)
+	require.Greater(t, i, 22, "commits should succeed until the limit is reached")
+	require.LessOrEqual(t, db.Stats().PendingPageN, 50+perCommit)
+
+	// The failed transaction was rolled back.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("widgets")).Get([]byte(fmt.Sprintf("%04d", i))))
+		return nil
+	}))
+
+	// Once the reader is gone the pages are released and commits succeed.
+	require.NoError(t, reader.Rollback())
+	require.NoError(t, put(i))
+
+	// Pages freed by the committing transaction itself don't count, so a
+	// delete freeing far more than the limit succeeds without readers.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}))
+	require.Greater(t, db.Stats().PendingPageN, 50)
+}
+
+// Ensure that a write transaction cannot grow past Options.TxMemoryBudget.
+func TestDB_TxMemoryBudget(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{TxMemoryBudget: 1 << 20})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		return b.Put([]byte("small"), make([]byte, 1000))
+	}))
+
+	// A Put that crosses the budget fails and leaves the bucket unchanged.
+	var n int
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for ; n < 10000; n++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", n)), make([]byte, 1000)); err != nil {
+				require.Nil(t, b.Get([]byte(fmt.Sprintf("%05d", n))))
+				return err
+			}
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, bolt.ErrTxMemoryExceeded)
+	require.Greater(t, n, 100)
+	require.Less(t, n, 1100)
+
+	// Commit counts the pages it writes out, too.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < n*2/3; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 1000)))
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, bolt.ErrTxMemoryExceeded)
+
+	// Both transactions were rolled back cleanly.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 1, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	}))
+	db.MustCheck()
+
+	// Smaller transactions still commit.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("other"), make([]byte, 1000))
+	}))
+}
+
+// Ensure that batched frees leave the same freelist as freeing page by page.
+// Ensure that nodes are merged below the configured rebalance threshold only.
+func TestOptions_RebalanceThreshold(t *testing.T) {
+	// Thin out leaves filled to the brim to about a third of a page.
+	leafPages := func(threshold float64) (before, after int) {
+		db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096, RebalanceThreshold: threshold})
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			require.NoError(t, err)
+			b.FillPercent = 1.0
+			for i := 0; i < 2000; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)))
+			}
+			return nil
+		}))
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			before = tx.Bucket([]byte("widgets")).Stats().LeafPageN
+			return nil
+		}))
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 2000; i++ {
+				if i%3 != 0 {
+					require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			after = tx.Bucket([]byte("widgets")).Stats().LeafPageN
+			return nil
+		}))
+		db.MustCheck()
+		return before, after
+	}
+
+	// Only the last leaf, which was not full, may be merged.
+	before, after := leafPages(0)
+	require.GreaterOrEqual(t, after, before-1, "default threshold merged pages above 25% fill")
+	before, after = leafPages(0.3)
+	require.GreaterOrEqual(t, after, before-1, "merged pages above 30% fill")
+	before, after = leafPages(0.4)
+	require.Less(t, after, before*2/3, "did not merge pages below 40% fill")
+
+	for _, threshold := range []float64{-0.1, 0.6} {
+		_, err := bolt.Open(filepath.Join(t.TempDir(), "db"), 0666, &bolt.Options{RebalanceThreshold: threshold})
+		require.Error(t, err)
+	}
+}
+
+// Ensure that the freelist region size is set when creating a database and
+// kept when reopening it.
+func TestOptions_FreelistRegionSize(t *testing.T) {
+	pageSize := os.Getpagesize()
+	for _, size := range []int{-pageSize, pageSize / 2, pageSize + 1} {
+		_, err := bolt.Open(filepath.Join(t.TempDir(), "db"), 0666, &bolt.Options{FreelistRegionSize: size})
+		require.Error(t, err, "size %d", size)
+	}
+
+	// fill writes one leaf page per key, then deletes every other key, which
+	// leaves as many free pages apart from each other.
+	fill := func(db *btesting.DB) error {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			require.NoError(t, err)
+			for i := 0; i < 2000; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, pageSize/2)))
+			}
+			return nil
+		}))
+		return db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 2000; i += 2 {
+				require.NoError(t, b.Delete([]byte(fmt.Sprintf("%04d", i))))
+			}
+			return nil
+		})
+	}
+
+	// A freelist too large for its region fails the commit, which leaves
+	// the database as it was.
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{FreelistRegionSize: 4 * pageSize})
+	require.ErrorIs(t, fill(db), bolt.ErrFreelistRegionFull)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 2000, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	}))
+
+	// Regions large enough for it are kept across reopens without the option.
+	db = btesting.MustCreateDBWithOption(t, &bolt.Options{FreelistRegionSize: 64 * pageSize})
+	require.NoError(t, fill(db))
+	db.MustClose()
+	db.SetOptions(nil)
+	db.MustReopen()
+	info, err := bolt.ReadInfo(db.Path())
+	require.NoError(t, err)
+	require.Equal(t, 64*pageSize, info.FreelistRegionSize)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 1000, b.Stats().KeyN)
+		return b.Put([]byte("0000"), []byte("bar"))
+	}))
+	db.MustCheck()
+}
+
+func TestOptions_BatchFree(t *testing.T) {
+	for _, ft := range []bolt.FreelistType{bolt.FreelistArrayType, bolt.FreelistMapType} {
+		t.Run(string(ft), func(t *testing.T) {
+			control := btesting.MustCreateDBWithOption(t, &bolt.Options{FreelistType: ft})
+			db := btesting.MustCreateDBWithOption(t, &bolt.Options{FreelistType: ft, BatchFree: true})
+
+			for _, d := range []*btesting.DB{control, db} {
+				require.NoError(t, d.Update(func(tx *bolt.Tx) error {
+					b, err := tx.CreateBucket([]byte("widgets"))
+					require.NoError(t, err)
+					for i := 0; i < 5000; i++ {
+						require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 200)))
+					}
+					require.NoError(t, b.Put([]byte("large"), make([]byte, 100000)))
+					return nil
+				}))
+
+				// An open reader keeps the freed pages pending.
+				rtx, err := d.Begin(false)
+				require.NoError(t, err)
+
+				// A rolled back delete leaves nothing behind.
+				errRollback := errors.New("rollback")
+				require.ErrorIs(t, d.Update(func(tx *bolt.Tx) error {
+					require.NoError(t, tx.DeleteBucket([]byte("widgets")))
+					return errRollback
+				}), errRollback)
+
+				require.NoError(t, d.Update(func(tx *bolt.Tx) error {
+					b := tx.Bucket([]byte("widgets"))
+					for i := 0; i < 5000; i += 3 {
+						require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+					}
+					return b.Delete([]byte("large"))
+				}))
+				require.Greater(t, d.Stats().PendingPageN, 0)
+				require.NoError(t, rtx.Rollback())
+
+				require.NoError(t, d.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+				}))
+				d.MustCheck()
+			}
+
+			require.Equal(t, control.Stats().FreePageN, db.Stats().FreePageN)
+			require.Equal(t, control.Stats().PendingPageN, db.Stats().PendingPageN)
+
+			db.MustClose()
+			db.MustReopen()
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				require.Equal(t, 3334, tx.Bucket([]byte("widgets")).Stats().KeyN)
+				return nil
+			}))
+		})
+	}
+}
+
+// Ensure that ReclaimPending releases the pages pinned by a closed reader.
+func TestDB_ReclaimPending(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	put := func(i int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000))
+		}))
+	}
+	for i := 0; i < 10; i++ {
+		put(i)
+	}
+
+	// Nothing is pending without readers once a writer has begun.
+	_, err := db.ReclaimPending()
+	require.NoError(t, err)
+	require.Equal(t, 0, db.Stats().PendingPageN)
+
+	reader, err := db.Begin(false)
+	require.NoError(t, err)
+	for i := 10; i < 20; i++ {
+		put(i)
+	}
+	pinned := db.Stats().PendingPageN
+	require.Greater(t, pinned, 0)
+
+	// The reader still pins the pages.
+	n, err := db.ReclaimPending()
+	require.NoError(t, err)
+	require.Less(t, n, pinned)
+	require.Greater(t, db.Stats().PendingPageN, 0)
+
+	require.NoError(t, reader.Rollback())
+	free := db.Stats().FreePageN
+	pending := db.Stats().PendingPageN
+	n, err = db.ReclaimPending()
+	require.NoError(t, err)
+	require.Equal(t, pending, n)
+	require.Equal(t, 0, db.Stats().PendingPageN)
+	require.Equal(t, free+n, db.Stats().FreePageN)
+}
+
 func ExampleDB_Update() {
 	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
@@ -1501,6 +2656,188 @@ func ExampleDB_Begin() {
 	// zephyr likes purple
 }
 
+func BenchmarkDB_Scan_Cold(b *testing.B) {
+	b.Run("Default", func(b *testing.B) { benchmarkDBScanCold(b, false) })
+	b.Run("MmapPopulate", func(b *testing.B) { benchmarkDBScanCold(b, true) })
+}
+
+// benchmarkDBScanCold reopens the database before every full scan so that
+// each iteration starts from a fresh mapping.
+func benchmarkDBScanCold(b *testing.B, populate bool) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{MmapPopulate: populate})
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i++ {
+			if err := bkt.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.MustClose()
+		db.MustReopen()
+		require.NoError(b, db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("bench")).ForEach(func(k, v []byte) error { return nil })
+		}))
+	}
+}
+
+// BenchmarkDB_GetFast compares GetFast with a Get in a read transaction.
+func BenchmarkDB_GetFast(b *testing.B) {
+	db := btesting.MustCreateDB(b)
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10000; i++ {
+			if err := bkt.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	key := []byte(fmt.Sprintf("%08d", 5000))
+
+	b.Run("View", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, db.View(func(tx *bolt.Tx) error {
+				_ = append([]byte(nil), tx.Bucket([]byte("bench")).Get(key)...)
+				return nil
+			}))
+		}
+	})
+	b.Run("GetFast", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetFast([]byte("bench"), key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDB_AllocAlignment(b *testing.B) {
+	b.Run("Default", func(b *testing.B) { benchmarkDBAllocAlignment(b, 0) })
+	b.Run("4096", func(b *testing.B) { benchmarkDBAllocAlignment(b, 4096) })
+}
+
+// benchmarkDBAllocAlignment commits a batch of multi-page values per
+// iteration, each of which is written from an overflow buffer.
+func benchmarkDBAllocAlignment(b *testing.B, align int) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{AllocAlignment: align, NoSync: true})
+	value := make([]byte, 64*1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+			bkt, err := tx.CreateBucketIfNotExists([]byte("bench"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 16; j++ {
+				if err := bkt.Put([]byte(fmt.Sprintf("%04d", j)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+}
+
+func BenchmarkDB_Delete_BatchFree(b *testing.B) {
+	b.Run("Default", func(b *testing.B) { benchmarkDBDeleteBatchFree(b, false) })
+	b.Run("BatchFree", func(b *testing.B) { benchmarkDBDeleteBatchFree(b, true) })
+}
+
+// benchmarkDBDeleteBatchFree times a transaction deleting every other key of
+// a large bucket, which frees most of its pages.
+func benchmarkDBDeleteBatchFree(b *testing.B, batch bool) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{BatchFree: batch, NoSync: true})
+	var keys [][]byte
+	for j := 0; j < 100000; j += 2 {
+		keys = append(keys, []byte(fmt.Sprintf("%08d", j)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+			_ = tx.DeleteBucket([]byte("bench"))
+			_, err := tx.CreateBucket([]byte("bench"))
+			return err
+		}))
+		for j := 0; j < 100000; j += 5000 {
+			require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+				bkt := tx.Bucket([]byte("bench"))
+				for k := j; k < j+5000; k++ {
+					if err := bkt.Put([]byte(fmt.Sprintf("%08d", k)), make([]byte, 500)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		b.StartTimer()
+
+		require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+			_, _, err := tx.Bucket([]byte("bench")).DeleteAll(keys)
+			return err
+		}))
+	}
+}
+
+func BenchmarkDB_MixedInsertDelete_RebalanceThreshold(b *testing.B) {
+	for _, threshold := range []float64{0.1, 0.4} {
+		b.Run(fmt.Sprint(threshold), func(b *testing.B) { benchmarkDBMixedInsertDelete(b, threshold) })
+	}
+}
+
+// benchmarkDBMixedInsertDelete times transactions that each insert and
+// delete random keys of a bucket holding about 50,000 keys.
+func benchmarkDBMixedInsertDelete(b *testing.B, threshold float64) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{RebalanceThreshold: threshold, NoSync: true})
+	for j := 0; j < 50000; j += 5000 {
+		require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+			bkt, err := tx.CreateBucketIfNotExists([]byte("bench"))
+			if err != nil {
+				return err
+			}
+			for k := j; k < j+5000; k++ {
+				if err := bkt.Put([]byte(fmt.Sprintf("%08d", k*2)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte("bench"))
+			for k := 0; k < 1000; k++ {
+				if err := bkt.Put([]byte(fmt.Sprintf("%08d", rnd.Intn(100000))), make([]byte, 100)); err != nil {
+					return err
+				}
+				if err := bkt.Delete([]byte(fmt.Sprintf("%08d", rnd.Intn(100000)))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	b.StopTimer()
+	stats := db.Stats()
+	b.ReportMetric(float64(stats.TxStats.GetWrite())/float64(b.N), "writes/op")
+}
+
 func BenchmarkDBBatchAutomatic(b *testing.B) {
 	db := btesting.MustCreateDB(b)
 
@@ -1714,3 +3051,52 @@ func u64tob(v uint64) []byte {
 	binary.BigEndian.PutUint64(b, v)
 	return b
 }
+
+// Ensure that the background compactor keeps the freelist small under churn.
+func TestOptions_FreelistAutoCompact(t *testing.T) {
+	churn := func(db *btesting.DB) {
+		rnd := rand.New(rand.NewSource(1))
+		for round := 0; round < 20; round++ {
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+				require.NoError(t, err)
+				for i := 0; i < 1000; i++ {
+					key := []byte(fmt.Sprintf("%08d", rnd.Intn(1000000)))
+					require.NoError(t, b.Put(key, make([]byte, 200)))
+				}
+				return nil
+			}))
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				c := tx.Bucket([]byte("widgets")).Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					if rnd.Intn(10) != 0 {
+						require.NoError(t, c.Delete())
+					}
+				}
+				return nil
+			}))
+		}
+		_, err := db.ReclaimPending()
+		require.NoError(t, err)
+	}
+
+	control := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	churn(control)
+	limit := control.Stats().FreePageN / 2
+	require.Greater(t, limit, 0)
+
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{
+		PageSize:                     4096,
+		FreelistAutoCompact:          time.Millisecond,
+		FreelistAutoCompactThreshold: 1e-9,
+	})
+	churn(db)
+	require.Eventually(t, func() bool {
+		return db.Stats().FreePageN < limit
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Close stops the compactor, and the database is still consistent.
+	db.MustClose()
+	db.MustReopen()
+	db.MustCheck()
+}
@@ -1,8 +1,15 @@
 package bbolt
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
@@ -66,3 +73,847 @@ func prepareData(t *testing.T) (string, error) {
 
 	return fileName, nil
 }
+
+func TestDB_VerifyWrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{VerifyWrites: true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	put := func(key string) error {
+		return db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), make([]byte, 3000))
+		})
+	}
+	require.NoError(t, put("foo"))
+
+	// Simulate storage that acknowledges writes but silently drops them.
+	writeAt := db.ops.writeAt
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		return len(b), nil
+	}
+	require.Equal(t, ErrWriteVerifyFailed, put("bar"))
+
+	// The failed commit is rolled back and the database stays usable.
+	db.ops.writeAt = writeAt
+	require.NoError(t, put("baz"))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NotNil(t, b.Get([]byte("foo")))
+		require.Nil(t, b.Get([]byte("bar")))
+		require.NotNil(t, b.Get([]byte("baz")))
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+}
+
+func TestDB_WarmUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, ErrBucketNotFound, db.WarmUp([][]byte{[]byte("missing")}))
+
+	var mu sync.Mutex
+	seen := make(map[pgid]bool)
+	db.ops.readPage = func(id pgid) {
+		mu.Lock()
+		seen[id] = true
+		mu.Unlock()
+	}
+	require.NoError(t, db.WarmUp([][]byte{[]byte("widgets")}))
+	warm := seen
+	branches := 0
+	for id := range warm {
+		if (db.page(id).flags & branchPageFlag) != 0 {
+			branches++
+		}
+	}
+	require.Greater(t, branches, 1)
+
+	// Reads after warming up only touch branch pages that were warmed.
+	seen = make(map[pgid]bool)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 20000; i += 997 {
+			require.NotNil(t, b.Get([]byte(fmt.Sprintf("%08d", i))))
+		}
+		return nil
+	}))
+	for id := range seen {
+		if (db.page(id).flags & branchPageFlag) != 0 {
+			require.True(t, warm[id], "branch page %d was not warmed up", id)
+		}
+	}
+}
+
+func TestTx_Commit_FreelistUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+
+	put := func(key string) error {
+		return db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), []byte("bar"))
+		})
+	}
+	require.NoError(t, put("foo"))
+
+	// Record whether a commit writes into either freelist region.
+	var freelistWrites int
+	lo, hi := int64(2*db.pageSize), int64(2*db.pageSize+2*db.freelistRegionSize)
+	writeAt := db.ops.writeAt
+	db.ops.writeAt = func(b []byte, off int64) (int, error) {
+		if off < hi && off+int64(len(b)) > lo {
+			freelistWrites++
+		}
+		return writeAt(b, off)
+	}
+
+	// A commit that leaves the freelist alone keeps the current region.
+	flid := db.meta().flid
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	}))
+	require.Zero(t, freelistWrites)
+	require.Equal(t, flid, db.meta().flid)
+
+	// The unused freelist buffer goes back to the page pool. The pool may
+	// drop buffers, so only check that most commits reuse one.
+	var allocs int
+	newBuffer := db.pagePool.New
+	db.pagePool.New = func() interface{} {
+		allocs++
+		return newBuffer()
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error { return nil }))
+	}
+	require.Less(t, allocs, 50)
+	db.pagePool.New = newBuffer
+
+	// A commit that frees pages switches to the other region.
+	require.NoError(t, put("baz"))
+	require.Equal(t, 1, freelistWrites)
+	require.Equal(t, flid+1, db.meta().flid)
+
+	// Data and freelist are intact after reopening.
+	require.NoError(t, db.Close())
+	db, err = Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("bar"), b.Get([]byte("foo")))
+		require.Equal(t, []byte("bar"), b.Get([]byte("baz")))
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+}
+
+func TestTx_WillRemap(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Grow the database in large steps until it has been remapped a few
+	// times, checking that the prediction made before each commit matches.
+	var remaps int
+	for i := 0; remaps < 2; i++ {
+		require.Less(t, i, 1000, "database was never remapped")
+
+		tx, err := db.Begin(true)
+		require.NoError(t, err)
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1<<20)))
+
+		predict := make([]bool, 2048)
+		for n := range predict {
+			predict[n] = tx.WillRemap(int64(n * db.pageSize))
+		}
+		pgid, datasz := tx.meta.pgid, db.datasz
+		require.NoError(t, tx.Commit())
+
+		grown := int(db.meta().pgid - pgid)
+		require.Less(t, grown, len(predict))
+		remapped := db.datasz != datasz
+		require.Equal(t, remapped, predict[grown], "commit %d grew by %d pages", i, grown)
+		if remapped {
+			remaps++
+		}
+	}
+}
+
+func TestTx_Check_BoltError(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 1000))
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		root := tx.Bucket([]byte("widgets")).root
+
+		// Corrupt the in-memory freelist so the bucket root looks freed.
+		ids := make([]pgid, db.freelist.count())
+		db.freelist.copyall(ids)
+		db.freelist.readIDs(append(ids, root))
+
+		var found bool
+		for err := range tx.Check() {
+			var berr *BoltError
+			if errors.As(err, &berr) && berr.PageID == int(root) {
+				require.Equal(t, [][]byte{[]byte("widgets")}, berr.BucketPath)
+				require.Contains(t, err.Error(), "reachable freed")
+				found = true
+			}
+		}
+		require.True(t, found)
+		return nil
+	}))
+}
+
+func TestDB_AllocAlignment(t *testing.T) {
+	const align = 4096
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{AllocAlignment: align})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, size := range []int{1, db.pageSize * 2, db.pageSize*5 + 1, 1 << 20} {
+		buf := db.allocBuffer(size)
+		require.Len(t, buf, size)
+		require.Equal(t, size, cap(buf))
+		require.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%align, "size %d", size)
+	}
+
+	errRollback := errors.New("rollback")
+	require.Equal(t, errRollback, db.Update(func(tx *Tx) error {
+		for count := 2; count < 10; count++ {
+			p, err := db.allocate(tx.meta.txid, count)
+			require.NoError(t, err)
+			require.Equal(t, uint32(count-1), p.overflow)
+			require.Zero(t, uintptr(unsafe.Pointer(p))%align, "count %d", count)
+		}
+		return errRollback
+	}))
+}
+
+func TestDB_FreelistFragmentation(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		typ := typ
+		t.Run(string(typ), func(t *testing.T) { testDBFreelistFragmentation(t, typ) })
+	}
+}
+
+func testDBFreelistFragmentation(t *testing.T, typ FreelistType) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{FreelistType: typ})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Zero(t, db.FreelistFragmentation())
+
+	// Free a long run of pages by deleting a large value.
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), make([]byte, 200*db.pageSize))
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("large"))
+	}))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error { return nil }))
+	}
+	require.Greater(t, db.Stats().FreePageN, 200)
+	coalesced := db.FreelistFragmentation()
+
+	// Keep only every other free page, as if the rest had been reused.
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		ids := db.freelist.getFreePageIDs()
+		var scattered []pgid
+		for i := 0; i < len(ids); i += 2 {
+			scattered = append(scattered, ids[i])
+		}
+		db.freelist.readIDs(scattered)
+		return nil
+	}))
+	scattered := db.FreelistFragmentation()
+
+	t.Logf("fragmentation: %.2f scattered, %.2f coalesced", scattered, coalesced)
+	require.Greater(t, scattered, 0.9)
+	require.Less(t, coalesced, 0.1)
+}
+
+func TestDB_ForEachFreeRun(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		typ := typ
+		t.Run(string(typ), func(t *testing.T) { testDBForEachFreeRun(t, typ) })
+	}
+}
+
+func testDBForEachFreeRun(t *testing.T, typ FreelistType) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{FreelistType: typ})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Free a long run of pages by deleting a large value.
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), make([]byte, 100*db.pageSize))
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("large"))
+	}))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error { return nil }))
+	}
+
+	// Keep three runs of known lengths, as if the rest had been reused.
+	var expected [][2]int
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		ids := db.freelist.getFreePageIDs()
+		require.Greater(t, len(ids), 50)
+		var kept []pgid
+		for _, r := range [][2]int{{0, 3}, {10, 5}, {40, 1}} {
+			kept = append(kept, ids[r[0]:r[0]+r[1]]...)
+			expected = append(expected, [2]int{int(ids[r[0]]), r[1]})
+		}
+		db.freelist.readIDs(kept)
+		return nil
+	}))
+
+	// The callback runs on a snapshot, so it can use the database itself.
+	var runs [][2]int
+	db.ForEachFreeRun(func(start, count int) {
+		require.NoError(t, db.View(func(tx *Tx) error { return nil }))
+		runs = append(runs, [2]int{start, count})
+	})
+	require.Equal(t, expected, runs)
+	require.Equal(t, len(expected), db.Stats().FreeRunN)
+}
+
+func TestDB_PagePool_PerDB(t *testing.T) {
+	dir := t.TempDir()
+	db1, err := Open(filepath.Join(dir, "db1"), 0666, &Options{PageSize: 4096})
+	require.NoError(t, err)
+	defer db1.Close()
+	db2, err := Open(filepath.Join(dir, "db2"), 0666, &Options{PageSize: 8192})
+	require.NoError(t, err)
+	defer db2.Close()
+
+	// A stray buffer of the wrong size in a pool is never used for a page.
+	db1.pagePool.Put(make([]byte, 8192))
+	db2.pagePool.Put(make([]byte, 4096))
+
+	for i := 0; i < 20; i++ {
+		for _, db := range []*DB{db1, db2} {
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				for j := 0; j < 100; j++ {
+					if err := b.Put([]byte(fmt.Sprintf("%02d-%03d", i, j)), make([]byte, 100)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+	}
+
+	for _, db := range []*DB{db1, db2} {
+		for i := 0; i < 10; i++ {
+			require.Len(t, db.getPageBuffer(), db.pageSize)
+		}
+		require.NoError(t, db.View(func(tx *Tx) error {
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			require.Equal(t, 2000, tx.Bucket([]byte("widgets")).Stats().KeyN)
+			return nil
+		}))
+	}
+
+	// Buffers of another size are not pooled.
+	db1.putPageBuffer(make([]byte, 8192))
+	for i := 0; i < 10; i++ {
+		require.Len(t, db1.pagePool.Get().([]byte), 4096)
+	}
+}
+
+func TestDB_MaxTreeDepthGuard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+	var root pgid
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("key-%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		require.NotZero(t, tx.page(root).flags&branchPageFlag)
+		return nil
+	}))
+	pageSize := db.pageSize
+	require.NoError(t, db.Close())
+
+	// Point the first child of the root branch page back at the root itself.
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	p := (*page)(unsafe.Pointer(&buf[int(root)*pageSize]))
+	p.branchPageElement(0).pgid = root
+	cyclic := filepath.Join(t.TempDir(), "cyclic.db")
+	require.NoError(t, os.WriteFile(cyclic, buf, 0666))
+
+	db, err = Open(cyclic, 0666, &Options{MaxTreeDepthGuard: 8})
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.MaxTreeDepth()
+	require.ErrorIs(t, err, ErrTreeTooDeep)
+
+	var found bool
+	require.NoError(t, db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			if errors.Is(err, ErrTreeTooDeep) {
+				found = true
+			}
+		}
+		return nil
+	}))
+	require.True(t, found, "Check did not report ErrTreeTooDeep")
+
+	// Cursors stop and report the error through Err.
+	require.NoError(t, db.View(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		k, _ := c.First()
+		require.Nil(t, k)
+		require.ErrorIs(t, c.Err(), ErrTreeTooDeep)
+		k, _ = c.Next()
+		require.Nil(t, k)
+
+		c = tx.Bucket([]byte("widgets")).Cursor()
+		k, _ = c.Seek([]byte("key-0000"))
+		require.Nil(t, k)
+		require.ErrorIs(t, c.Err(), ErrTreeTooDeep)
+
+		err := tx.Bucket([]byte("widgets")).ForEach(func(_, _ []byte) error { return nil })
+		require.ErrorIs(t, err, ErrTreeTooDeep)
+		return nil
+	}))
+
+	// Walking the pages of the bucket returns the error too.
+	require.NoError(t, db.View(func(tx *Tx) error {
+		err := tx.Bucket([]byte("widgets")).forEachPageNode(func(*page, *node, int) {})
+		require.ErrorIs(t, err, ErrTreeTooDeep)
+		return nil
+	}))
+	err = db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	})
+	require.ErrorIs(t, err, ErrTreeTooDeep)
+
+	// The last keys are not reached through the cyclic child.
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("widgets")).Get([]byte("key-0999")))
+		return nil
+	}))
+}
+
+func TestDB_FsyncMode(t *testing.T) {
+	testCases := []struct {
+		mode     FsyncMode
+		expected []string
+	}{
+		{mode: "", expected: []string{"data", "sync", "meta", "sync"}},
+		{mode: FsyncBoth, expected: []string{"data", "sync", "meta", "sync"}},
+		{mode: FsyncMetaOnly, expected: []string{"data", "meta", "sync"}},
+		{mode: FsyncDataOnly, expected: []string{"data", "sync", "meta"}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(string(tc.mode), func(t *testing.T) {
+			db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{FsyncMode: tc.mode, NoGrowSync: true})
+			require.NoError(t, err)
+			defer db.Close()
+
+			// Record the order of data writes, meta writes and syncs.
+			var events []string
+			record := func(e string) {
+				if len(events) == 0 || events[len(events)-1] != e {
+					events = append(events, e)
+				}
+			}
+			writeAt, fdatasync := db.ops.writeAt, db.ops.fdatasync
+			db.ops.writeAt = func(b []byte, off int64) (int, error) {
+				if off < 2*int64(db.pageSize) {
+					record("meta")
+				} else {
+					record("data")
+				}
+				return writeAt(b, off)
+			}
+			db.ops.fdatasync = func(db *DB) error {
+				record("sync")
+				return fdatasync(db)
+			}
+
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("foo"), []byte("bar"))
+			}))
+			require.Equal(t, tc.expected, events)
+		})
+	}
+
+	_, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{FsyncMode: "sometimes"})
+	require.Error(t, err)
+}
+
+func TestDB_StrictModeReturnsError(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{StrictModeReturnsError: true})
+	require.NoError(t, err)
+	defer db.Close()
+	db.StrictMode = true
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 5000))
+	}))
+
+	// Simulate a bug by freeing a page that is still in use.
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		tx.db.freelist.free(tx.meta.txid, tx.page(b.root))
+		_, err := tx.CreateBucket([]byte("lost"))
+		return err
+	})
+	var checkErr *CheckError
+	require.ErrorAs(t, err, &checkErr)
+	require.NotEmpty(t, checkErr.Errors)
+
+	// The transaction was rolled back and the database is still usable.
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		require.Nil(t, tx.Bucket([]byte("lost")))
+		require.Len(t, tx.Bucket([]byte("widgets")).Get([]byte("foo")), 5000)
+		_, err := tx.CreateBucket([]byte("other"))
+		return err
+	}))
+}
+
+func TestCursor_MaxValueRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, &Options{PageSize: 4096})
+	require.NoError(t, err)
+
+	var root pgid
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("bar"), make([]byte, 200)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), make([]byte, 1000)); err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), make([]byte, 10000))
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// Give the first value of the bucket an absurd size.
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	buf := make([]byte, 4096)
+	_, err = f.ReadAt(buf, int64(root)*4096)
+	require.NoError(t, err)
+	elem := (*page)(unsafe.Pointer(&buf[0])).leafPageElement(0)
+	elem.fill(elem.flags(), uintptr(elem.pos()), int(elem.ksize()), 0xFFFFFF)
+	_, err = f.WriteAt(buf, int64(root)*4096)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = Open(path, 0666, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		c.MaxValueRead = 1000
+
+		k, v := c.First()
+		require.Equal(t, []byte("bar"), k)
+		require.Len(t, v, 1000)
+		require.True(t, c.Truncated())
+
+		k, v = c.Next()
+		require.Equal(t, []byte("foo"), k)
+		require.Len(t, v, 1000)
+		require.False(t, c.Truncated())
+
+		k, v = c.Next()
+		require.Equal(t, []byte("large"), k)
+		require.Len(t, v, 1000)
+		require.True(t, c.Truncated())
+
+		// Without a limit the damaged size is taken at face value.
+		c.MaxValueRead = 0
+		_, v = c.First()
+		require.Len(t, v, 0xFFFFFF)
+		require.False(t, c.Truncated())
+		return nil
+	}))
+}
+
+// Ensure that a page whose overflow runs into the next live page is reported
+// as an overlap.
+func TestDB_DetectOverlaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 200; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 500)))
+		}
+		return nil
+	}))
+	overlaps, err := db.DetectOverlaps()
+	require.NoError(t, err)
+	require.Empty(t, overlaps)
+
+	// Find a leaf that is directly followed by another one.
+	var leaf pgid
+	require.NoError(t, db.View(func(tx *Tx) error {
+		starts := make(map[pgid]bool)
+		require.NoError(t, tx.forEachPage(tx.Bucket([]byte("widgets")).root, func(p *page, _ int, _ []pgid) {
+			if p.flags&leafPageFlag != 0 && p.overflow == 0 {
+				starts[p.id] = true
+			}
+		}))
+		for id := range starts {
+			if starts[id+1] && (leaf == 0 || id < leaf) {
+				leaf = id
+			}
+		}
+		return nil
+	}))
+	require.NotZero(t, leaf)
+	pageSize := db.pageSize
+	require.NoError(t, db.Close())
+
+	// Stretch the leaf over its neighbor.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	buf := make([]byte, pageSize)
+	_, err = f.ReadAt(buf, int64(leaf)*int64(pageSize))
+	require.NoError(t, err)
+	(*page)(unsafe.Pointer(&buf[0])).overflow = 1
+	_, err = f.WriteAt(buf, int64(leaf)*int64(pageSize))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	overlaps, err = db.DetectOverlaps()
+	require.NoError(t, err)
+	require.Len(t, overlaps, 1)
+	o := overlaps[0]
+	require.Equal(t, int(leaf+1), o.ID)
+	require.ElementsMatch(t, []int{int(leaf), int(leaf + 1)}, []int{o.Owner, o.Other})
+	require.Equal(t, [][]byte{[]byte("widgets")}, o.Bucket)
+}
+
+func TestTx_CheckWithOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, 0666, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Free a few dozen pages.
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 200; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 500)))
+		}
+		return nil
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error { return nil }))
+
+	collect := func(tx *Tx, options ...CheckOption) []error {
+		var errs []error
+		for err := range tx.CheckWithOptions(options...) {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Empty(t, collect(tx))
+
+		// Forget the free pages so each of them is reported as unreachable.
+		freelist := db.freelist
+		db.freelist = newFreelist(db.FreelistType)
+		defer func() { db.freelist = freelist }()
+
+		errs := collect(tx)
+		require.Greater(t, len(errs), 10)
+		require.Equal(t, errs[:10], collect(tx, WithMaxErrors(10)))
+		require.Equal(t, errs, collect(tx, WithMaxErrors(len(errs)+1)))
+		require.Empty(t, collect(tx, WithFreelistCheck(false)))
+		return nil
+	}))
+}
+
+// Ensure that the changes tracked for Bucket.ChangedSince stay bounded by
+// the retention and are released with deleted buckets.
+func TestDB_ChangesBounded(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{MutationLog: io.Discard, ChangesRetention: 10})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%03d", i)), []byte("1"))
+		}))
+	}
+	path := changesPath([][]byte{[]byte("widgets")})
+	require.LessOrEqual(t, len(db.changes[path]), 20)
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}))
+	require.Empty(t, db.changes)
+}
+
+// Ensure that a GetFast epoch keeps the pages of its snapshot from being
+// reused by later commits until its reader leaves, and that remapping the
+// file unpublishes it.
+func TestDB_FastEpoch(t *testing.T) {
+	// Remapping waits for the reader, so keep the writes from growing the
+	// mapping while it is held.
+	db, err := Open(filepath.Join(t.TempDir(), "db"), 0666, &Options{InitialMmapSize: 1 << 22})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	put := func(v string) {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 100; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%03d", i)), []byte(v)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	put("old")
+
+	e := db.enterFastEpoch()
+	require.NotNil(t, e)
+	var left int32
+	leave := func() {
+		if atomic.CompareAndSwapInt32(&left, 0, 1) {
+			atomic.AddInt64(&e.readers, -1)
+		}
+	}
+	t.Cleanup(leave)
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("new%d", i))
+	}
+	require.Contains(t, db.fastRetired, e)
+
+	// Read the snapshot the way GetFast does.
+	tx := Tx{db: db, meta: &e.meta}
+	tx.root = newBucket(&tx)
+	root := tx.meta.root
+	tx.root.bucket = &root
+	for i := 0; i < 100; i++ {
+		v, err := tx.getCopy([]byte("widgets"), []byte(fmt.Sprintf("%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte("old"), v)
+	}
+	leave()
+
+	// The next writer drops the epochs without readers.
+	put("last")
+	require.NotContains(t, db.fastRetired, e)
+
+	require.NoError(t, db.mmap(db.datasz*2))
+	require.Empty(t, db.fastRetired)
+	v, err := db.GetFast([]byte("widgets"), []byte("000"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("last"), v)
+}
@@ -1,6 +1,11 @@
 package bbolt
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
 
 // These errors can be returned when opening or calling methods on a DB.
 var (
@@ -26,9 +31,17 @@ var (
 	// ErrChecksum is returned when either meta page checksum does not match.
 	ErrChecksum = errors.New("checksum error")
 
+	// ErrFreelistCorrupt is returned when the freelist page does not match
+	// its stored checksum.
+	ErrFreelistCorrupt = errors.New("freelist corrupt")
+
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
+
+	// ErrCloseTimeout is returned when a database cannot be closed because
+	// read transactions are still open after Options.CloseTimeout.
+	ErrCloseTimeout = errors.New("close timeout")
 )
 
 // These errors can occur when beginning or committing a Tx.
@@ -37,6 +50,10 @@ var (
 	// read-only transaction.
 	ErrTxNotWritable = errors.New("tx not writable")
 
+	// ErrTxWritable is returned when performing an operation that needs a
+	// read-only transaction on a writable one.
+	ErrTxWritable = errors.New("tx writable")
+
 	// ErrTxClosed is returned when committing or rolling back a transaction
 	// that has already been committed or rolled back.
 	ErrTxClosed = errors.New("tx closed")
@@ -53,6 +70,42 @@ var (
 	// running, which holds a large number of pending free pages waiting to be
 	// released. At this time, no more write transactions can take place.
 	ErrHighLoadPendingPages = errors.New("too many pending pages")
+
+	// ErrTooManyOverflowPages is returned when a commit needs to allocate a
+	// page with more overflow pages than DB.MaxOverflowPages allows.
+	ErrTooManyOverflowPages = errors.New("too many overflow pages")
+
+	// ErrTooManyPendingPages is returned when a commit would leave more pages
+	// pending release than DB.MaxPendingPages allows.
+	ErrTooManyPendingPages = errors.New("too many pages pending release")
+
+	// ErrTxMemoryExceeded is returned when a write transaction would hold
+	// more memory than Options.TxMemoryBudget allows.
+	ErrTxMemoryExceeded = errors.New("transaction memory budget exceeded")
+
+	// ErrSnapshotExpired is returned by DB.GetAsOf when the pages of the
+	// requested transaction may have been reused.
+	ErrSnapshotExpired = errors.New("snapshot expired")
+
+	// ErrWriteVerifyFailed is returned when DB.VerifyWrites is enabled and a
+	// page read back from the data file differs from what was written.
+	ErrWriteVerifyFailed = errors.New("write verification failed")
+
+	// ErrFreelistRegionFull is returned when committing a transaction whose
+	// freelist would not fit in a freelist region. The transaction is rolled
+	// back. See Options.FreelistRegionSize.
+	ErrFreelistRegionFull = errors.New("freelist region full")
+
+	// ErrChangesUnavailable is returned by Bucket.ChangedSince when the
+	// changes since the requested transaction are not tracked.
+	ErrChangesUnavailable = errors.New("changes unavailable")
+
+	// ErrMutationLogWrite is returned by Tx.Commit when the records of the
+	// transaction could not be fully written to Options.MutationLog. The
+	// transaction is committed regardless. Later write transactions fail
+	// with the same error until the database is reopened, so that no change
+	// goes missing from the log unnoticed.
+	ErrMutationLogWrite = errors.New("mutation log write failed")
 )
 
 // These errors can occur when putting or deleting a value or a bucket.
@@ -76,8 +129,98 @@ var (
 	// ErrValueTooLarge is returned when inserting a value that is larger than MaxValueSize.
 	ErrValueTooLarge = errors.New("value too large")
 
+	// ErrKeyNotFound is returned when moving a key that does not exist.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrInvalidFillPercent is returned when persisting a fill percent that is
+	// outside of the range accepted by Bucket.SetPersistentFillPercent.
+	ErrInvalidFillPercent = errors.New("invalid fill percent")
+
+	// ErrUnknownComparator is returned when a bucket is set to, or opened
+	// with, a comparator that was not registered with RegisterComparator.
+	ErrUnknownComparator = errors.New("unknown comparator")
+
+	// ErrBucketNotEmpty is returned when changing the key order of a bucket
+	// that already holds keys.
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+
+	// ErrPrefixUnordered is returned by prefix operations on a bucket whose
+	// comparator does not keep keys with a common prefix adjacent, which is
+	// any comparator other than BytesComparator.
+	ErrPrefixUnordered = errors.New("keys with a common prefix are not adjacent")
+
+	// ErrTreeTooDeep is returned when walking a B+tree goes deeper than
+	// Options.MaxTreeDepthGuard, which usually means a branch page points
+	// back at one of its ancestors.
+	ErrTreeTooDeep = errors.New("tree too deep")
+
 	// ErrIncompatibleValue is returned when trying create or delete a bucket
 	// on an existing non-bucket key or when trying to create or delete a
 	// non-bucket key on an existing bucket key.
 	ErrIncompatibleValue = errors.New("incompatible value")
+
+	// ErrValueFlagsUnsupported is returned when trying to write a flagged
+	// value into a data file whose format version predates value flags.
+	ErrValueFlagsUnsupported = errors.New("value flags not supported by file format version")
+
+	// ErrBucketSettingsUnsupported is returned when trying to store a
+	// setting with a bucket in a data file whose format version predates
+	// stored bucket settings.
+	ErrBucketSettingsUnsupported = errors.New("bucket settings not supported by file format version")
 )
+
+// BoltError describes where an error occurred. It wraps the underlying error,
+// usually one of the sentinel errors above, so errors.Is still matches the
+// sentinel while errors.As gives access to the context.
+type BoltError struct {
+	// Err is the underlying error.
+	Err error
+
+	// PageID is the page the error was detected on, or zero if unknown or if
+	// the bucket is inline. It is not included in the error message.
+	PageID int
+
+	// BucketPath holds the names of the buckets leading to the bucket
+	// the error occurred in, outermost first. It is nil for the root bucket.
+	BucketPath [][]byte
+
+	// Key is the key the operation was applied to, if any.
+	Key []byte
+}
+
+func (e *BoltError) Error() string {
+	msg := e.Err.Error()
+	if len(e.BucketPath) > 0 {
+		msg += fmt.Sprintf(" (bucket %q", bytes.Join(e.BucketPath, []byte("/")))
+		if e.Key != nil {
+			msg += fmt.Sprintf(", key %q", e.Key)
+		}
+		msg += ")"
+	} else if e.Key != nil {
+		msg += fmt.Sprintf(" (key %q)", e.Key)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *BoltError) Unwrap() error {
+	return e.Err
+}
+
+// CheckError aggregates the inconsistencies found by the check run on Open
+// when Options.CheckOnOpen is set.
+type CheckError struct {
+	// Errors holds every problem reported by Tx.Check, in order.
+	Errors []error
+}
+
+// Error returns the number of problems found followed by each of them.
+func (e *CheckError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "consistency check failed with %d error(s)", len(e.Errors))
+	for _, err := range e.Errors {
+		buf.WriteString("; ")
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
@@ -0,0 +1,386 @@
+package bbolt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ExportDB writes the bucket and all of its nested buckets into a new
+// standalone database at path. The bucket becomes the sole top-level bucket
+// of the new database, keeping its name and sequence. The new database uses
+// the same page size and freelist type as the source database.
+//
+// The file at path must not already contain a bucket with the same name.
+// Use Tx.ImportDB or Bucket.ImportDB to load the exported bucket back.
+func (b *Bucket) ExportDB(path string) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if b.name == nil {
+		return ErrBucketNameRequired
+	}
+
+	mode := os.FileMode(0666)
+	if info, err := b.tx.db.file.Stat(); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	dst, err := Open(path, mode, &Options{
+		PageSize:     b.tx.db.pageSize,
+		FreelistType: b.tx.db.FreelistType,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = dst.Update(func(tx *Tx) error {
+		child, err := tx.CreateBucket(b.name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, b)
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ImportDB loads the sole top-level bucket of the standalone database at
+// path, as written by Bucket.ExportDB, into the root of the transaction.
+// Returns ErrBucketExists if a bucket with the same name already exists.
+func (tx *Tx) ImportDB(path string) error {
+	return tx.root.ImportDB(path)
+}
+
+// ImportDB loads the sole top-level bucket of the standalone database at
+// path, as written by Bucket.ExportDB, as a nested bucket of b.
+// Returns ErrBucketExists if a bucket with the same name already exists.
+func (b *Bucket) ImportDB(path string) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	src, err := Open(path, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return src.View(func(tx *Tx) error {
+		var name []byte
+		var n int
+		if err := tx.ForEach(func(k []byte, _ *Bucket) error {
+			name = k
+			n++
+			return nil
+		}); err != nil {
+			return err
+		}
+		if n != 1 {
+			return fmt.Errorf("import: expected a single top-level bucket, found %d", n)
+		}
+
+		child, err := b.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, tx.Bucket(name))
+	})
+}
+
+// ShardTo splits the contents of the transaction across len(writers)
+// independent databases and writes each one to its writer as a complete
+// database file. shardFn chooses the shard of every key in a top-level bucket
+// by returning its index in writers; nested buckets are kept whole in the
+// shard chosen for their key. Every shard gets all top-level buckets, with
+// their sequences, even if they end up empty. The shards use the same page
+// size and freelist type as the source database and are built in temporary
+// files, so enough disk space for all of them is needed.
+func (tx *Tx) ShardTo(writers []io.Writer, shardFn func(key []byte) int) (err error) {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if len(writers) == 0 {
+		return fmt.Errorf("shard: no writers")
+	}
+
+	dir, err := os.MkdirTemp("", "bolt-shard-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// Build every shard in a single write transaction.
+	shards := make([]*DB, len(writers))
+	txs := make([]*Tx, len(writers))
+	defer func() {
+		for i, db := range shards {
+			if db == nil {
+				continue
+			}
+			if txs[i] != nil {
+				_ = txs[i].Rollback()
+			}
+			if cerr := db.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}()
+	for i := range writers {
+		if shards[i], err = Open(filepath.Join(dir, fmt.Sprintf("shard-%d.db", i)), 0600, &Options{
+			PageSize:     tx.db.pageSize,
+			FreelistType: tx.db.FreelistType,
+			NoSync:       true,
+		}); err != nil {
+			return err
+		}
+		if txs[i], err = shards[i].Begin(true); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.ForEach(func(name []byte, src *Bucket) error {
+		dsts := make([]*Bucket, len(txs))
+		for i, stx := range txs {
+			b, err := stx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+			if err := copyBucketSettings(b, src); err != nil {
+				return err
+			}
+			dsts[i] = b
+		}
+
+		c := src.Cursor()
+		for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+			i := shardFn(k)
+			if i < 0 || i >= len(dsts) {
+				return fmt.Errorf("shard: key %q mapped to shard %d of %d", k, i, len(dsts))
+			}
+			if (flags & bucketLeafFlag) == 0 {
+				if err := dsts[i].put(k, cloneBytes(v), flags&FlaggedValue); err != nil {
+					return err
+				}
+				continue
+			}
+			child, err := dsts[i].CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(child, src.childBucket(k, v)); err != nil {
+				return err
+			}
+		}
+		return c.err
+	}); err != nil {
+		return err
+	}
+
+	for i, stx := range txs {
+		txs[i] = nil
+		if err := stx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	// Stream the finished files out.
+	for i, db := range shards {
+		shards[i] = nil
+		path := db.Path()
+		if err := db.Close(); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writers[i], f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge copies every bucket, nested bucket and key/value pair of src into
+// the transaction, reading src in a read-only transaction of its own. Keys
+// that only exist in src are added as they are. When a key exists in both,
+// resolve is called with the key, the current value and the value from src,
+// and returns the value to keep; returning nil deletes the key. The slices
+// passed to resolve are only valid for the duration of the call. Bucket
+// sequences become the larger of the two.
+//
+// Returns ErrIncompatibleValue if a key is a nested bucket in one database
+// and a plain value in the other. Changes made before an error are not
+// undone; roll back the transaction to discard them.
+func (tx *Tx) Merge(src *DB, resolve func(key, existing, incoming []byte) []byte) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	return src.View(func(stx *Tx) error {
+		return mergeBucket(&tx.root, &stx.root, resolve)
+	})
+}
+
+// mergeBucket recursively merges src into dst as described by Tx.Merge.
+func mergeBucket(dst, src *Bucket, resolve func(key, existing, incoming []byte) []byte) error {
+	if src.Sequence() > dst.Sequence() {
+		if err := dst.SetSequence(src.Sequence()); err != nil {
+			return err
+		}
+	}
+
+	sc := src.Cursor()
+	for k, v, flags := sc.first(); k != nil; k, v, flags = sc.next() {
+		c := dst.Cursor()
+		ek, ev, eflags := c.seek(k)
+		if c.err != nil {
+			return c.err
+		}
+		exists := bytes.Equal(k, ek)
+		if exists && (eflags&bucketLeafFlag) != (flags&bucketLeafFlag) {
+			return c.wrapError(ErrIncompatibleValue, k)
+		}
+
+		if (flags & bucketLeafFlag) != 0 {
+			if exists {
+				existing, err := dst.OpenBucket(k)
+				if err != nil {
+					return err
+				}
+				if err := mergeBucket(existing, src.childBucket(k, v), resolve); err != nil {
+					return err
+				}
+				continue
+			}
+			child, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(child, src.childBucket(k, v)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !exists {
+			if err := dst.put(k, cloneBytes(v), flags&FlaggedValue); err != nil {
+				return err
+			}
+			continue
+		}
+
+		winner := resolve(k, ev, v)
+		if winner == nil {
+			if err := dst.Delete(k); err != nil {
+				return err
+			}
+		} else if !bytes.Equal(winner, ev) {
+			if err := dst.put(k, cloneBytes(winner), flags&FlaggedValue); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.err
+}
+
+// copyBucket recursively copies all keys, value flags, nested buckets,
+// sequences and stored settings from src into dst.
+func copyBucket(dst, src *Bucket) error {
+	if err := copyBucketSettings(dst, src); err != nil {
+		return err
+	}
+
+	c := src.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if (flags & bucketLeafFlag) == 0 {
+			if err := dst.put(k, cloneBytes(v), flags&FlaggedValue); err != nil {
+				return err
+			}
+			continue
+		}
+
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(child, src.childBucket(k, v)); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// copyBucketSettings copies the sequence of src and the settings stored with
+// it, its comparator and persisted fill percent, to the empty bucket dst.
+func copyBucketSettings(dst, src *Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	if err := dst.SetComparator(src.Comparator()); err != nil {
+		return err
+	}
+	return dst.SetPersistentFillPercent(src.PersistentFillPercent())
+}
+
+// Equal reports whether the databases at aPath and bPath hold the same
+// buckets, keys, values and value flags, and the same bucket sequences,
+// however their pages are laid out. Both files are opened read-only, so it
+// can be used to verify a backup or a migration.
+func Equal(aPath, bPath string) (bool, error) {
+	a, err := Open(aPath, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+
+	b, err := Open(bPath, 0666, &Options{ReadOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	var equal bool
+	err = a.View(func(atx *Tx) error {
+		return b.View(func(btx *Tx) error {
+			equal = bucketsEqual(&atx.root, &btx.root)
+			return nil
+		})
+	})
+	return equal, err
+}
+
+// bucketsEqual recursively compares the contents of two buckets as described
+// by Equal.
+func bucketsEqual(a, b *Bucket) bool {
+	if a.Sequence() != b.Sequence() {
+		return false
+	}
+
+	ac, bc := a.Cursor(), b.Cursor()
+	ak, av, aflags := ac.first()
+	bk, bv, bflags := bc.first()
+	for ; ak != nil && bk != nil; ak, av, aflags = ac.next() {
+		if !bytes.Equal(ak, bk) || aflags != bflags {
+			return false
+		}
+		if (aflags & bucketLeafFlag) != 0 {
+			if !bucketsEqual(a.childBucket(ak, av), b.childBucket(bk, bv)) {
+				return false
+			}
+		} else if !bytes.Equal(av, bv) {
+			return false
+		}
+		bk, bv, bflags = bc.next()
+	}
+	return ak == nil && bk == nil && ac.err == nil && bc.err == nil
+}
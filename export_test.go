@@ -0,0 +1,338 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// Ensure that an exported bucket can be opened as a standalone database.
+func TestBucket_ExportDB(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	path := filepath.Join(t.TempDir(), "shard")
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("other"))
+		require.NoError(t, err)
+
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(42))
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		require.NoError(t, err)
+		require.NoError(t, sub.PutFlagged([]byte("foo"), []byte("bar")))
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).ExportDB(path)
+	})
+	require.NoError(t, err)
+
+	shard := btesting.MustOpenDBWithOption(t, path, nil)
+	err = shard.View(func(tx *bolt.Tx) error {
+		var names []string
+		require.NoError(t, tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		}))
+		require.Equal(t, []string{"widgets"}, names)
+
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, uint64(42), b.Sequence())
+		require.Equal(t, []byte("value-999"), b.Get([]byte("0999")))
+		c := b.Bucket([]byte("sub")).Cursor()
+		k, v := c.First()
+		require.Equal(t, []byte("foo"), k)
+		require.Equal(t, []byte("bar"), v)
+		require.Equal(t, uint32(bolt.FlaggedValue), c.Flags())
+		require.Equal(t, 1002, b.Stats().KeyN)
+
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that an exported bucket can be imported into another database.
+func TestTx_ImportDB(t *testing.T) {
+	src := btesting.MustCreateDB(t)
+	path := filepath.Join(t.TempDir(), "shard")
+
+	err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("bar")))
+		return b.ExportDB(path)
+	})
+	require.NoError(t, err)
+
+	dst := btesting.MustCreateDB(t)
+	err = dst.Update(func(tx *bolt.Tx) error {
+		return tx.ImportDB(path)
+	})
+	require.NoError(t, err)
+
+	err = dst.Update(func(tx *bolt.Tx) error {
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		require.ErrorIs(t, tx.ImportDB(path), bolt.ErrBucketExists)
+
+		parent, err := tx.CreateBucket([]byte("parent"))
+		require.NoError(t, err)
+		require.NoError(t, parent.ImportDB(path))
+		require.Equal(t, []byte("bar"), parent.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Ensure that a transaction can be split into shards by key.
+func TestTx_ShardTo(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("empty"))
+		require.NoError(t, err)
+
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(7))
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		sub, err := b.CreateBucket([]byte("sub1"))
+		require.NoError(t, err)
+		return sub.Put([]byte("foo"), []byte("bar"))
+	})
+	require.NoError(t, err)
+
+	// Shard by the parity of the last byte of the key.
+	parity := func(k []byte) int { return int(k[len(k)-1] % 2) }
+	var bufs [2]bytes.Buffer
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return tx.ShardTo([]io.Writer{&bufs[0], &bufs[1]}, parity)
+	}))
+
+	var total int
+	for i := range bufs {
+		path := filepath.Join(t.TempDir(), "shard")
+		require.NoError(t, os.WriteFile(path, bufs[i].Bytes(), 0600))
+		shard, err := bolt.Open(path, 0600, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, shard.View(func(tx *bolt.Tx) error {
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			require.NotNil(t, tx.Bucket([]byte("empty")))
+
+			b := tx.Bucket([]byte("widgets"))
+			require.Equal(t, uint64(7), b.Sequence())
+			return b.ForEach(func(k, v []byte) error {
+				require.Equal(t, i, parity(k), "key %q in shard %d", k, i)
+				if v == nil {
+					require.Equal(t, []byte("bar"), b.Bucket(k).Get([]byte("foo")))
+				} else {
+					require.Equal(t, fmt.Sprintf("value-%d", mustAtoi(t, string(k))), string(v))
+				}
+				total++
+				return nil
+			})
+		}))
+		require.NoError(t, shard.Close())
+	}
+	require.Equal(t, 1001, total)
+
+	// Keys mapped outside of the writers are rejected.
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ShardTo([]io.Writer{io.Discard}, func([]byte) int { return 1 })
+	})
+	require.Error(t, err)
+}
+
+func mustAtoi(t testing.TB, s string) int {
+	n, err := strconv.Atoi(s)
+	require.NoError(t, err)
+	return n
+}
+
+// Ensure that Merge copies another database and resolves conflicts.
+func TestTx_Merge(t *testing.T) {
+	dst := btesting.MustCreateDB(t)
+	src := btesting.MustCreateDB(t)
+
+	require.NoError(t, dst.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(5))
+		require.NoError(t, b.Put([]byte("a"), []byte("3")))
+		require.NoError(t, b.Put([]byte("b"), []byte("9")))
+		require.NoError(t, b.Put([]byte("c"), []byte("1")))
+		require.NoError(t, b.Put([]byte("gone"), []byte("1")))
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		return child.Put([]byte("x"), []byte("1"))
+	}))
+	require.NoError(t, src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.SetSequence(10))
+		require.NoError(t, b.Put([]byte("a"), []byte("7")))
+		require.NoError(t, b.Put([]byte("b"), []byte("2")))
+		require.NoError(t, b.Put([]byte("d"), []byte("4")))
+		require.NoError(t, b.Put([]byte("gone"), []byte("2")))
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		require.NoError(t, child.Put([]byte("x"), []byte("5")))
+		require.NoError(t, child.Put([]byte("y"), []byte("6")))
+
+		other, err := tx.CreateBucket([]byte("gadgets"))
+		require.NoError(t, err)
+		return other.Put([]byte("foo"), []byte("bar"))
+	}))
+
+	var conflicts []string
+	require.NoError(t, dst.Update(func(tx *bolt.Tx) error {
+		return tx.Merge(src.DB, func(key, existing, incoming []byte) []byte {
+			conflicts = append(conflicts, string(key))
+			if bytes.Equal(key, []byte("gone")) {
+				return nil
+			}
+			if bytes.Compare(incoming, existing) > 0 {
+				return incoming
+			}
+			return existing
+		})
+	}))
+	require.Equal(t, []string{"a", "b", "gone", "x"}, conflicts)
+
+	require.NoError(t, dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, uint64(10), b.Sequence())
+		require.Equal(t, []byte("7"), b.Get([]byte("a")))
+		require.Equal(t, []byte("9"), b.Get([]byte("b")))
+		require.Equal(t, []byte("1"), b.Get([]byte("c")))
+		require.Equal(t, []byte("4"), b.Get([]byte("d")))
+		require.Nil(t, b.Get([]byte("gone")))
+
+		child := b.Bucket([]byte("nested"))
+		require.Equal(t, []byte("5"), child.Get([]byte("x")))
+		require.Equal(t, []byte("6"), child.Get([]byte("y")))
+
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("gadgets")).Get([]byte("foo")))
+		return nil
+	}))
+}
+
+// Ensure that Merge rejects a key that is a bucket on one side only.
+func TestTx_Merge_IncompatibleValue(t *testing.T) {
+	dst := btesting.MustCreateDB(t)
+	src := btesting.MustCreateDB(t)
+
+	require.NoError(t, dst.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		return b.Put([]byte("foo"), []byte("bar"))
+	}))
+	require.NoError(t, src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		_, err = b.CreateBucket([]byte("foo"))
+		return err
+	}))
+
+	err := dst.Update(func(tx *bolt.Tx) error {
+		return tx.Merge(src.DB, func(key, existing, incoming []byte) []byte { return incoming })
+	})
+	require.ErrorIs(t, err, bolt.ErrIncompatibleValue)
+}
+
+// Ensure that Equal compares contents rather than page layout.
+func TestEqual(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(strconv.Itoa(i))))
+		}
+		require.NoError(t, b.PutFlagged([]byte("flagged"), []byte("yes")))
+		child, err := b.CreateBucket([]byte("nested"))
+		require.NoError(t, err)
+		return child.Put([]byte("foo"), []byte("bar"))
+	}))
+	// Leave free pages behind so that the compacted copy is laid out
+	// differently.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i += 2 {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%04d", i))))
+		}
+		return nil
+	}))
+
+	dir := t.TempDir()
+	copyPath := filepath.Join(dir, "copy.db")
+	require.NoError(t, db.CopyFile(copyPath, 0600))
+	compactPath := filepath.Join(dir, "compact.db")
+	compacted, err := bolt.Open(compactPath, 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, bolt.Compact(compacted, db.DB, 0))
+	require.NoError(t, compacted.Close())
+	db.MustClose()
+
+	equal, err := bolt.Equal(db.Path(), copyPath)
+	require.NoError(t, err)
+	require.True(t, equal)
+	equal, err = bolt.Equal(db.Path(), compactPath)
+	require.NoError(t, err)
+	require.True(t, equal)
+
+	mutations := []func(tx *bolt.Tx) error{
+		func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("0001"), []byte("changed"))
+		},
+		func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("9999"), []byte("extra"))
+		},
+		func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put([]byte("flagged"), []byte("yes"))
+		},
+		func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Bucket([]byte("nested")).Delete([]byte("foo"))
+		},
+		func(tx *bolt.Tx) error {
+			_, err := tx.Bucket([]byte("widgets")).NextSequence()
+			return err
+		},
+	}
+	for i, mutate := range mutations {
+		path := filepath.Join(dir, fmt.Sprintf("mutated-%d.db", i))
+		data, err := os.ReadFile(copyPath)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0600))
+
+		mutated, err := bolt.Open(path, 0600, nil)
+		require.NoError(t, err)
+		require.NoError(t, mutated.Update(mutate))
+		require.NoError(t, mutated.Close())
+
+		equal, err := bolt.Equal(db.Path(), path)
+		require.NoError(t, err)
+		require.False(t, equal, "mutation %d", i)
+	}
+}
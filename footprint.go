@@ -0,0 +1,214 @@
+package bbolt
+
+import (
+	"sort"
+)
+
+// FootprintBytes returns the number of bytes the database will span once the
+// transaction commits, that is its high water mark after the commit times the
+// page size. It works out how the changed nodes will be split and which pages
+// they will take from the freelist without writing anything, so it can be
+// used to enforce a size limit before calling Commit. The file itself may be
+// larger, as it grows in chunks of AllocSize.
+//
+// Nodes changed by deletions are rebalanced first, as Commit would do. Which
+// free pages a commit reuses depends on the order nested buckets are written
+// in, so when the free pages are fragmented the result can be off by the
+// pages of a node that spans several pages. For a read-only transaction it
+// returns Size().
+func (tx *Tx) FootprintBytes() int64 {
+	if tx.db == nil {
+		return 0
+	} else if !tx.writable {
+		return tx.Size()
+	}
+
+	tx.root.rebalance()
+
+	fp := &footprint{tx: tx, hwm: tx.meta.pgid, values: make(map[*node]map[string]int)}
+	fp.freelist = newFreelist(tx.db.freelist.freelistType)
+	fp.freelist.readIDs(append([]pgid(nil), tx.db.freelist.getFreePageIDs()...))
+	fp.bucket(&tx.root)
+	return int64(fp.hwm) * int64(tx.db.pageSize)
+}
+
+// footprint simulates the spill of a transaction.
+type footprint struct {
+	tx       *Tx
+	freelist *freelist // a copy of the free pages to allocate from
+	hwm      pgid
+
+	// values holds the sizes of the bucket values of leaf nodes that the
+	// spill of their nested buckets will change.
+	values map[*node]map[string]int
+}
+
+// footprintElem is an element of a simulated node.
+type footprintElem struct {
+	keySize int // size of the key
+	size    int // size of the element on its page
+}
+
+// bucket follows Bucket.spill.
+func (fp *footprint) bucket(b *Bucket) {
+	for name, child := range b.buckets {
+		var size int
+		if child.inlineable() {
+			size = bucketHeaderSize + child.rootNode.size()
+		} else {
+			fp.bucket(child)
+			size = bucketHeaderSize
+		}
+		size += len(child.trailer())
+
+		if child.rootNode == nil {
+			continue
+		}
+
+		// The spill updates the value in the parent's leaf, which comes
+		// into being as a node just as it does here.
+		c := b.Cursor()
+		c.seek([]byte(name))
+		n := c.node()
+		if fp.values[n] == nil {
+			fp.values[n] = make(map[string]int)
+		}
+		fp.values[n][name] = size
+	}
+
+	if b.rootNode == nil {
+		return
+	}
+
+	// A root that splits gets a new branch root above it, which may split
+	// in turn.
+	pieces := fp.node(b.rootNode)
+	for len(pieces) > 1 {
+		elems := make([]footprintElem, len(pieces))
+		for i, p := range pieces {
+			elems[i] = footprintElem{keySize: p.keySize, size: int(branchPageElementSize) + p.keySize}
+		}
+		pieces = fp.split(b, false, elems)
+	}
+}
+
+// node follows node.spill, and returns the first element of each of the
+// nodes that n is split into, as they will appear in n's parent.
+func (fp *footprint) node(n *node) []footprintElem {
+	var elems []footprintElem
+	if n.isLeaf {
+		values, elsz := fp.values[n], int(n.pageElementSize())
+		for _, inode := range n.inodes {
+			vsize := len(inode.value)
+			if size, ok := values[string(inode.key)]; ok {
+				vsize = size
+			}
+			elems = append(elems, footprintElem{
+				keySize: len(inode.key),
+				size:    elsz + len(inode.key) + vsize,
+			})
+		}
+	} else {
+		// Spill the children in the same order as node.spill, and replace
+		// each child's element with one for every node it is split into.
+		children := make(nodes, len(n.children))
+		copy(children, n.children)
+		sort.Sort(children)
+		pieces := make(map[string][]footprintElem, len(children))
+		for _, child := range children {
+			pieces[string(child.key)] = fp.node(child)
+		}
+		for _, inode := range n.inodes {
+			if ps, ok := pieces[string(inode.key)]; ok {
+				for _, p := range ps {
+					elems = append(elems, footprintElem{keySize: p.keySize, size: int(branchPageElementSize) + p.keySize})
+				}
+				continue
+			}
+			elems = append(elems, footprintElem{keySize: len(inode.key), size: int(branchPageElementSize) + len(inode.key)})
+		}
+	}
+	return fp.split(n.bucket, n.isLeaf, elems)
+}
+
+// split follows node.split and allocates a page run for every resulting
+// node, returning the first element of each.
+func (fp *footprint) split(b *Bucket, isLeaf bool, elems []footprintElem) []footprintElem {
+	pageSize := fp.tx.db.pageSize
+	var firsts []footprintElem
+	for {
+		n := len(elems)
+		if i := fp.splitIndex(b, isLeaf, elems); i > 0 {
+			n = i
+		}
+
+		size := int(pageHeaderSize)
+		for _, e := range elems[:n] {
+			size += e.size
+		}
+		fp.allocate((size + pageSize - 1) / pageSize)
+		if len(elems) > 0 {
+			firsts = append(firsts, elems[0])
+		} else {
+			firsts = append(firsts, footprintElem{})
+		}
+
+		if n == len(elems) {
+			return firsts
+		}
+		elems = elems[n:]
+	}
+}
+
+// splitIndex follows node.splitTwo, returning where elems are split or 0 if
+// they fit a single node.
+func (fp *footprint) splitIndex(b *Bucket, isLeaf bool, elems []footprintElem) int {
+	pageSize := fp.tx.db.pageSize
+
+	size, huge := int(pageHeaderSize), false
+	for _, e := range elems {
+		size += e.size
+		huge = huge || e.size > hugeElementSize
+	}
+	if size < pageSize {
+		return 0
+	}
+	minKeys := minKeysPerPage
+	if isLeaf && huge {
+		minKeys = 1
+	} else if len(elems) <= minKeysPerPage*2 {
+		return 0
+	}
+	if len(elems) < 2*minKeys {
+		return 0
+	}
+
+	var fillPercent = b.FillPercent
+	if fillPercent < minFillPercent {
+		fillPercent = minFillPercent
+	} else if fillPercent > maxFillPercent {
+		fillPercent = maxFillPercent
+	}
+	threshold := int(float64(pageSize) * fillPercent)
+
+	index, sz := 0, int(pageHeaderSize)
+	for i := 0; i < len(elems)-minKeys; i++ {
+		index = i
+		if index >= minKeys && sz+elems[i].size > threshold {
+			break
+		}
+		sz += elems[i].size
+	}
+	if index < minKeys {
+		index = minKeys
+	}
+	return index
+}
+
+// allocate takes count contiguous pages from the copy of the freelist, or
+// from the end of the database.
+func (fp *footprint) allocate(count int) {
+	if fp.freelist.allocate(fp.tx.meta.txid, count) == 0 {
+		fp.hwm += pgid(count)
+	}
+}
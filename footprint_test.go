@@ -0,0 +1,85 @@
+package bbolt_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// Ensure that FootprintBytes predicts the size of the database after commit.
+func TestTx_FootprintBytes(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	rnd := rand.New(rand.NewSource(1))
+
+	// commit runs fn in a write transaction and checks the footprint it
+	// reports just before committing.
+	commit := func(fn func(tx *bolt.Tx)) {
+		tx, err := db.Begin(true)
+		require.NoError(t, err)
+		fn(tx)
+		footprint := tx.FootprintBytes()
+		require.NoError(t, tx.Commit())
+
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			require.Equal(t, tx.Size(), footprint)
+			require.Equal(t, tx.Size(), tx.FootprintBytes())
+			return nil
+		}))
+		fi, err := os.Stat(db.Path())
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, fi.Size(), footprint)
+	}
+
+	// Growing a new database, with a root split, large values and nested
+	// buckets both inline and not.
+	commit(func(tx *bolt.Tx) {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, i := range rnd.Perm(5000) {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, rnd.Intn(200))))
+		}
+		require.NoError(t, b.Put([]byte("large"), make([]byte, 50000)))
+		for i := 0; i < 20; i++ {
+			sub, err := b.CreateBucket([]byte(fmt.Sprintf("sub%02d", i)))
+			require.NoError(t, err)
+			for j := 0; j < i*20; j++ {
+				require.NoError(t, sub.Put([]byte(fmt.Sprintf("%03d", j)), make([]byte, 10)))
+			}
+		}
+	})
+
+	// Freeing pages, then reusing them alongside new ones.
+	commit(func(tx *bolt.Tx) {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 5000; i += 2 {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%05d", i))))
+		}
+		require.NoError(t, b.Delete([]byte("large")))
+		require.NoError(t, b.DeleteBucket([]byte("sub19")))
+	})
+	commit(func(tx *bolt.Tx) {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 10000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("x%05d", rnd.Intn(100000))), make([]byte, 100)))
+		}
+		// Move a bucket out of line and another one in.
+		for j := 0; j < 200; j++ {
+			require.NoError(t, b.Bucket([]byte("sub01")).Put([]byte(fmt.Sprintf("%03d", j)), make([]byte, 10)))
+		}
+		c := b.Bucket([]byte("sub18")).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			require.NoError(t, c.Delete())
+		}
+		_, err := tx.CreateBucket([]byte("empty"))
+		require.NoError(t, err)
+	})
+
+	// A transaction that changes nothing leaves the size as it is.
+	commit(func(tx *bolt.Tx) {})
+}
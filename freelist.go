@@ -1,19 +1,40 @@
 package bbolt
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
 	"sort"
 	"unsafe"
 )
 
+// freelistChecksumSize is the size of the checksum that is stored right
+// after the page ids of a freelist page.
+const freelistChecksumSize = 8
+
 // txPending holds a list of pgids and corresponding allocation txns
 // that are pending to be freed.
 type txPending struct {
 	ids              []pgid
 	alloctx          []txid // txids allocating the ids
 	lastReleaseBegin txid   // beginning txid of last matching releaseRange
+	minReleaseBegin  txid   // lowest beginning txid of any matching releaseRange
+}
+
+// batchedFree is a page, along with its overflow pages, freed while the
+// freelist batches frees.
+type batchedFree struct {
+	id       pgid
+	overflow uint32
+	alloctx  txid // txid allocating the page
 }
 
+type batchedFrees []batchedFree
+
+func (s batchedFrees) Len() int           { return len(s) }
+func (s batchedFrees) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s batchedFrees) Less(i, j int) bool { return s[i].id < s[j].id }
+
 // pidSet holds the set of starting pgids which have the same span size
 type pidSet map[pgid]struct{}
 
@@ -33,6 +54,9 @@ type freelist struct {
 	mergeSpans     func(ids pgids)             // the mergeSpan func
 	getFreePageIDs func() []pgid               // get free pgids func
 	readIDs        func(pgids []pgid)          // readIDs func reads list of pages and init the freelist
+	batchFree      bool                        // collect freed pages in batch until flushBatch
+	batch          []batchedFree               // pages freed by the current write transaction
+	checksum       bool                        // end written pages with a checksum
 }
 
 // newFreelist returns an empty, initialized freelist.
@@ -71,7 +95,11 @@ func (f *freelist) size() int {
 		// The first element will be used to store the count. See freelist.write.
 		n++
 	}
-	return int(pageHeaderSize) + (int(unsafe.Sizeof(pgid(0))) * n)
+	size := int(pageHeaderSize) + (int(unsafe.Sizeof(pgid(0))) * n)
+	if f.checksum {
+		size += freelistChecksumSize
+	}
+	return size
 }
 
 // count returns count of pages on the freelist
@@ -84,6 +112,56 @@ func (f *freelist) arrayFreeCount() int {
 	return len(f.ids)
 }
 
+// freeRun is a contiguous run of free pages.
+type freeRun struct {
+	start pgid
+	count uint64
+}
+
+// runs returns the contiguous runs of free pages, ordered by start page.
+func (f *freelist) runs() []freeRun {
+	var runs []freeRun
+	if f.freelistType == FreelistMapType {
+		runs = make([]freeRun, 0, len(f.forwardMap))
+		for start, size := range f.forwardMap {
+			runs = append(runs, freeRun{start: start, count: size})
+		}
+		sort.Slice(runs, func(i, j int) bool { return runs[i].start < runs[j].start })
+		return runs
+	}
+	for i, id := range f.ids {
+		if i == 0 || id != f.ids[i-1]+1 {
+			runs = append(runs, freeRun{start: id})
+		}
+		runs[len(runs)-1].count++
+	}
+	return runs
+}
+
+// trimTail removes the run of free pages that ends just below the high water
+// mark hwm, if any, and returns the new high water mark.
+func (f *freelist) trimTail(hwm pgid) pgid {
+	start := hwm
+	if f.freelistType == FreelistMapType {
+		if size, ok := f.backwardMap[hwm-1]; ok {
+			start = hwm - pgid(size)
+			f.delSpan(start, size)
+		}
+	} else {
+		i := len(f.ids)
+		for i > 0 && f.ids[i-1] == start-1 {
+			i--
+			start--
+		}
+		f.ids = f.ids[:i]
+	}
+
+	for id := start; id < hwm; id++ {
+		delete(f.cache, id)
+	}
+	return start
+}
+
 // pending_count returns count of pending pages
 func (f *freelist) pending_count() int {
 	var count int
@@ -93,6 +171,29 @@ func (f *freelist) pending_count() int {
 	return count
 }
 
+// pendingCountBefore returns count of pending pages freed by transactions
+// before tid, which are the pages that readers may still hold.
+func (f *freelist) pendingCountBefore(tid txid) int {
+	count := f.pending_count()
+	if txp := f.pending[tid]; txp != nil {
+		count -= len(txp.ids)
+	}
+	return count
+}
+
+// freedBy returns count of pages freed by tid so far, including those batched
+// by free and not yet flushed.
+func (f *freelist) freedBy(tid txid) int {
+	var count int
+	if txp := f.pending[tid]; txp != nil {
+		count = len(txp.ids)
+	}
+	for _, e := range f.batch {
+		count += int(e.overflow) + 1
+	}
+	return count
+}
+
 // copyall copies a list of all free ids and all pending ids in one sorted list.
 // f.count returns the minimum length required for dst.
 func (f *freelist) copyall(dst []pgid) {
@@ -155,12 +256,6 @@ func (f *freelist) free(txid txid, p *page) {
 		panic(fmt.Sprintf("cannot free page 0 or 1: %d", p.id))
 	}
 
-	// Free page and all its overflow pages.
-	txp := f.pending[txid]
-	if txp == nil {
-		txp = &txPending{}
-		f.pending[txid] = txp
-	}
 	allocTxid, ok := f.allocs[p.id]
 	if ok {
 		delete(f.allocs, p.id)
@@ -169,6 +264,17 @@ func (f *freelist) free(txid txid, p *page) {
 		allocTxid = txid - 1
 	}
 
+	if f.batchFree {
+		f.batch = append(f.batch, batchedFree{id: p.id, overflow: p.overflow, alloctx: allocTxid})
+		return
+	}
+
+	// Free page and all its overflow pages.
+	txp := f.pending[txid]
+	if txp == nil {
+		txp = &txPending{}
+		f.pending[txid] = txp
+	}
 	for id := p.id; id <= p.id+pgid(p.overflow); id++ {
 		// Verify that page is not already free.
 		if _, ok := f.cache[id]; ok {
@@ -181,6 +287,51 @@ func (f *freelist) free(txid txid, p *page) {
 	}
 }
 
+// flushBatch adds the pages batched by free to the pending pages of tid,
+// in page id order, growing the pending lists once.
+func (f *freelist) flushBatch(tid txid) {
+	if len(f.batch) == 0 {
+		return
+	}
+	sort.Sort(batchedFrees(f.batch))
+
+	n := 0
+	for _, e := range f.batch {
+		n += int(e.overflow) + 1
+	}
+	// Growing the cache once beats growing it step by step when the batch
+	// is larger than what it already holds.
+	if n > len(f.cache) {
+		cache := make(map[pgid]struct{}, len(f.cache)+n)
+		for id := range f.cache {
+			cache[id] = struct{}{}
+		}
+		f.cache = cache
+	}
+	txp := f.pending[tid]
+	if txp == nil {
+		txp = &txPending{}
+		f.pending[tid] = txp
+	}
+	if cap(txp.ids)-len(txp.ids) < n {
+		txp.ids = append(make([]pgid, 0, len(txp.ids)+n), txp.ids...)
+		txp.alloctx = append(make([]txid, 0, len(txp.alloctx)+n), txp.alloctx...)
+	}
+
+	for _, e := range f.batch {
+		for id := e.id; id <= e.id+pgid(e.overflow); id++ {
+			// Verify that page is not already free.
+			if _, ok := f.cache[id]; ok {
+				panic(fmt.Sprintf("page %d already freed", id))
+			}
+			txp.ids = append(txp.ids, id)
+			txp.alloctx = append(txp.alloctx, e.alloctx)
+			f.cache[id] = struct{}{}
+		}
+	}
+	f.batch = f.batch[:0]
+}
+
 // release moves all page ids for a transaction id (or older) to the freelist.
 func (f *freelist) release(txid txid) {
 	m := make(pgids, 0)
@@ -209,6 +360,9 @@ func (f *freelist) releaseRange(begin, end txid) {
 		if txp.lastReleaseBegin == begin {
 			continue
 		}
+		if txp.minReleaseBegin == 0 || begin < txp.minReleaseBegin {
+			txp.minReleaseBegin = begin
+		}
 		for i := 0; i < len(txp.ids); i++ {
 			if atx := txp.alloctx[i]; atx < begin || atx > end {
 				continue
@@ -228,8 +382,55 @@ func (f *freelist) releaseRange(begin, end txid) {
 	f.mergeSpans(m)
 }
 
+// releaseRangeOutside is releaseRange restricted to the pages with ids below
+// lo or from hi on. It releases the pages that a backup has copied already or
+// that are past the end of its snapshot.
+func (f *freelist) releaseRangeOutside(begin, end txid, lo, hi pgid) {
+	if begin > end {
+		return
+	}
+	var m pgids
+	for tid, txp := range f.pending {
+		if tid < begin || tid > end {
+			continue
+		}
+		if txp.minReleaseBegin == 0 || begin < txp.minReleaseBegin {
+			txp.minReleaseBegin = begin
+		}
+		for i := 0; i < len(txp.ids); i++ {
+			if atx := txp.alloctx[i]; atx < begin || atx > end {
+				continue
+			} else if id := txp.ids[i]; id >= lo && id < hi {
+				continue
+			}
+			m = append(m, txp.ids[i])
+			txp.ids[i] = txp.ids[len(txp.ids)-1]
+			txp.ids = txp.ids[:len(txp.ids)-1]
+			txp.alloctx[i] = txp.alloctx[len(txp.alloctx)-1]
+			txp.alloctx = txp.alloctx[:len(txp.alloctx)-1]
+			i--
+		}
+		if len(txp.ids) == 0 {
+			delete(f.pending, tid)
+		}
+	}
+	f.mergeSpans(m)
+}
+
+// retainsFreed returns whether every page freed by txid that was allocated
+// no later than snapshot is still pending. releaseRange only releases pages
+// allocated at or after its beginning txid.
+func (f *freelist) retainsFreed(txid, snapshot txid) bool {
+	txp := f.pending[txid]
+	return txp != nil && (txp.minReleaseBegin == 0 || txp.minReleaseBegin > snapshot)
+}
+
 // rollback removes the pages from a given pending tx.
 func (f *freelist) rollback(txid txid) {
+	// Batched pages are rolled back like the others, which restores their
+	// allocating txids.
+	f.flushBatch(txid)
+
 	// Remove page ids from cache.
 	txp := f.pending[txid]
 	if txp == nil {
@@ -334,10 +535,79 @@ func (f *freelist) write(p *page) error {
 		ids[0] = pgid(l)
 		f.copyall(ids[1:])
 	}
+	if f.checksum {
+		p.setFreelistChecksum()
+	}
+
+	return nil
+}
+
+// freelistEnd returns the offset just past the page ids of a freelist page,
+// which is where its checksum is stored if it has one, or -1 if the page ids
+// would not fit in size bytes.
+func (p *page) freelistEnd(size int) int {
+	var idx, count = 0, int(p.count)
+	if count == 0xFFFF {
+		if int(pageHeaderSize)+int(unsafe.Sizeof(pgid(0))) > size {
+			return -1
+		}
+		idx = 1
+		c := *(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
+		if c > pgid(size) {
+			return -1
+		}
+		count = int(c)
+	}
+	end := int(pageHeaderSize) + int(unsafe.Sizeof(pgid(0)))*(idx+count)
+	if end > size {
+		return -1
+	}
+	return end
+}
+
+// freelistSum64 returns the checksum of the freelist page up to end.
+func (p *page) freelistSum64(end int) uint64 {
+	var h = fnv.New64a()
+	_, _ = h.Write(unsafeByteSlice(unsafe.Pointer(p), 0, 0, end))
+	return h.Sum64()
+}
 
+// setFreelistChecksum stores the checksum of a freelist page after its
+// page ids. The page buffer must have room for the checksum.
+func (p *page) setFreelistChecksum() {
+	end := p.freelistEnd(int(^uint(0) >> 1))
+	*(*uint64)(unsafeAdd(unsafe.Pointer(p), uintptr(end))) = p.freelistSum64(end)
+}
+
+// verifyFreelistChecksum returns ErrFreelistCorrupt if the freelist page,
+// which spans at most size bytes, does not match its stored checksum.
+func (p *page) verifyFreelistChecksum(size int) error {
+	if (p.flags & freelistPageFlag) == 0 {
+		return ErrFreelistCorrupt
+	}
+	end := p.freelistEnd(size)
+	if end < 0 || end+freelistChecksumSize > size || *(*uint64)(unsafeAdd(unsafe.Pointer(p), uintptr(end))) != p.freelistSum64(end) {
+		return ErrFreelistCorrupt
+	}
 	return nil
 }
 
+// sameFreelist reports whether the freelist page q, as found in a freelist
+// region, holds the same bytes as p from the flags field of the page header
+// to the end of the freed page ids. The id field of the header, which
+// differs between the regions, and the trailing checksum are not compared.
+func (p *page) sameFreelist(q *page, regionSize int) bool {
+	end := p.freelistEnd(int(^uint(0) >> 1))
+	if q.freelistEnd(regionSize) != end {
+		return false
+	}
+	off := unsafe.Offsetof(p.flags)
+	return bytes.Equal(
+		unsafeByteSlice(unsafe.Pointer(p), off, 0, end-int(off)),
+		unsafeByteSlice(unsafe.Pointer(q), off, 0, end-int(off)),
+	)
+}
+
 // reload reads the freelist from a page and filters out pending items.
 func (f *freelist) reload(p *page) {
 	f.read(p)
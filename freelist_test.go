@@ -301,6 +301,83 @@ func TestFreelist_write(t *testing.T) {
 	}
 }
 
+// Ensure that batched frees reach the pending list sorted once flushed.
+func TestFreelist_free_batch(t *testing.T) {
+	f := newTestFreelist()
+	f.batchFree = true
+	f.free(100, &page{id: 20})
+	f.free(100, &page{id: 12, overflow: 2})
+	f.free(100, &page{id: 16})
+	if f.pending[100] != nil || f.freed(12) {
+		t.Fatalf("pages pending before flush: %v", f.pending[100])
+	}
+
+	f.flushBatch(100)
+	if exp := []pgid{12, 13, 14, 16, 20}; !reflect.DeepEqual(exp, f.pending[100].ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[100].ids)
+	}
+	if !f.freed(13) || len(f.batch) != 0 {
+		t.Fatal("flush did not take the batch")
+	}
+
+	// A page freed twice is caught when the batch is flushed.
+	f.free(100, &page{id: 13})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	f.flushBatch(100)
+}
+
+// Ensure that rolling back a batch restores the allocating txids.
+func TestFreelist_rollback_batch(t *testing.T) {
+	f := newTestFreelist()
+	f.batchFree = true
+	f.readIDs([]pgid{3, 4, 5})
+	if id := f.allocate(99, 1); id != 3 {
+		t.Fatalf("unexpected allocation: %d", id)
+	}
+	f.allocs[10] = 50
+
+	f.free(100, &page{id: 3})
+	f.free(100, &page{id: 10})
+	f.rollback(100)
+
+	if f.pending[100] != nil || len(f.batch) != 0 {
+		t.Fatalf("batch survived rollback: %v %v", f.pending[100], f.batch)
+	}
+	if f.allocs[3] != 99 || f.allocs[10] != 50 {
+		t.Fatalf("allocs not restored: %v", f.allocs)
+	}
+}
+
+func Benchmark_FreelistFree100K(b *testing.B)      { benchmark_FreelistFree(b, 100000, false) }
+func Benchmark_FreelistFree100KBatch(b *testing.B) { benchmark_FreelistFree(b, 100000, true) }
+
+// benchmark_FreelistFree frees pages in random order, as a large delete
+// does, and then flushes them and copies out the freelist as commit does.
+func benchmark_FreelistFree(b *testing.B, size int, batch bool) {
+	ids := randomPgids(size)
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	pages := make([]page, len(ids))
+	for i, id := range ids {
+		pages[i].id = id + 2
+	}
+	dst := make([]pgid, len(ids))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := newTestFreelist()
+		f.batchFree = batch
+		for j := range pages {
+			f.free(100, &pages[j])
+		}
+		f.flushBatch(100)
+		f.copyall(dst)
+	}
+}
+
 func Benchmark_FreelistRelease10K(b *testing.B)    { benchmark_FreelistRelease(b, 10000) }
 func Benchmark_FreelistRelease100K(b *testing.B)   { benchmark_FreelistRelease(b, 100000) }
 func Benchmark_FreelistRelease1000K(b *testing.B)  { benchmark_FreelistRelease(b, 1000000) }
@@ -0,0 +1,139 @@
+package bbolt
+
+import "bytes"
+
+// IndexFunc returns the index key of a key/value pair of an indexed bucket.
+// A nil result leaves the pair out of the index. The returned slice may
+// alias key or value; it is copied before being stored.
+type IndexFunc func(key, value []byte) []byte
+
+// bucketIndex is a secondary index registered with Bucket.WithIndex.
+type bucketIndex struct {
+	name []byte
+	fn   IndexFunc
+}
+
+// WithIndex keeps a secondary index of the bucket up to date for the rest of
+// the transaction. The index is stored in the nested bucket name, which maps
+// every index key returned by fn to a nested bucket holding the keys of the
+// pairs it was derived from, with empty values. Every Put, Delete and
+// Cursor.Delete on the bucket then updates the index as well.
+//
+// Index functions are not persisted, so WithIndex must be called in every
+// transaction that changes the bucket, with the same name and an equivalent
+// fn. If the index bucket does not exist yet it is built from the pairs
+// already in the bucket. Registering a name again replaces its fn.
+//
+// The index bucket shows up as a nested bucket when iterating the bucket,
+// and must not be changed directly. Returns an error if the bucket was
+// created from a read-only transaction or if name is not a valid bucket name.
+func (b *Bucket) WithIndex(name []byte, fn IndexFunc) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	idx := b.Bucket(name)
+	if idx == nil {
+		var err error
+		if idx, err = b.CreateBucket(name); err != nil {
+			return err
+		}
+		if err := buildIndex(b, idx, fn); err != nil {
+			return err
+		}
+	}
+
+	for _, ix := range b.indexes {
+		if bytes.Equal(ix.name, name) {
+			ix.fn = fn
+			return nil
+		}
+	}
+	b.indexes = append(b.indexes, &bucketIndex{name: cloneBytes(name), fn: fn})
+	return nil
+}
+
+// buildIndex adds every key/value pair of b to the index bucket idx.
+func buildIndex(b, idx *Bucket, fn IndexFunc) error {
+	c := b.Cursor()
+	for k, v, flags := c.first(); k != nil; k, v, flags = c.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			continue
+		}
+		if ik := fn(k, v); ik != nil {
+			if err := addIndexEntry(idx, ik, k); err != nil {
+				return err
+			}
+		}
+	}
+	return c.err
+}
+
+// reindex updates the indexes of b after key changed. old is its previous
+// value if found is set, and value its new one if put is set.
+func (b *Bucket) reindex(key, old, value []byte, found, put bool) error {
+	for _, ix := range b.indexes {
+		var from, to []byte
+		if found {
+			from = ix.fn(key, old)
+		}
+		if put {
+			to = ix.fn(key, value)
+		}
+		if (from == nil && to == nil) || (from != nil && to != nil && bytes.Equal(from, to)) {
+			continue
+		}
+
+		idx, err := b.bucketOrCreate(ix.name)
+		if err != nil {
+			return err
+		}
+		if from != nil {
+			if err := removeIndexEntry(idx, from, key); err != nil {
+				return err
+			}
+		}
+		if to != nil {
+			if err := addIndexEntry(idx, to, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addIndexEntry records key under the index key ik.
+func addIndexEntry(idx *Bucket, ik, key []byte) error {
+	keys, err := idx.bucketOrCreate(ik)
+	if err != nil {
+		return err
+	}
+	return keys.Put(key, nil)
+}
+
+// removeIndexEntry drops key from under the index key ik, and ik itself once
+// no key is left under it.
+func removeIndexEntry(idx *Bucket, ik, key []byte) error {
+	keys := idx.Bucket(ik)
+	if keys == nil {
+		return nil
+	}
+	if err := keys.Delete(key); err != nil {
+		return err
+	}
+	if k, _, _ := keys.Cursor().first(); k == nil {
+		return idx.DeleteBucket(ik)
+	}
+	return nil
+}
+
+// bucketOrCreate is CreateBucketIfNotExists for the common case of an
+// existing bucket, without building the ErrBucketExists error.
+func (b *Bucket) bucketOrCreate(name []byte) (*Bucket, error) {
+	if child := b.Bucket(name); child != nil {
+		return child, nil
+	}
+	return b.CreateBucket(name)
+}
@@ -0,0 +1,169 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// byCity indexes values of the form "name@city" by city, and leaves values
+// without a city out of the index.
+func byCity(key, value []byte) []byte {
+	if i := bytes.IndexByte(value, '@'); i >= 0 {
+		return value[i+1:]
+	}
+	return nil
+}
+
+// requireIndex checks that the index bucket name of b holds exactly the
+// entries fn derives from the pairs of b.
+func requireIndex(t *testing.T, b *bolt.Bucket, name []byte, fn bolt.IndexFunc) {
+	want := map[string][]string{}
+	require.NoError(t, b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		if ik := fn(k, v); ik != nil {
+			want[string(ik)] = append(want[string(ik)], string(k))
+		}
+		return nil
+	}))
+
+	got := map[string][]string{}
+	idx := b.Bucket(name)
+	require.NotNil(t, idx)
+	require.NoError(t, idx.ForEachBucket(func(ik []byte) error {
+		return idx.Bucket(ik).ForEach(func(k, v []byte) error {
+			require.Empty(t, v)
+			got[string(ik)] = append(got[string(ik)], string(k))
+			return nil
+		})
+	}))
+	require.Equal(t, want, got)
+}
+
+// Ensure that WithIndex keeps an index bucket in step with the bucket.
+func TestBucket_WithIndex(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	name := []byte("by_city")
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("alice"), []byte("Alice@Paris")))
+		require.NoError(t, b.Put([]byte("bob"), []byte("Bob@Oslo")))
+
+		// The index is built from the pairs already in the bucket.
+		require.NoError(t, b.WithIndex(name, byCity))
+		requireIndex(t, b, name, byCity)
+
+		require.NoError(t, b.Put([]byte("carol"), []byte("Carol@Paris")))
+		require.NoError(t, b.Put([]byte("dave"), []byte("Dave")))
+		_, err = b.TestPut([]byte("erin"), []byte("Erin@Rome"))
+		require.NoError(t, err)
+		requireIndex(t, b, name, byCity)
+
+		k, _ := b.Bucket(name).Bucket([]byte("Paris")).Cursor().Seek([]byte("carol"))
+		require.Equal(t, []byte("carol"), k)
+		return nil
+	}))
+
+	// Index functions must be registered again in every transaction.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		require.NoError(t, b.WithIndex(name, byCity))
+
+		// Moving a key to another index key.
+		require.NoError(t, b.Put([]byte("bob"), []byte("Bob@Paris")))
+		// Moving a key out of and into the index.
+		require.NoError(t, b.Put([]byte("alice"), []byte("Alice")))
+		require.NoError(t, b.PutFlagged([]byte("dave"), []byte("Dave@Oslo")))
+		requireIndex(t, b, name, byCity)
+
+		require.NoError(t, b.Delete([]byte("carol")))
+		require.NoError(t, b.Delete([]byte("missing")))
+		ok, err := b.DeleteIf([]byte("erin"), func([]byte) bool { return true })
+		require.NoError(t, err)
+		require.True(t, ok)
+		requireIndex(t, b, name, byCity)
+
+		// Index keys with no keys left under them are removed.
+		require.Nil(t, b.Bucket(name).Bucket([]byte("Rome")))
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		require.NoError(t, b.WithIndex(name, byCity))
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, b.Put([]byte{'k', byte(i)}, []byte{'v', '@', byte(i % 7)}))
+		}
+		_, err := b.TestDelete([]byte("bob"))
+		require.NoError(t, err)
+		_, _, err = b.DeleteAll([][]byte{[]byte("dave"), {'k', 1}, {'k', 2}})
+		require.NoError(t, err)
+
+		c := b.Cursor()
+		for k, v := c.Seek([]byte{'k'}); k != nil && k[0] == 'k'; k, v = c.Next() {
+			if v[2]%2 == 0 {
+				require.NoError(t, c.Delete())
+			}
+		}
+		requireIndex(t, b, name, byCity)
+
+		// The index bucket itself can't be overwritten through the bucket.
+		require.ErrorIs(t, b.Put(name, []byte("x")), bolt.ErrIncompatibleValue)
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		requireIndex(t, b, name, byCity)
+		require.ErrorIs(t, b.WithIndex(name, byCity), bolt.ErrTxNotWritable)
+		return nil
+	}))
+}
+
+// Ensure that Truncate and Clear leave registered indexes empty and in use.
+func TestBucket_WithIndex_Truncate(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	name := []byte("by_city")
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("users"))
+		require.NoError(t, err)
+		require.NoError(t, b.WithIndex(name, byCity))
+		for i := 0; i < 100; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("user%03d", i)), []byte(fmt.Sprintf("User@%d", i%5))))
+		}
+		return nil
+	}))
+
+	for _, clear := range []bool{false, true} {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("users"))
+			require.NoError(t, b.WithIndex(name, byCity))
+			if clear {
+				require.NoError(t, b.Clear())
+			} else {
+				require.NoError(t, b.Truncate())
+			}
+			requireIndex(t, b, name, byCity)
+
+			require.NoError(t, b.Put([]byte("alice"), []byte("Alice@Paris")))
+			requireIndex(t, b, name, byCity)
+			return nil
+		}))
+		require.NoError(t, db.View(func(tx *bolt.Tx) error {
+			requireIndex(t, tx.Bucket([]byte("users")), name, byCity)
+			return nil
+		}))
+	}
+	db.MustCheck()
+}
@@ -0,0 +1,326 @@
+package bbolt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MutationOp identifies the kind of change held by a mutation log record.
+type MutationOp byte
+
+const (
+	// MutationPut records a key being set to a value.
+	MutationPut MutationOp = 'P'
+
+	// MutationDelete records a key being removed.
+	MutationDelete MutationOp = 'D'
+)
+
+// Mutation is a single committed change, as written to Options.MutationLog.
+//
+// Each record is encoded as the op byte followed by the number of bucket
+// names, each bucket name, the key and the value, where every count and
+// byte string is prefixed by its length as a uvarint.
+type Mutation struct {
+	Op MutationOp
+
+	// Bucket holds the names of the buckets leading from the root to the
+	// bucket holding the key, outermost first.
+	Bucket [][]byte
+
+	Key   []byte
+	Value []byte // nil for MutationDelete
+}
+
+// ReadMutation decodes the next record of a mutation log.
+// Returns io.EOF when there are no more records.
+func ReadMutation(r *bufio.Reader) (*Mutation, error) {
+	op, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mutation{Op: MutationOp(op)}
+	if m.Op != MutationPut && m.Op != MutationDelete {
+		return nil, fmt.Errorf("invalid mutation op %q", op)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	for i := uint64(0); i < n; i++ {
+		name, err := readMutationBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Bucket = append(m.Bucket, name)
+	}
+
+	if m.Key, err = readMutationBytes(r); err != nil {
+		return nil, err
+	}
+	if m.Op == MutationPut {
+		if m.Value, err = readMutationBytes(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func readMutationBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, noEOF(err)
+	}
+	return b, nil
+}
+
+// noEOF turns an EOF in the middle of a record into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// logMutation appends a record of a change to b to the transaction's pending
+// mutation log, if the database has one. The record is encoded right away,
+// so key and value may be reused by the caller.
+func (b *Bucket) logMutation(op MutationOp, key, value []byte) {
+	tx := b.tx
+	if tx.db.mutationLog == nil {
+		return
+	}
+
+	path := b.path()
+	buf := append(tx.mutations, byte(op))
+	buf = appendUvarint(buf, uint64(len(path)))
+	for _, name := range path {
+		buf = appendMutationBytes(buf, name)
+	}
+	buf = appendMutationBytes(buf, key)
+	if op == MutationPut {
+		buf = appendMutationBytes(buf, value)
+	}
+	tx.mutations = buf
+}
+
+// logBucketDrop notes that the child bucket key of b was deleted, so that the
+// changes tracked for it and its nested buckets are dropped at commit.
+func (b *Bucket) logBucketDrop(key []byte) {
+	tx := b.tx
+	if tx.db.mutationLog == nil {
+		return
+	}
+	tx.droppedBuckets = append(tx.droppedBuckets, changesPath(append(b.path(), key)))
+}
+
+func appendMutationBytes(buf, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// flushMutations writes the pending mutation log once the transaction has
+// committed. It must be called while the writer lock is still held, which
+// keeps the log in commit order, and before the commit handlers run, so that
+// they may start write transactions of their own. A failed or short write is
+// kept on the DB and returned, wrapped in ErrMutationLogWrite.
+func (tx *Tx) flushMutations() error {
+	if len(tx.droppedBuckets) > 0 {
+		tx.db.dropChanges(tx.droppedBuckets, tx.meta.txid)
+	}
+	if len(tx.mutations) == 0 {
+		return nil
+	}
+
+	tx.db.recordChanges(tx.mutations, tx.meta.txid)
+	n, err := tx.db.mutationLog.Write(tx.mutations)
+	if err == nil && n < len(tx.mutations) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		tx.db.mutationLogErr = fmt.Errorf("%w: %v", ErrMutationLogWrite, err)
+	}
+	return tx.db.mutationLogErr
+}
+
+// recordChanges notes id as the last change to every key in the mutation
+// records of buf.
+func (db *DB) recordChanges(buf []byte, id txid) {
+	db.changesMu.Lock()
+	defer db.changesMu.Unlock()
+	if db.changes == nil {
+		return
+	}
+	forEachMutation(buf, func(m *Mutation) {
+		path := changesPath(m.Bucket)
+		keys := db.changes[path]
+		if keys == nil {
+			keys = make(map[string]txid)
+			db.changes[path] = keys
+		}
+		keys[string(m.Key)] = id
+	})
+
+	// Forget changes past the retention in batches, so that pruning scans
+	// the tracked keys once every changesRetention transactions.
+	retention := txid(db.changesRetention)
+	if id >= db.changesFrom+2*retention {
+		db.changesFrom = id - retention + 1
+		for path, keys := range db.changes {
+			for k, t := range keys {
+				if t < db.changesFrom {
+					delete(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				delete(db.changes, path)
+			}
+		}
+		for path, t := range db.changesDropped {
+			if t < db.changesFrom {
+				delete(db.changesDropped, path)
+			}
+		}
+	}
+}
+
+// dropChanges forgets the changes of every bucket in paths and of the
+// buckets nested in them, and notes id as the txid they were deleted by.
+func (db *DB) dropChanges(paths []string, id txid) {
+	db.changesMu.Lock()
+	defer db.changesMu.Unlock()
+	if db.changes == nil {
+		return
+	}
+	for _, dropped := range paths {
+		for path := range db.changes {
+			if strings.HasPrefix(path, dropped) {
+				delete(db.changes, path)
+			}
+		}
+		db.changesDropped[dropped] = id
+	}
+}
+
+// changesDroppedSince reports whether a bucket holding path, or path itself,
+// was deleted by a transaction with an id of since or later. The deletions of
+// tx, if writable, are included.
+func (db *DB) changesDroppedSince(tx *Tx, path string, since txid) bool {
+	for dropped, t := range db.changesDropped {
+		if t >= since && strings.HasPrefix(path, dropped) {
+			return true
+		}
+	}
+	if tx.writable && tx.meta.txid >= since {
+		for _, dropped := range tx.droppedBuckets {
+			if strings.HasPrefix(path, dropped) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forEachMutation calls fn with every record of a mutation log held in buf.
+func forEachMutation(buf []byte, fn func(m *Mutation)) {
+	r := bufio.NewReader(bytes.NewReader(buf))
+	for {
+		m, err := ReadMutation(r)
+		if err != nil {
+			return
+		}
+		fn(m)
+	}
+}
+
+// changesPath encodes the names of a bucket path as a key of DB.changes.
+func changesPath(path [][]byte) string {
+	var buf []byte
+	for _, name := range path {
+		buf = appendMutationBytes(buf, name)
+	}
+	return string(buf)
+}
+
+// ChangedSince calls fn for every key of the bucket changed by a transaction
+// with an id of since or later, in key order, for incremental syncs. v is the
+// current value, or nil if the key has since been deleted. Keys holding
+// nested buckets are skipped. The changes of a writable transaction are
+// included before it commits, and keys changed again by transactions that
+// committed after this one was opened may be reported too.
+//
+// Changes are tracked in memory, per key, from the moment the database is
+// opened, for the last Options.ChangesRetention transactions, and only if
+// Options.MutationLog is set. Returns ErrChangesUnavailable if since is older
+// than that, or if the bucket or one holding it was deleted since then. The
+// keys and values are only valid for the life of the transaction.
+func (b *Bucket) ChangedSince(since int, fn func(k, v []byte) error) error {
+	db := b.tx.db
+	if db == nil {
+		return ErrTxClosed
+	}
+	if since < 0 {
+		since = 0
+	}
+	id, path := txid(since), b.path()
+	pathKey := changesPath(path)
+
+	var keys [][]byte
+	db.changesMu.RLock()
+	if db.changes == nil || id < db.changesFrom || db.changesDroppedSince(b.tx, pathKey, id) {
+		db.changesMu.RUnlock()
+		return ErrChangesUnavailable
+	}
+	for k, t := range db.changes[pathKey] {
+		if t >= id {
+			keys = append(keys, []byte(k))
+		}
+	}
+	db.changesMu.RUnlock()
+
+	// Add the changes of this transaction, which are not recorded yet.
+	if b.tx.writable && b.tx.meta.txid >= id {
+		forEachMutation(b.tx.mutations, func(m *Mutation) {
+			if changesPath(m.Bucket) == pathKey {
+				keys = append(keys, m.Key)
+			}
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return b.compareKeys(keys[i], keys[j]) < 0
+	})
+	c := b.Cursor()
+	for i, key := range keys {
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			continue
+		}
+		k, v, flags := c.reseek(key)
+		if !bytes.Equal(key, k) {
+			k, v = key, nil
+		} else if (flags & bucketLeafFlag) != 0 {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
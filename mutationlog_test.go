@@ -0,0 +1,391 @@
+package bbolt_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	bolt "github.com/coyove/bbolt"
+	"github.com/coyove/bbolt/internal/btesting"
+)
+
+// Ensure that only the mutations of committed transactions are logged.
+func TestOptions_MutationLog(t *testing.T) {
+	var log bytes.Buffer
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: &log})
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("1")))
+		require.NoError(t, b.Put([]byte("bar"), []byte("2")))
+
+		child, err := b.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+		return child.Put([]byte("baz"), []byte("3"))
+	}))
+
+	// A rolled back transaction leaves no trace.
+	errRollback := errors.New("rollback")
+	require.ErrorIs(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("foo"), []byte("lost")))
+		require.NoError(t, b.Delete([]byte("bar")))
+		return errRollback
+	}), errRollback)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Delete([]byte("foo")))
+		// Deleting a missing key changes nothing.
+		require.NoError(t, b.Delete([]byte("missing")))
+
+		c := b.Bucket([]byte("child")).Cursor()
+		c.First()
+		return c.Delete()
+	}))
+
+	widgets := [][]byte{[]byte("widgets")}
+	child := [][]byte{[]byte("widgets"), []byte("child")}
+	require.Equal(t, []bolt.Mutation{
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("foo"), Value: []byte("1")},
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("bar"), Value: []byte("2")},
+		{Op: bolt.MutationPut, Bucket: child, Key: []byte("baz"), Value: []byte("3")},
+		{Op: bolt.MutationDelete, Bucket: widgets, Key: []byte("foo")},
+		{Op: bolt.MutationDelete, Bucket: child, Key: []byte("baz")},
+	}, readMutations(t, &log))
+}
+
+// Ensure that commit handlers can start write transactions of their own,
+// and that a panicking handler doesn't stop later commits from being logged.
+func TestOptions_MutationLog_CommitHandlers(t *testing.T) {
+	var log bytes.Buffer
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: &log})
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		tx.OnCommit(func() {
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte("bar"), []byte("2"))
+			}))
+		})
+		return b.Put([]byte("foo"), []byte("1"))
+	}))
+
+	require.Panics(t, func() {
+		_ = db.Update(func(tx *bolt.Tx) error {
+			tx.OnCommit(func() { panic("handler") })
+			return tx.Bucket([]byte("widgets")).Put([]byte("baz"), []byte("3"))
+		})
+	})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("foo"))
+	}))
+
+	widgets := [][]byte{[]byte("widgets")}
+	require.Equal(t, []bolt.Mutation{
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("foo"), Value: []byte("1")},
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("bar"), Value: []byte("2")},
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("baz"), Value: []byte("3")},
+		{Op: bolt.MutationDelete, Bucket: widgets, Key: []byte("foo")},
+	}, readMutations(t, &log))
+}
+
+// shortWriter accepts at most n more bytes, then writes short.
+type shortWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+	w.n -= len(p)
+	return w.Buffer.Write(p)
+}
+
+// Ensure that a failed mutation log write is reported by Commit and stops
+// later write transactions, while the committed changes are kept.
+func TestOptions_MutationLog_WriteError(t *testing.T) {
+	log := &shortWriter{n: 20}
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: log})
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		return b.Put([]byte("foo"), []byte("1"))
+	}))
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("bar"), bytes.Repeat([]byte("v"), 100))
+	})
+	require.ErrorIs(t, err, bolt.ErrMutationLogWrite)
+	require.Contains(t, err.Error(), io.ErrShortWrite.Error())
+
+	// The changes are committed, but no further ones are accepted.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Len(t, tx.Bucket([]byte("widgets")).Get([]byte("bar")), 100)
+		return nil
+	}))
+	_, err = db.Begin(true)
+	require.ErrorIs(t, err, bolt.ErrMutationLogWrite)
+
+	// Reopening clears the error.
+	db.MustClose()
+	db.MustReopen()
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+}
+
+// Ensure that Truncate and Clear log a delete for every key they remove.
+func TestOptions_MutationLog_Truncate(t *testing.T) {
+	var log bytes.Buffer
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: &log})
+
+	var id int
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), []byte("1")))
+		require.NoError(t, b.Put([]byte("bar"), []byte("2")))
+		_, err = b.CreateBucket([]byte("child"))
+		id = tx.ID()
+		return err
+	}))
+	log.Reset()
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Truncate()
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("baz"), []byte("3")))
+		return b.Clear()
+	}))
+
+	widgets := [][]byte{[]byte("widgets")}
+	require.Equal(t, []bolt.Mutation{
+		{Op: bolt.MutationDelete, Bucket: widgets, Key: []byte("bar")},
+		{Op: bolt.MutationDelete, Bucket: widgets, Key: []byte("foo")},
+		{Op: bolt.MutationPut, Bucket: widgets, Key: []byte("baz"), Value: []byte("3")},
+		{Op: bolt.MutationDelete, Bucket: widgets, Key: []byte("baz")},
+	}, readMutations(t, &log))
+
+	// ChangedSince reports the removed keys as deleted.
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		deleted := map[string]bool{}
+		require.NoError(t, tx.Bucket([]byte("widgets")).ChangedSince(id, func(k, v []byte) error {
+			require.Nil(t, v)
+			deleted[string(k)] = true
+			return nil
+		}))
+		require.Equal(t, map[string]bool{"foo": true, "bar": true, "baz": true}, deleted)
+		return nil
+	}))
+}
+
+// readMutations decodes every record of a mutation log.
+func readMutations(t testing.TB, log io.Reader) []bolt.Mutation {
+	var got []bolt.Mutation
+	r := bufio.NewReader(log)
+	for {
+		m, err := bolt.ReadMutation(r)
+		if err == io.EOF {
+			return got
+		}
+		require.NoError(t, err)
+		got = append(got, *m)
+	}
+}
+
+// Ensure that only the keys changed since a transaction are reported.
+func TestBucket_ChangedSince(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: io.Discard})
+
+	// changed returns the keys reported since id, with the values of
+	// deleted keys as "<nil>".
+	changed := func(tx *bolt.Tx, name string, id int) map[string]string {
+		got := make(map[string]string)
+		require.NoError(t, tx.Bucket([]byte(name)).ChangedSince(id, func(k, v []byte) error {
+			if v == nil {
+				got[string(k)] = "<nil>"
+			} else {
+				got[string(k)] = string(v)
+			}
+			return nil
+		}))
+		return got
+	}
+
+	var first, second int
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		first = tx.ID()
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for _, k := range []string{"a", "b", "c", "d"} {
+			require.NoError(t, b.Put([]byte(k), []byte("1")))
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+		return child.Put([]byte("x"), []byte("1"))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		second = tx.ID()
+		b := tx.Bucket([]byte("widgets"))
+		require.NoError(t, b.Put([]byte("b"), []byte("2")))
+		require.NoError(t, b.Put([]byte("e"), []byte("2")))
+		return b.Delete([]byte("c"))
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, map[string]string{"a": "1", "b": "2", "c": "<nil>", "d": "1", "e": "2"}, changed(tx, "widgets", first))
+		require.Equal(t, map[string]string{"b": "2", "c": "<nil>", "e": "2"}, changed(tx, "widgets", second))
+		require.Empty(t, changed(tx, "widgets", second+1))
+
+		// Nested buckets keep their own changes.
+		child := tx.Bucket([]byte("widgets")).Bucket([]byte("child"))
+		var keys []string
+		require.NoError(t, child.ChangedSince(first, func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"x"}, keys)
+
+		// Errors from fn stop the iteration.
+		errStop := errors.New("stop")
+		require.ErrorIs(t, tx.Bucket([]byte("widgets")).ChangedSince(first, func(k, v []byte) error {
+			return errStop
+		}), errStop)
+
+		// Changes made before the database was opened are unknown.
+		require.ErrorIs(t, tx.Bucket([]byte("widgets")).ChangedSince(first-1, func(k, v []byte) error {
+			return nil
+		}), bolt.ErrChangesUnavailable)
+		return nil
+	}))
+
+	// A writable transaction sees its own changes.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.NoError(t, tx.Bucket([]byte("widgets")).Put([]byte("f"), []byte("3")))
+		require.Equal(t, map[string]string{"f": "3"}, changed(tx, "widgets", tx.ID()))
+		return nil
+	}))
+
+	// Reopening the database forgets the changes.
+	db.MustClose()
+	db.MustReopen()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.ErrorIs(t, tx.Bucket([]byte("widgets")).ChangedSince(second, func(k, v []byte) error {
+			return nil
+		}), bolt.ErrChangesUnavailable)
+		require.Empty(t, changed(tx, "widgets", tx.ID()+1))
+		return nil
+	}))
+}
+
+// Ensure that changes are not tracked without a mutation log.
+func TestBucket_ChangedSince_NoMutationLog(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("a"), []byte("1")))
+		return nil
+	}))
+	require.ErrorIs(t, db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).ChangedSince(tx.ID(), func(k, v []byte) error {
+			return nil
+		})
+	}), bolt.ErrChangesUnavailable)
+}
+
+// Ensure that changes older than Options.ChangesRetention are forgotten.
+func TestBucket_ChangedSince_Retention(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: io.Discard, ChangesRetention: 5})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}))
+
+	var ids []int
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			ids = append(ids, tx.ID())
+			return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("%02d", i)), []byte("1"))
+		}))
+	}
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		require.ErrorIs(t, b.ChangedSince(ids[0], func(k, v []byte) error {
+			return nil
+		}), bolt.ErrChangesUnavailable)
+
+		var keys []string
+		require.NoError(t, b.ChangedSince(ids[len(ids)-5], func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"15", "16", "17", "18", "19"}, keys)
+		return nil
+	}))
+}
+
+// Ensure that the changes of a deleted bucket are dropped, and that asking
+// for changes from before the deletion fails.
+func TestBucket_ChangedSince_DeleteBucket(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MutationLog: io.Discard})
+
+	var first, second int
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		first = tx.ID()
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("a"), []byte("1")))
+		child, err := b.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+		return child.Put([]byte("x"), []byte("1"))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.NoError(t, tx.DeleteBucket([]byte("widgets")))
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		_, err = b.CreateBucket([]byte("child"))
+		require.NoError(t, err)
+
+		// The deletion is seen before it commits.
+		require.ErrorIs(t, b.ChangedSince(first, func(k, v []byte) error {
+			return nil
+		}), bolt.ErrChangesUnavailable)
+		return nil
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		second = tx.ID()
+		return tx.Bucket([]byte("widgets")).Bucket([]byte("child")).Put([]byte("y"), []byte("2"))
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, b := range []*bolt.Bucket{b, b.Bucket([]byte("child"))} {
+			require.ErrorIs(t, b.ChangedSince(first, func(k, v []byte) error {
+				return nil
+			}), bolt.ErrChangesUnavailable)
+		}
+
+		var keys []string
+		require.NoError(t, b.Bucket([]byte("child")).ChangedSince(second, func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"y"}, keys)
+		return nil
+	}))
+}
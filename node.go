@@ -61,14 +61,29 @@ func (n *node) sizeLessThan(v uintptr) bool {
 	return true
 }
 
-// pageElementSize returns the size of each page element based on the type of node.
+// pageElementSize returns the size of each page element based on the type of
+// node. It includes the value flags byte on leaf pages that need one.
 func (n *node) pageElementSize() uintptr {
 	if n.isLeaf {
+		if n.hasValueFlags() {
+			return leafPageElementSize + 1
+		}
 		return leafPageElementSize
 	}
 	return branchPageElementSize
 }
 
+// hasValueFlags returns true if any element of a leaf node has value flags,
+// so that its page must store them.
+func (n *node) hasValueFlags() bool {
+	for i := range n.inodes {
+		if n.inodes[i].flags&^bucketLeafFlag != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // childAt returns the child node at a given index.
 func (n *node) childAt(index int) *node {
 	if n.isLeaf {
@@ -79,7 +94,7 @@ func (n *node) childAt(index int) *node {
 
 // childIndex returns the index of a given child node.
 func (n *node) childIndex(child *node) int {
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, child.key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].key, child.key) != -1 })
 	return index
 }
 
@@ -116,14 +131,14 @@ func (n *node) prevSibling() *node {
 func (n *node) put(oldKey, newKey, value []byte, pgId pgid, flags uint32) {
 	if pgId >= n.bucket.tx.meta.pgid {
 		panic(fmt.Sprintf("pgId (%d) above high water mark (%d)", pgId, n.bucket.tx.meta.pgid))
-	} else if len(oldKey) <= 0 {
+	} else if len(oldKey) <= 0 && !n.emptyKeysAllowed() {
 		panic("put: zero-length old key")
-	} else if len(newKey) <= 0 {
+	} else if len(newKey) <= 0 && !n.emptyKeysAllowed() {
 		panic("put: zero-length new key")
 	}
 
 	// Find insertion index.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, oldKey) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].key, oldKey) != -1 })
 
 	// Add capacity and shift nodes if we don't have an exact match and need to insert.
 	exact := (len(n.inodes) > 0 && index < len(n.inodes) && bytes.Equal(n.inodes[index].key, oldKey))
@@ -137,13 +152,13 @@ func (n *node) put(oldKey, newKey, value []byte, pgId pgid, flags uint32) {
 	inode.key = newKey
 	inode.value = value
 	inode.pgid = pgId
-	_assert(len(inode.key) > 0, "put: zero-length inode key")
+	_assert(len(inode.key) > 0 || n.emptyKeysAllowed(), "put: zero-length inode key")
 }
 
 // del removes a key from the node.
 func (n *node) del(key []byte) {
 	// Find index of key.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.compareKeys(n.inodes[i].key, key) != -1 })
 
 	// Exit if the key isn't found.
 	if index >= len(n.inodes) || !bytes.Equal(n.inodes[index].key, key) {
@@ -157,6 +172,12 @@ func (n *node) del(key []byte) {
 	n.unbalanced = true
 }
 
+// emptyKeysAllowed returns true if the database was opened with
+// Options.AllowEmptyKeys, in which case the first key of a node may be empty.
+func (n *node) emptyKeysAllowed() bool {
+	return n.bucket.tx.db.allowEmptyKeys
+}
+
 // read initializes the node from a page.
 func (n *node) read(p *page) {
 	n.pgid = p.id
@@ -167,7 +188,7 @@ func (n *node) read(p *page) {
 		inode := &n.inodes[i]
 		if n.isLeaf {
 			elem := p.leafPageElement(uint16(i))
-			inode.flags = elem.flags()
+			inode.flags = p.leafPageElementFlags(uint16(i))
 			inode.key = elem.key()
 			inode.value = elem.value()
 		} else {
@@ -175,13 +196,13 @@ func (n *node) read(p *page) {
 			inode.pgid = elem.pgid
 			inode.key = elem.key()
 		}
-		_assert(len(inode.key) > 0, "read: zero-length inode key")
+		_assert(len(inode.key) > 0 || n.emptyKeysAllowed(), "read: zero-length inode key")
 	}
 
 	// Save first key so we can find the node in the parent when we spill.
 	if len(n.inodes) > 0 {
 		n.key = n.inodes[0].key
-		_assert(len(n.key) > 0, "read: zero-length node key")
+		_assert(len(n.key) > 0 || n.emptyKeysAllowed(), "read: zero-length node key")
 	} else {
 		n.key = nil
 	}
@@ -194,7 +215,10 @@ func (n *node) write(p *page) {
 	_assert(p.count == 0 && p.flags == 0, "node cannot be written into a not empty page")
 
 	// Initialize page.
-	if n.isLeaf {
+	valueFlags := n.isLeaf && n.hasValueFlags()
+	if valueFlags {
+		p.flags = leafPageFlag | valueFlagsPageFlag
+	} else if n.isLeaf {
 		p.flags = leafPageFlag
 	} else {
 		p.flags = branchPageFlag
@@ -214,21 +238,27 @@ func (n *node) write(p *page) {
 	// off tracks the offset into p of the start of the next data.
 	off := unsafe.Sizeof(*p) + n.pageElementSize()*uintptr(len(n.inodes))
 	for i, item := range n.inodes {
-		_assert(len(item.key) > 0, "write: zero-length inode key")
+		_assert(len(item.key) > 0 || n.emptyKeysAllowed(), "write: zero-length inode key")
 
 		// Create a slice to write into of needed size and advance
 		// byte pointer for next iteration.
+		// The data address is taken from off rather than &b[0], since an
+		// empty key on a branch page has no data at all.
 		sz := len(item.key) + len(item.value)
 		b := unsafeByteSlice(unsafe.Pointer(p), off, 0, sz)
+		data := uintptr(unsafe.Pointer(p)) + off
 		off += uintptr(sz)
 
-		// Write the page element.
+		// Write the page element, and its value flags after the elements.
 		if n.isLeaf {
 			elem := p.leafPageElement(uint16(i))
-			elem.fill(item.flags, uintptr(unsafe.Pointer(&b[0]))-uintptr(unsafe.Pointer(elem)), len(item.key), len(item.value))
+			elem.fill(item.flags, data-uintptr(unsafe.Pointer(elem)), len(item.key), len(item.value))
+			if valueFlags {
+				p.valueFlags()[i] = byte(item.flags &^ bucketLeafFlag)
+			}
 		} else {
 			elem := p.branchPageElement(uint16(i))
-			elem.pos = uint32(uintptr(unsafe.Pointer(&b[0])) - uintptr(unsafe.Pointer(elem)))
+			elem.pos = uint32(data - uintptr(unsafe.Pointer(elem)))
 			elem.ksize = uint32(len(item.key))
 			elem.pgid = item.pgid
 			_assert(elem.pgid != p.id, "write: circular dependency occurred")
@@ -269,8 +299,18 @@ func (n *node) split(pageSize uintptr) []*node {
 // This should only be called from the split() function.
 func (n *node) splitTwo(pageSize uintptr) (*node, *node) {
 	// Ignore the split if the page doesn't have at least enough nodes for
-	// two pages or if the nodes can fit in a single page.
-	if len(n.inodes) <= (minKeysPerPage*2) || n.sizeLessThan(pageSize) {
+	// two pages or if the nodes can fit in a single page. Leaves holding a
+	// huge value may go down to a single key per page.
+	if n.sizeLessThan(pageSize) {
+		return n, nil
+	}
+	minKeys := minKeysPerPage
+	if n.isLeaf && n.hasHugeElement() {
+		minKeys = 1
+	} else if len(n.inodes) <= (minKeysPerPage * 2) {
+		return n, nil
+	}
+	if len(n.inodes) < 2*minKeys {
 		return n, nil
 	}
 
@@ -284,7 +324,10 @@ func (n *node) splitTwo(pageSize uintptr) (*node, *node) {
 	threshold := int(float64(pageSize) * fillPercent)
 
 	// Determine split position and sizes of the two pages.
-	splitIndex, _ := n.splitIndex(threshold)
+	splitIndex, _ := n.splitIndex(threshold, minKeys)
+	if splitIndex < uintptr(minKeys) {
+		splitIndex = uintptr(minKeys)
+	}
 
 	// Split node into two separate nodes.
 	// If there's no parent then we'll need to create one.
@@ -309,18 +352,19 @@ func (n *node) splitTwo(pageSize uintptr) (*node, *node) {
 // splitIndex finds the position where a page will fill a given threshold.
 // It returns the index as well as the size of the first page.
 // This is only be called from split().
-func (n *node) splitIndex(threshold int) (index, sz uintptr) {
+func (n *node) splitIndex(threshold int, minKeys int) (index, sz uintptr) {
 	sz = pageHeaderSize
+	elsz := n.pageElementSize()
 
 	// Loop until we only have the minimum number of keys required for the second page.
-	for i := 0; i < len(n.inodes)-minKeysPerPage; i++ {
+	for i := 0; i < len(n.inodes)-minKeys; i++ {
 		index = uintptr(i)
 		inode := n.inodes[i]
-		elsize := n.pageElementSize() + uintptr(len(inode.key)) + uintptr(len(inode.value))
+		elsize := elsz + uintptr(len(inode.key)) + uintptr(len(inode.value))
 
 		// If we have at least the minimum number of keys and adding another
 		// node would put us over the threshold then exit and return.
-		if index >= minKeysPerPage && sz+elsize > uintptr(threshold) {
+		if index >= uintptr(minKeys) && sz+elsize > uintptr(threshold) {
 			break
 		}
 
@@ -331,6 +375,23 @@ func (n *node) splitIndex(threshold int) (index, sz uintptr) {
 	return
 }
 
+// hugeElementSize is the element size above which a leaf element may be
+// split onto a page of its own. A page holding two such elements would be
+// larger than the largest value.
+const hugeElementSize = MaxValueSize / 2
+
+// hasHugeElement returns true if any element of the node is larger than
+// hugeElementSize.
+func (n *node) hasHugeElement() bool {
+	elsz := n.pageElementSize()
+	for _, inode := range n.inodes {
+		if elsz+uintptr(len(inode.key))+uintptr(len(inode.value)) > hugeElementSize {
+			return true
+		}
+	}
+	return false
+}
+
 // spill writes the nodes to dirty pages and splits nodes as it goes.
 // Returns an error if dirty pages cannot be allocated.
 func (n *node) spill() error {
@@ -384,7 +445,7 @@ func (n *node) spill() error {
 
 			node.parent.put(key, node.inodes[0].key, nil, node.pgid, 0)
 			node.key = node.inodes[0].key
-			_assert(len(node.key) > 0, "spill: zero-length node key")
+			_assert(len(node.key) > 0 || n.emptyKeysAllowed(), "spill: zero-length node key")
 		}
 
 		// Update the statistics.
@@ -412,9 +473,10 @@ func (n *node) rebalance() {
 	// Update statistics.
 	n.bucket.tx.stats.IncRebalance(1)
 
-	// Ignore if node is above threshold (25%) and has enough keys.
-	var threshold = n.bucket.tx.db.pageSize / 4
-	if n.size() > threshold && len(n.inodes) > n.minKeys() {
+	// Ignore if node is above threshold (25% by default) and has enough keys,
+	// or if it is a leaf holding a single huge value.
+	var threshold = int(float64(n.bucket.tx.db.pageSize) * n.bucket.tx.db.rebalanceThreshold)
+	if n.size() > threshold && (len(n.inodes) > n.minKeys() || n.hasHugeElement()) {
 		return
 	}
 
@@ -522,7 +584,7 @@ func (n *node) dereference() {
 		key := make([]byte, len(n.key))
 		copy(key, n.key)
 		n.key = key
-		_assert(n.pgid == 0 || len(n.key) > 0, "dereference: zero-length node key on existing node")
+		_assert(n.pgid == 0 || len(n.key) > 0 || n.emptyKeysAllowed(), "dereference: zero-length node key on existing node")
 	}
 
 	for i := range n.inodes {
@@ -531,7 +593,7 @@ func (n *node) dereference() {
 		key := make([]byte, len(inode.key))
 		copy(key, inode.key)
 		inode.key = key
-		_assert(len(inode.key) > 0, "dereference: zero-length inode key")
+		_assert(len(inode.key) > 0 || n.emptyKeysAllowed(), "dereference: zero-length inode key")
 
 		value := make([]byte, len(inode.value))
 		copy(value, inode.value)
@@ -582,10 +644,6 @@ func (n *node) dump() {
 }
 */
 
-func compareKeys(left, right []byte) int {
-	return bytes.Compare(left, right)
-}
-
 type nodes []*node
 
 func (s nodes) Len() int      { return len(s) }
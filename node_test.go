@@ -99,6 +99,43 @@ func TestNode_write_LeafPage(t *testing.T) {
 	}
 }
 
+// Ensure that value flags are written after the leaf elements, and only on
+// pages that have some.
+func TestNode_write_LeafPage_ValueFlags(t *testing.T) {
+	n := &node{isLeaf: true, inodes: make(inodes, 0), bucket: &Bucket{tx: &Tx{db: &DB{}, meta: &meta{pgid: 1}}}}
+	n.put([]byte("john"), []byte("john"), []byte("johnson"), 0, 0)
+	n.put([]byte("sub"), []byte("sub"), []byte("bucket"), 0, bucketLeafFlag)
+
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	n.write(p)
+	if p.flags != leafPageFlag {
+		t.Fatalf("exp=%x; got=%x", leafPageFlag, p.flags)
+	} else if size := n.size(); size != int(pageHeaderSize+2*leafPageElementSize)+20 {
+		t.Fatalf("unexpected size: %d", size)
+	}
+
+	n.put([]byte("susy"), []byte("susy"), []byte("que"), 0, FlaggedValue)
+	buf = [4096]byte{}
+	n.write(p)
+	if p.flags != leafPageFlag|valueFlagsPageFlag {
+		t.Fatalf("exp=%x; got=%x", leafPageFlag|valueFlagsPageFlag, p.flags)
+	} else if size := n.size(); size != int(pageHeaderSize+3*(leafPageElementSize+1))+27 {
+		t.Fatalf("unexpected size: %d", size)
+	}
+
+	n2 := &node{}
+	n2.read(p)
+	for i, exp := range []uint32{0, bucketLeafFlag, FlaggedValue} {
+		if flags := n2.inodes[i].flags; flags != exp {
+			t.Fatalf("%s: exp=%x; got=%x", n2.inodes[i].key, exp, flags)
+		}
+	}
+	if k, v := n2.inodes[2].key, n2.inodes[2].value; string(k) != "susy" || string(v) != "que" {
+		t.Fatalf("exp=<susy,que>; got=<%s,%s>", k, v)
+	}
+}
+
 // Ensure that a node can split into appropriate subgroups.
 func TestNode_split(t *testing.T) {
 	// Create a node.
@@ -0,0 +1,122 @@
+package bbolt
+
+import (
+	"fmt"
+)
+
+// Overlap is a page claimed by more than one live page span, as reported by
+// DB.DetectOverlaps.
+type Overlap struct {
+	ID int // page claimed more than once
+
+	// Owner is the first page of the span that claimed ID first, and Other
+	// the first page of the span found claiming it again. The meta pages and
+	// the freelist regions count as spans of their own.
+	Owner, Other int
+
+	// Bucket is the path of the bucket whose tree references Other, empty
+	// for the root bucket.
+	Bucket [][]byte
+}
+
+// DetectOverlaps walks the B+tree of every bucket and reports the pages that
+// two live page spans claim, in the order they are found. A span is a page
+// and its overflow pages, so a branch or leaf page whose overflow count runs
+// into the next page is caught even though nothing references that page
+// twice, which Check only looks for by page id. A page referenced twice is
+// reported once for every page of its span, and its children are not walked
+// again. Returns an error if a page lies past the high water mark or the
+// tree is deeper than Options.MaxTreeDepthGuard, as the walk can't go on.
+func (db *DB) DetectOverlaps() ([]Overlap, error) {
+	var overlaps []Overlap
+	err := db.View(func(tx *Tx) error {
+		var err error
+		overlaps, err = tx.detectOverlaps()
+		return err
+	})
+	return overlaps, err
+}
+
+// overlapDetector tracks the spans claiming each page below the high water
+// mark.
+type overlapDetector struct {
+	tx       *Tx
+	owners   []pgid // first page of the claiming span plus one, or zero
+	overlaps []Overlap
+}
+
+func (tx *Tx) detectOverlaps() ([]Overlap, error) {
+	d := &overlapDetector{tx: tx, owners: make([]pgid, tx.meta.pgid)}
+
+	// The meta pages and the freelist regions come first.
+	d.claim(0, 1, nil)
+	d.claim(1, 1, nil)
+	regionPages := pgid(tx.db.freelistRegionSize / tx.db.pageSize)
+	for _, id := range []pgid{tx.db.freelistRegion(0), tx.db.freelistRegion(1)} {
+		if n := regionPages; id+n > tx.meta.pgid {
+			d.claim(id, tx.meta.pgid-id, nil)
+		} else {
+			d.claim(id, n, nil)
+		}
+	}
+
+	if err := d.bucket(&tx.root); err != nil {
+		return nil, err
+	}
+	return d.overlaps, nil
+}
+
+// claim marks the span of n pages starting at id as claimed, recording an
+// overlap for every page of it claimed already.
+func (d *overlapDetector) claim(id, n pgid, path [][]byte) {
+	for i := id; i < id+n; i++ {
+		if owner := d.owners[i]; owner != 0 {
+			d.overlaps = append(d.overlaps, Overlap{ID: int(i), Owner: int(owner - 1), Other: int(id), Bucket: path})
+			continue
+		}
+		d.owners[i] = id + 1
+	}
+}
+
+// bucket claims the pages of b and of its nested buckets.
+func (d *overlapDetector) bucket(b *Bucket) error {
+	// Inline buckets live in their parent's leaf.
+	if b.root == 0 {
+		return nil
+	}
+
+	path := b.path()
+	if err := d.page(b.root, 0, path); err != nil {
+		return err
+	}
+	return b.forEachChild(d.bucket)
+}
+
+// page claims the span of page id and walks its children.
+func (d *overlapDetector) page(id pgid, depth int, path [][]byte) error {
+	hwm := d.tx.meta.pgid
+	if depth >= d.tx.db.maxTreeDepth {
+		return &BoltError{Err: ErrTreeTooDeep, PageID: int(id), BucketPath: path}
+	} else if id >= hwm {
+		return &BoltError{Err: fmt.Errorf("page %d: out of bounds: %d", int(id), int(hwm)), PageID: int(id), BucketPath: path}
+	}
+
+	p := d.tx.page(id)
+	n := pgid(p.overflow) + 1
+	if id+n > hwm {
+		return &BoltError{Err: fmt.Errorf("page %d: overflow out of bounds: %d", int(id), int(hwm)), PageID: int(id), BucketPath: path}
+	}
+
+	// A page referenced twice has had its children walked already.
+	walked := d.owners[id] == id+1
+	d.claim(id, n, path)
+	if walked || (p.flags&branchPageFlag) == 0 {
+		return nil
+	}
+	for i := 0; i < int(p.count); i++ {
+		if err := d.page(p.branchPageElement(uint16(i)).pgid, depth+1, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -19,6 +19,11 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+
+	// valueFlagsPageFlag marks a leaf page that stores a byte of value flags
+	// for each element, right after the elements. It is only written to
+	// files of format version 3 or later.
+	valueFlagsPageFlag = 0x20
 )
 
 var fastCheckBits = func() (bits [0x11]bool) {
@@ -31,6 +36,15 @@ var fastCheckBits = func() (bits [0x11]bool) {
 
 const (
 	bucketLeafFlag = 0x01
+
+	// FlaggedValue is reported by Cursor.Flags for values that were
+	// written with Bucket.PutFlagged. Unlike bucketLeafFlag, it is not
+	// packed into the leaf element; see valueFlagsPageFlag.
+	FlaggedValue = 0x02
+
+	// BucketLeafFlag is reported by Bucket.GetWithFlags for keys that hold
+	// a nested bucket.
+	BucketLeafFlag = bucketLeafFlag
 )
 
 type pgid uint64
@@ -66,17 +80,42 @@ func (p *page) fastCheck(id pgid) {
 		panic(fmt.Sprintf("Page expected to be: %v, but self identifies as %v", id, p.id))
 	}
 	// Only one flag of page-type can be set.
-	if p.flags > freelistPageFlag || !fastCheckBits[p.flags] {
+	if flags := p.typeFlags(); flags > freelistPageFlag || !fastCheckBits[flags] {
 		panic(fmt.Sprintf("page %v: has unexpected type/flags: %x", p.id, p.flags))
 	}
 }
 
+// typeFlags returns the page flags without valueFlagsPageFlag, if the page
+// is a leaf page.
+func (p *page) typeFlags() uint16 {
+	if p.flags == leafPageFlag|valueFlagsPageFlag {
+		return leafPageFlag
+	}
+	return p.flags
+}
+
 // leafPageElement retrieves the leaf node by index
 func (p *page) leafPageElement(index uint16) *leafPageElement {
 	return (*leafPageElement)(unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p),
 		leafPageElementSize, int(index)))
 }
 
+// leafPageElementFlags returns the flags of the leaf node at index, including
+// its value flags.
+func (p *page) leafPageElementFlags(index uint16) uint32 {
+	flags := p.leafPageElement(index).flags()
+	if (p.flags & valueFlagsPageFlag) != 0 {
+		flags |= uint32(p.valueFlags()[index])
+	}
+	return flags
+}
+
+// valueFlags returns the value flags of the elements of a leaf page that has
+// valueFlagsPageFlag set.
+func (p *page) valueFlags() []byte {
+	return unsafeByteSlice(unsafe.Pointer(p), unsafe.Sizeof(*p)+leafPageElementSize*uintptr(p.count), 0, int(p.count))
+}
+
 // leafPageElements retrieves a list of leaf nodes.
 func (p *page) leafPageElements() []leafPageElement {
 	if p.count == 0 {
@@ -129,6 +168,18 @@ func (n *branchPageElement) key() []byte {
 	return unsafeByteSlice(unsafe.Pointer(n), 0, int(n.pos), int(n.pos)+int(n.ksize))
 }
 
+// Widths of the fields packed into leafPageElement.data.
+const (
+	leafFlagBits  = 1 // bucketLeafFlag
+	leafPosBits   = 26
+	leafKsizeBits = 13
+	leafVsizeBits = 24
+
+	maxLeafPos   = 1<<leafPosBits - 1
+	maxLeafKsize = 1<<leafKsizeBits - 1
+	maxLeafVsize = 1<<leafVsizeBits - 1
+)
+
 // leafPageElement represents a node on a leaf page.
 type leafPageElement struct {
 	//  1: flags
@@ -138,12 +189,14 @@ type leafPageElement struct {
 	data uint64
 }
 
+// flags returns the flags packed into the element, which is bucketLeafFlag
+// or zero. Use page.leafPageElementFlags to include the value flags.
 func (n *leafPageElement) flags() uint32 {
 	return uint32(n.data >> 63)
 }
 
 func (n *leafPageElement) pos() uint32 {
-	return uint32(n.data>>37) & 0x3FFFFFF
+	return uint32(n.data>>37) & maxLeafPos
 }
 
 func (n *leafPageElement) ksize() uint32 {
@@ -155,8 +208,10 @@ func (n *leafPageElement) vsize() uint32 {
 }
 
 func (n *leafPageElement) fill(flags uint32, pos uintptr, ksize, vsize int) *leafPageElement {
-	_assert(pos <= 0x3FFFFFF, "impossible page offset: %d", pos)
-	n.data = uint64(flags)<<63 | uint64(pos)<<37 | uint64(ksize)<<24 | uint64(vsize)
+	_assert(pos <= maxLeafPos, "impossible page offset: %d", pos)
+	_assert(ksize <= maxLeafKsize, "key too large for a leaf element: %d", ksize)
+	_assert(vsize <= maxLeafVsize, "value too large for a leaf element: %d", vsize)
+	n.data = uint64(flags&bucketLeafFlag)<<63 | uint64(pos)<<37 | uint64(ksize)<<24 | uint64(vsize)
 	return n
 }
 
@@ -182,6 +237,21 @@ type PageInfo struct {
 	OverflowCount int
 }
 
+// PageDetail represents extended information about a page.
+type PageDetail struct {
+	PageInfo
+
+	// OverflowStart and OverflowEnd are the first and last (inclusive)
+	// overflow page ids. Both are zero if the page has no overflow.
+	OverflowStart int
+	OverflowEnd   int
+
+	// KeySizes and ValueSizes hold the size of each element's key and
+	// value in page order. They are only set for leaf pages.
+	KeySizes   []int
+	ValueSizes []int
+}
+
 type pgids []pgid
 
 func (s pgids) Len() int           { return len(s) }
@@ -31,6 +31,30 @@ func TestPage_dump(t *testing.T) {
 	(&page{id: 256}).hexdump(16)
 }
 
+// Ensure that leaf elements hold the largest key and value sizes, and that
+// fill refuses sizes that its packed fields would truncate.
+func TestLeafPageElement_fill(t *testing.T) {
+	var n leafPageElement
+	n.fill(bucketLeafFlag, maxLeafPos, MaxKeySize, MaxValueSize)
+	if n.flags() != bucketLeafFlag || n.pos() != maxLeafPos || n.ksize() != MaxKeySize || n.vsize() != MaxValueSize {
+		t.Fatalf("unexpected element: flags=%d pos=%d ksize=%d vsize=%d", n.flags(), n.pos(), n.ksize(), n.vsize())
+	}
+
+	for _, tc := range []struct{ ksize, vsize int }{
+		{MaxKeySize + 1, 0},
+		{0, MaxValueSize + 1},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic for ksize=%d vsize=%d", tc.ksize, tc.vsize)
+				}
+			}()
+			n.fill(0, 0, tc.ksize, tc.vsize)
+		}()
+	}
+}
+
 func TestPgids_merge(t *testing.T) {
 	a := pgids{4, 5, 6, 10, 11, 12, 13, 27}
 	b := pgids{1, 3, 8, 9, 25, 30}
@@ -1,7 +1,13 @@
 package bbolt
 
 import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -20,14 +26,24 @@ type txid uint64
 // are using them. A long running read transaction can cause the database to
 // quickly grow.
 type Tx struct {
-	writable       bool
-	managed        bool
-	db             *DB
-	meta           *meta
-	root           Bucket
-	pages          map[pgid]*page
-	stats          TxStats
-	commitHandlers []func()
+	writable         bool
+	managed          bool
+	db               *DB
+	meta             *meta
+	root             Bucket
+	pages            map[pgid]*page
+	cleanPages       map[pgid]*page // pages read from the file, see cleanPage
+	stats            TxStats
+	statsReset       TxStats // counts dropped from stats by ResetStats
+	commitHandlers   []func()
+	mutations        []byte
+	droppedBuckets   []string // changesPath of each deleted bucket
+	rollbackHandlers []func()
+	filters          map[string]*bloomFilter
+	start            time.Time
+	reclaimed        int // pending pages released when the transaction began
+	memory           int // approximate bytes of nodes and dirty pages
+	writeChecksum    uint32
 
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
@@ -42,6 +58,8 @@ type Tx struct {
 func (tx *Tx) init(db *DB) {
 	tx.db = db
 	tx.pages = nil
+	tx.filters = db.filters
+	tx.start = time.Now()
 
 	// Copy the meta page since it can be changed by the writer.
 	tx.meta = &meta{}
@@ -56,7 +74,6 @@ func (tx *Tx) init(db *DB) {
 	if tx.writable {
 		tx.pages = make(map[pgid]*page)
 		tx.meta.txid += txid(1)
-		tx.meta.flid++
 	}
 }
 
@@ -75,6 +92,171 @@ func (tx *Tx) Size() int64 {
 	return int64(tx.meta.pgid) * int64(tx.db.pageSize)
 }
 
+// WillRemap returns whether a commit that grows the database by
+// additionalBytes beyond the size seen by this transaction would need to
+// remap the data file, which blocks until all read transactions finish.
+// Space reused from the freelist does not grow the database.
+func (tx *Tx) WillRemap(additionalBytes int64) bool {
+	if tx.db == nil {
+		return false
+	}
+	pageSize := int64(tx.db.pageSize)
+	n := (additionalBytes + pageSize - 1) / pageSize
+	return (int64(tx.meta.pgid)+n+1)*pageSize >= int64(tx.db.datasz)
+}
+
+// WriteTo writes the database as seen by the transaction to w, so that a
+// consistent copy can be taken while other transactions go on. Exactly
+// Size() bytes are written. The data pages are read from the database file,
+// which is opened with WriteFlag, and the meta pages and freelist are built
+// from the transaction: the freelist holds every page below the high water
+// mark that is not reachable from a bucket.
+//
+// The CRC-32 (IEEE) of the bytes written is available from LastWriteChecksum
+// afterwards. If w fails, the number of bytes written so far is returned
+// with the error. Returns ErrTxWritable for a writable transaction, whose
+// changes are not in the file yet.
+func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if tx.writable {
+		return 0, ErrTxWritable
+	}
+
+	f, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	crc := crc32.NewIEEE()
+	defer func() { tx.writeChecksum = crc.Sum32() }()
+	emit := func(b []byte) error {
+		wn, err := w.Write(b)
+		_, _ = crc.Write(b[:wn])
+		n += int64(wn)
+		if err == nil && wn < len(b) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}
+
+	header, err := tx.snapshotHeader(tx.reachablePages())
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range header {
+		if err := emit(b); err != nil {
+			return n, err
+		}
+	}
+
+	// Copy the data pages up to the high water mark.
+	off := int64(tx.db.dataStart()) * int64(tx.db.pageSize)
+	r := io.NewSectionReader(f, off, tx.Size()-off)
+	chunk := make([]byte, 256*tx.db.pageSize)
+	for {
+		rn, rerr := r.Read(chunk)
+		if rn > 0 {
+			if err := emit(chunk[:rn]); err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+	if n != tx.Size() {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// LastWriteChecksum returns the CRC-32 (IEEE) of the bytes written by the
+// last call to WriteTo on the transaction.
+func (tx *Tx) LastWriteChecksum() uint32 {
+	return tx.writeChecksum
+}
+
+// snapshotHeader returns the meta pages and freelist regions of a copy of
+// the database as seen by the transaction. The freelist region of the
+// transaction may have been rewritten by later commits, so it gets a freelist
+// rebuilt from the reachable pages, and the other region is left empty.
+// Returns ErrFreelistRegionFull if that freelist does not fit its region.
+func (tx *Tx) snapshotHeader(reachable pageSet) ([][]byte, error) {
+	// Both meta pages are written, the second with a lower transaction id.
+	meta0 := make([]byte, tx.db.pageSize)
+	p := (*page)(unsafe.Pointer(&meta0[0]))
+	p.flags = metaPageFlag
+	*p.meta() = *tx.meta
+	p.meta().checksum = p.meta().sum64()
+	meta1 := make([]byte, tx.db.pageSize)
+	copy(meta1, meta0)
+	p = (*page)(unsafe.Pointer(&meta1[0]))
+	p.id = 1
+	p.meta().txid--
+	p.meta().checksum = p.meta().sum64()
+
+	var free []pgid
+	for id := tx.db.dataStart(); id < tx.meta.pgid; id++ {
+		if !reachable.has(id) {
+			free = append(free, id)
+		}
+	}
+	fl := newFreelist(FreelistArrayType)
+	fl.checksum = tx.meta.freelistChecksum()
+	fl.readIDs(free)
+	if fl.size() >= tx.db.freelistRegionSize-tx.db.pageSize {
+		return nil, ErrFreelistRegionFull
+	}
+
+	region := make([]byte, tx.db.freelistRegionSize)
+	p = (*page)(unsafe.Pointer(&region[0]))
+	p.id = tx.db.freelistRegion(tx.meta.flid)
+	p.overflow = uint32(fl.size() / tx.db.pageSize)
+	_ = fl.write(p)
+	empty := make([]byte, tx.db.freelistRegionSize)
+	if tx.meta.flid%2 == 1 {
+		return [][]byte{meta0, meta1, empty, region}, nil
+	}
+	return [][]byte{meta0, meta1, region, empty}, nil
+}
+
+// pageSet is a bitmap of page ids.
+type pageSet []uint64
+
+func (s pageSet) add(id pgid)      { s[id/64] |= 1 << (id % 64) }
+func (s pageSet) has(id pgid) bool { return s[id/64]&(1<<(id%64)) != 0 }
+
+// reachablePages returns the pages below the high water mark that a bucket
+// of the transaction refers to.
+func (tx *Tx) reachablePages() pageSet {
+	reachable := make(pageSet, (tx.meta.pgid+63)/64)
+	mark := func(p *page, _ int, _ []pgid) {
+		for id := p.id; id <= p.id+pgid(p.overflow) && id < tx.meta.pgid; id++ {
+			reachable.add(id)
+		}
+	}
+	var walk func(b *Bucket)
+	walk = func(b *Bucket) {
+		if b.root != 0 {
+			_ = tx.forEachPage(b.root, mark)
+		}
+		_ = b.forEachChild(func(child *Bucket) error {
+			walk(child)
+			return nil
+		})
+	}
+	walk(&tx.root)
+	return reachable
+}
+
 // Writable returns whether the transaction can perform write operations.
 func (tx *Tx) Writable() bool {
 	return tx.writable
@@ -93,13 +275,34 @@ func (tx *Tx) Stats() TxStats {
 	return tx.stats
 }
 
+// ResetStats zeroes the transaction statistics, so that Stats only counts
+// what the transaction does from then on, such as a single phase of a long
+// write. The counts dropped are still merged into the DB's statistics when
+// the transaction closes.
+func (tx *Tx) ResetStats() {
+	// Subtract the counts rather than overwriting them, which keeps any
+	// increment made meanwhile.
+	stats := tx.stats
+	tx.statsReset.add(&stats)
+	delta := (&TxStats{}).Sub(&stats)
+	tx.stats.add(&delta)
+}
+
 // Bucket retrieves a bucket by name.
-// Returns nil if the bucket does not exist.
+// Returns nil if the bucket does not exist, or if its keys are ordered by a
+// comparator that is not registered.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (tx *Tx) Bucket(name []byte) *Bucket {
 	return tx.root.Bucket(name)
 }
 
+// OpenBucket retrieves a bucket by name, like Bucket, but returns an error if
+// the bucket cannot be opened. See Bucket.OpenBucket.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) OpenBucket(name []byte) (*Bucket, error) {
+	return tx.root.OpenBucket(name)
+}
+
 // CreateBucket creates a new bucket.
 // Returns an error if the bucket already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
@@ -120,12 +323,170 @@ func (tx *Tx) DeleteBucket(name []byte) error {
 	return tx.root.DeleteBucket(name)
 }
 
+// ReplaceBucket rebuilds an existing top-level bucket. The build function is
+// called with a new, empty bucket which is swapped in for the old one only if
+// build returns nil; the old bucket and all of its pages are then released.
+// If build returns an error the old bucket is left untouched and the error is
+// returned. Readers see either the old or the new contents once committed.
+// Returns an error if the bucket cannot be found or if the key represents a
+// non-bucket value.
+func (tx *Tx) ReplaceBucket(name []byte, build func(*Bucket) error) error {
+	return tx.root.replaceBucket(name, build)
+}
+
+// MoveKey moves key and its value from the top-level bucket srcBucket to the
+// top-level bucket dstBucket, replacing any existing value for key there.
+// Both changes become visible together when the transaction commits.
+// Returns ErrBucketNotFound if either bucket does not exist, ErrKeyNotFound if
+// key does not exist in srcBucket, and ErrIncompatibleValue if key names a
+// nested bucket in either bucket.
+func (tx *Tx) MoveKey(srcBucket, dstBucket, key []byte) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	src, err := tx.OpenBucket(srcBucket)
+	if err != nil {
+		return err
+	}
+	dst, err := tx.OpenBucket(dstBucket)
+	if err != nil {
+		return err
+	}
+
+	c := src.Cursor()
+	k, v, flags := c.seek(key)
+	if c.err != nil {
+		return c.err
+	} else if !bytes.Equal(key, k) {
+		return c.wrapError(ErrKeyNotFound, key)
+	} else if (flags & bucketLeafFlag) != 0 {
+		return c.wrapError(ErrIncompatibleValue, key)
+	}
+	if src == dst {
+		return nil
+	}
+
+	// Insert first so that a failure leaves the source untouched.
+	if err := dst.put(key, cloneBytes(v), flags&FlaggedValue); err != nil {
+		return err
+	}
+	return src.Delete(key)
+}
+
+// RotateBuckets keeps a bounded ring of top-level generation buckets, named
+// prefix followed by a decimal generation number, such as "log0", "log1" and
+// so on. It creates a new, empty generation numbered one past the newest
+// existing one, or 0 if there is none, and then deletes the oldest
+// generations along with their contents until at most maxGenerations remain.
+// Top-level names starting with prefix that are not followed by a plain
+// decimal number are left alone.
+func (tx *Tx) RotateBuckets(prefix []byte, maxGenerations int) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if maxGenerations < 1 {
+		return fmt.Errorf("invalid max generations %d", maxGenerations)
+	}
+
+	var gens []uint64
+	c := tx.root.Cursor()
+	for k, _, flags := c.seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _, flags = c.next() {
+		if (flags & bucketLeafFlag) == 0 {
+			continue
+		}
+		if n, ok := parseGeneration(k[len(prefix):]); ok {
+			gens = append(gens, n)
+		}
+	}
+	if c.err != nil {
+		return c.err
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+
+	var next uint64
+	if len(gens) > 0 {
+		next = gens[len(gens)-1] + 1
+	}
+	if _, err := tx.CreateBucket(generationName(prefix, next)); err != nil {
+		return err
+	}
+	gens = append(gens, next)
+
+	for len(gens) > maxGenerations {
+		if err := tx.DeleteBucket(generationName(prefix, gens[0])); err != nil {
+			return err
+		}
+		gens = gens[1:]
+	}
+	return nil
+}
+
+// parseGeneration parses the generation number of a RotateBuckets bucket,
+// rejecting anything but the canonical decimal form.
+func parseGeneration(b []byte) (uint64, bool) {
+	if len(b) == 0 || (b[0] == '0' && len(b) > 1) {
+		return 0, false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	return n, err == nil
+}
+
+func generationName(prefix []byte, n uint64) []byte {
+	return strconv.AppendUint(append([]byte(nil), prefix...), n, 10)
+}
+
+// Lookup names a key in a top-level bucket, for use with Tx.GetAll.
+type Lookup struct {
+	Bucket []byte
+	Key    []byte
+}
+
+// GetAll returns the values of several keys, which may live in different
+// top-level buckets, all read from the transaction's snapshot. Each bucket
+// is resolved once, however many lookups name it. A value is nil if its key
+// does not exist or is a nested bucket. Returns ErrBucketNotFound if any of
+// the buckets does not exist. The values are only valid for the life of the
+// transaction.
+func (tx *Tx) GetAll(lookups []Lookup) ([][]byte, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	buckets := make(map[string]*Bucket)
+	values := make([][]byte, len(lookups))
+	for i, l := range lookups {
+		b, ok := buckets[string(l.Bucket)]
+		if !ok {
+			var err error
+			if b, err = tx.OpenBucket(l.Bucket); err != nil {
+				return nil, err
+			}
+			buckets[string(l.Bucket)] = b
+		}
+		values[i] = b.Get(l.Key)
+	}
+	return values, nil
+}
+
 // ForEach executes a function for each bucket in the root.
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller.
 func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
 	return tx.root.ForEach(func(k, v []byte) error {
-		return fn(k, tx.root.Bucket(k))
+		b, err := tx.root.OpenBucket(k)
+		if err != nil {
+			return err
+		}
+		return fn(k, b)
 	})
 }
 
@@ -134,10 +495,35 @@ func (tx *Tx) OnCommit(fn func()) {
 	tx.commitHandlers = append(tx.commitHandlers, fn)
 }
 
+// OnRollback adds a handler function to be executed after the transaction
+// is rolled back, either by calling Rollback or because a commit failed.
+func (tx *Tx) OnRollback(fn func()) {
+	tx.rollbackHandlers = append(tx.rollbackHandlers, fn)
+}
+
+// PendingCommitHandlers returns the number of handlers registered with
+// OnCommit so far, which helps spot code that registers them in a loop.
+func (tx *Tx) PendingCommitHandlers() int {
+	return len(tx.commitHandlers)
+}
+
 // Commit writes all changes to disk and updates the meta page.
 // Returns an error if a disk write error occurs, or if Commit is
-// called on a read-only transaction.
+// called on a read-only transaction. An ErrMutationLogWrite error is
+// returned after the changes are written.
 func (tx *Tx) Commit() error {
+	return tx.commit(true)
+}
+
+// CommitNoRebalance behaves like Commit but skips the rebalance phase.
+// It is intended for insert-only bulk loads and must only be used when
+// nothing has been deleted in the transaction, otherwise the resulting
+// tree may contain underfilled or empty pages.
+func (tx *Tx) CommitNoRebalance() error {
+	return tx.commit(false)
+}
+
+func (tx *Tx) commit(rebalance bool) error {
 	_assert(!tx.managed, "managed tx commit not allowed")
 	if tx.db == nil {
 		return ErrTxClosed
@@ -145,13 +531,13 @@ func (tx *Tx) Commit() error {
 		return ErrTxNotWritable
 	}
 
-	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
-
 	// Rebalance nodes which have had deletions.
 	var startTime = time.Now()
-	tx.root.rebalance()
-	if tx.stats.GetRebalance() > 0 {
-		tx.stats.IncRebalanceTime(time.Since(startTime))
+	if rebalance {
+		tx.root.rebalance()
+		if tx.stats.GetRebalance() > 0 {
+			tx.stats.IncRebalanceTime(time.Since(startTime))
+		}
 	}
 
 	opgid := tx.meta.pgid
@@ -163,6 +549,15 @@ func (tx *Tx) Commit() error {
 		return err
 	}
 	tx.stats.IncSpillTime(time.Since(startTime))
+	tx.db.freelist.flushBatch(tx.meta.txid)
+
+	// Refuse to let pages held back by readers pile up past the limit. The
+	// pages this transaction just freed are left out: no reader holds them
+	// yet, and counting them would fail every large enough rewrite.
+	if max := tx.db.MaxPendingPages; max > 0 && tx.db.freelist.pendingCountBefore(tx.meta.txid) > max {
+		tx.rollback()
+		return ErrTooManyPendingPages
+	}
 
 	// Free the old root bucket.
 	tx.meta.root.root = tx.root.root
@@ -194,16 +589,23 @@ func (tx *Tx) Commit() error {
 	// If strict mode is enabled then perform a consistency check.
 	if tx.db.StrictMode {
 		ch := tx.Check()
-		var errs []string
+		var errs []error
 		for {
 			err, ok := <-ch
 			if !ok {
 				break
 			}
-			errs = append(errs, err.Error())
+			errs = append(errs, err)
 		}
-		if len(errs) > 0 {
-			panic("check fail: " + strings.Join(errs, "\n"))
+		if len(errs) > 0 && tx.db.StrictModeReturnsError {
+			tx.rollback()
+			return &CheckError{Errors: errs}
+		} else if len(errs) > 0 {
+			msgs := make([]string, len(errs))
+			for i, err := range errs {
+				msgs[i] = err.Error()
+			}
+			panic("check fail: " + strings.Join(msgs, "\n"))
 		}
 	}
 
@@ -213,6 +615,8 @@ func (tx *Tx) Commit() error {
 		return err
 	}
 	tx.stats.IncWriteTime(time.Since(startTime))
+	tx.db.publishFastEpoch(tx.meta)
+	logErr := tx.flushMutations()
 
 	// Finalize the transaction.
 	tx.close()
@@ -222,30 +626,50 @@ func (tx *Tx) Commit() error {
 		fn()
 	}
 
-	return nil
+	return logErr
 }
 
 func (tx *Tx) commitFreelist() error {
-	_assert(tx.db.freelist.size() < freelistRegionSize-tx.db.pageSize, "fatal: freelist too large")
+	// The freelist must fit in its region, leaving room for the header.
+	// Strict mode keeps treating an overflow as fatal unless it returns
+	// errors.
+	if tx.db.freelist.size() >= tx.db.freelistRegionSize-tx.db.pageSize {
+		_assert(!tx.db.StrictMode || tx.db.StrictModeReturnsError, "fatal: freelist too large")
+		tx.rollback()
+		return ErrFreelistRegionFull
+	}
 
 	var buf []byte
 	var pages int
 	if size := tx.db.freelist.size(); size < tx.db.pageSize {
 		pages = 1
-		buf = tx.db.pagePool.Get().([]byte)
+		buf = tx.db.getPageBuffer()
 	} else {
 		pages = size/tx.db.pageSize + 1
-		buf = make([]byte, pages*tx.db.pageSize)
+		buf = tx.db.allocBuffer(pages * tx.db.pageSize)
 	}
 	p := (*page)(unsafe.Pointer(&buf[0]))
-	p.id = 2 + (tx.meta.flid%2)*freelistRegionSize/pgid(tx.db.pageSize)
+	p.id = tx.db.freelistRegion(tx.meta.flid + 1)
 	p.overflow = uint32(pages) - 1
 
 	if err := tx.db.freelist.write(p); err != nil {
+		tx.db.putPageBuffer(buf)
 		tx.rollback()
 		return err
 	}
 
+	// Keep using the current region if the freelist has not changed, which
+	// saves writing it out again. Otherwise switch to the other region so
+	// the current one stays intact until the new meta page is written.
+	// The buffer is not written in that case, so it goes straight back to
+	// the pool.
+	cur := tx.db.page(tx.db.freelistRegion(tx.meta.flid))
+	if p.sameFreelist(cur, tx.db.freelistRegionSize) {
+		tx.db.putPageBuffer(buf)
+		return nil
+	}
+	tx.meta.flid++
+
 	tx.pages[p.id] = p
 	return nil
 }
@@ -270,6 +694,7 @@ func (tx *Tx) nonPhysicalRollback() {
 		tx.db.freelist.rollback(tx.meta.txid)
 	}
 	tx.close()
+	tx.runRollbackHandlers()
 }
 
 // rollback needs to reload the free pages from disk in case some system error happens like fsync error.
@@ -287,6 +712,15 @@ func (tx *Tx) rollback() {
 		}
 	}
 	tx.close()
+	tx.runRollbackHandlers()
+}
+
+// runRollbackHandlers executes rollback handlers once the locks have been
+// removed by close.
+func (tx *Tx) runRollbackHandlers() {
+	for _, fn := range tx.rollbackHandlers {
+		fn()
+	}
 }
 
 func (tx *Tx) close() {
@@ -296,21 +730,28 @@ func (tx *Tx) close() {
 	if tx.writable {
 		// Grab freelist stats.
 		var freelistFreeN = tx.db.freelist.free_count()
+		var freelistRuns = tx.db.freelist.runs()
 		var freelistPendingN = tx.db.freelist.pending_count()
+		var freelistPendingTxN = len(tx.db.freelist.pending)
 		var freelistAlloc = tx.db.freelist.size()
 
 		// Remove transaction ref & writer lock.
+		tx.db.metalock.Lock()
 		tx.db.rwtx = nil
+		tx.db.metalock.Unlock()
 		tx.db.rwlock.Unlock()
 
 		// Merge statistics.
 		tx.db.statlock.Lock()
 		tx.db.stats.FreePageN = freelistFreeN
+		tx.db.stats.FreeRunN = len(freelistRuns)
+		tx.db.freeRuns = freelistRuns
 		tx.db.stats.PendingPageN = freelistPendingN
-		tx.db.stats.PendingN = len(tx.db.freelist.pending)
+		tx.db.stats.PendingN = freelistPendingTxN
 		tx.db.stats.FreeAlloc = (freelistFreeN + freelistPendingN) * tx.db.pageSize
 		tx.db.stats.FreelistInuse = freelistAlloc
 		tx.db.stats.TxStats.add(&tx.stats)
+		tx.db.stats.TxStats.add(&tx.statsReset)
 		tx.db.statlock.Unlock()
 	} else {
 		tx.db.removeTx(tx)
@@ -321,10 +762,15 @@ func (tx *Tx) close() {
 	tx.meta = nil
 	tx.root = Bucket{tx: tx}
 	tx.pages = nil
+	tx.cleanPages = nil
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
 func (tx *Tx) allocate(count int) (*page, error) {
+	if err := tx.chargeMemory(count * tx.db.pageSize); err != nil {
+		return nil, err
+	}
+
 	p, err := tx.db.allocate(tx.meta.txid, count)
 	if err != nil {
 		return nil, err
@@ -340,6 +786,17 @@ func (tx *Tx) allocate(count int) (*page, error) {
 	return p, nil
 }
 
+// chargeMemory adds n bytes to the memory held by the transaction and returns
+// ErrTxMemoryExceeded if that takes it past Options.TxMemoryBudget.
+func (tx *Tx) chargeMemory(n int) error {
+	tx.memory += n
+	if budget := tx.db.txMemoryBudget; budget > 0 && tx.memory > budget {
+		tx.memory -= n
+		return ErrTxMemoryExceeded
+	}
+	return nil
+}
+
 // write writes any dirty pages to disk.
 func (tx *Tx) write() error {
 	// Sort pages by id.
@@ -351,42 +808,66 @@ func (tx *Tx) write() error {
 	tx.pages = make(map[pgid]*page)
 	sort.Sort(pages)
 
-	// Write pages to disk in order.
-	for _, p := range pages {
-		rem := (uint64(p.overflow) + 1) * uint64(tx.db.pageSize)
-		offset := int64(p.id) * int64(tx.db.pageSize)
-		var written uintptr
+	// Coalesce runs of physically contiguous pages into a single write,
+	// up to the configured buffer size.
+	limit := tx.db.WriteCoalesceSize
+	if limit > maxAllocSize-1 {
+		limit = maxAllocSize - 1
+	}
+	var coalesced []byte
 
-		// Write out page in "max allocation" sized chunks.
-		for {
-			sz := rem
-			if sz > maxAllocSize-1 {
-				sz = maxAllocSize - 1
+	// Write pages to disk in order.
+	for i := 0; i < len(pages); {
+		p := pages[i]
+		size := (int(p.overflow) + 1) * tx.db.pageSize
+
+		// Find the end of the run of contiguous pages starting at p.
+		j := i + 1
+		for ; j < len(pages); j++ {
+			prev, next := pages[j-1], pages[j]
+			nsize := (int(next.overflow) + 1) * tx.db.pageSize
+			if next.id != prev.id+pgid(prev.overflow)+1 || size+nsize > limit {
+				break
 			}
-			buf := unsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
+			size += nsize
+		}
 
-			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
+		// A single page is written directly without copying.
+		if j == i+1 {
+			if err := tx.writePage(p); err != nil {
 				return err
 			}
+			i = j
+			continue
+		}
 
-			// Update statistics.
-			tx.stats.IncWrite(1)
+		if cap(coalesced) < size {
+			coalesced = make([]byte, 0, size)
+		}
+		coalesced = coalesced[:0]
+		for _, p := range pages[i:j] {
+			sz := (int(p.overflow) + 1) * tx.db.pageSize
+			coalesced = append(coalesced, unsafeByteSlice(unsafe.Pointer(p), 0, 0, sz)...)
+		}
+		if _, err := tx.db.ops.writeAt(coalesced, int64(p.id)*int64(tx.db.pageSize)); err != nil {
+			return err
+		}
 
-			// Exit inner for loop if we've written all the chunks.
-			rem -= sz
-			if rem == 0 {
-				break
-			}
+		// Update statistics.
+		tx.stats.IncWrite(1)
+		i = j
+	}
 
-			// Otherwise move offset forward and move pointer to next chunk.
-			offset += int64(sz)
-			written += uintptr(sz)
+	// Ignore file sync if flag is set on DB.
+	if (!tx.db.NoSync || IgnoreNoSync) && tx.db.FsyncMode != FsyncMetaOnly {
+		if err := tx.db.ops.fdatasync(tx.db); err != nil {
+			return err
 		}
 	}
 
-	// Ignore file sync if flag is set on DB.
-	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
+	// Read written pages back and compare them if requested.
+	if tx.db.VerifyWrites {
+		if err := tx.verifyPages(pages); err != nil {
 			return err
 		}
 	}
@@ -399,15 +880,63 @@ func (tx *Tx) write() error {
 			continue
 		}
 
-		buf := unsafeByteSlice(unsafe.Pointer(p), 0, 0, tx.db.pageSize)
+		tx.db.putPageBuffer(unsafeByteSlice(unsafe.Pointer(p), 0, 0, tx.db.pageSize))
+	}
+
+	return nil
+}
+
+// writePage writes a single page and its overflow to disk.
+func (tx *Tx) writePage(p *page) error {
+	rem := (uint64(p.overflow) + 1) * uint64(tx.db.pageSize)
+	offset := int64(p.id) * int64(tx.db.pageSize)
+	var written uintptr
+
+	// Write out page in "max allocation" sized chunks.
+	for {
+		sz := rem
+		if sz > maxAllocSize-1 {
+			sz = maxAllocSize - 1
+		}
+		buf := unsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
+
+		if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
+			return err
+		}
+
+		// Update statistics.
+		tx.stats.IncWrite(1)
 
-		// See https://go.googlesource.com/go/+/f03c9202c43e0abb130669852082117ca50aa9b1
-		for i := range buf {
-			buf[i] = 0
+		// Exit inner for loop if we've written all the chunks.
+		rem -= sz
+		if rem == 0 {
+			return nil
 		}
-		tx.db.pagePool.Put(buf) //nolint:staticcheck
+
+		// Otherwise move offset forward and move pointer to next chunk.
+		offset += int64(sz)
+		written += uintptr(sz)
 	}
+}
 
+// verifyPages reads the given pages back from the data file and returns
+// ErrWriteVerifyFailed if any of them differs from its in-memory buffer.
+func (tx *Tx) verifyPages(pages pages) error {
+	var buf []byte
+	for _, p := range pages {
+		sz := (int(p.overflow) + 1) * tx.db.pageSize
+		if cap(buf) < sz {
+			buf = make([]byte, sz)
+		}
+		buf = buf[:sz]
+
+		if _, err := tx.db.file.ReadAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, unsafeByteSlice(unsafe.Pointer(p), 0, 0, sz)) {
+			return ErrWriteVerifyFailed
+		}
+	}
 	return nil
 }
 
@@ -422,8 +951,8 @@ func (tx *Tx) writeMeta() error {
 	if _, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
 		return err
 	}
-	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
+	if (!tx.db.NoSync || IgnoreNoSync) && tx.db.FsyncMode != FsyncDataOnly {
+		if err := tx.db.ops.fdatasync(tx.db); err != nil {
 			return err
 		}
 	}
@@ -437,6 +966,10 @@ func (tx *Tx) writeMeta() error {
 // page returns a reference to the page with a given id.
 // If page has been written to then a temporary buffered page is returned.
 func (tx *Tx) page(id pgid) *page {
+	if tx.db.ops.readPage != nil {
+		tx.db.ops.readPage(id)
+	}
+
 	// Check the dirty pages first.
 	if tx.pages != nil {
 		if p, ok := tx.pages[id]; ok {
@@ -445,32 +978,94 @@ func (tx *Tx) page(id pgid) *page {
 		}
 	}
 
+	// A private mapping may hold bytes a caller wrote through a returned
+	// slice. Writable transactions turn pages into nodes and copy inline
+	// buckets from them, so they must not see those bytes.
+	if tx.writable && tx.db.copyOnWriteMmap {
+		return tx.cleanPage(id)
+	}
+
 	// Otherwise return directly from the mmap.
 	p := tx.db.page(id)
 	p.fastCheck(id)
 	return p
 }
 
+// cleanPage returns the page with a given id as it is in the data file,
+// reading it with its overflow pages once per transaction.
+func (tx *Tx) cleanPage(id pgid) *page {
+	if p, ok := tx.cleanPages[id]; ok {
+		return p
+	}
+
+	// The overflow count of the page header tells how much to read. The
+	// header itself is never written through a returned slice.
+	sz := (int(tx.db.page(id).overflow) + 1) * tx.db.pageSize
+	buf := make([]byte, sz)
+	_, err := tx.db.file.ReadAt(buf, int64(id)*int64(tx.db.pageSize))
+	_assert(err == nil, "read page %d: %v", id, err)
+
+	p := tx.db.pageInBuffer(buf, 0)
+	p.fastCheck(id)
+	if tx.cleanPages == nil {
+		tx.cleanPages = make(map[pgid]*page)
+	}
+	tx.cleanPages[id] = p
+	return p
+}
+
 // forEachPage iterates over every page within a given page and executes a function.
-func (tx *Tx) forEachPage(pgidnum pgid, fn func(*page, int, []pgid)) {
+// It stops and returns ErrTreeTooDeep if the tree is deeper than the depth guard.
+func (tx *Tx) forEachPage(pgidnum pgid, fn func(*page, int, []pgid)) error {
+	return tx.forEachPageWhile(pgidnum, func(p *page, depth int, stack []pgid) bool {
+		fn(p, depth, stack)
+		return true
+	})
+}
+
+// forEachPageWhile is forEachPage, except that it stops early once fn
+// returns false.
+func (tx *Tx) forEachPageWhile(pgidnum pgid, fn func(*page, int, []pgid) bool) error {
 	stack := make([]pgid, 10)
 	stack[0] = pgidnum
-	tx.forEachPageInternal(stack[:1], fn)
+	_, err := tx.forEachPageInternal(stack[:1], fn)
+	return err
 }
 
-func (tx *Tx) forEachPageInternal(pgidstack []pgid, fn func(*page, int, []pgid)) {
-	p := tx.page(pgidstack[len(pgidstack)-1])
+func (tx *Tx) forEachPageInternal(pgidstack []pgid, fn func(*page, int, []pgid) bool) (bool, error) {
+	id := pgidstack[len(pgidstack)-1]
+	if len(pgidstack) > tx.db.maxTreeDepth {
+		return false, &BoltError{Err: ErrTreeTooDeep, PageID: int(id)}
+	}
+	p := tx.page(id)
 
 	// Execute function.
-	fn(p, len(pgidstack)-1, pgidstack)
+	if !fn(p, len(pgidstack)-1, pgidstack) {
+		return false, nil
+	}
 
 	// Recursively loop over children.
 	if (p.flags & branchPageFlag) != 0 {
 		for i := 0; i < int(p.count); i++ {
 			elem := p.branchPageElement(uint16(i))
-			tx.forEachPageInternal(append(pgidstack, elem.pgid), fn)
+			if ok, err := tx.forEachPageInternal(append(pgidstack, elem.pgid), fn); !ok || err != nil {
+				return ok, err
+			}
 		}
 	}
+	return true, nil
+}
+
+// warmUpBranch reads the branch page id and its descendants down to the
+// given number of levels above the leaves.
+func (tx *Tx) warmUpBranch(id pgid, depth int) {
+	if depth == 0 {
+		return
+	}
+	p := tx.page(id)
+	for i := uint16(0); i < p.count; i++ {
+		tx.warmUpBranch(p.branchPageElement(i).pgid, depth-1)
+	}
 }
 
 // Page returns page information for a given page number.
@@ -482,7 +1077,7 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 		return nil, nil
 	}
 
-	if tx.db.freelist == nil {
+	if tx.db.freelist == nil && !tx.db.skipFreelist {
 		return nil, ErrFreePagesNotLoaded
 	}
 
@@ -495,7 +1090,15 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 	}
 
 	// Determine the type (or if it's free).
-	if tx.db.freelist.freed(pgid(id)) {
+	if tx.db.freelist == nil {
+		// Without a freelist, a page without a single valid type is
+		// presumably free.
+		if flags := p.typeFlags(); flags <= freelistPageFlag && fastCheckBits[flags] {
+			info.Type = p.typ()
+		} else {
+			info.Type = "unknown-free"
+		}
+	} else if tx.db.freelist.freed(pgid(id)) {
 		info.Type = "free"
 	} else {
 		info.Type = p.typ()
@@ -504,6 +1107,124 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 	return info, nil
 }
 
+// PageDetail returns extended page information for a given page number,
+// including the range of overflow pages and, for leaf pages, the sizes of
+// every key and value stored on the page.
+// This is only safe for concurrent use when used by a writable transaction.
+func (tx *Tx) PageDetail(id int) (*PageDetail, error) {
+	info, err := tx.Page(id)
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	d := &PageDetail{PageInfo: *info}
+	if info.OverflowCount > 0 {
+		d.OverflowStart = id + 1
+		d.OverflowEnd = id + info.OverflowCount
+	}
+
+	if info.Type == "leaf" {
+		p := tx.db.page(pgid(id))
+		d.KeySizes = make([]int, p.count)
+		d.ValueSizes = make([]int, p.count)
+		for i := uint16(0); i < p.count; i++ {
+			e := p.leafPageElement(i)
+			d.KeySizes[i] = int(e.ksize())
+			d.ValueSizes[i] = int(e.vsize())
+		}
+	}
+
+	return d, nil
+}
+
+// ForEachPageOrdered calls fn for every page of the file below the high water
+// mark, in page id order, with its type: "meta", "freelist", "branch",
+// "leaf" or "free". A page with overflow pages is reported once, and the
+// iteration resumes after its last overflow page; each half of the fixed
+// freelist region is reported as one "freelist" page in the same way.
+// Pages pending release are reported as "free". It stops at the first error
+// returned by fn. Returns ErrFreePagesNotLoaded if the freelist was not
+// loaded.
+// This is only safe for concurrent use when used by a writable transaction.
+func (tx *Tx) ForEachPageOrdered(fn func(*PageInfo) error) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if tx.db.freelist == nil {
+		return ErrFreePagesNotLoaded
+	}
+
+	regionPages := pgid(tx.db.freelistRegionSize / tx.db.pageSize)
+	for id := pgid(0); id < tx.meta.pgid; {
+		var info *PageInfo
+		switch {
+		case id < 2:
+			info = &PageInfo{ID: int(id), Type: "meta"}
+		case id < 2+2*regionPages:
+			info = &PageInfo{ID: int(id), Type: "freelist", OverflowCount: int(regionPages - 1)}
+		case tx.db.freelist.freed(id):
+			// The header of a free page is stale, so its overflow is unknown.
+			info = &PageInfo{ID: int(id), Type: "free"}
+		default:
+			var err error
+			if info, err = tx.Page(int(id)); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(info); err != nil {
+			return err
+		}
+		id += pgid(info.OverflowCount) + 1
+	}
+	return nil
+}
+
+// WriteDOT writes the page tree of the named top-level bucket to w as a
+// Graphviz DOT graph, with one node per page labelled with its id, type, key
+// count and overflow, and one edge per branch element. A nil name draws the
+// tree of top-level buckets. Only committed pages are drawn, so changes made
+// earlier in a writable transaction are not shown. An inline bucket has no
+// pages and produces an empty graph.
+func (tx *Tx) WriteDOT(w io.Writer, name []byte) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+
+	root := tx.root.root
+	if name != nil {
+		b := tx.Bucket(name)
+		if b == nil {
+			return ErrBucketNotFound
+		}
+		root = b.root
+	}
+
+	var werr error
+	printf := func(format string, a ...interface{}) {
+		if werr == nil {
+			_, werr = fmt.Fprintf(w, format, a...)
+		}
+	}
+
+	printf("digraph bbolt {\n\tnode [shape=record];\n")
+	if root != 0 {
+		if err := tx.forEachPage(root, func(p *page, depth int, stack []pgid) {
+			label := fmt.Sprintf("page %d|%s|keys: %d", p.id, p.typ(), p.count)
+			if p.overflow > 0 {
+				label += fmt.Sprintf("|overflow: %d", p.overflow)
+			}
+			printf("\tp%d [label=\"{%s}\"];\n", p.id, label)
+			if depth > 0 {
+				printf("\tp%d -> p%d;\n", stack[depth-1], p.id)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	printf("}\n")
+	return werr
+}
+
 // TxStats represents statistics about the actions performed by the transaction.
 type TxStats struct {
 	// Page statistics.
@@ -2,6 +2,7 @@ package bbolt
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 )
 
@@ -18,96 +19,144 @@ func (tx *Tx) Check() <-chan error {
 }
 
 // CheckWithOptions allows users to provide a customized `KVStringer` implementation,
-// so that bolt can generate human-readable diagnostic messages.
+// so that bolt can generate human-readable diagnostic messages, to skip the
+// freelist verification, or to stop after a number of errors.
 func (tx *Tx) CheckWithOptions(options ...CheckOption) <-chan error {
 	chkConfig := checkConfig{
 		kvStringer: HexKVStringer(),
+		freelist:   true,
 	}
 	for _, op := range options {
 		op(&chkConfig)
 	}
 
 	ch := make(chan error)
-	go tx.check(chkConfig.kvStringer, ch)
-	return ch
+	if chkConfig.maxErrors <= 0 {
+		go tx.check(&chkConfig, ch)
+		return ch
+	}
+
+	// Forward the first maxErrors errors, then tell the check to stop and
+	// drain whatever it reports until it notices.
+	chkConfig.stop = make(chan struct{})
+	out := make(chan error)
+	go tx.check(&chkConfig, ch)
+	go func() {
+		n := 0
+		for err := range ch {
+			if n == chkConfig.maxErrors {
+				continue
+			}
+			out <- err
+			if n++; n == chkConfig.maxErrors {
+				close(chkConfig.stop)
+				close(out)
+			}
+		}
+		if n < chkConfig.maxErrors {
+			close(out)
+		}
+	}()
+	return out
 }
 
-func (tx *Tx) check(kvStringer KVStringer, ch chan error) {
-	// Force loading free list if opened in ReadOnly mode.
-	tx.db.loadFreelist()
+func (tx *Tx) check(cfg *checkConfig, ch chan error) {
+	// Close the channel to signal completion.
+	defer close(ch)
 
 	// Check if any pages are double freed.
 	freed := make(map[pgid]bool)
-	all := make([]pgid, tx.db.freelist.count())
-	tx.db.freelist.copyall(all)
-	for _, id := range all {
-		if freed[id] {
-			ch <- fmt.Errorf("page %d: already freed", id)
+	if cfg.freelist {
+		// Force loading free list if opened in ReadOnly mode.
+		tx.db.loadFreelist()
+
+		all := make([]pgid, tx.db.freelist.count())
+		tx.db.freelist.copyall(all)
+		for _, id := range all {
+			if freed[id] {
+				ch <- fmt.Errorf("page %d: already freed", id)
+			}
+			freed[id] = true
 		}
-		freed[id] = true
 	}
 
 	// Track every reachable page.
 	reachable := make(map[pgid]*page)
 	reachable[0] = tx.page(0) // meta0
 	reachable[1] = tx.page(1) // meta1
-	for i := uint32(2); i < 2+freelistRegionSize*2/uint32(tx.db.pageSize); i++ {
+	for i := pgid(2); i < tx.db.dataStart(); i++ {
 		// Hack here.
-		reachable[pgid(i)] = nil // tx.page(pgid(i))
+		reachable[i] = nil // tx.page(pgid(i))
 	}
 
 	// Recursively check buckets.
-	tx.checkBucket(&tx.root, reachable, freed, kvStringer, ch)
+	tx.checkBucket(&tx.root, reachable, freed, cfg, ch)
+	if !cfg.freelist {
+		return
+	}
 
 	// Ensure all pages below high water mark are either reachable or freed.
-	for i := pgid(0); i < tx.meta.pgid; i++ {
+	for i := pgid(0); i < tx.meta.pgid && !cfg.stopped(); i++ {
 		_, isReachable := reachable[i]
 		if !isReachable && !freed[i] {
 			ch <- fmt.Errorf("page %d: unreachable unfreed", int(i))
 		}
 	}
-
-	// Close the channel to signal completion.
-	close(ch)
 }
 
 func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool,
-	kvStringer KVStringer, ch chan error) {
+	cfg *checkConfig, ch chan error) {
 	// Ignore inline buckets.
-	if b.root == 0 {
+	if b.root == 0 || cfg.stopped() {
 		return
 	}
 
 	// Check every page used by this bucket.
-	b.tx.forEachPage(b.root, func(p *page, _ int, stack []pgid) {
+	path := b.path()
+	err := b.tx.forEachPageWhile(b.root, func(p *page, _ int, stack []pgid) bool {
 		if p.id > tx.meta.pgid {
-			ch <- fmt.Errorf("page %d: out of bounds: %d (stack: %v)", int(p.id), int(b.tx.meta.pgid), stack)
+			ch <- &BoltError{Err: fmt.Errorf("page %d: out of bounds: %d (stack: %v)", int(p.id), int(b.tx.meta.pgid), stack), PageID: int(p.id), BucketPath: path}
 		}
 
 		// Ensure each page is only referenced once.
 		for i := pgid(0); i <= pgid(p.overflow); i++ {
 			var id = p.id + i
 			if _, ok := reachable[id]; ok {
-				ch <- fmt.Errorf("page %d: multiple references (stack: %v)", int(id), stack)
+				ch <- &BoltError{Err: fmt.Errorf("page %d: multiple references (stack: %v)", int(id), stack), PageID: int(id), BucketPath: path}
 			}
 			reachable[id] = p
 		}
 
 		// We should only encounter un-freed leaf and branch pages.
 		if freed[p.id] {
-			ch <- fmt.Errorf("page %d: reachable freed", int(p.id))
+			ch <- &BoltError{Err: fmt.Errorf("page %d: reachable freed", int(p.id)), PageID: int(p.id), BucketPath: path}
 		} else if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
-			ch <- fmt.Errorf("page %d: invalid type: %s (stack: %v)", int(p.id), p.typ(), stack)
+			ch <- &BoltError{Err: fmt.Errorf("page %d: invalid type: %s (stack: %v)", int(p.id), p.typ(), stack), PageID: int(p.id), BucketPath: path}
 		}
+		return !cfg.stopped()
 	})
+	if err != nil {
+		// The tree cannot be walked safely, so skip the rest of the bucket.
+		if be, ok := err.(*BoltError); ok {
+			be.BucketPath = path
+		}
+		ch <- err
+		return
+	}
 
-	tx.recursivelyCheckPages(b.root, kvStringer.KeyToString, ch)
+	// Keys can only be ordered with a registered comparator.
+	if _, ok := lookupComparator(b.Comparator()); !ok {
+		ch <- &BoltError{Err: ErrUnknownComparator, BucketPath: path, Key: []byte(b.comparator)}
+		return
+	}
+	tx.recursivelyCheckPages(b.root, b.compareKeys, cfg, ch)
 
 	// Check each bucket within this bucket.
-	_ = b.ForEachBucket(func(k []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.checkBucket(child, reachable, freed, kvStringer, ch)
+	_ = b.forEachChild(func(child *Bucket) error {
+		if cfg.stopped() {
+			return errCheckStopped
 		}
+		tx.checkBucket(child, reachable, freed, cfg, ch)
 		return nil
 	})
 }
@@ -116,19 +165,23 @@ func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bo
 // key order constraints:
 //   - keys on pages must be sorted
 //   - keys on children pages are between 2 consecutive keys on the parent's branch page).
-func (tx *Tx) recursivelyCheckPages(pgId pgid, keyToString func([]byte) string, ch chan error) {
-	tx.recursivelyCheckPagesInternal(pgId, nil, nil, nil, keyToString, ch)
+func (tx *Tx) recursivelyCheckPages(pgId pgid, compare func(a, b []byte) int, cfg *checkConfig, ch chan error) {
+	tx.recursivelyCheckPagesInternal(pgId, nil, nil, nil, compare, cfg, ch)
 }
 
 // recursivelyCheckPagesInternal verifies that all keys in the subtree rooted at `pgid` are:
 //   - >=`minKeyClosed` (can be nil)
 //   - <`maxKeyOpen` (can be nil)
-//   - Are in right ordering relationship to their parents.
+//   - Are in right ordering relationship to their parents, as ordered by `compare`.
 //     `pagesStack` is expected to contain IDs of pages from the tree root to `pgid` for the clean debugging message.
 func (tx *Tx) recursivelyCheckPagesInternal(
 	pgId pgid, minKeyClosed, maxKeyOpen []byte, pagesStack []pgid,
-	keyToString func([]byte) string, ch chan error) (maxKeyInSubtree []byte) {
+	compare func(a, b []byte) int, cfg *checkConfig, ch chan error) (maxKeyInSubtree []byte) {
 
+	if cfg.stopped() {
+		return nil
+	}
+	keyToString := cfg.kvStringer.KeyToString
 	p := tx.page(pgId)
 	pagesStack = append(pagesStack, pgId)
 	switch {
@@ -137,13 +190,13 @@ func (tx *Tx) recursivelyCheckPagesInternal(
 		runningMin := minKeyClosed
 		for i := range p.branchPageElements() {
 			elem := p.branchPageElement(uint16(i))
-			verifyKeyOrder(elem.pgid, "branch", i, elem.key(), runningMin, maxKeyOpen, ch, keyToString, pagesStack)
+			verifyKeyOrder(elem.pgid, "branch", i, elem.key(), runningMin, maxKeyOpen, ch, compare, keyToString, pagesStack)
 
 			maxKey := maxKeyOpen
 			if i < len(p.branchPageElements())-1 {
 				maxKey = p.branchPageElement(uint16(i + 1)).key()
 			}
-			maxKeyInSubtree = tx.recursivelyCheckPagesInternal(elem.pgid, elem.key(), maxKey, pagesStack, keyToString, ch)
+			maxKeyInSubtree = tx.recursivelyCheckPagesInternal(elem.pgid, elem.key(), maxKey, pagesStack, compare, cfg, ch)
 			runningMin = maxKeyInSubtree
 		}
 		return maxKeyInSubtree
@@ -151,7 +204,7 @@ func (tx *Tx) recursivelyCheckPagesInternal(
 		runningMin := minKeyClosed
 		for i := range p.leafPageElements() {
 			elem := p.leafPageElement(uint16(i))
-			verifyKeyOrder(pgId, "leaf", i, elem.key(), runningMin, maxKeyOpen, ch, keyToString, pagesStack)
+			verifyKeyOrder(pgId, "leaf", i, elem.key(), runningMin, maxKeyOpen, ch, compare, keyToString, pagesStack)
 			runningMin = elem.key()
 		}
 		if p.count > 0 {
@@ -167,13 +220,13 @@ func (tx *Tx) recursivelyCheckPagesInternal(
  * verifyKeyOrder checks whether an entry with given #index on pgId (pageType: "branch|leaf") that has given "key",
  * is within range determined by (previousKey..maxKeyOpen) and reports found violations to the channel (ch).
  */
-func verifyKeyOrder(pgId pgid, pageType string, index int, key []byte, previousKey []byte, maxKeyOpen []byte, ch chan error, keyToString func([]byte) string, pagesStack []pgid) {
-	if index == 0 && previousKey != nil && compareKeys(previousKey, key) > 0 {
+func verifyKeyOrder(pgId pgid, pageType string, index int, key []byte, previousKey []byte, maxKeyOpen []byte, ch chan error, compare func(a, b []byte) int, keyToString func([]byte) string, pagesStack []pgid) {
+	if index == 0 && previousKey != nil && compare(previousKey, key) > 0 {
 		ch <- fmt.Errorf("the first key[%d]=(hex)%s on %s page(%d) needs to be >= the key in the ancestor (%s). Stack: %v",
 			index, keyToString(key), pageType, pgId, keyToString(previousKey), pagesStack)
 	}
 	if index > 0 {
-		cmpRet := compareKeys(previousKey, key)
+		cmpRet := compare(previousKey, key)
 		if cmpRet > 0 {
 			ch <- fmt.Errorf("key[%d]=(hex)%s on %s page(%d) needs to be > (found <) than previous element (hex)%s. Stack: %v",
 				index, keyToString(key), pageType, pgId, keyToString(previousKey), pagesStack)
@@ -183,7 +236,7 @@ func verifyKeyOrder(pgId pgid, pageType string, index int, key []byte, previousK
 				index, keyToString(key), pageType, pgId, keyToString(previousKey), pagesStack)
 		}
 	}
-	if maxKeyOpen != nil && compareKeys(key, maxKeyOpen) >= 0 {
+	if maxKeyOpen != nil && compare(key, maxKeyOpen) >= 0 {
 		ch <- fmt.Errorf("key[%d]=(hex)%s on %s page(%d) needs to be < than key of the next element in ancestor (hex)%s. Pages stack: %v",
 			index, keyToString(key), pageType, pgId, keyToString(previousKey), pagesStack)
 	}
@@ -191,8 +244,30 @@ func verifyKeyOrder(pgId pgid, pageType string, index int, key []byte, previousK
 
 // ===========================================================================================
 
+// errCheckStopped breaks out of the bucket iteration once a check has
+// reported as many errors as it was asked to.
+var errCheckStopped = errors.New("check stopped")
+
 type checkConfig struct {
 	kvStringer KVStringer
+	freelist   bool
+	maxErrors  int
+
+	// stop is closed once maxErrors errors have been reported.
+	stop chan struct{}
+}
+
+// stopped returns true if the check has reported enough errors.
+func (c *checkConfig) stopped() bool {
+	if c.stop == nil {
+		return false
+	}
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 type CheckOption func(options *checkConfig)
@@ -203,6 +278,24 @@ func WithKVStringer(kvStringer KVStringer) CheckOption {
 	}
 }
 
+// WithFreelistCheck enables or disables the freelist verification, which is
+// on by default. Without it, double frees, reachable freed pages and
+// unreachable unfreed pages are not reported, and only the bucket trees are
+// checked.
+func WithFreelistCheck(enabled bool) CheckOption {
+	return func(c *checkConfig) {
+		c.freelist = enabled
+	}
+}
+
+// WithMaxErrors stops the check once n errors have been reported. Zero or a
+// negative n reports every error found.
+func WithMaxErrors(n int) CheckOption {
+	return func(c *checkConfig) {
+		c.maxErrors = n
+	}
+}
+
 // KVStringer allows to prepare human-readable diagnostic messages.
 type KVStringer interface {
 	KeyToString([]byte) string
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -123,6 +127,52 @@ func TestTx_Commit_ErrTxNotWritable(t *testing.T) {
 	}
 }
 
+// Ensure that a commit whose freelist overflows its region fails and leaves
+// the database usable.
+func TestTx_Commit_ErrFreelistRegionFull(t *testing.T) {
+	pageSize := os.Getpagesize()
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{FreelistRegionSize: 4 * pageSize})
+	db.StrictMode, db.StrictModeReturnsError = true, true
+
+	// Give every key a leaf page of its own.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, pageSize/2)))
+		}
+		return nil
+	}))
+
+	// Freeing every other page leaves more free ids than the region holds.
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	b := tx.Bucket([]byte("widgets"))
+	for i := 0; i < 2000; i += 2 {
+		require.NoError(t, b.Delete([]byte(fmt.Sprintf("%04d", i))))
+	}
+	require.ErrorIs(t, tx.Commit(), bolt.ErrFreelistRegionFull)
+	require.ErrorIs(t, tx.Rollback(), bolt.ErrTxClosed)
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 2000, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	}))
+
+	// Smaller changes still commit.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 20; i += 2 {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%04d", i))))
+		}
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, 1990, tx.Bucket([]byte("widgets")).Stats().KeyN)
+		return nil
+	}))
+}
+
 // Ensure that a transaction can retrieve a cursor on the root bucket.
 func TestTx_Cursor(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -323,7 +373,7 @@ func TestTx_CreateBucket_ErrBucketExists(t *testing.T) {
 
 	// Create the same bucket again.
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucket([]byte("widgets")); err != bolt.ErrBucketExists {
+		if _, err := tx.CreateBucket([]byte("widgets")); !errors.Is(err, bolt.ErrBucketExists) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -391,6 +441,245 @@ func TestTx_DeleteBucket(t *testing.T) {
 	}
 }
 
+// Ensure that a key can be moved between top-level buckets.
+func TestTx_MoveKey(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		src, err := tx.CreateBucket([]byte("src"))
+		require.NoError(t, err)
+		_, err = tx.CreateBucket([]byte("dst"))
+		require.NoError(t, err)
+		require.NoError(t, src.Put([]byte("foo"), []byte("bar")))
+		require.NoError(t, src.PutFlagged([]byte("flagged"), []byte("baz")))
+		_, err = src.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.NoError(t, tx.MoveKey([]byte("src"), []byte("dst"), []byte("foo")))
+		require.NoError(t, tx.MoveKey([]byte("src"), []byte("dst"), []byte("flagged")))
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		src, dst := tx.Bucket([]byte("src")), tx.Bucket([]byte("dst"))
+		require.Nil(t, src.Get([]byte("foo")))
+		require.Equal(t, []byte("bar"), dst.Get([]byte("foo")))
+
+		c := dst.Cursor()
+		k, v := c.Seek([]byte("flagged"))
+		require.Equal(t, []byte("flagged"), k)
+		require.Equal(t, []byte("baz"), v)
+		require.Equal(t, uint32(bolt.FlaggedValue), c.Flags())
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		require.Equal(t, bolt.ErrTxNotWritable, tx.MoveKey([]byte("dst"), []byte("src"), []byte("foo")))
+		return nil
+	}))
+}
+
+// Ensure that moving a missing key fails without changing either bucket.
+func TestTx_MoveKey_KeyNotFound(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		src, err := tx.CreateBucket([]byte("src"))
+		require.NoError(t, err)
+		_, err = tx.CreateBucket([]byte("dst"))
+		require.NoError(t, err)
+		_, err = src.CreateBucket([]byte("sub"))
+		return err
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		err := tx.MoveKey([]byte("src"), []byte("dst"), []byte("missing"))
+		require.ErrorIs(t, err, bolt.ErrKeyNotFound)
+		var berr *bolt.BoltError
+		require.True(t, errors.As(err, &berr))
+		require.Equal(t, [][]byte{[]byte("src")}, berr.BucketPath)
+		require.Equal(t, []byte("missing"), berr.Key)
+
+		require.ErrorIs(t, tx.MoveKey([]byte("src"), []byte("dst"), []byte("sub")), bolt.ErrIncompatibleValue)
+		require.Nil(t, tx.Bucket([]byte("dst")).Get([]byte("missing")))
+		require.NotNil(t, tx.Bucket([]byte("src")).Bucket([]byte("sub")))
+		return nil
+	}))
+}
+
+// Ensure that moving into a missing bucket fails and keeps the source key.
+func TestTx_MoveKey_BucketNotFound(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		src, err := tx.CreateBucket([]byte("src"))
+		require.NoError(t, err)
+		return src.Put([]byte("foo"), []byte("bar"))
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.ErrorIs(t, tx.MoveKey([]byte("src"), []byte("missing"), []byte("foo")), bolt.ErrBucketNotFound)
+		require.ErrorIs(t, tx.MoveKey([]byte("missing"), []byte("src"), []byte("foo")), bolt.ErrBucketNotFound)
+		require.Equal(t, []byte("bar"), tx.Bucket([]byte("src")).Get([]byte("foo")))
+		return nil
+	}))
+}
+
+// Ensure that RotateBuckets adds a new generation and drops the oldest ones.
+func TestTx_RotateBuckets(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	names := func(tx *bolt.Tx) []string {
+		var got []string
+		require.NoError(t, tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			got = append(got, string(name))
+			return nil
+		}))
+		return got
+	}
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		// Names that aren't generations are left alone.
+		_, err := tx.CreateBucket([]byte("log-old"))
+		require.NoError(t, err)
+		_, err = tx.CreateBucket([]byte("log01"))
+		require.NoError(t, err)
+
+		require.NoError(t, tx.RotateBuckets([]byte("log"), 3))
+		require.NoError(t, tx.Bucket([]byte("log0")).Put([]byte("foo"), []byte("0")))
+		require.NoError(t, tx.RotateBuckets([]byte("log"), 3))
+		require.NoError(t, tx.Bucket([]byte("log1")).Put([]byte("foo"), []byte("1")))
+		require.Equal(t, []string{"log-old", "log0", "log01", "log1"}, names(tx))
+		return nil
+	}))
+
+	for i := 2; i <= 11; i++ {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			return tx.RotateBuckets([]byte("log"), 3)
+		}))
+	}
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		// Generations sort numerically, not by name.
+		require.Equal(t, []string{"log-old", "log01", "log10", "log11", "log9"}, names(tx))
+		require.Zero(t, tx.Bucket([]byte("log11")).Stats().KeyN)
+		require.ErrorIs(t, tx.RotateBuckets([]byte("log"), 3), bolt.ErrTxNotWritable)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.Error(t, tx.RotateBuckets([]byte("log"), 0))
+
+		// Shrinking the ring drops every generation but the new one.
+		require.NoError(t, tx.RotateBuckets([]byte("log"), 1))
+		require.Equal(t, []string{"log-old", "log01", "log12"}, names(tx))
+		return nil
+	}))
+}
+
+// Ensure that a bucket can be rebuilt and readers see either the old or the new contents.
+func TestTx_ReplaceBucket(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	fill := func(b *bolt.Bucket, gen string) error {
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(gen)); err != nil {
+				return err
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		return sub.Put([]byte("gen"), []byte(gen))
+	}
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return fill(b, "old")
+	}))
+
+	// A failed build leaves the bucket untouched.
+	errBuild := errors.New("build failed")
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.ErrorIs(t, tx.ReplaceBucket([]byte("missing"), func(*bolt.Bucket) error { return nil }), bolt.ErrBucketNotFound)
+		require.Equal(t, errBuild, tx.ReplaceBucket([]byte("widgets"), func(b *bolt.Bucket) error {
+			if err := b.Put([]byte("partial"), []byte("x")); err != nil {
+				return err
+			}
+			return errBuild
+		}))
+		require.Nil(t, tx.Bucket([]byte("widgets")).Get([]byte("partial")))
+		return nil
+	}))
+
+	// Readers check that all values belong to a single generation.
+	check := func(tx *bolt.Tx) (string, error) {
+		b := tx.Bucket([]byte("widgets"))
+		gen := string(b.Bucket([]byte("sub")).Get([]byte("gen")))
+		n := 0
+		err := b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			} else if string(v) != gen {
+				return fmt.Errorf("key %s: got generation %q, want %q", k, v, gen)
+			}
+			n++
+			return nil
+		})
+		if err == nil && n != 500 {
+			err = fmt.Errorf("got %d keys, want 500", n)
+		}
+		return gen, err
+	}
+
+	old, err := db.Begin(false)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, old.Rollback()) }()
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.View(func(tx *bolt.Tx) error {
+				_, err := check(tx)
+				return err
+			}); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.ReplaceBucket([]byte("widgets"), func(b *bolt.Bucket) error {
+			return fill(b, "new")
+		})
+	}))
+	close(done)
+	require.NoError(t, <-errc)
+
+	gen, err := check(old)
+	require.NoError(t, err)
+	require.Equal(t, "old", gen)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		gen, err := check(tx)
+		require.NoError(t, err)
+		require.Equal(t, "new", gen)
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+}
+
 // Ensure that deleting a bucket on a closed transaction returns an error.
 func TestTx_DeleteBucket_ErrTxClosed(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -423,7 +712,7 @@ func TestTx_DeleteBucket_ReadOnly(t *testing.T) {
 func TestTx_DeleteBucket_NotFound(t *testing.T) {
 	db := btesting.MustCreateDB(t)
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if err := tx.DeleteBucket([]byte("widgets")); err != bolt.ErrBucketNotFound {
+		if err := tx.DeleteBucket([]byte("widgets")); !errors.Is(err, bolt.ErrBucketNotFound) {
 			t.Fatalf("unexpected error: %s", err)
 		}
 		return nil
@@ -499,6 +788,23 @@ func TestTx_OnCommit(t *testing.T) {
 	}
 }
 
+// Ensure that PendingCommitHandlers reports the handlers registered so far.
+func TestTx_PendingCommitHandlers(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		require.Equal(t, 0, tx.PendingCommitHandlers())
+		for i := 1; i <= 3; i++ {
+			tx.OnCommit(func() {})
+			require.Equal(t, i, tx.PendingCommitHandlers())
+		}
+		// Rollback handlers are not counted.
+		tx.OnRollback(func() {})
+		require.Equal(t, 3, tx.PendingCommitHandlers())
+		return nil
+	}))
+}
+
 // Ensure that Tx commit handlers are NOT called after a transaction rolls back.
 func TestTx_OnCommit_Rollback(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -518,6 +824,188 @@ func TestTx_OnCommit_Rollback(t *testing.T) {
 	}
 }
 
+// Ensure that Tx rollback handlers are called after an explicit rollback,
+// once the writer lock has been released.
+func TestTx_OnRollback(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	var x int
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	tx.OnCommit(func() { x += 100 })
+	tx.OnRollback(func() { x += 1 })
+	tx.OnRollback(func() {
+		// Starting another writer would block if the lock were still held.
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("cleanup"))
+			return err
+		}))
+		x += 2
+	})
+	_, err = tx.CreateBucket([]byte("widgets"))
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+	require.Equal(t, 3, x)
+
+	// Handlers run once, and also for read-only and managed transactions.
+	require.Equal(t, bolt.ErrTxClosed, tx.Rollback())
+	require.Equal(t, 3, x)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		tx.OnRollback(func() { x += 10 })
+		return nil
+	}))
+	require.Equal(t, 13, x)
+	require.Error(t, db.Update(func(tx *bolt.Tx) error {
+		tx.OnRollback(func() { x += 20 })
+		return errors.New("rollback this commit")
+	}))
+	require.Equal(t, 33, x)
+
+	// Handlers are not called after a successful commit.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		tx.OnRollback(func() { x += 1000 })
+		return nil
+	}))
+	require.Equal(t, 33, x)
+}
+
+// Ensure that Tx rollback handlers are called when a commit fails.
+func TestTx_OnRollback_CommitFailure(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{MaxOverflowPages: 1})
+
+	var committed, rolledBack bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		tx.OnCommit(func() { committed = true })
+		tx.OnRollback(func() { rolledBack = true })
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), make([]byte, 4*db.Info().PageSize))
+	})
+	require.Equal(t, bolt.ErrTooManyOverflowPages, err)
+	require.False(t, committed)
+	require.True(t, rolledBack)
+}
+
+// Ensure that an insert-only transaction committed without rebalancing
+// produces a valid tree.
+func TestTx_CommitNoRebalance(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	b, err := tx.CreateBucket([]byte("widgets"))
+	require.NoError(t, err)
+	for i := 0; i < 10000; i++ {
+		require.NoError(t, b.Put([]byte(fmt.Sprintf("%08d", i)), make([]byte, 100)))
+	}
+	require.NoError(t, tx.CommitNoRebalance())
+	require.Equal(t, bolt.ErrTxClosed, tx.CommitNoRebalance())
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		b := tx.Bucket([]byte("widgets"))
+		require.Equal(t, 10000, b.Stats().KeyN)
+		require.NotNil(t, b.Get([]byte("00009999")))
+		return nil
+	}))
+}
+
+func BenchmarkTx_Commit_InsertOnly(b *testing.B) {
+	b.Run("Rebalance", func(b *testing.B) { benchmarkTxCommitInsertOnly(b, (*bolt.Tx).Commit) })
+	b.Run("NoRebalance", func(b *testing.B) { benchmarkTxCommitInsertOnly(b, (*bolt.Tx).CommitNoRebalance) })
+}
+
+func benchmarkTxCommitInsertOnly(b *testing.B, commit func(*bolt.Tx) error) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{NoSync: true})
+	require.NoError(b, db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("bench"))
+		return err
+	}))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx, err := db.Begin(true)
+		require.NoError(b, err)
+		bkt := tx.Bucket([]byte("bench"))
+		for j := 0; j < 1000; j++ {
+			require.NoError(b, bkt.Put([]byte(fmt.Sprintf("%08d-%04d", i, j)), []byte("value")))
+		}
+		require.NoError(b, commit(tx))
+	}
+}
+
+// Ensure that PageDetail reports the overflow range of a page holding a large value.
+func TestTx_PageDetail(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		require.NoError(t, b.Put([]byte("foo"), make([]byte, 5000)))
+		require.NoError(t, b.Put([]byte("large"), make([]byte, 100000)))
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		root := int(tx.Bucket([]byte("widgets")).Root())
+		d, err := tx.PageDetail(root)
+		require.NoError(t, err)
+		require.Equal(t, "leaf", d.Type)
+		require.Equal(t, 2, d.Count)
+
+		// Page header (16) + 2 elements (16) + keys and values.
+		overflow := (16+16+3+5000+5+100000+4095)/4096 - 1
+		require.Equal(t, overflow, d.OverflowCount)
+		require.Equal(t, root+1, d.OverflowStart)
+		require.Equal(t, root+overflow, d.OverflowEnd)
+		require.Equal(t, []int{3, 5}, d.KeySizes)
+		require.Equal(t, []int{5000, 100000}, d.ValueSizes)
+
+		d, err = tx.PageDetail(0)
+		require.NoError(t, err)
+		require.Equal(t, "meta", d.Type)
+		require.Zero(t, d.OverflowStart)
+		require.Nil(t, d.KeySizes)
+
+		d, err = tx.PageDetail(int(tx.Size() / 4096))
+		require.NoError(t, err)
+		require.Nil(t, d)
+		return nil
+	}))
+}
+
+func BenchmarkTx_Write_Contiguous(b *testing.B) {
+	b.Run("Coalesced", func(b *testing.B) { benchmarkTxWriteContiguous(b, bolt.DefaultWriteCoalesceSize) })
+	b.Run("PerPage", func(b *testing.B) { benchmarkTxWriteContiguous(b, 0) })
+}
+
+func benchmarkTxWriteContiguous(b *testing.B, coalesceSize int) {
+	db := btesting.MustCreateDBWithOption(b, &bolt.Options{NoSync: true})
+	db.WriteCoalesceSize = coalesceSize
+
+	var writes int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Every commit creates a fresh bucket so its pages are allocated
+		// contiguously at the end of the file.
+		tx, err := db.Begin(true)
+		require.NoError(b, err)
+		bkt, err := tx.CreateBucket([]byte(fmt.Sprintf("bench-%d", i)))
+		require.NoError(b, err)
+		for j := 0; j < 1000; j++ {
+			require.NoError(b, bkt.Put([]byte(fmt.Sprintf("%08d", j)), make([]byte, 100)))
+		}
+		require.NoError(b, tx.Commit())
+		st := tx.Stats()
+		writes += st.GetWrite()
+	}
+	b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+}
+
 // Ensure that the database can be copied to a file path.
 func TestTx_CopyFile(t *testing.T) {
 	db := btesting.MustCreateDB(t)
@@ -954,6 +1442,44 @@ func TestTxStats_GetAndIncAtomically(t *testing.T) {
 	)
 }
 
+// Ensure that resetting the stats of a transaction only drops them from the
+// transaction's own counts.
+func TestTx_ResetStats(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	before := db.Stats().TxStats
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	b, err := tx.CreateBucket([]byte("widgets"))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.Put([]byte(fmt.Sprintf("%03d", i)), []byte("v")))
+	}
+	first := tx.Stats()
+	require.Positive(t, first.GetCursorCount())
+	require.Positive(t, first.GetNodeCount())
+
+	tx.ResetStats()
+	require.Equal(t, bolt.TxStats{}, tx.Stats())
+
+	// Only the cursors opened since the reset are counted.
+	for i := 0; i < 3; i++ {
+		b.Cursor()
+	}
+	second := tx.Stats()
+	require.Equal(t, int64(3), second.GetCursorCount())
+	require.Zero(t, second.GetNodeCount())
+	require.NoError(t, tx.Commit())
+
+	// The DB's stats still count everything the transaction did, including
+	// the commit.
+	after := db.Stats().TxStats
+	diff := after.Sub(&before)
+	require.GreaterOrEqual(t, diff.GetCursorCount(), first.GetCursorCount()+3)
+	require.GreaterOrEqual(t, diff.GetNodeCount(), first.GetNodeCount())
+	require.Positive(t, diff.GetWrite())
+}
+
 func TestTxStats_Sub(t *testing.T) {
 	statsA := bolt.TxStats{
 		PageCount:     1,
@@ -1043,3 +1569,257 @@ func TestTx_TruncateBeforeWrite(t *testing.T) {
 		})
 	}
 }
+
+// Ensure that WriteDOT draws one node per page and one edge per child page.
+func TestTx_WriteDOT(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 500; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+		}
+		_, err = tx.CreateBucket([]byte("inline"))
+		return err
+	}))
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		stats := tx.Bucket([]byte("widgets")).Stats()
+		require.Greater(t, stats.BranchPageN, 0)
+
+		var buf bytes.Buffer
+		require.NoError(t, tx.WriteDOT(&buf, []byte("widgets")))
+		out := buf.String()
+		require.True(t, strings.HasPrefix(out, "digraph bbolt {"))
+		require.True(t, strings.HasSuffix(out, "}\n"))
+
+		pages := stats.BranchPageN + stats.LeafPageN
+		require.Equal(t, pages, strings.Count(out, "[label="))
+		require.Equal(t, pages-1, strings.Count(out, " -> "))
+		require.Equal(t, stats.BranchPageN, strings.Count(out, "|branch|"))
+
+		buf.Reset()
+		require.NoError(t, tx.WriteDOT(&buf, []byte("inline")))
+		require.Equal(t, 0, strings.Count(buf.String(), "[label="))
+
+		buf.Reset()
+		require.NoError(t, tx.WriteDOT(&buf, nil))
+		require.Equal(t, 1, strings.Count(buf.String(), "|leaf|"))
+
+		require.ErrorIs(t, tx.WriteDOT(&buf, []byte("missing")), bolt.ErrBucketNotFound)
+		return nil
+	}))
+}
+
+// Ensure that GetAll reads keys from several buckets in one snapshot.
+func TestTx_GetAll(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"users", "orders", "items"} {
+			b, err := tx.CreateBucket([]byte(name))
+			require.NoError(t, err)
+			require.NoError(t, b.Put([]byte("1"), []byte(name+"-1")))
+			require.NoError(t, b.Put([]byte("2"), []byte(name+"-2")))
+		}
+		_, err := tx.Bucket([]byte("items")).CreateBucket([]byte("nested"))
+		return err
+	}))
+
+	lookups := []bolt.Lookup{
+		{Bucket: []byte("users"), Key: []byte("1")},
+		{Bucket: []byte("orders"), Key: []byte("2")},
+		{Bucket: []byte("items"), Key: []byte("1")},
+		{Bucket: []byte("users"), Key: []byte("2")},
+		{Bucket: []byte("orders"), Key: []byte("missing")},
+		{Bucket: []byte("items"), Key: []byte("nested")},
+	}
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	// A write committed after the snapshot was taken is not seen.
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).Put([]byte("1"), []byte("changed"))
+	}))
+
+	values, err := tx.GetAll(lookups)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{
+		[]byte("users-1"),
+		[]byte("orders-2"),
+		[]byte("items-1"),
+		[]byte("users-2"),
+		nil,
+		nil,
+	}, values)
+
+	_, err = tx.GetAll([]bolt.Lookup{{Bucket: []byte("missing"), Key: []byte("1")}})
+	require.ErrorIs(t, err, bolt.ErrBucketNotFound)
+}
+
+// Ensure that ForEachPageOrdered covers every page in order.
+func TestTx_ForEachPageOrdered(t *testing.T) {
+	db := btesting.MustCreateDBWithOption(t, &bolt.Options{PageSize: 4096})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)))
+		}
+		return b.Put([]byte("large"), make([]byte, 10000))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 500; i++ {
+			require.NoError(t, b.Delete([]byte(fmt.Sprintf("%04d", i))))
+		}
+		return nil
+	}))
+	_, err := db.ReclaimPending()
+	require.NoError(t, err)
+
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		types := make(map[string]int)
+		var next int
+		require.NoError(t, tx.ForEachPageOrdered(func(info *bolt.PageInfo) error {
+			require.Equal(t, next, info.ID)
+			next += info.OverflowCount + 1
+			types[info.Type]++
+			if info.Type == "leaf" || info.Type == "branch" {
+				page, err := tx.Page(info.ID)
+				require.NoError(t, err)
+				require.Equal(t, page, info)
+			}
+			return nil
+		}))
+		require.Equal(t, tx.Size(), int64(next)*4096)
+
+		stats := tx.Bucket([]byte("widgets")).Stats()
+		require.Equal(t, 2, types["meta"])
+		require.Equal(t, 2, types["freelist"])
+		require.Equal(t, stats.BranchPageN+stats.LeafPageN+1, types["branch"]+types["leaf"]) // and the root bucket
+		require.Equal(t, db.Stats().FreePageN, types["free"])
+		require.Greater(t, types["free"], 0)
+		require.Len(t, types, 5)
+
+		// Stop at the first error.
+		errStop := errors.New("stop")
+		var n int
+		require.ErrorIs(t, tx.ForEachPageOrdered(func(*bolt.PageInfo) error {
+			n++
+			return errStop
+		}), errStop)
+		require.Equal(t, 1, n)
+		return nil
+	}))
+
+	// The freelist is needed to tell free pages apart.
+	db.MustClose()
+	ro, err := bolt.Open(db.Path(), 0666, &bolt.Options{ReadOnly: true, ReadOnlyNoFreelist: true})
+	require.NoError(t, err)
+	defer ro.Close()
+	require.NoError(t, ro.View(func(tx *bolt.Tx) error {
+		require.ErrorIs(t, tx.ForEachPageOrdered(func(*bolt.PageInfo) error { return nil }), bolt.ErrFreePagesNotLoaded)
+		return nil
+	}))
+}
+
+// limitWriter fails once limit bytes have been written. If short is set it
+// reports the failing write as short instead of returning an error.
+type limitWriter struct {
+	limit int
+	short bool
+	buf   bytes.Buffer
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.buf.Len(); len(p) > room {
+		w.buf.Write(p[:room])
+		if w.short {
+			return room, nil
+		}
+		return room, errors.New("disk full")
+	}
+	return w.buf.Write(p)
+}
+
+// Ensure that Tx.WriteTo writes a consistent copy of the transaction's view.
+func TestTx_WriteTo(t *testing.T) {
+	db := btesting.MustCreateDB(t)
+	put := func(gen int) {
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			require.NoError(t, err)
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%d-%d", gen, i))))
+			}
+			sub, err := b.CreateBucketIfNotExists([]byte("sub"))
+			require.NoError(t, err)
+			return sub.Put([]byte(fmt.Sprintf("%d", gen)), make([]byte, 5000))
+		}))
+	}
+	put(0)
+	put(1)
+
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	// Later commits rewrite both freelist regions and the meta pages.
+	for gen := 2; gen < 6; gen++ {
+		put(gen)
+	}
+
+	var buf bytes.Buffer
+	n, err := tx.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, tx.Size(), n)
+	require.Equal(t, int(n), buf.Len())
+	require.Equal(t, crc32.ChecksumIEEE(buf.Bytes()), tx.LastWriteChecksum())
+
+	path := filepath.Join(t.TempDir(), "copy.db")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0666))
+	cp, err := bolt.Open(path, 0666, nil)
+	require.NoError(t, err)
+	require.NoError(t, cp.View(func(ctx *bolt.Tx) error {
+		for err := range ctx.Check() {
+			t.Fatal(err)
+		}
+		require.Equal(t, tx.ID(), ctx.ID())
+		b := ctx.Bucket([]byte("widgets"))
+		require.Equal(t, []byte("1-999"), b.Get([]byte("0999")))
+		require.NotNil(t, b.Bucket([]byte("sub")).Get([]byte("1")))
+		require.Nil(t, b.Bucket([]byte("sub")).Get([]byte("2")))
+		return nil
+	}))
+	// The copy can be written to.
+	require.NoError(t, cp.Update(func(ctx *bolt.Tx) error {
+		return ctx.Bucket([]byte("widgets")).Put([]byte("new"), make([]byte, 10000))
+	}))
+	require.NoError(t, cp.View(func(ctx *bolt.Tx) error {
+		for err := range ctx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}))
+	require.NoError(t, cp.Close())
+
+	// Failing and short writes return the bytes written so far.
+	for _, short := range []bool{false, true} {
+		w := &limitWriter{limit: 10000, short: short}
+		n, err = tx.WriteTo(w)
+		require.Error(t, err)
+		if short {
+			require.ErrorIs(t, err, io.ErrShortWrite)
+		}
+		require.Equal(t, int64(10000), n)
+		require.Equal(t, crc32.ChecksumIEEE(w.buf.Bytes()), tx.LastWriteChecksum())
+	}
+
+	require.NoError(t, db.Update(func(wtx *bolt.Tx) error {
+		_, err := wtx.WriteTo(io.Discard)
+		require.ErrorIs(t, err, bolt.ErrTxWritable)
+		return nil
+	}))
+}